@@ -0,0 +1,85 @@
+// Code generated by examplegen; DO NOT EDIT.
+
+terraform {
+  required_providers {
+    aws           = { source = "hashicorp/aws" }
+    awsssmtunnels = { source = "ComplyCo/aws-ssm-tunnels" }
+    postgresql    = { source = "cyrilgdn/postgresql" }
+  }
+}
+
+variable "region" {
+  type    = string
+  default = "us-east-1"
+}
+
+// terraform plan -var mock=true plans without opening the tunnel
+variable "mock" {
+  type    = bool
+  default = false
+}
+
+variable "pg_user" {
+  type = string
+}
+
+variable "pg_password" {
+  type      = string
+  sensitive = true
+}
+
+provider "aws" {
+  region = var.region
+}
+
+// The bastion runs the SSM agent and may connect to the database, see its security groups
+data "aws_instance" "bastion" {
+  filter {
+    name   = "tag:Name"
+    values = ["bastion"]
+  }
+
+  filter {
+    name   = "instance-state-name"
+    values = ["running"]
+  }
+}
+
+data "aws_db_instance" "example" {
+  db_instance_identifier = "example"
+}
+
+provider "awsssmtunnels" {
+  region = var.region
+  target = data.aws_instance.bastion.id
+  mock   = var.mock
+}
+
+resource "awsssmtunnels_remote_tunnel" "rds" {
+  refresh_id  = "one"
+  remote_host = data.aws_db_instance.example.address
+  remote_port = data.aws_db_instance.example.port
+}
+
+provider "postgresql" {
+  host            = awsssmtunnels_remote_tunnel.rds.local_host
+  port            = awsssmtunnels_remote_tunnel.rds.local_port
+  database        = data.aws_db_instance.example.db_name
+  username        = var.pg_user
+  password        = var.pg_password
+  sslmode         = "require"
+  superuser       = false
+  connect_timeout = 15
+}
+
+resource "postgresql_schema" "app" {
+  name = "app"
+}
+
+// Keeps the provider, and with it the tunnel, running until the postgresql provider is done
+data "awsssmtunnels_keepalive" "rds" {
+  depends_on = [
+    postgresql_schema.app,
+    awsssmtunnels_remote_tunnel.rds,
+  ]
+}
@@ -0,0 +1,21 @@
+provider "awsssmtunnels" {
+  region = "us-east-1"
+  target = "i-123456789"
+
+  tunnels = {
+    rds = {
+      remote_host = "mydb.abcdefghijkl.us-east-1.rds.amazonaws.com"
+      remote_port = 5432
+    }
+  }
+}
+
+// In any module using the provider
+data "awsssmtunnels_tunnel" "rds" {
+  name = "rds"
+}
+
+provider "postgresql" {
+  host = data.awsssmtunnels_tunnel.rds.local_host
+  port = data.awsssmtunnels_tunnel.rds.local_port
+}
@@ -0,0 +1,11 @@
+// Terraform 1.10 or later: the tunnel is only open while the postgresql
+// provider needs it, and its endpoint never lands in the state.
+ephemeral "awsssmtunnels_remote_tunnel" "rds" {
+  remote_host = "mydb.abcdefghijkl.us-east-1.rds.amazonaws.com"
+  remote_port = 5432
+}
+
+provider "postgresql" {
+  host = ephemeral.awsssmtunnels_remote_tunnel.rds.local_host
+  port = ephemeral.awsssmtunnels_remote_tunnel.rds.local_port
+}
@@ -0,0 +1,5 @@
+// A port for a local service which must not collide with the tunnels, the
+// same in every run
+output "metrics_port" {
+  value = provider::awsssmtunnels::port_from_key("metrics", 9100, 9199)
+}
@@ -0,0 +1,15 @@
+// Fails the apply within seconds if the bastion can't reach the database, before
+// any of the expensive resources depending on it are created.
+resource "awsssmtunnels_connectivity_check" "rds" {
+  remote_host     = aws_rds_cluster.example.endpoint
+  remote_port     = 5432
+  timeout_seconds = 30
+}
+
+resource "awsssmtunnels_remote_tunnel" "rds" {
+  refresh_id  = "one"
+  remote_host = aws_rds_cluster.example.endpoint
+  remote_port = 5432
+
+  depends_on = [awsssmtunnels_connectivity_check.rds]
+}
@@ -25,7 +25,7 @@ data "aws_eks_cluster_auth" "example" {
 }
 
 resource "awsssmtunnels_remote_tunnel" "eks" {
-  refresh_id  = "one" // Anything string can go here as this resource will always find a diff on this
+  refresh_id  = "one" // Any string, changing it starts the tunnel again
   target      = "i-123456789"
   remote_host = replace(aws_eks_cluster.example.endpoint, "https://", "")
   remote_port = 443
@@ -34,9 +34,9 @@ resource "awsssmtunnels_remote_tunnel" "eks" {
 }
 
 // NOTE: The import is needed for the first plan, otherwise TF will hold off on the create until the Apply phase.
-// The import allows it to run in the very first plan.
+// The import allows it to run in the very first plan. The ID is `target,remote_host:remote_port`, optionally followed by `,region`.
 import {
-  id = "i-123456789|${replace(aws_eks_cluster.example.endpoint, "https://", "")}|443|16534|127.0.0.1|us-east-1"
+  id = "i-123456789,${replace(aws_eks_cluster.example.endpoint, "https://", "")}:443,us-east-1"
   to = awsssmtunnels_remote_tunnel.eks
 }
 
@@ -60,14 +60,14 @@ data "awsssmtunnels_keepalive" "eks" {
 ##############################################
 
 resource "awsssmtunnels_remote_tunnel" "rds" {
-  refresh_id  = "one" // Anything string can go here as this resource will always find a diff on this
+  refresh_id  = "one" // Any string, changing it starts the tunnel again
   remote_host = aws_rds_cluster.example.endpoint
   remote_port = 5432 // This is a PostgreSQL RDS cluster example
   local_port  = 17638
 }
 
 import {
-  id = "<remote host>|<remote port>|<local port>|127.0.0.1"
+  id = "<target>,<remote host>:<remote port>"
   to = awsssmtunnels_remote_tunnel.rds
 }
 
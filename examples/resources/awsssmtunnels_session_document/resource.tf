@@ -0,0 +1,25 @@
+// Sessions with the document can only reach the database.
+resource "awsssmtunnels_session_document" "db" {
+  name          = "tunnels-db"
+  description   = "Port forwarding to the database"
+  allowed_hosts = [aws_rds_cluster.example.endpoint]
+  allowed_ports = [5432]
+}
+
+resource "awsssmtunnels_remote_tunnel" "db" {
+  refresh_id    = "one"
+  remote_host   = aws_rds_cluster.example.endpoint
+  remote_port   = 5432
+  document_name = awsssmtunnels_session_document.db.name
+}
+
+// Allow operators to start sessions with the document only.
+data "aws_iam_policy_document" "tunnels" {
+  statement {
+    actions = ["ssm:StartSession"]
+    resources = [
+      "arn:aws:ec2:*:*:instance/*",
+      "arn:aws:ssm:*:*:document/${awsssmtunnels_session_document.db.name}",
+    ]
+  }
+}
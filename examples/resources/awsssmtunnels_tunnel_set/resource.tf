@@ -0,0 +1,28 @@
+// The database and cache of an environment, both reached through the same bastion.
+resource "awsssmtunnels_tunnel_set" "env" {
+  refresh_id = "one" // Any string, changing it starts the tunnels again
+
+  forward {
+    remote_host = aws_rds_cluster.example.endpoint
+    remote_port = 5432
+  }
+
+  forward {
+    remote_host = aws_elasticache_replication_group.example.primary_endpoint_address
+    remote_port = 6379
+    local_port  = 16379
+  }
+}
+
+locals {
+  // e.g. "127.0.0.1:16042"
+  db_endpoint = awsssmtunnels_tunnel_set.env.endpoints["${aws_rds_cluster.example.endpoint}:5432"]
+}
+
+provider "postgresql" {
+  host     = split(":", local.db_endpoint)[0]
+  port     = split(":", local.db_endpoint)[1]
+  database = "mydb"
+  username = var.pg_user
+  password = var.pg_password
+}
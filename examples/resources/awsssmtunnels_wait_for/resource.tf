@@ -0,0 +1,19 @@
+resource "awsssmtunnels_remote_tunnel" "api" {
+  refresh_id  = "one"
+  remote_host = "api.example.internal"
+  remote_port = 443
+}
+
+// Waits until the API reports itself healthy through the tunnel, for services
+// which are provisioned and then configured in one apply.
+resource "awsssmtunnels_wait_for" "api" {
+  local_host = awsssmtunnels_remote_tunnel.api.local_host
+  local_port = awsssmtunnels_remote_tunnel.api.local_port
+
+  probe = {
+    type        = "grpc"
+    tls         = true
+    server_name = awsssmtunnels_remote_tunnel.api.remote_host
+  }
+  timeout_seconds = 600
+}
@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwltypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+const (
+	// flushInterval is how often queued events are sent to CloudWatch Logs.
+	flushInterval = 5 * time.Second
+	// batchSize is the most events sent with one PutLogEvents call, which
+	// accepts up to 10000 events and 1 MB. Records are well below 2 KB.
+	batchSize = 500
+	// queueSize is the most events waiting to be sent, further ones are dropped.
+	queueSize = 10000
+)
+
+// CloudWatchLogger writes one audit event per forwarded connection to a
+// CloudWatch Logs log stream. The log group must already exist, the log
+// stream is created when the logger is constructed. Events are queued and
+// sent in batches in the background, so connections never wait for
+// CloudWatch Logs; Close sends the events still queued.
+type CloudWatchLogger struct {
+	client   *cloudwatchlogs.Client
+	logGroup string
+	stream   string
+
+	events    chan cwltypes.InputLogEvent
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewCloudWatchLogger(ctx context.Context, client *cloudwatchlogs.Client, logGroup string) (*CloudWatchLogger, error) {
+	if logGroup == "" {
+		return nil, fmt.Errorf("logGroup must be set")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	stream := fmt.Sprintf("awsssmtunnels/%s/%d", hostname, time.Now().UnixNano())
+
+	_, err = client.CreateLogStream(ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(logGroup),
+		LogStreamName: aws.String(stream),
+	})
+	var alreadyExists *cwltypes.ResourceAlreadyExistsException
+	if err != nil && !errors.As(err, &alreadyExists) {
+		return nil, err
+	}
+
+	l := &CloudWatchLogger{
+		client:   client,
+		logGroup: logGroup,
+		stream:   stream,
+		events:   make(chan cwltypes.InputLogEvent, queueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// LogConnection queues the record for CloudWatch Logs. Failures are logged but
+// never interrupt the tunnel.
+func (l *CloudWatchLogger) LogConnection(record ssmtunnels.ConnectionRecord) {
+	message, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding audit record: %v", err)
+		return
+	}
+
+	select {
+	case l.events <- cwltypes.InputLogEvent{
+		Message:   aws.String(string(message)),
+		Timestamp: aws.Int64(record.StartedAt.UnixMilli()),
+	}:
+	default:
+		log.Printf("Dropping audit record of %s, %d records are waiting to be written to %s", record.SourceAddr, queueSize, l.logGroup)
+	}
+}
+
+// Close sends the queued events and stops the logger. Records logged
+// afterwards are dropped. It returns once the events were sent or ctx is done.
+func (l *CloudWatchLogger) Close(ctx context.Context) {
+	if l == nil {
+		return
+	}
+	l.closeOnce.Do(func() { close(l.stop) })
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		log.Printf("Not waiting for audit records to be written to %s: %v", l.logGroup, ctx.Err())
+	}
+}
+
+// run sends the queued events every flushInterval, or once a batch is full.
+func (l *CloudWatchLogger) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []cwltypes.InputLogEvent
+	for {
+		select {
+		case event := <-l.events:
+			batch = append(batch, event)
+			if len(batch) >= batchSize {
+				l.put(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			l.put(batch)
+			batch = nil
+		case <-l.stop:
+			for {
+				select {
+				case event := <-l.events:
+					batch = append(batch, event)
+					if len(batch) >= batchSize {
+						l.put(batch)
+						batch = nil
+					}
+				default:
+					l.put(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// put sends a batch of events with a single PutLogEvents call.
+func (l *CloudWatchLogger) put(batch []cwltypes.InputLogEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	// The events of a call have to be in chronological order, records are logged as connections close
+	sort.SliceStable(batch, func(i, j int) bool { return *batch[i].Timestamp < *batch[j].Timestamp })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := l.client.PutLogEvents(ctx, &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(l.logGroup),
+		LogStreamName: aws.String(l.stream),
+		LogEvents:     batch,
+	})
+	if err != nil {
+		log.Printf("Error writing %d audit records to %s: %v", len(batch), l.logGroup, err)
+	}
+}
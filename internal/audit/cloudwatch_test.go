@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// fakeLogs answers CreateLogStream and records the PutLogEvents calls. While
+// blocked is open, PutLogEvents waits for it to be closed.
+type fakeLogs struct {
+	mu      sync.Mutex
+	batches [][]int64
+	blocked chan struct{}
+}
+
+func (f *fakeLogs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if !strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".PutLogEvents") {
+		w.Write([]byte("{}"))
+		return
+	}
+	var input struct {
+		LogEvents []struct{ Timestamp int64 }
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.blocked != nil {
+		<-f.blocked
+	}
+	timestamps := make([]int64, 0, len(input.LogEvents))
+	for _, event := range input.LogEvents {
+		timestamps = append(timestamps, event.Timestamp)
+	}
+	f.mu.Lock()
+	f.batches = append(f.batches, timestamps)
+	f.mu.Unlock()
+	w.Write([]byte("{}"))
+}
+
+func (f *fakeLogs) calls() [][]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]int64(nil), f.batches...)
+}
+
+func newTestLogger(t *testing.T, fake *fakeLogs) *CloudWatchLogger {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client := cloudwatchlogs.New(cloudwatchlogs.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	logger, err := NewCloudWatchLogger(context.Background(), client, "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+func TestCloudWatchLoggerBatches(t *testing.T) {
+	fake := &fakeLogs{}
+	logger := newTestLogger(t, fake)
+
+	// Records are logged as connections close, not as they start
+	start := time.UnixMilli(1700000000000)
+	for _, offset := range []time.Duration{2 * time.Second, 0, time.Second} {
+		logger.LogConnection(ssmtunnels.ConnectionRecord{StartedAt: start.Add(offset)})
+	}
+	if calls := fake.calls(); len(calls) != 0 {
+		t.Fatalf("expected the records to be queued, got PutLogEvents calls %v", calls)
+	}
+
+	logger.Close(context.Background())
+	calls := fake.calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected the records to be sent with one PutLogEvents call on Close, got %v", calls)
+	}
+	want := []int64{start.UnixMilli(), start.UnixMilli() + 1000, start.UnixMilli() + 2000}
+	if len(calls[0]) != len(want) {
+		t.Fatalf("expected %d events, got %v", len(want), calls[0])
+	}
+	for i := range want {
+		if calls[0][i] != want[i] {
+			t.Fatalf("expected events in chronological order %v, got %v", want, calls[0])
+		}
+	}
+
+	// Records of connections closed later are dropped instead of sent
+	logger.LogConnection(ssmtunnels.ConnectionRecord{StartedAt: start})
+	logger.Close(context.Background())
+	if calls := fake.calls(); len(calls) != 1 {
+		t.Fatalf("expected no PutLogEvents call after Close, got %v", calls)
+	}
+}
+
+func TestCloudWatchLoggerFullBatch(t *testing.T) {
+	fake := &fakeLogs{}
+	logger := newTestLogger(t, fake)
+	defer logger.Close(context.Background())
+
+	for i := 0; i < batchSize+1; i++ {
+		logger.LogConnection(ssmtunnels.ConnectionRecord{StartedAt: time.UnixMilli(int64(i))})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.calls()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a full batch to be sent without waiting for the flush interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := fake.calls(); len(calls[0]) != batchSize {
+		t.Fatalf("expected a batch of %d events, got %d", batchSize, len(calls[0]))
+	}
+}
+
+func TestCloudWatchLoggerDoesNotBlock(t *testing.T) {
+	fake := &fakeLogs{blocked: make(chan struct{})}
+	logger := newTestLogger(t, fake)
+	defer close(fake.blocked)
+
+	// Fill a batch, whose PutLogEvents call hangs, then the queue
+	started := time.Now()
+	for i := 0; i < batchSize+queueSize+10; i++ {
+		logger.LogConnection(ssmtunnels.ConnectionRecord{StartedAt: time.UnixMilli(int64(i))})
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("expected LogConnection not to wait for CloudWatch Logs, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	logger.Close(ctx)
+	if ctx.Err() == nil {
+		t.Fatal("expected Close to wait until its context is done")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+// completeExample reaches a PostgreSQL RDS instance through a bastion found by
+// its Name tag.
+var completeExample = []block{
+	{
+		kind: "terraform",
+		blocks: []block{
+			{
+				kind: "required_providers",
+				attrs: []attr{
+					{name: "aws", expr: `{ source = "hashicorp/aws" }`},
+					{name: "awsssmtunnels", expr: `{ source = "ComplyCo/aws-ssm-tunnels" }`},
+					{name: "postgresql", expr: `{ source = "cyrilgdn/postgresql" }`},
+				},
+			},
+		},
+	},
+	{
+		kind:   "variable",
+		labels: []string{"region"},
+		attrs: []attr{
+			{name: "type", expr: "string"},
+			{name: "default", expr: `"us-east-1"`},
+		},
+	},
+	{
+		kind:    "variable",
+		labels:  []string{"mock"},
+		comment: "terraform plan -var mock=true plans without opening the tunnel",
+		attrs: []attr{
+			{name: "type", expr: "bool"},
+			{name: "default", expr: "false"},
+		},
+	},
+	{
+		kind:   "variable",
+		labels: []string{"pg_user"},
+		attrs: []attr{
+			{name: "type", expr: "string"},
+		},
+	},
+	{
+		kind:   "variable",
+		labels: []string{"pg_password"},
+		attrs: []attr{
+			{name: "type", expr: "string"},
+			{name: "sensitive", expr: "true"},
+		},
+	},
+	{
+		kind:   "provider",
+		labels: []string{"aws"},
+		attrs: []attr{
+			{name: "region", expr: "var.region"},
+		},
+	},
+	{
+		kind:    "data",
+		labels:  []string{"aws_instance", "bastion"},
+		comment: "The bastion runs the SSM agent and may connect to the database, see its security groups",
+		blocks: []block{
+			{
+				kind: "filter",
+				attrs: []attr{
+					{name: "name", expr: `"tag:Name"`},
+					{name: "values", expr: `["bastion"]`},
+				},
+			},
+			{
+				kind: "filter",
+				attrs: []attr{
+					{name: "name", expr: `"instance-state-name"`},
+					{name: "values", expr: `["running"]`},
+				},
+			},
+		},
+	},
+	{
+		kind:   "data",
+		labels: []string{"aws_db_instance", "example"},
+		attrs: []attr{
+			{name: "db_instance_identifier", expr: `"example"`},
+		},
+	},
+	{
+		kind:   "provider",
+		labels: []string{providerName},
+		attrs: []attr{
+			{name: "region", expr: "var.region"},
+			{name: "target", expr: "data.aws_instance.bastion.id"},
+			{name: "mock", expr: "var.mock"},
+		},
+	},
+	{
+		kind:   "resource",
+		labels: []string{providerName + "_remote_tunnel", "rds"},
+		attrs: []attr{
+			{name: "refresh_id", expr: `"one"`},
+			{name: "remote_host", expr: "data.aws_db_instance.example.address"},
+			{name: "remote_port", expr: "data.aws_db_instance.example.port"},
+		},
+	},
+	{
+		kind:   "provider",
+		labels: []string{"postgresql"},
+		attrs: []attr{
+			{name: "host", expr: providerName + "_remote_tunnel.rds.local_host"},
+			{name: "port", expr: providerName + "_remote_tunnel.rds.local_port"},
+			{name: "database", expr: "data.aws_db_instance.example.db_name"},
+			{name: "username", expr: "var.pg_user"},
+			{name: "password", expr: "var.pg_password"},
+			{name: "sslmode", expr: `"require"`},
+			{name: "superuser", expr: "false"},
+			{name: "connect_timeout", expr: "15"},
+		},
+	},
+	{
+		kind:   "resource",
+		labels: []string{"postgresql_schema", "app"},
+		attrs: []attr{
+			{name: "name", expr: `"app"`},
+		},
+	},
+	{
+		kind:    "data",
+		labels:  []string{providerName + "_keepalive", "rds"},
+		comment: "Keeps the provider, and with it the tunnel, running until the postgresql provider is done",
+		attrs: []attr{
+			{name: "depends_on", list: []string{
+				"postgresql_schema.app",
+				providerName + "_remote_tunnel.rds",
+			}},
+		},
+	},
+}
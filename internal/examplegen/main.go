@@ -0,0 +1,197 @@
+// Command examplegen writes examples/complete/main.tf, a whole stack using the
+// provider: the bastion is looked up, an RDS instance is reached through a
+// tunnel and the postgresql provider uses the tunnel. The blocks of this
+// provider are checked against its schema while generating, so the example
+// can't rot when an attribute is renamed or becomes required. Run it with
+// go generate, see main.go.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/provider"
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+)
+
+// providerName is the local name of the provider, the prefix of its resource types.
+const providerName = "awsssmtunnels"
+
+// metaArguments are handled by Terraform and aren't in the schema.
+var metaArguments = map[string]bool{
+	"count":      true,
+	"depends_on": true,
+	"for_each":   true,
+	"provider":   true,
+	"alias":      true,
+}
+
+// block is a block of the example, e.g. a resource.
+type block struct {
+	kind    string
+	labels  []string
+	comment string
+	attrs   []attr
+	blocks  []block
+}
+
+// attr is an argument of a block. expr is written as is, list as a list with
+// one expression per line.
+type attr struct {
+	name string
+	expr string
+	list []string
+}
+
+func (b block) address() string {
+	return strings.Join(append([]string{b.kind}, b.labels...), ".")
+}
+
+// schema returns the schema of the block if it belongs to this provider, ok
+// is false for blocks of other providers and of Terraform itself.
+func (b block) schema(schemas *tfprotov6.GetProviderSchemaResponse) (s *tfprotov6.Schema, ok bool) {
+	if len(b.labels) == 0 {
+		return nil, false
+	}
+	switch {
+	case b.kind == "provider" && b.labels[0] == providerName:
+		return schemas.Provider, true
+	case b.kind == "resource" && strings.HasPrefix(b.labels[0], providerName+"_"):
+		return schemas.ResourceSchemas[b.labels[0]], true
+	case b.kind == "data" && strings.HasPrefix(b.labels[0], providerName+"_"):
+		return schemas.DataSourceSchemas[b.labels[0]], true
+	}
+	return nil, false
+}
+
+// check fails unless the arguments of the block are attributes of the schema
+// which can be set, and every required attribute is set.
+func (b block) check(s *tfprotov6.Schema) error {
+	attributes := map[string]*tfprotov6.SchemaAttribute{}
+	for _, attribute := range s.Block.Attributes {
+		attributes[attribute.Name] = attribute
+	}
+	set := map[string]bool{}
+	for _, a := range b.attrs {
+		if metaArguments[a.name] {
+			continue
+		}
+		attribute, ok := attributes[a.name]
+		switch {
+		case !ok:
+			return fmt.Errorf("%s: %s is not an attribute", b.address(), a.name)
+		case !attribute.Required && !attribute.Optional:
+			return fmt.Errorf("%s: %s is read-only", b.address(), a.name)
+		case attribute.Deprecated:
+			return fmt.Errorf("%s: %s is deprecated", b.address(), a.name)
+		}
+		set[a.name] = true
+	}
+	for _, attribute := range s.Block.Attributes {
+		if attribute.Required && !set[attribute.Name] {
+			return fmt.Errorf("%s: required attribute %s is not set", b.address(), attribute.Name)
+		}
+	}
+	return nil
+}
+
+// write appends the block formatted like terraform fmt.
+func (b block) write(out *strings.Builder, indent string) {
+	if b.comment != "" {
+		for _, line := range strings.Split(b.comment, "\n") {
+			fmt.Fprintf(out, "%s// %s\n", indent, line)
+		}
+	}
+	out.WriteString(indent + b.kind)
+	for _, label := range b.labels {
+		fmt.Fprintf(out, " %q", label)
+	}
+	out.WriteString(" {\n")
+
+	inner := indent + "  "
+	// Consecutive single line arguments have their equal signs aligned
+	width := 0
+	for i, a := range b.attrs {
+		if a.list != nil {
+			width = 0
+			fmt.Fprintf(out, "%s%s = [\n", inner, a.name)
+			for _, item := range a.list {
+				fmt.Fprintf(out, "%s  %s,\n", inner, item)
+			}
+			fmt.Fprintf(out, "%s]\n", inner)
+			continue
+		}
+		if width == 0 {
+			for _, next := range b.attrs[i:] {
+				if next.list != nil {
+					break
+				}
+				width = max(width, len(next.name))
+			}
+		}
+		fmt.Fprintf(out, "%s%-*s = %s\n", inner, width, a.name, a.expr)
+	}
+	for i, nested := range b.blocks {
+		if i > 0 || len(b.attrs) > 0 {
+			out.WriteString("\n")
+		}
+		nested.write(out, inner)
+	}
+	out.WriteString(indent + "}\n")
+}
+
+// generate returns the example, failing if a block of the provider doesn't
+// match its schema.
+func generate(blocks []block, schemas *tfprotov6.GetProviderSchemaResponse) (string, error) {
+	var out strings.Builder
+	out.WriteString("// Code generated by examplegen; DO NOT EDIT.\n")
+	for _, b := range blocks {
+		if s, ok := b.schema(schemas); ok {
+			if s == nil {
+				return "", fmt.Errorf("%s: no such type", b.address())
+			}
+			if err := b.check(s); err != nil {
+				return "", err
+			}
+		}
+		out.WriteString("\n")
+		b.write(&out, "")
+	}
+	return out.String(), nil
+}
+
+func main() {
+	path := flag.String("out", "examples/complete/main.tf", "file to write the example to")
+	flag.Parse()
+
+	server, err := providerserver.NewProtocol6WithError(provider.New("generate")())()
+	if err != nil {
+		log.Fatal(err)
+	}
+	schemas, err := server.GetProviderSchema(context.Background(), &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, d := range schemas.Diagnostics {
+		if d.Severity == tfprotov6.DiagnosticSeverityError {
+			log.Fatalf("%s: %s", d.Summary, d.Detail)
+		}
+	}
+
+	example, err := generate(completeExample, schemas)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*path), 0o755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*path, []byte(example), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
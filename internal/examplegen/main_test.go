@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/provider"
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+)
+
+func providerSchemas(t *testing.T) *tfprotov6.GetProviderSchemaResponse {
+	t.Helper()
+	server, err := providerserver.NewProtocol6WithError(provider.New("test")())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := server.GetProviderSchema(context.Background(), &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schemas
+}
+
+func TestCompleteExampleUpToDate(t *testing.T) {
+	example, err := generate(completeExample, providerSchemas(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile("../../examples/complete/main.tf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(committed) != example {
+		t.Error("examples/complete/main.tf is out of date, run go generate")
+	}
+}
+
+func TestGenerateChecksSchema(t *testing.T) {
+	schemas := providerSchemas(t)
+	tunnel := func(attrs ...attr) []block {
+		return []block{{kind: "resource", labels: []string{"awsssmtunnels_remote_tunnel", "rds"}, attrs: attrs}}
+	}
+
+	tests := map[string]struct {
+		blocks []block
+		want   string
+	}{
+		"unknown attribute": {
+			blocks: tunnel(attr{name: "remote_host", expr: `"db"`}, attr{name: "remote_port", expr: "5432"}, attr{name: "refresh_id", expr: `"one"`}, attr{name: "remote_hostname", expr: `"db"`}),
+			want:   "remote_hostname is not an attribute",
+		},
+		"missing required attribute": {
+			blocks: tunnel(attr{name: "remote_host", expr: `"db"`}),
+			want:   "required attribute",
+		},
+		"read-only attribute": {
+			blocks: tunnel(attr{name: "remote_host", expr: `"db"`}, attr{name: "remote_port", expr: "5432"}, attr{name: "refresh_id", expr: `"one"`}, attr{name: "platform", expr: `"Linux"`}),
+			want:   "platform is read-only",
+		},
+		"unknown type": {
+			blocks: []block{{kind: "data", labels: []string{"awsssmtunnels_bastion", "example"}}},
+			want:   "no such type",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := generate(test.blocks, schemas)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package pac
+
+import (
+	"net"
+	"strings"
+)
+
+// builtins are the helper functions every PAC runtime provides, by the name
+// scripts call them with. goja converts the arguments and results, e.g. a
+// missing argument to "" and a nil any to null.
+var builtins = map[string]any{
+	"isPlainHostName": func(host string) bool {
+		return !strings.Contains(host, ".")
+	},
+	"dnsDomainIs": func(host, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	},
+	"localHostOrDomainIs": func(host, hostdom string) bool {
+		host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+		if host == hostdom {
+			return true
+		}
+		return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+	},
+	"isResolvable": func(host string) bool {
+		return resolve(host) != ""
+	},
+	"dnsResolve": func(host string) any {
+		if ip := resolve(host); ip != "" {
+			return ip
+		}
+		return nil
+	},
+	"isInNet": func(host, pattern, mask string) bool {
+		ip := net.ParseIP(resolve(host))
+		patternIP := net.ParseIP(pattern)
+		maskIP := net.ParseIP(mask)
+		if ip == nil || patternIP == nil || maskIP == nil || ip.To4() == nil {
+			return false
+		}
+		ipMask := net.IPMask(maskIP.To4())
+		return ip.To4().Mask(ipMask).Equal(patternIP.To4().Mask(ipMask))
+	},
+	"myIpAddress": myIPAddress,
+	"dnsDomainLevels": func(host string) int {
+		return strings.Count(host, ".")
+	},
+	"shExpMatch": func(s, pattern string) bool {
+		return globMatch(pattern, s)
+	},
+}
+
+func myIPAddress() string {
+	// No packets are sent, this only asks the OS which interface it would use
+	conn, err := net.Dial("udp", "198.51.100.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+// globMatch implements shell expression matching, where * and ? match any character.
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if globMatch(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && globMatch(pattern[1:], s[1:])
+	default:
+		return s != "" && s[0] == pattern[0] && globMatch(pattern[1:], s[1:])
+	}
+}
@@ -0,0 +1,190 @@
+// Package pac evaluates proxy auto-config (PAC) files.
+//
+// PAC files are JavaScript, evaluated with goja, an ECMAScript 5.1 engine
+// written in Go, so the provider doesn't need a JavaScript runtime next to it.
+// The standard PAC helper functions are provided, except the date and time
+// functions weekdayRange, dateRange and timeRange, and the Microsoft IPv6
+// extensions ending in Ex. Calling those fails the evaluation, as does a
+// script running longer than evalTimeout.
+package pac
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// evalTimeout bounds running the script and each FindProxyForURL call, so a
+// PAC file looping forever can't hang the provider.
+var evalTimeout = 5 * time.Second
+
+// Script is a parsed PAC file.
+type Script struct {
+	// mu serializes calls, a goja runtime isn't safe for concurrent use
+	mu              sync.Mutex
+	vm              *goja.Runtime
+	findProxyForURL goja.Callable
+}
+
+// Parse parses and runs the source of a PAC file. It must declare FindProxyForURL.
+func Parse(source string) (*Script, error) {
+	program, err := goja.Compile("proxy.pac", source, false)
+	if err != nil {
+		return nil, err
+	}
+
+	vm := goja.New()
+	for name, builtin := range builtins {
+		if err := vm.Set(name, builtin); err != nil {
+			return nil, err
+		}
+	}
+	// Global variable declarations are evaluated once
+	if err := interruptAfter(vm, evalTimeout, func() error {
+		_, err := vm.RunProgram(program)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	findProxyForURL, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("PAC file does not define FindProxyForURL")
+	}
+	return &Script{vm: vm, findProxyForURL: findProxyForURL}, nil
+}
+
+// FindProxyForURL runs the PAC function for the URL and returns its raw result,
+// e.g. "PROXY proxy.example.com:8080; DIRECT".
+func (s *Script) FindProxyForURL(u *url.URL) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result goja.Value
+	err := interruptAfter(s.vm, evalTimeout, func() error {
+		var err error
+		result, err = s.findProxyForURL(goja.Undefined(), s.vm.ToValue(u.String()), s.vm.ToValue(u.Hostname()))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	str, ok := result.Export().(string)
+	if !ok {
+		return "", fmt.Errorf("FindProxyForURL returned %v instead of a string", result)
+	}
+	return str, nil
+}
+
+// interruptAfter runs run, interrupting the runtime if it takes longer than timeout.
+func interruptAfter(vm *goja.Runtime, timeout time.Duration, run func() error) error {
+	timer := time.AfterFunc(timeout, func() {
+		vm.Interrupt(fmt.Errorf("PAC file did not finish within %s", timeout))
+	})
+	defer timer.Stop()
+	defer vm.ClearInterrupt()
+	return run()
+}
+
+// Proxy returns the proxy URL to use for the request URL, or nil for a direct connection.
+func (s *Script) Proxy(u *url.URL) (*url.URL, error) {
+	result, err := s.FindProxyForURL(u)
+	if err != nil {
+		return nil, err
+	}
+	return ParseResult(result)
+}
+
+// ParseResult picks the first usable entry of a FindProxyForURL result.
+func ParseResult(result string) (*url.URL, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+	}
+	return nil, fmt.Errorf("no usable entry in PAC result %q", result)
+}
+
+func resolve(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if addr.To4() != nil {
+			return addr.String()
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0].String()
+	}
+	return ""
+}
+
+// Load fetches and parses the PAC file at location, which can be an http(s)
+// or file URL.
+func Load(ctx context.Context, client *http.Client, location string) (*Script, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	var source []byte
+	switch u.Scheme {
+	case "file":
+		if source, err = os.ReadFile(u.Path); err != nil {
+			return nil, err
+		}
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch PAC file %s: %s", location, resp.Status)
+		}
+		if source, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PAC URL scheme %q", u.Scheme)
+	}
+
+	return Parse(string(source))
+}
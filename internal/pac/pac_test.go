@@ -0,0 +1,235 @@
+package pac
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// corporatePAC is shaped like the PAC files of corporate proxies: plain and
+// internal hosts go direct, private networks by their address, and a few
+// SaaS domains through a dedicated proxy with failover.
+const corporatePAC = `
+var directDomains = [".corp.example.com", ".internal.example.com"];
+var saasProxy = "PROXY saas-proxy.example.com:3128; PROXY proxy.example.com:8080; DIRECT";
+
+function isDirectDomain(host) {
+	for (var i = 0; i < directDomains.length; i++) {
+		if (dnsDomainIs(host, directDomains[i])) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || isDirectDomain(host) || localHostOrDomainIs(host, "intranet.example.com")) {
+		return "DIRECT";
+	}
+	if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+		if (isInNet(host, "10.0.0.0", "255.0.0.0") ||
+			isInNet(host, "172.16.0.0", "255.240.0.0") ||
+			isInNet(host, "192.168.0.0", "255.255.0.0") ||
+			isInNet(host, "127.0.0.0", "255.0.0.0")) {
+			return "DIRECT";
+		}
+	}
+	if (shExpMatch(host, "*.salesforce.com") || shExpMatch(url, "https://*.atlassian.net/*")) {
+		return saasProxy;
+	}
+	if (url.substring(0, 5) == "http:") {
+		return "PROXY proxy.example.com:8080";
+	}
+	return "HTTPS proxy.example.com:8443; SOCKS socks.example.com:1080";
+}
+`
+
+// awsPAC is shaped like the PAC files which send only the AWS endpoints of
+// a VPN through its proxy, with a switch and a helper table.
+const awsPAC = `
+var regions = { "eu-west-1": true, "us-east-1": true };
+
+function FindProxyForURL(url, host) {
+	var parts = host.split(".");
+	switch (parts[parts.length - 2] + "." + parts[parts.length - 1]) {
+	case "amazonaws.com":
+		if (parts.length >= 4 && regions[parts[parts.length - 3]]) {
+			return "PROXY vpn-proxy.example.com:3128";
+		}
+		return "DIRECT";
+	default:
+		return dnsDomainLevels(host) > 0 ? "DIRECT" : "PROXY proxy.example.com:8080";
+	}
+}
+`
+
+func TestFindProxyForURL(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		url    string
+		want   string
+	}{
+		{"plain host", corporatePAC, "http://wiki/", "DIRECT"},
+		{"internal domain", corporatePAC, "https://git.corp.example.com/", "DIRECT"},
+		{"internal domain in capitals", corporatePAC, "https://GIT.CORP.EXAMPLE.COM/", "DIRECT"},
+		{"local host or domain", corporatePAC, "https://intranet.example.com/", "DIRECT"},
+		{"private network", corporatePAC, "http://10.1.2.3:8080/", "DIRECT"},
+		{"other private network", corporatePAC, "http://172.20.0.1/", "DIRECT"},
+		{"public address", corporatePAC, "https://203.0.113.7/", "HTTPS proxy.example.com:8443; SOCKS socks.example.com:1080"},
+		{"host glob", corporatePAC, "https://eu1.salesforce.com/login", "PROXY saas-proxy.example.com:3128; PROXY proxy.example.com:8080; DIRECT"},
+		{"url glob", corporatePAC, "https://acme.atlassian.net/browse/OPS-1", "PROXY saas-proxy.example.com:3128; PROXY proxy.example.com:8080; DIRECT"},
+		{"plain http", corporatePAC, "http://example.org/", "PROXY proxy.example.com:8080"},
+		{"https", corporatePAC, "https://example.org/", "HTTPS proxy.example.com:8443; SOCKS socks.example.com:1080"},
+		{"regional endpoint", awsPAC, "https://ssmmessages.eu-west-1.amazonaws.com/v1/data-channel", "PROXY vpn-proxy.example.com:3128"},
+		{"other region", awsPAC, "https://ssm.ap-south-1.amazonaws.com/", "DIRECT"},
+		{"other domain", awsPAC, "https://example.org/", "DIRECT"},
+		{"single label", awsPAC, "http://localhost/", "PROXY proxy.example.com:8080"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			script, err := Parse(tc.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := script.FindProxyForURL(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"syntax error", "function FindProxyForURL(url, host) { return \"DIRECT\"", "Unexpected end of input"},
+		{"no FindProxyForURL", "function findProxy(url, host) { return \"DIRECT\"; }", "does not define FindProxyForURL"},
+		{"not a function", "var FindProxyForURL = \"DIRECT\";", "does not define FindProxyForURL"},
+		{"global throws", "throw new Error(\"broken\"); function FindProxyForURL(url, host) { return \"DIRECT\"; }", "broken"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.script)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindProxyForURLErrors(t *testing.T) {
+	defer func(timeout time.Duration) { evalTimeout = timeout }(evalTimeout)
+	evalTimeout = 100 * time.Millisecond
+
+	cases := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"not a string", "function FindProxyForURL(url, host) { return 42; }", "instead of a string"},
+		{"unsupported helper", "function FindProxyForURL(url, host) { return weekdayRange(\"MON\", \"FRI\") ? \"DIRECT\" : \"PROXY p:1\"; }", "weekdayRange is not defined"},
+		{"endless loop", "function FindProxyForURL(url, host) { while (true) {} }", "did not finish within"},
+	}
+	u := &url.URL{Scheme: "https", Host: "example.org"}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			script, err := Parse(tc.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = script.FindProxyForURL(u)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want one containing %q", err, tc.want)
+			}
+			// The runtime stays usable after an interrupted call
+			if tc.name == "endless loop" {
+				if _, err := script.vm.RunString("1"); err != nil {
+					t.Errorf("running after the interrupt: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseResult(t *testing.T) {
+	cases := []struct {
+		result string
+		want   string
+	}{
+		{"DIRECT", ""},
+		{"PROXY proxy.example.com:8080", "http://proxy.example.com:8080"},
+		{"proxy proxy.example.com:8080; DIRECT", "http://proxy.example.com:8080"},
+		{"HTTPS proxy.example.com:8443", "https://proxy.example.com:8443"},
+		{"SOCKS5 socks.example.com:1080", "socks5://socks.example.com:1080"},
+		{"QUIC quic.example.com:443; PROXY proxy.example.com:8080", "http://proxy.example.com:8080"},
+		{"PROXY; DIRECT", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.result, func(t *testing.T) {
+			got, err := ParseResult(tc.result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+				t.Errorf("got %v, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := ParseResult("BLOCKED"); err == nil {
+		t.Error("got no error for a result without a usable entry")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxy.pac" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = w.Write([]byte(corporatePAC))
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(file, []byte(awsPAC), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, location := range []string{server.URL + "/proxy.pac", "file://" + file} {
+		script, err := Load(ctx, server.Client(), location)
+		if err != nil {
+			t.Fatalf("%s: %v", location, err)
+		}
+		if _, err := script.Proxy(&url.URL{Scheme: "https", Host: "example.org"}); err != nil {
+			t.Errorf("%s: %v", location, err)
+		}
+	}
+
+	if _, err := Load(ctx, server.Client(), server.URL+"/missing.pac"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got error %v for a missing PAC file, want a 404", err)
+	}
+	if _, err := Load(ctx, server.Client(), "ftp://example.org/proxy.pac"); err == nil {
+		t.Error("got no error for an ftp URL")
+	}
+}
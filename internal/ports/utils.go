@@ -4,28 +4,91 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 )
 
+// FindOpenPort returns a port in the range nothing listens on. The port may
+// be taken by the time it is used, see ReservePort.
 func FindOpenPort(lowerPort, upperPort int) (int, error) {
+	port := 0
+	err := searchRange(lowerPort, upperPort, func(candidate int) error {
+		if !IsPortFree(candidate) {
+			return fmt.Errorf("port %d is in use", candidate)
+		}
+		port = candidate
+		return nil
+	})
+	return port, err
+}
+
+// ReservePort picks a port in the range like FindOpenPort, except ports for
+// which skip returns true, and keeps listening on it on host. Nothing else can
+// bind the port until the returned listener is closed or adopted, e.g. by the
+// forwarder of the tunnel the port was picked for.
+func ReservePort(host string, lowerPort, upperPort int, skip func(port int) bool) (net.Listener, error) {
+	var listener net.Listener
+	err := searchRange(lowerPort, upperPort, func(port int) error {
+		if skip != nil && skip(port) {
+			return fmt.Errorf("port %d is reserved", port)
+		}
+		// The port has to be free on every interface, like for FindOpenPort
+		if !IsPortFree(port) {
+			return fmt.Errorf("port %d is in use", port)
+		}
+		var err error
+		listener, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		return err
+	})
+	return listener, err
+}
+
+// searchRange calls try with the ports of the range until it succeeds.
+func searchRange(lowerPort, upperPort int, try func(port int) error) error {
 	if lowerPort < 0 || upperPort < 0 {
-		return 0, fmt.Errorf("port range must be positive")
+		return fmt.Errorf("port range must be positive")
 	}
 
 	if lowerPort > upperPort {
-		return 0, fmt.Errorf("lower port must be less than upper port")
+		return fmt.Errorf("lower port must be less than upper port")
 	}
 
 	if lowerPort > 65535 || upperPort > 65535 {
-		return 0, fmt.Errorf("port range must be less than 65536")
+		return fmt.Errorf("port range must be less than 65536")
 	}
 
-	for port := rand.Intn(upperPort-lowerPort+1) + lowerPort; port <= upperPort; port++ {
-		address := fmt.Sprintf(":%d", port)
-		listener, err := net.Listen("tcp", address)
-		if err == nil {
-			listener.Close()
-			return port, nil // Port is open
+	// Start at a random port and wrap around, so small ranges are fully searched
+	size := upperPort - lowerPort + 1
+	offset := rand.Intn(size)
+	var lastErr error
+	for i := 0; i < size; i++ {
+		if lastErr = try(lowerPort + (offset+i)%size); lastErr == nil {
+			return nil
 		}
 	}
-	return 0, fmt.Errorf("no open port found in the range %d-%d", lowerPort, upperPort)
+	return fmt.Errorf("no open port found in the range %d-%d: %w", lowerPort, upperPort, lastErr)
+}
+
+// FindEphemeralPort asks the operating system for a free port on the loopback interface.
+func FindEphemeralPort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unexpected listener address type %T", listener.Addr())
+	}
+	return addr.Port, nil
+}
+
+// IsPortFree reports whether nothing is listening on the port.
+func IsPortFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
 }
@@ -0,0 +1,1762 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ports"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmfake"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// testAccFake starts the Session Manager fake and points the SSM client of the
+// provider at it. Every other service uses AWS_ENDPOINT_URL, e.g. LocalStack
+// or moto, whose SSM doesn't implement sessions.
+func testAccFake(t *testing.T) *ssmfake.Server {
+	t.Helper()
+	testAccPreCheck(t)
+
+	fake := ssmfake.NewServer()
+	t.Cleanup(fake.Close)
+	t.Setenv("AWS_ENDPOINT_URL_SSM", fake.URL())
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" && os.Getenv("AWS_PROFILE") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "test")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	}
+	t.Cleanup(func() {
+		if err := CloseAllTunnels(context.Background()); err != nil {
+			t.Errorf("closing tunnels: %v", err)
+		}
+	})
+	return fake
+}
+
+// testAccLocalStack skips the test unless AWS_ENDPOINT_URL points at an
+// emulator like LocalStack, see make testacc-localstack.
+func testAccLocalStack(t *testing.T) aws.Config {
+	t.Helper()
+	if os.Getenv("AWS_ENDPOINT_URL") == "" {
+		t.Skip("Needs AWS_ENDPOINT_URL to point at LocalStack or moto")
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion("us-east-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// echoServer stands in for the remote host of a tunnel.
+func echoServer(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// testAccEcho sends a line through the tunnel listening on port and expects it back.
+func testAccEcho(t *testing.T, port int64, message string) {
+	t.Helper()
+	if reply := testAccExchange(t, port, message); reply != message {
+		t.Fatalf("got %q back, want %q", reply, message)
+	}
+}
+
+// testAccExchange sends a line through the tunnel listening on port and returns the line coming back.
+func testAccExchange(t *testing.T, port int64, message string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(port, 10)), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := io.WriteString(conn, message+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading through the tunnel: %v", err)
+	}
+	return strings.TrimSuffix(reply, "\n")
+}
+
+// testAccApply plans and applies a change of a resource like terraform apply
+// and returns its new attributes. A null config destroys the resource.
+func testAccApply(t *testing.T, server tfprotov6.ProviderServer, schemas *tfprotov6.GetProviderSchemaResponse, typeName string, prior tftypes.Value, config tftypes.Value) map[string]tftypes.Value {
+	t.Helper()
+	ctx := context.Background()
+	resourceType := schemas.ResourceSchemas[typeName].ValueType()
+
+	plan, err := server.PlanResourceChange(ctx, &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         typeName,
+		PriorState:       dynamicValue(t, resourceType, prior),
+		ProposedNewState: dynamicValue(t, resourceType, config),
+		Config:           dynamicValue(t, resourceType, config),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(plan.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning %s: %v", typeName, errs)
+	}
+
+	apply, err := server.ApplyResourceChange(ctx, &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:     typeName,
+		PriorState:   dynamicValue(t, resourceType, prior),
+		PlannedState: plan.PlannedState,
+		Config:       dynamicValue(t, resourceType, config),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(apply.Diagnostics); len(errs) > 0 {
+		t.Fatalf("applying %s: %v", typeName, errs)
+	}
+
+	state, err := apply.NewState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned, err := plan.PlannedState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := unplannedChanges(t, planned, state); len(changed) > 0 {
+		t.Fatalf("applying %s: inconsistent result after apply, planned values changed: %v", typeName, changed)
+	}
+	var attrs map[string]tftypes.Value
+	if err := state.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	return attrs
+}
+
+// unplannedChanges returns the paths whose known planned value differs from
+// the applied one, which Terraform rejects as an inconsistent result.
+func unplannedChanges(t *testing.T, planned tftypes.Value, applied tftypes.Value) []string {
+	t.Helper()
+	var changed []string
+	err := tftypes.Walk(planned, func(at *tftypes.AttributePath, value tftypes.Value) (bool, error) {
+		if !value.IsKnown() {
+			return false, nil
+		}
+		if !value.IsFullyKnown() {
+			return true, nil
+		}
+		got, _, err := tftypes.WalkAttributePath(applied, at)
+		if err != nil || !value.Equal(got.(tftypes.Value)) {
+			changed = append(changed, at.String())
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changed
+}
+
+// testAccRefresh reads a resource like terraform refresh and returns its new state.
+func testAccRefresh(t *testing.T, server tfprotov6.ProviderServer, schemas *tfprotov6.GetProviderSchemaResponse, typeName string, state tftypes.Value) tftypes.Value {
+	t.Helper()
+	resourceType := schemas.ResourceSchemas[typeName].ValueType()
+	read, err := server.ReadResource(context.Background(), &tfprotov6.ReadResourceRequest{
+		TypeName:     typeName,
+		CurrentState: dynamicValue(t, resourceType, state),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(read.Diagnostics); len(errs) > 0 {
+		t.Fatalf("reading %s: %v", typeName, errs)
+	}
+	refreshed, err := read.NewState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refreshed
+}
+
+// testAccCreateRemoteTunnel creates an awsssmtunnels_remote_tunnel and returns its state.
+func testAccCreateRemoteTunnel(t *testing.T, server tfprotov6.ProviderServer, schemas *tfprotov6.GetProviderSchemaResponse, values map[string]tftypes.Value) tftypes.Value {
+	t.Helper()
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	attrs := testAccApply(t, server, schemas, "awsssmtunnels_remote_tunnel",
+		tftypes.NewValue(resourceType, nil), objectValue(resourceType, values))
+	return tftypes.NewValue(resourceType, attrs)
+}
+
+// testAccDestroyRemoteTunnel destroys an awsssmtunnels_remote_tunnel.
+func testAccDestroyRemoteTunnel(t *testing.T, server tfprotov6.ProviderServer, schemas *tfprotov6.GetProviderSchemaResponse, state tftypes.Value) {
+	t.Helper()
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType()
+	testAccApply(t, server, schemas, "awsssmtunnels_remote_tunnel", state, tftypes.NewValue(resourceType, nil))
+}
+
+// testAccKeepalive reads awsssmtunnels_keepalive like at the end of a run and
+// returns its errors.
+func testAccKeepalive(t *testing.T, server tfprotov6.ProviderServer, schemas *tfprotov6.GetProviderSchemaResponse) []string {
+	t.Helper()
+	dataSourceType := schemas.DataSourceSchemas["awsssmtunnels_keepalive"].ValueType().(tftypes.Object)
+	resp, err := server.ReadDataSource(context.Background(), &tfprotov6.ReadDataSourceRequest{
+		TypeName: "awsssmtunnels_keepalive",
+		Config:   dynamicValue(t, dataSourceType, objectValue(dataSourceType, map[string]tftypes.Value{})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diagnosticErrors(resp.Diagnostics)
+}
+
+func attrInt64(t *testing.T, state tftypes.Value, name string) int64 {
+	t.Helper()
+	var attrs map[string]tftypes.Value
+	if err := state.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	var value big.Float
+	if err := attrs[name].As(&value); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	n, _ := value.Int64()
+	return n
+}
+
+func attrString(t *testing.T, state tftypes.Value, name string) string {
+	t.Helper()
+	var attrs map[string]tftypes.Value
+	if err := state.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := attrs[name].As(&value); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return value
+}
+
+func TestAccRemoteTunnel(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	localPort := attrInt64(t, state, "local_port")
+	if platform := attrString(t, state, "platform"); platform != "Linux" {
+		t.Errorf("got platform %q, want Linux", platform)
+	}
+	testAccEcho(t, localPort, "hello")
+	// The forwarder keeps serving after the first connection is closed
+	testAccEcho(t, localPort, "again")
+
+	sessions := fake.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	if s := sessions[0]; s.Target != "i-0123456789abcdef0" || s.RemoteHost != "127.0.0.1" || s.RemotePort != remotePort {
+		t.Errorf("got session to %s:%d on %s, want 127.0.0.1:%d on i-0123456789abcdef0", s.RemoteHost, s.RemotePort, s.Target, remotePort)
+	}
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+	if s := fake.Sessions()[0]; !s.Terminated {
+		t.Errorf("session %s is still running after destroy", s.Id)
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(localPort, 10))); err == nil {
+		conn.Close()
+		t.Errorf("port %d still accepts connections after destroy", localPort)
+	}
+}
+
+func TestAccRemoteTunnelPlannedState(t *testing.T) {
+	testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	// testAccApply fails unless the applied state keeps every planned value,
+	// including the defaults of the schema which aren't in the configuration
+	values := map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	}
+	state := testAccCreateRemoteTunnel(t, server, schemas, values)
+	if probeTimeout := attrInt64(t, state, "probe_timeout_seconds"); probeTimeout != defaultProbeTimeoutSeconds {
+		t.Errorf("probe_timeout_seconds: got %d, want the default %d", probeTimeout, defaultProbeTimeoutSeconds)
+	}
+
+	// Moving the tunnel to another local port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	values["local_port"] = tftypes.NewValue(tftypes.Number, localPort)
+	state = tftypes.NewValue(resourceType, testAccApply(t, server, schemas, "awsssmtunnels_remote_tunnel", state, objectValue(resourceType, values)))
+	testAccEcho(t, int64(localPort), "moved")
+
+	// Starting the tunnel again with other settings
+	values["max_connections"] = tftypes.NewValue(tftypes.Number, 4)
+	state = tftypes.NewValue(resourceType, testAccApply(t, server, schemas, "awsssmtunnels_remote_tunnel", state, objectValue(resourceType, values)))
+	testAccEcho(t, int64(localPort), "restarted")
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+}
+
+func TestAccRemoteTunnelReady(t *testing.T) {
+	testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	var attrs map[string]tftypes.Value
+	if err := state.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	if !attrs["ready"].Equal(tftypes.NewValue(tftypes.Bool, true)) {
+		t.Errorf("got ready %v for a tunnel to a listening port, want true", attrs["ready"])
+	}
+}
+
+func TestAccRemoteTunnelDrain(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":    tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":   tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":   tftypes.NewValue(tftypes.Number, remotePort),
+		"drain_timeout": tftypes.NewValue(tftypes.String, "30s"),
+	})
+	localPort := attrInt64(t, state, "local_port")
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(localPort, 10)), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReader(conn)
+	exchange := func(message string) error {
+		if _, err := io.WriteString(conn, message+"\n"); err != nil {
+			return err
+		}
+		reply, err := reader.ReadString('\n')
+		if err == nil && reply != message+"\n" {
+			err = fmt.Errorf("got %q back", reply)
+		}
+		return err
+	}
+	if err := exchange("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection keeps working while the tunnel is destroyed, until it is done
+	done := make(chan error, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		if other, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(localPort, 10))); err == nil {
+			other.Close()
+			done <- fmt.Errorf("the draining tunnel accepted a new connection")
+			return
+		}
+		err := exchange("during")
+		conn.Close()
+		done <- err
+	}()
+	started := time.Now()
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+	if err := <-done; err != nil {
+		t.Errorf("using the connection open while destroying the tunnel: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 500*time.Millisecond || elapsed > 20*time.Second {
+		t.Errorf("destroying took %s, want it to wait for the open connection only", elapsed)
+	}
+	if s := fake.Sessions()[0]; !s.Terminated {
+		t.Error("the session wasn't terminated after draining")
+	}
+}
+
+func TestAccRemoteTunnelQueue(t *testing.T) {
+	testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":             tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":            tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":            tftypes.NewValue(tftypes.Number, remotePort),
+		"max_connections":        tftypes.NewValue(tftypes.Number, 1),
+		"max_queued_connections": tftypes.NewValue(tftypes.Number, 1),
+	})
+	addr := net.JoinHostPort("127.0.0.1", strconv.FormatInt(attrInt64(t, state, "local_port"), 10))
+	dial := func() net.Conn {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+		return conn
+	}
+
+	// The first connection takes the only slot, the second one waits for it
+	forwarded := dial()
+	if _, err := io.WriteString(forwarded, "first\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(forwarded).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	dial()
+	trackersMu.Lock()
+	tracker := trackers[len(trackers)-1]
+	trackersMu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for tracker.TunnelStats()[0].QueuedConnections == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The queue is full, so the third one is closed right away
+	if _, err := dial().Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading from the connection beyond the queue, want EOF", err)
+	}
+
+	dataSourceType := schemas.DataSourceSchemas["awsssmtunnels_keepalive"].ValueType().(tftypes.Object)
+	resp, err := server.ReadDataSource(context.Background(), &tfprotov6.ReadDataSourceRequest{
+		TypeName: "awsssmtunnels_keepalive",
+		Config: dynamicValue(t, dataSourceType, objectValue(dataSourceType, map[string]tftypes.Value{
+			"record_stats_in_state": tftypes.NewValue(tftypes.Bool, true),
+		})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	keepalive, err := resp.State.Unmarshal(dataSourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrs map[string]tftypes.Value
+	var stats []tftypes.Value
+	if err := keepalive.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	if err := attrs["tunnel_stats"].As(&stats); err != nil || len(stats) != 1 {
+		t.Fatalf("got tunnel_stats %v, want the tunnel: %v", attrs["tunnel_stats"], err)
+	}
+	for name, want := range map[string]int64{
+		"queued_connections":      1,
+		"peak_queued_connections": 1,
+		"rejected_connections":    1,
+	} {
+		if got := attrInt64(t, stats[0], name); got != want {
+			t.Errorf("got %s %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestAccRemoteTunnelTransferLimit(t *testing.T) {
+	testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":         tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":        tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":        tftypes.NewValue(tftypes.Number, remotePort),
+		"max_transfer_bytes": tftypes.NewValue(tftypes.Number, 64),
+	})
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(attrInt64(t, state, "local_port"), 10)), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.WriteString(conn, strings.Repeat("x", 100)+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, conn)
+
+	trackersMu.Lock()
+	tracker := trackers[len(trackers)-1]
+	trackersMu.Unlock()
+	select {
+	case <-tracker.started[0].forwarder.Stopped():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the tunnel wasn't closed after exceeding its transfer limit")
+	}
+
+	// Refreshing reports the limit instead of starting the tunnel again
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType()
+	read, err := server.ReadResource(context.Background(), &tfprotov6.ReadResourceRequest{
+		TypeName:     "awsssmtunnels_remote_tunnel",
+		CurrentState: dynamicValue(t, resourceType, state),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(read.Diagnostics); len(errs) != 1 || !strings.Contains(errs[0], "Tunnel transfer limit exceeded") {
+		t.Errorf("got %v refreshing the tunnel, want the transfer limit", errs)
+	}
+	if errs := testAccKeepalive(t, server, schemas); len(errs) != 1 || !strings.Contains(errs[0], "Tunnel transfer limit exceeded") {
+		t.Errorf("got keepalive errors %v, want the transfer limit", errs)
+	}
+}
+
+func TestAccRunnerID(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{
+		"session_reason_prefix": tftypes.NewValue(tftypes.String, "terraform"),
+		"runner_id":             tftypes.NewValue(tftypes.String, "https://ci.example.com/jobs/7"),
+	})
+
+	testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	want := fmt.Sprintf("terraform: port forwarding to 127.0.0.1:%d from https://ci.example.com/jobs/7", remotePort)
+	if reason := fake.Sessions()[0].Reason; reason != want {
+		t.Errorf("got session reason %q, want %q", reason, want)
+	}
+}
+
+func TestAccRemoteTunnelShared(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	values := map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	}
+	first := testAccCreateRemoteTunnel(t, server, schemas, values)
+	second := testAccCreateRemoteTunnel(t, server, schemas, values)
+	localPort := attrInt64(t, first, "local_port")
+	if port := attrInt64(t, second, "local_port"); port != localPort {
+		t.Errorf("second tunnel got local port %d, want the shared port %d", port, localPort)
+	}
+	if sessions := fake.Sessions(); len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1 shared by both resources", len(sessions))
+	}
+
+	// The tunnel stays open while the second resource still uses it
+	testAccDestroyRemoteTunnel(t, server, schemas, first)
+	if s := fake.Sessions()[0]; s.Terminated {
+		t.Fatalf("session %s was terminated while still in use", s.Id)
+	}
+	testAccEcho(t, localPort, "hello")
+
+	testAccDestroyRemoteTunnel(t, server, schemas, second)
+	if s := fake.Sessions()[0]; !s.Terminated {
+		t.Errorf("session %s is still running after destroying both resources", s.Id)
+	}
+}
+
+func TestAccRemoteTunnelSharedSession(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	plain := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	ruleType := rewriteRuleType.TerraformType(context.Background()).(tftypes.Object)
+	rewriting := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+		"rewrite": tftypes.NewValue(tftypes.List{ElementType: ruleType}, []tftypes.Value{
+			objectValue(ruleType, map[string]tftypes.Value{
+				"match":   tftypes.NewValue(tftypes.String, "hello"),
+				"replace": tftypes.NewValue(tftypes.String, "howdy"),
+			}),
+		}),
+	})
+
+	// Each tunnel forwards on a port of its own, over the same session
+	plainPort, rewritingPort := attrInt64(t, plain, "local_port"), attrInt64(t, rewriting, "local_port")
+	if plainPort == rewritingPort {
+		t.Fatalf("both tunnels listen on port %d", plainPort)
+	}
+	if sessions := fake.Sessions(); len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1 shared by both tunnels", len(sessions))
+	}
+	testAccEcho(t, plainPort, "hello")
+	if reply := testAccExchange(t, rewritingPort, "hello"); reply != "howdy" {
+		t.Errorf("got %q back through the rewriting tunnel, want %q", reply, "howdy")
+	}
+
+	// The session stays up for the tunnel still using it
+	testAccDestroyRemoteTunnel(t, server, schemas, plain)
+	if s := fake.Sessions()[0]; s.Terminated {
+		t.Fatalf("session %s was terminated while still in use", s.Id)
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(plainPort, 10))); err == nil {
+		conn.Close()
+		t.Errorf("port %d still accepts connections after destroy", plainPort)
+	}
+	if reply := testAccExchange(t, rewritingPort, "hello"); reply != "howdy" {
+		t.Errorf("got %q back through the rewriting tunnel, want %q", reply, "howdy")
+	}
+
+	testAccDestroyRemoteTunnel(t, server, schemas, rewriting)
+	if s := fake.Sessions()[0]; !s.Terminated {
+		t.Errorf("session %s is still running after destroying both tunnels", s.Id)
+	}
+}
+
+func TestAccRemoteTunnelRewriteDefaults(t *testing.T) {
+	testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	// testAccApply fails unless the defaults of direction and regex planned
+	// for the rule are kept in the state
+	ruleType := rewriteRuleType.TerraformType(context.Background()).(tftypes.Object)
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+		"rewrite": tftypes.NewValue(tftypes.List{ElementType: ruleType}, []tftypes.Value{
+			objectValue(ruleType, map[string]tftypes.Value{
+				"match":   tftypes.NewValue(tftypes.String, "hello"),
+				"replace": tftypes.NewValue(tftypes.String, "howdy"),
+			}),
+		}),
+	})
+
+	var attrs map[string]tftypes.Value
+	if err := state.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	var rules []tftypes.Value
+	if err := attrs["rewrite"].As(&rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("got %d rewrite rules, want 1", len(rules))
+	}
+	if direction := attrString(t, rules[0], "direction"); direction != string(ssmtunnels.RewriteResponse) {
+		t.Errorf("direction: got %q, want the default %q", direction, ssmtunnels.RewriteResponse)
+	}
+	var rule map[string]tftypes.Value
+	if err := rules[0].As(&rule); err != nil {
+		t.Fatal(err)
+	}
+	var regex bool
+	if err := rule["regex"].As(&regex); err != nil || regex {
+		t.Errorf("regex: got %v, want the default false", rule["regex"])
+	}
+	if reply := testAccExchange(t, attrInt64(t, state, "local_port"), "hello"); reply != "howdy" {
+		t.Errorf("got %q back through the rewriting tunnel, want %q", reply, "howdy")
+	}
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+}
+
+func TestAccRemoteTunnelSessionEnded(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	localPort := attrInt64(t, state, "local_port")
+	testAccEcho(t, localPort, "hello")
+
+	// Like a reboot of the target, the listener stays while the session is gone
+	first := fake.Sessions()[0].Id
+	fake.TerminateSession(first)
+	trackersMu.Lock()
+	tracker := trackers[len(trackers)-1]
+	trackersMu.Unlock()
+	tracker.mu.Lock()
+	tunnel := tracker.started[0]
+	tracker.mu.Unlock()
+	// The plugin noticed once the session ended or was already replaced
+	noticed := func() bool { return tunnel.sessionEnded() || tunnel.currentSession().Id != first }
+	deadline := time.Now().Add(10 * time.Second)
+	for !noticed() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !noticed() {
+		t.Fatal("the plugin didn't notice the session ended")
+	}
+
+	// Refreshing keeps the local port, with the new session started meanwhile
+	state = testAccRefresh(t, server, schemas, "awsssmtunnels_remote_tunnel", state)
+	if port := attrInt64(t, state, "local_port"); port != localPort {
+		t.Errorf("got local port %d after the refresh, want %d", port, localPort)
+	}
+	sessions := fake.Sessions()
+	if len(sessions) != 2 || sessions[1].Terminated {
+		t.Fatalf("got sessions %+v, want a second one running", sessions)
+	}
+	testAccEcho(t, localPort, "again")
+}
+
+func TestAccRemoteTunnelEphemeral(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	provider, schemas := configureProvider(t, map[string]tftypes.Value{})
+	server := provider.(tfprotov6.ProviderServerWithEphemeralResources)
+	ctx := context.Background()
+	ephemeralType := schemas.EphemeralResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	open, err := server.OpenEphemeralResource(ctx, &tfprotov6.OpenEphemeralResourceRequest{
+		TypeName: "awsssmtunnels_remote_tunnel",
+		Config: dynamicValue(t, ephemeralType, objectValue(ephemeralType, map[string]tftypes.Value{
+			"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+			"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+		})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(open.Diagnostics); len(errs) > 0 {
+		t.Fatalf("opening: %v", errs)
+	}
+	if open.RenewAt.IsZero() {
+		t.Error("got no renewal time, want the tunnel to be renewed")
+	}
+	result, err := open.Result.Unmarshal(ephemeralType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := attrInt64(t, result, "local_port")
+	testAccEcho(t, localPort, "hello")
+
+	// Renewing starts a new session on the same port once the old one ended
+	first := fake.Sessions()[0].Id
+	fake.TerminateSession(first)
+	trackersMu.Lock()
+	tracker := trackers[len(trackers)-1]
+	trackersMu.Unlock()
+	tracker.mu.Lock()
+	tunnel := tracker.started[0]
+	tracker.mu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for !tunnel.sessionEnded() && tunnel.currentSession().Id == first && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	renew, err := server.RenewEphemeralResource(ctx, &tfprotov6.RenewEphemeralResourceRequest{
+		TypeName: "awsssmtunnels_remote_tunnel",
+		Private:  open.Private,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(renew.Diagnostics); len(errs) > 0 {
+		t.Fatalf("renewing: %v", errs)
+	}
+	if !renew.RenewAt.After(open.RenewAt) {
+		t.Errorf("got renewal time %s, want one after %s", renew.RenewAt, open.RenewAt)
+	}
+	testAccEcho(t, localPort, "again")
+
+	closed, err := server.CloseEphemeralResource(ctx, &tfprotov6.CloseEphemeralResourceRequest{
+		TypeName: "awsssmtunnels_remote_tunnel",
+		Private:  open.Private,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(closed.Diagnostics); len(errs) > 0 {
+		t.Fatalf("closing: %v", errs)
+	}
+	for _, s := range fake.Sessions() {
+		if !s.Terminated {
+			t.Errorf("session %s is still running after closing", s.Id)
+		}
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(localPort, 10))); err == nil {
+		conn.Close()
+		t.Error("the local port is still listened on after closing")
+	}
+}
+
+func TestAccRemoteTunnelReconnect(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	localPort := attrInt64(t, state, "local_port")
+	testAccEcho(t, localPort, "hello")
+
+	// Like a restart of the SSM agent, whose first new session is refused
+	fake.DisconnectTarget("i-0123456789abcdef0", 1)
+	fake.TerminateSession(fake.Sessions()[0].Id)
+
+	// A new session is started without any Terraform operation asking for the tunnel
+	deadline := time.Now().Add(30 * time.Second)
+	for len(fake.Sessions()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sessions := fake.Sessions()
+	if len(sessions) != 2 || sessions[1].Terminated {
+		t.Fatalf("got sessions %+v, want a second one running", sessions)
+	}
+	// Connections wait for the new session instead of failing
+	testAccEcho(t, localPort, "again")
+	// The refused attempt doesn't fail the run, the tunnel has a session again
+	if errs := testAccKeepalive(t, server, schemas); len(errs) > 0 {
+		t.Errorf("keepalive failed after the tunnel reconnected: %v", errs)
+	}
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+	if s := fake.Sessions()[1]; !s.Terminated {
+		t.Errorf("session %s is still running after destroy", s.Id)
+	}
+}
+
+func TestAccRemoteTunnelResumeWithRefreshedCredentials(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+
+	// The profile's credentials expire shortly after the tunnel started
+	dir := t.TempDir()
+	credentialsFile := filepath.Join(dir, "credentials.json")
+	writeCredentials := func(accessKeyId string, expires time.Time) {
+		content := fmt.Sprintf(`{"Version": 1, "AccessKeyId": %q, "SecretAccessKey": "secret", "SessionToken": "token", "Expiration": %q}`,
+			accessKeyId, expires.UTC().Format(time.RFC3339))
+		if err := os.WriteFile(credentialsFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCredentials("AKIDEXPIRING", time.Now().Add(2*time.Second))
+	configFile := filepath.Join(dir, "config")
+	if err := os.WriteFile(configFile, []byte("[profile rotating]\ncredential_process = cat "+credentialsFile+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+		"profile":     tftypes.NewValue(tftypes.String, "rotating"),
+	})
+	localPort := attrInt64(t, state, "local_port")
+	testAccEcho(t, localPort, "hello")
+	if keys := fake.AccessKeyIds("StartSession"); len(keys) != 1 || keys[0] != "AKIDEXPIRING" {
+		t.Fatalf("got sessions started with %v, want the initial credentials", keys)
+	}
+
+	// Once they expired, a network interruption makes the plugin resume the
+	// session, which it does with the refreshed credentials
+	time.Sleep(3 * time.Second)
+	writeCredentials("AKIDREFRESHED", time.Now().Add(time.Hour))
+	fake.DropDataChannel(fake.Sessions()[0].Id)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for len(fake.AccessKeyIds("ResumeSession")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if keys := fake.AccessKeyIds("ResumeSession"); len(keys) == 0 || keys[len(keys)-1] != "AKIDREFRESHED" {
+		t.Fatalf("got the session resumed with %v, want the refreshed credentials", keys)
+	}
+	// The same session carries the tunnel again
+	testAccEcho(t, localPort, "again")
+	if sessions := fake.Sessions(); len(sessions) != 1 || sessions[0].Terminated {
+		t.Errorf("got sessions %+v, want the resumed one", sessions)
+	}
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+}
+
+func TestAccRemoteTunnelReconnectGivesUp(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{
+		"wait_for_target_timeout": tftypes.NewValue(tftypes.String, "2s"),
+	})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	localPort := attrInt64(t, state, "local_port")
+
+	// The target stays away for longer than wait_for_target_timeout
+	fake.DisconnectTarget("i-0123456789abcdef0", 1000)
+	fake.TerminateSession(fake.Sessions()[0].Id)
+
+	var errs []string
+	deadline := time.Now().Add(30 * time.Second)
+	for len(errs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		errs = testAccKeepalive(t, server, schemas)
+	}
+	// Only the last attempt is reported, also after retrying gave up
+	time.Sleep(3 * time.Second)
+	errs = testAccKeepalive(t, server, schemas)
+	if len(errs) != 1 || !strings.Contains(errs[0], "TargetNotConnected") {
+		t.Fatalf("got keepalive errors %v, want the one of the last attempt", errs)
+	}
+
+	// The next connection starts a session once the target is back
+	fake.DisconnectTarget("i-0123456789abcdef0", 0)
+	testAccEcho(t, localPort, "back")
+	if errs := testAccKeepalive(t, server, schemas); len(errs) > 0 {
+		t.Errorf("keepalive failed after a session started: %v", errs)
+	}
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+}
+
+func TestAccRemoteTunnelCloseAfterIdle(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":       tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":      tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":      tftypes.NewValue(tftypes.Number, remotePort),
+		"close_after_idle": tftypes.NewValue(tftypes.String, "2s"),
+	})
+	localPort := attrInt64(t, state, "local_port")
+	testAccEcho(t, localPort, "hello")
+
+	// The idle session is terminated while the tunnel keeps its local port
+	deadline := time.Now().Add(10 * time.Second)
+	for !fake.Sessions()[0].Terminated && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if s := fake.Sessions()[0]; !s.Terminated {
+		t.Fatalf("session %s is still running after being idle", s.Id)
+	}
+
+	// The next connection starts a new session
+	testAccEcho(t, localPort, "again")
+	sessions := fake.Sessions()
+	if len(sessions) != 2 || sessions[1].Terminated {
+		t.Fatalf("got sessions %+v, want a second one running", sessions)
+	}
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+	if s := fake.Sessions()[1]; !s.Terminated {
+		t.Errorf("session %s is still running after destroy", s.Id)
+	}
+}
+
+func TestAccRemoteTunnelNetworkChange(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	localPort := attrInt64(t, state, "local_port")
+	testAccEcho(t, localPort, "hello")
+
+	trackersMu.Lock()
+	tracker := trackers[len(trackers)-1]
+	trackersMu.Unlock()
+	tracker.mu.Lock()
+	tunnel := tracker.started[0]
+	tracker.mu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for tunnel.Stats().ActiveConnections > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	// The idle session may use a route which is gone, so it is replaced
+	tracker.revalidateSessions([]string{"utun3 came up with 10.9.0.2/32"})
+	sessions := fake.Sessions()
+	if len(sessions) != 2 || !sessions[0].Terminated || sessions[1].Terminated {
+		t.Fatalf("got sessions %+v, want the first one replaced by a second one", sessions)
+	}
+	testAccEcho(t, localPort, "again")
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+	if s := fake.Sessions()[1]; !s.Terminated {
+		t.Errorf("session %s is still running after destroy", s.Id)
+	}
+}
+
+func TestAccStopProvider(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	localPort := attrInt64(t, state, "local_port")
+
+	// Like an interrupted apply, which leaves the tunnel without a destroy
+	if _, err := (stoppingServer{ProviderServer: server}).StopProvider(context.Background(), &tfprotov6.StopProviderRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := fake.Sessions()[0]; !s.Terminated {
+		t.Errorf("session %s is still running after the provider was stopped", s.Id)
+	}
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(localPort, 10))); err == nil {
+		conn.Close()
+		t.Errorf("port %d still accepts connections after the provider was stopped", localPort)
+	}
+}
+
+func TestAccTerminateOrphanedSessions(t *testing.T) {
+	fake := testAccFake(t)
+	target := "i-0123456789abcdef0"
+	orphaned := fake.AddSession(target, "terraform: port forwarding to db.internal:5432", time.Now().Add(-2*time.Hour))
+	recent := fake.AddSession(target, "terraform: port forwarding to db.internal:5432", time.Now().Add(-time.Minute))
+	interactive := fake.AddSession(target, "debugging the database", time.Now().Add(-2*time.Hour))
+
+	configureProvider(t, map[string]tftypes.Value{
+		"session_reason_prefix":             tftypes.NewValue(tftypes.String, "terraform"),
+		"terminate_orphaned_sessions_after": tftypes.NewValue(tftypes.String, "1h"),
+	})
+
+	terminated := map[string]bool{}
+	for _, s := range fake.Sessions() {
+		terminated[s.Id] = s.Terminated
+	}
+	if !terminated[orphaned] {
+		t.Errorf("orphaned session %s is still running", orphaned)
+	}
+	if terminated[recent] {
+		t.Errorf("session %s started a minute ago was terminated", recent)
+	}
+	if terminated[interactive] {
+		t.Errorf("session %s without the reason prefix was terminated", interactive)
+	}
+}
+
+func TestAccRemoteTunnelTargets(t *testing.T) {
+	fake := testAccFake(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{
+		"targets": tftypes.NewValue(tftypes.List{ElementType: tftypes.String}, []tftypes.Value{
+			tftypes.NewValue(tftypes.String, "i-0aaaaaaaaaaaaaaaa"),
+			tftypes.NewValue(tftypes.String, "i-0bbbbbbbbbbbbbbbb"),
+		}),
+	})
+
+	// Tunnels to the same endpoint would share a session, so each gets its own remote host
+	var targets []string
+	for _, name := range []string{"one", "two"} {
+		state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+			"refresh_id":  tftypes.NewValue(tftypes.String, name),
+			"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+			"remote_port": tftypes.NewValue(tftypes.Number, echoServer(t)),
+		})
+		testAccEcho(t, attrInt64(t, state, "local_port"), name)
+		targets = append(targets, attrString(t, state, "target"))
+	}
+
+	if targets[0] == targets[1] {
+		t.Errorf("both tunnels run on %s, want them spread across the targets", targets[0])
+	}
+	if n := len(fake.Sessions()); n != 2 {
+		t.Errorf("got %d sessions, want 2", n)
+	}
+}
+
+func TestAccNamedTunnel(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	tunnelType := namedTunnelType.TerraformType(context.Background()).(tftypes.Object)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{
+		"tunnels": tftypes.NewValue(tftypes.Map{ElementType: tunnelType}, map[string]tftypes.Value{
+			"db": objectValue(tunnelType, map[string]tftypes.Value{
+				"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+				"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+			}),
+		}),
+	})
+
+	dataSourceType := schemas.DataSourceSchemas["awsssmtunnels_tunnel"].ValueType().(tftypes.Object)
+	resp, err := server.ReadDataSource(context.Background(), &tfprotov6.ReadDataSourceRequest{
+		TypeName: "awsssmtunnels_tunnel",
+		Config: dynamicValue(t, dataSourceType, objectValue(dataSourceType, map[string]tftypes.Value{
+			"name": tftypes.NewValue(tftypes.String, "db"),
+		})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("reading the tunnel: %v", errs)
+	}
+	state, err := resp.State.Unmarshal(dataSourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAccEcho(t, attrInt64(t, state, "local_port"), "named")
+	if n := len(fake.Sessions()); n != 1 {
+		t.Errorf("got %d sessions, want 1", n)
+	}
+}
+
+func TestAccNamedTunnelConnectWhileStarting(t *testing.T) {
+	testAccFake(t)
+	remotePort := echoServer(t)
+	localPort, err := ports.FindEphemeralPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like a provider destroying resources at the start of a destroy, while the
+	// provider is still being configured
+	echoed := make(chan error, 1)
+	go func() {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))
+		deadline := time.Now().Add(30 * time.Second)
+		conn, err := net.Dial("tcp", addr)
+		for err != nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			conn, err = net.Dial("tcp", addr)
+		}
+		if err != nil {
+			echoed <- err
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+		if _, err := io.WriteString(conn, "early\n"); err != nil {
+			echoed <- err
+			return
+		}
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		echoed <- err
+	}()
+
+	tunnelType := namedTunnelType.TerraformType(context.Background()).(tftypes.Object)
+	configureProvider(t, map[string]tftypes.Value{
+		"tunnels": tftypes.NewValue(tftypes.Map{ElementType: tunnelType}, map[string]tftypes.Value{
+			"db": objectValue(tunnelType, map[string]tftypes.Value{
+				"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+				"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+				"local_port":  tftypes.NewValue(tftypes.Number, localPort),
+			}),
+		}),
+	})
+	if err := <-echoed; err != nil {
+		t.Fatalf("connecting while the tunnel was started: %v", err)
+	}
+}
+
+func TestAccRemoteTunnelWaitForVPCEndpoints(t *testing.T) {
+	fake := testAccFake(t)
+	cfg := testAccLocalStack(t)
+	ctx := context.Background()
+
+	client := ec2.NewFromConfig(cfg)
+	vpc, err := client.CreateVpc(ctx, &ec2.CreateVpcInput{CidrBlock: aws.String("10.42.0.0/16")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = client.DeleteVpc(ctx, &ec2.DeleteVpcInput{VpcId: vpc.Vpc.VpcId})
+	})
+	endpoint, err := client.CreateVpcEndpoint(ctx, &ec2.CreateVpcEndpointInput{
+		VpcId:           vpc.Vpc.VpcId,
+		ServiceName:     aws.String("com.amazonaws.us-east-1.ssm"),
+		VpcEndpointType: ec2types.VpcEndpointTypeInterface,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = client.DeleteVpcEndpoints(ctx, &ec2.DeleteVpcEndpointsInput{VpcEndpointIds: []string{aws.ToString(endpoint.VpcEndpoint.VpcEndpointId)}})
+	})
+
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+		"wait_for_vpc_endpoints": tftypes.NewValue(tftypes.List{ElementType: tftypes.String}, []tftypes.Value{
+			tftypes.NewValue(tftypes.String, aws.ToString(endpoint.VpcEndpoint.VpcEndpointId)),
+		}),
+	})
+	testAccEcho(t, attrInt64(t, state, "local_port"), "endpoints")
+
+	if n := len(fake.Sessions()); n != 1 {
+		t.Errorf("got %d sessions, want 1", n)
+	}
+}
+
+func TestAccRemoteTunnelWaitForTargetOnline(t *testing.T) {
+	fake := testAccFake(t)
+	// The instance was just created, its agent hasn't connected yet
+	fake.SetOffline("i-0123456789abcdef0", 1)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	started := time.Now()
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":             tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":            tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":            tftypes.NewValue(tftypes.Number, remotePort),
+		"wait_for_target_online": tftypes.NewValue(tftypes.Bool, true),
+	})
+	testAccEcho(t, attrInt64(t, state, "local_port"), "online")
+
+	sessions := fake.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(sessions))
+	}
+	// The session is only started once the target was polled again
+	if waited := sessions[0].Started.Sub(started); waited < 5*time.Second {
+		t.Errorf("the session was started %s after the create began, want it to wait for the target to be online", waited)
+	}
+}
+
+func TestAccRemoteTunnelRequirePlatform(t *testing.T) {
+	fake := testAccFake(t)
+	fake.SetPlatform("i-0123456789abcdef0", "Windows")
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":       tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":      tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":      tftypes.NewValue(tftypes.Number, echoServer(t)),
+		"require_platform": tftypes.NewValue(tftypes.String, "Linux"),
+	}))
+	prior := dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil))
+	plan, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       prior,
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(plan.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+
+	apply, err := server.ApplyResourceChange(context.Background(), &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:     "awsssmtunnels_remote_tunnel",
+		PriorState:   prior,
+		PlannedState: plan.PlannedState,
+		Config:       config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := diagnosticErrors(apply.Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "runs Windows, but Linux is required") {
+		t.Fatalf("got %v, want the target to be refused for its platform", errs)
+	}
+	// The target is refused before a session is started
+	if sessions := fake.Sessions(); len(sessions) != 0 {
+		t.Errorf("got sessions %+v, want none", sessions)
+	}
+}
+
+func TestAccRemoteTunnelTargetNotConnected(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+
+	// Without wait_for_target_timeout the apply fails right away
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	values := map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	}
+	config := dynamicValue(t, resourceType, objectValue(resourceType, values))
+	prior := dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil))
+	plan, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       prior,
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(plan.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+	fake.DisconnectTarget("i-0123456789abcdef0", 1)
+	apply, err := server.ApplyResourceChange(context.Background(), &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:     "awsssmtunnels_remote_tunnel",
+		PriorState:   prior,
+		PlannedState: plan.PlannedState,
+		Config:       config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := diagnosticErrors(apply.Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "Target is not connected to Session Manager") {
+		t.Fatalf("got %v, want the target to be reported as not connected", errs)
+	}
+
+	// With it, sessions are started again until the agent connected
+	server, schemas = configureProvider(t, map[string]tftypes.Value{
+		"wait_for_target_timeout": tftypes.NewValue(tftypes.String, "1m"),
+	})
+	fake.DisconnectTarget("i-0123456789abcdef0", 2)
+	state := testAccCreateRemoteTunnel(t, server, schemas, values)
+	testAccEcho(t, attrInt64(t, state, "local_port"), "connected")
+	if sessions := fake.Sessions(); len(sessions) != 1 {
+		t.Errorf("got sessions %+v, want the one started once the target connected", sessions)
+	}
+}
+
+func TestAccRemoteTunnelCreateTimeout(t *testing.T) {
+	fake := testAccFake(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	timeoutsType := resourceType.AttributeTypes["timeouts"].(tftypes.Object)
+
+	// The data channel of the session takes longer than the timeout to open
+	fake.DelayHandshake(10 * time.Second)
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, echoServer(t)),
+		"timeouts": objectValue(timeoutsType, map[string]tftypes.Value{
+			"create": tftypes.NewValue(tftypes.String, "2s"),
+		}),
+	}))
+	prior := dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil))
+	plan, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       prior,
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(plan.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+
+	start := time.Now()
+	apply, err := server.ApplyResourceChange(context.Background(), &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:     "awsssmtunnels_remote_tunnel",
+		PriorState:   prior,
+		PlannedState: plan.PlannedState,
+		Config:       config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := diagnosticErrors(apply.Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "Timed out starting remote tunnel") {
+		t.Fatalf("got %v, want the create to time out", errs)
+	}
+	// Automation reading the diagnostic can tell a retry may succeed
+	detail := apply.Diagnostics[0].Detail
+	var class failureClass
+	if err := json.Unmarshal([]byte(detail[strings.LastIndex(detail, failureMarker)+len(failureMarker):]), &class); err != nil {
+		t.Fatalf("classification of %q: %s", detail, err)
+	}
+	if want := (failureClass{ErrorCode: "timeout", Retryable: true, Subsystem: subsystemTunnel}); class != want {
+		t.Errorf("got classification %+v, want %+v", class, want)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the create failed after %s, want it bounded by the timeout", elapsed)
+	}
+
+	sessions := fake.Sessions()
+	if len(sessions) != 1 || !sessions[0].Terminated {
+		t.Errorf("got sessions %+v, want the one started to be terminated", sessions)
+	}
+}
+
+func TestAccConnectivityCheck(t *testing.T) {
+	testAccFake(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_connectivity_check"].ValueType().(tftypes.Object)
+
+	config := func(port int, failOnError bool) tftypes.Value {
+		return objectValue(resourceType, map[string]tftypes.Value{
+			"remote_host":     tftypes.NewValue(tftypes.String, "127.0.0.1"),
+			"remote_port":     tftypes.NewValue(tftypes.Number, port),
+			"timeout_seconds": tftypes.NewValue(tftypes.Number, 5),
+			"fail_on_error":   tftypes.NewValue(tftypes.Bool, failOnError),
+		})
+	}
+
+	attrs := testAccApply(t, server, schemas, "awsssmtunnels_connectivity_check", tftypes.NewValue(resourceType, nil), config(echoServer(t), true))
+	var success bool
+	if err := attrs["success"].As(&success); err != nil || !success {
+		t.Errorf("got success %v, want a connection to the echo server", attrs["success"])
+	}
+	if attrs["latency_ms"].IsNull() {
+		t.Error("got no latency for the connection to the echo server")
+	}
+}
+
+func TestAccTunnelSet(t *testing.T) {
+	fake := testAccFake(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_tunnel_set"].ValueType().(tftypes.Object)
+
+	config := func(remotePorts ...int) tftypes.Value {
+		var forwards []map[string]tftypes.Value
+		for _, port := range remotePorts {
+			forwards = append(forwards, map[string]tftypes.Value{
+				"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+				"remote_port": tftypes.NewValue(tftypes.Number, port),
+			})
+		}
+		return objectValue(resourceType, map[string]tftypes.Value{
+			"refresh_id": tftypes.NewValue(tftypes.String, "one"),
+			"forward":    tunnelSetForwards(resourceType, forwards...),
+		})
+	}
+	// echoEndpoints sends a line through the local endpoint of every forward
+	echoEndpoints := func(attrs map[string]tftypes.Value, remotePorts ...int) {
+		t.Helper()
+		var endpoints map[string]tftypes.Value
+		if err := attrs["endpoints"].As(&endpoints); err != nil {
+			t.Fatal(err)
+		}
+		if len(endpoints) != len(remotePorts) {
+			t.Fatalf("got endpoints %v, want one per forward", endpoints)
+		}
+		for _, port := range remotePorts {
+			var local string
+			if err := endpoints[net.JoinHostPort("127.0.0.1", strconv.Itoa(port))].As(&local); err != nil {
+				t.Fatal(err)
+			}
+			_, localPort, err := net.SplitHostPort(local)
+			if err != nil {
+				t.Fatalf("endpoint of %d: %v", port, err)
+			}
+			n, _ := strconv.ParseInt(localPort, 10, 64)
+			testAccEcho(t, n, "set")
+		}
+	}
+
+	db, cache := echoServer(t), echoServer(t)
+	attrs := testAccApply(t, server, schemas, "awsssmtunnels_tunnel_set", tftypes.NewValue(resourceType, nil), config(db, cache))
+	echoEndpoints(attrs, db, cache)
+	sessions := fake.Sessions()
+	if len(sessions) != 2 || sessions[0].Target != "i-0123456789abcdef0" || sessions[1].Target != "i-0123456789abcdef0" {
+		t.Fatalf("got sessions %+v, want one per forward on the target", sessions)
+	}
+
+	// Adding a forward leaves the sessions of the others running
+	api := echoServer(t)
+	attrs = testAccApply(t, server, schemas, "awsssmtunnels_tunnel_set", tftypes.NewValue(resourceType, attrs), config(db, cache, api))
+	echoEndpoints(attrs, db, cache, api)
+	sessions = fake.Sessions()
+	if len(sessions) != 3 {
+		t.Fatalf("got %d sessions, want 3", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.Terminated {
+			t.Errorf("session %s to port %d was terminated by adding a forward", s.Id, s.RemotePort)
+		}
+	}
+
+	testAccApply(t, server, schemas, "awsssmtunnels_tunnel_set", tftypes.NewValue(resourceType, attrs), tftypes.NewValue(resourceType, nil))
+	for _, s := range fake.Sessions() {
+		if !s.Terminated {
+			t.Errorf("session %s is still running after destroy", s.Id)
+		}
+	}
+}
+
+func TestAccSessionDocument(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_session_document"].ValueType().(tftypes.Object)
+
+	config := func(ports ...int) tftypes.Value {
+		var allowed []tftypes.Value
+		for _, port := range ports {
+			allowed = append(allowed, tftypes.NewValue(tftypes.Number, port))
+		}
+		return objectValue(resourceType, map[string]tftypes.Value{
+			"name":          tftypes.NewValue(tftypes.String, "tunnels-example"),
+			"allowed_hosts": tftypes.NewValue(tftypes.List{ElementType: tftypes.String}, []tftypes.Value{tftypes.NewValue(tftypes.String, "127.0.0.1")}),
+			"allowed_ports": tftypes.NewValue(tftypes.List{ElementType: tftypes.Number}, allowed),
+		})
+	}
+	attrs := testAccApply(t, server, schemas, "awsssmtunnels_session_document", tftypes.NewValue(resourceType, nil), config(remotePort))
+	state := tftypes.NewValue(resourceType, attrs)
+	if version := attrString(t, state, "document_version"); version != "1" {
+		t.Errorf("got version %s, want 1", version)
+	}
+
+	// Tunnels started with the document reach the allowed endpoint
+	tunnel := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":    tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":   tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":   tftypes.NewValue(tftypes.Number, remotePort),
+		"document_name": tftypes.NewValue(tftypes.String, "tunnels-example"),
+	})
+	testAccEcho(t, attrInt64(t, tunnel, "local_port"), "hello")
+	if s := fake.Sessions()[0]; s.Document != "tunnels-example" {
+		t.Errorf("got session with document %s, want tunnels-example", s.Document)
+	}
+	testAccDestroyRemoteTunnel(t, server, schemas, tunnel)
+
+	// Allowing another port adds a version
+	attrs = testAccApply(t, server, schemas, "awsssmtunnels_session_document", state, config(remotePort, 5432))
+	state = tftypes.NewValue(resourceType, attrs)
+	if version := attrString(t, state, "document_version"); version != "2" {
+		t.Errorf("got version %s, want 2", version)
+	}
+	if content, _ := fake.Document("tunnels-example"); !strings.Contains(content, `"5432"`) {
+		t.Errorf("got content %s, want it to allow port 5432", content)
+	}
+
+	testAccApply(t, server, schemas, "awsssmtunnels_session_document", state, tftypes.NewValue(resourceType, nil))
+	if _, ok := fake.Document("tunnels-example"); ok {
+		t.Error("the document still exists after destroy")
+	}
+}
+
+// preflightSessions returns the targets of the sessions started by preflight checks.
+func preflightSessions(t *testing.T, fake *ssmfake.Server) []string {
+	t.Helper()
+	var targets []string
+	for _, session := range fake.Sessions() {
+		if !strings.Contains(session.Reason, "preflight check") {
+			continue
+		}
+		if !session.Terminated {
+			t.Errorf("preflight session %s on %s is still active", session.Id, session.Target)
+		}
+		targets = append(targets, session.Target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+func TestAccPreflightChecks(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	tunnelType := namedTunnelType.TerraformType(context.Background()).(tftypes.Object)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{
+		"preflight_checks": tftypes.NewValue(tftypes.Bool, true),
+		"tunnels": tftypes.NewValue(tftypes.Map{ElementType: tunnelType}, map[string]tftypes.Value{
+			// A lazy tunnel doesn't start its session before it is used, it is checked when it is started
+			"lazy": objectValue(tunnelType, map[string]tftypes.Value{
+				"target":      tftypes.NewValue(tftypes.String, "i-0bbbbbbbbbbbbbbbb"),
+				"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+				"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+				"lazy":        tftypes.NewValue(tftypes.Bool, true),
+			}),
+		}),
+	})
+	want := []string{"i-0bbbbbbbbbbbbbbbb"}
+	if targets := preflightSessions(t, fake); !slices.Equal(targets, want) {
+		t.Fatalf("got preflight sessions on %v after configuring the provider, want %v", targets, want)
+	}
+
+	// Refreshing, at the start of every run, checks the target before starting the tunnel
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	state := testAccRefresh(t, server, schemas, "awsssmtunnels_remote_tunnel", objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+		"id":          tftypes.NewValue(tftypes.String, "db"),
+	}))
+	want = []string{"i-0123456789abcdef0", "i-0bbbbbbbbbbbbbbbb"}
+	if targets := preflightSessions(t, fake); !slices.Equal(targets, want) {
+		t.Fatalf("got preflight sessions on %v after refreshing, want %v", targets, want)
+	}
+	testAccEcho(t, attrInt64(t, state, "local_port"), "checked")
+
+	// Targets are checked once per run
+	other := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "localhost"),
+		"remote_port": tftypes.NewValue(tftypes.Number, remotePort),
+	})
+	if targets := preflightSessions(t, fake); !slices.Equal(targets, want) {
+		t.Errorf("got preflight sessions on %v after the second resource, want %v", targets, want)
+	}
+	testAccDestroyRemoteTunnel(t, server, schemas, other)
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+
+	// Credentials may only be allowed to start sessions with a custom document,
+	// which only allows the endpoints of the tunnels
+	documentType := schemas.ResourceSchemas["awsssmtunnels_session_document"].ValueType().(tftypes.Object)
+	document := tftypes.NewValue(documentType, testAccApply(t, server, schemas, "awsssmtunnels_session_document", tftypes.NewValue(documentType, nil), objectValue(documentType, map[string]tftypes.Value{
+		"name":          tftypes.NewValue(tftypes.String, "tunnels-example"),
+		"allowed_hosts": tftypes.NewValue(tftypes.List{ElementType: tftypes.String}, []tftypes.Value{tftypes.NewValue(tftypes.String, "127.0.0.1")}),
+		"allowed_ports": tftypes.NewValue(tftypes.List{ElementType: tftypes.Number}, []tftypes.Value{tftypes.NewValue(tftypes.Number, remotePort)}),
+	})))
+	restricted := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":    tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":   tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":   tftypes.NewValue(tftypes.Number, remotePort),
+		"document_name": tftypes.NewValue(tftypes.String, "tunnels-example"),
+	})
+	var documents []string
+	for _, session := range fake.Sessions() {
+		if strings.Contains(session.Reason, "preflight check") {
+			documents = append(documents, session.Document)
+		}
+	}
+	if !slices.Contains(documents, "tunnels-example") {
+		t.Errorf("got preflight sessions with the documents %v, want one with tunnels-example", documents)
+	}
+	testAccDestroyRemoteTunnel(t, server, schemas, restricted)
+	testAccApply(t, server, schemas, "awsssmtunnels_session_document", document, tftypes.NewValue(documentType, nil))
+}
+
+// A check given up on by its caller, e.g. for the timeouts of a resource,
+// doesn't fail the tunnels started later in the run.
+func TestAccPreflightChecksCancelled(t *testing.T) {
+	fake := testAccFake(t)
+	configureProvider(t, map[string]tftypes.Value{
+		"preflight_checks": tftypes.NewValue(tftypes.Bool, true),
+	})
+	trackersMu.Lock()
+	tracker := trackers[len(trackers)-1]
+	trackersMu.Unlock()
+
+	spec := TunnelSpec{Target: "i-0123456789abcdef0", Region: tracker.Svc.Options().Region, RemoteHost: "127.0.0.1", RemotePort: 5432}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tracker.preflight(ctx, spec); err == nil {
+		t.Fatal("got no error checking with a cancelled context")
+	}
+	if err := tracker.preflight(context.Background(), spec); err != nil {
+		t.Fatalf("got %v checking again, want the check to run again and pass", err)
+	}
+	if targets := preflightSessions(t, fake); !slices.Equal(targets, []string{"i-0123456789abcdef0"}) {
+		t.Errorf("got preflight sessions on %v, want one on i-0123456789abcdef0", targets)
+	}
+}
+
+func TestAccPreflightChecksFail(t *testing.T) {
+	fake := testAccFake(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{
+		"preflight_checks": tftypes.NewValue(tftypes.Bool, true),
+	})
+	fake.DisconnectTarget("i-0123456789abcdef0", 1)
+
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port": tftypes.NewValue(tftypes.Number, echoServer(t)),
+	}))
+	prior := dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil))
+	plan, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       prior,
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(plan.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+
+	apply, err := server.ApplyResourceChange(context.Background(), &tfprotov6.ApplyResourceChangeRequest{
+		TypeName:     "awsssmtunnels_remote_tunnel",
+		PriorState:   prior,
+		PlannedState: plan.PlannedState,
+		Config:       config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := diagnosticErrors(apply.Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "preflight check of i-0123456789abcdef0 failed") || !strings.Contains(errs[0], "TargetNotConnected") {
+		t.Fatalf("got %v, want the preflight check to fail", errs)
+	}
+	// The tunnel isn't started after the check failed
+	if sessions := fake.Sessions(); len(sessions) != 0 {
+		t.Errorf("got sessions %+v, want none", sessions)
+	}
+}
+
+func TestAccRemoteTunnelProbeCommand(t *testing.T) {
+	fake := testAccFake(t)
+	remotePort := echoServer(t)
+	server, schemas := configureProvider(t, map[string]tftypes.Value{})
+
+	// The session is only started once the probe succeeded on the target, the fake runs it successfully
+	state := testAccCreateRemoteTunnel(t, server, schemas, map[string]tftypes.Value{
+		"refresh_id":    tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":   tftypes.NewValue(tftypes.String, "127.0.0.1"),
+		"remote_port":   tftypes.NewValue(tftypes.Number, remotePort),
+		"probe_command": tftypes.NewValue(tftypes.String, "systemctl is-active postgresql"),
+	})
+	if commands := fake.Commands("i-0123456789abcdef0"); !slices.Equal(commands, []string{"systemctl is-active postgresql"}) {
+		t.Errorf("got commands %q, want the probe", commands)
+	}
+	testAccEcho(t, attrInt64(t, state, "local_port"), "probed")
+
+	testAccDestroyRemoteTunnel(t, server, schemas, state)
+}
@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+)
+
+// accessMatrix is the file access_matrix_file names: every tunnel declared in
+// the configuration as a row of a Markdown table, from the machine running
+// Terraform through the target to the remote endpoint, so the network access a
+// change requires can be reviewed with the plan. Resources don't know their
+// address, so rows name the type of the resource declaring the tunnel.
+type accessMatrix struct {
+	path string
+	// source describes the machine running Terraform, see defaultRunnerID
+	source string
+
+	mu   sync.Mutex
+	rows map[accessRow]bool
+}
+
+// accessRow is a row of the access matrix.
+type accessRow struct {
+	change      string
+	declaredBy  string
+	local       string
+	through     string
+	destination string
+	credentials string
+}
+
+// newAccessMatrix returns the matrix written to path, which is emptied until
+// the first tunnel is recorded, so a matrix left by an earlier run isn't
+// mistaken for the one of this run.
+func newAccessMatrix(path string, source string) (*accessMatrix, error) {
+	m := &accessMatrix{path: path, source: source, rows: map[accessRow]bool{}}
+	return m, m.write()
+}
+
+// plannedChange describes what the plan of a resource does to it.
+func plannedChange(state tfsdk.State, plan tfsdk.Plan) string {
+	switch {
+	case state.Raw.IsNull():
+		return "create"
+	case plan.Raw.IsNull():
+		return "destroy"
+	case plan.Raw.Equal(state.Raw):
+		return "no change"
+	}
+	return "update"
+}
+
+// record adds the tunnel to the matrix and rewrites the file. m may be nil
+// when access_matrix_file isn't set.
+func (m *accessMatrix) record(declaredBy string, change string, tunnel plannedTunnel) error {
+	if m == nil {
+		return nil
+	}
+	row := accessRow{
+		change:      change,
+		declaredBy:  declaredBy,
+		local:       tunnel.local,
+		through:     fmt.Sprintf("%s in %s", tunnel.target, tunnel.region),
+		destination: tunnel.destination(),
+		credentials: tunnel.credentials(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rows[row] {
+		return nil
+	}
+	m.rows[row] = true
+	return m.write()
+}
+
+// write replaces the file with the rows recorded so far, renaming a temporary
+// file over it, so a reader never sees half a table. The caller holds mu.
+func (m *accessMatrix) write() error {
+	rows := make([]accessRow, 0, len(m.rows))
+	for row := range m.rows {
+		rows = append(rows, row)
+	}
+	slices.SortFunc(rows, func(a, b accessRow) int {
+		return strings.Compare(
+			strings.Join([]string{a.destination, a.through, a.local, a.declaredBy, a.change, a.credentials}, "\x00"),
+			strings.Join([]string{b.destination, b.through, b.local, b.declaredBy, b.change, b.credentials}, "\x00"),
+		)
+	})
+
+	var b strings.Builder
+	b.WriteString("# Network access\n\n")
+	if m.source != "" {
+		fmt.Fprintf(&b, "Tunnels opened from %s.\n\n", markdownCell(m.source))
+	}
+	b.WriteString("| Source | Through | Destination | Credentials | Declared by | Change |\n")
+	b.WriteString("|---|---|---|---|---|---|\n")
+	for _, row := range rows {
+		cells := []string{row.local, row.through, row.destination, row.credentials, row.declaredBy, row.change}
+		for i, cell := range cells {
+			cells[i] = markdownCell(cell)
+		}
+		fmt.Fprintf(&b, "| %s |\n", strings.Join(cells, " | "))
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(m.path), "."+filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), m.path)
+}
+
+// markdownCell escapes text for a cell of a Markdown table.
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", `\|`)
+	return strings.ReplaceAll(text, "\n", " ")
+}
@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// roleSessionName identifies sessions of assumed roles in CloudTrail.
+	roleSessionName = "awsssmtunnels"
+	// credentialsExpiryWindow is how long before expiry assumed role credentials are refreshed.
+	credentialsExpiryWindow = 10 * time.Minute
+)
+
+type clientKey struct {
+	region  string
+	roleArn string
+	profile string
+}
+
+// credentialsKey identifies credentials shared by the clients of every region.
+type credentialsKey struct {
+	roleArn string
+	profile string
+}
+
+type awsClients struct {
+	ssm *ssm.Client
+	ec2 *ec2.Client
+}
+
+// clientsFor returns the clients for the region, role and profile, an empty
+// roleArn and profile meaning the provider credentials. Clients are cached so
+// that tunnels sharing a region, role and profile share their clients.
+func (t *TunnelTracker) clientsFor(ctx context.Context, region, roleArn, profile string) (*ssm.Client, *ec2.Client, error) {
+	if roleArn == "" && profile == "" && region == t.Svc.Options().Region {
+		return t.Svc, t.EC2, nil
+	}
+
+	key := clientKey{region: region, roleArn: roleArn, profile: profile}
+	t.mu.Lock()
+	clients, ok := t.clients[key]
+	t.mu.Unlock()
+	if ok {
+		return clients.ssm, clients.ec2, nil
+	}
+
+	cfg := t.AWSConfig.Copy()
+	cfg.Region = region
+	if roleArn != "" || profile != "" {
+		creds, err := t.credentialsFor(ctx, region, roleArn, profile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.Credentials = creds
+	}
+	clients = &awsClients{
+		ssm: ssm.NewFromConfig(cfg),
+		ec2: ec2.NewFromConfig(cfg),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Tunnels started in parallel share the clients created first
+	if existing, ok := t.clients[key]; ok {
+		return existing.ssm, existing.ec2, nil
+	}
+	if t.clients == nil {
+		t.clients = map[clientKey]*awsClients{}
+	}
+	t.clients[key] = clients
+	return clients.ssm, clients.ec2, nil
+}
+
+// credentialsFor returns the credentials of the role and profile. They are
+// cached across regions, so a role is assumed once per run however many
+// tunnels use it, and refreshed only when the credentials expire. Roles which
+// require MFA would otherwise ask for a token, or be throttled, for every tunnel.
+// The profile is loaded without holding the lock of the tracker.
+func (t *TunnelTracker) credentialsFor(ctx context.Context, region, roleArn, profile string) (aws.CredentialsProvider, error) {
+	key := credentialsKey{roleArn: roleArn, profile: profile}
+	t.mu.Lock()
+	creds, ok := t.credentials[key]
+	t.mu.Unlock()
+	if ok {
+		return creds, nil
+	}
+
+	cfg := t.AWSConfig.Copy()
+	cfg.Region = region
+	if profile != "" {
+		// Only the credentials come from the profile, everything else from the provider configuration
+		loadOptions := []func(*config.LoadOptions) error{
+			config.WithSharedConfigProfile(profile),
+			config.WithRegion(region),
+			config.WithHTTPClient(cfg.HTTPClient),
+		}
+		if len(t.SharedConfigFiles) > 0 {
+			loadOptions = append(loadOptions, config.WithSharedConfigFiles(t.SharedConfigFiles))
+		}
+		profileCfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("loading profile %s: %w", profile, err)
+		}
+		cfg.Credentials = profileCfg.Credentials
+	}
+	if roleArn != "" {
+		// STS is called with the provider or profile credentials, in the region of the first tunnel unless sts_region is set
+		stsClient := sts.NewFromConfig(cfg, func(o *sts.Options) {
+			if t.STSRegion != "" {
+				o.Region = t.STSRegion
+			}
+		})
+		// Refresh well before expiry, the plugin processes fetch the credentials from us, see ssmtunnels.Session
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, roleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = roleSessionName
+			if t.SourceIdentity != "" {
+				o.SourceIdentity = aws.String(t.SourceIdentity)
+			}
+			if t.RoleExternalId != "" {
+				o.ExternalID = aws.String(t.RoleExternalId)
+			}
+		}), func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = credentialsExpiryWindow
+		})
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// The role is assumed lazily, so only the credentials stored first are ever used
+	if existing, ok := t.credentials[key]; ok {
+		return existing, nil
+	}
+	if t.credentials == nil {
+		t.credentials = map[credentialsKey]aws.CredentialsProvider{}
+	}
+	t.credentials[key] = cfg.Credentials
+	return cfg.Credentials, nil
+}
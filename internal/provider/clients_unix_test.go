@@ -0,0 +1,66 @@
+//go:build !windows
+
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func TestClientsForLoadsProfileUnlocked(t *testing.T) {
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	tracker := NewTunnelTracker(ssm.NewFromConfig(cfg))
+	tracker.EC2 = ec2.NewFromConfig(cfg)
+	tracker.AWSConfig = cfg
+
+	// Loading the profile blocks until the shared config file is written
+	configFile := filepath.Join(t.TempDir(), "config")
+	if err := syscall.Mkfifo(configFile, 0o600); err != nil {
+		t.Skipf("creating a named pipe: %v", err)
+	}
+	tracker.SharedConfigFiles = []string{configFile}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	loaded := make(chan error, 1)
+	go func() {
+		svc, _, err := tracker.clientsFor(context.Background(), "eu-west-1", "", "deploy")
+		if err == nil {
+			var creds aws.Credentials
+			creds, err = svc.Options().Credentials.Retrieve(context.Background())
+			if err == nil && creds.AccessKeyID != "AKIDPROFILE" {
+				t.Errorf("got credentials %s, want those of the profile", creds.AccessKeyID)
+			}
+		}
+		loaded <- err
+	}()
+
+	// Opening the pipe for writing waits until the profile is being loaded
+	pipe, err := os.OpenFile(configFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.mu.TryLock() {
+		t.Error("the tracker is locked while the profile is loaded")
+	} else {
+		tracker.mu.Unlock()
+	}
+	if _, err := pipe.WriteString("[profile deploy]\naws_access_key_id = AKIDPROFILE\naws_secret_access_key = SECRET\n"); err != nil {
+		t.Fatal(err)
+	}
+	pipe.Close()
+
+	if err := <-loaded; err != nil {
+		t.Fatal(err)
+	}
+}
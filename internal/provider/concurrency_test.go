@@ -0,0 +1,441 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// parallelOperations is well above the default terraform -parallelism of 10.
+const parallelOperations = 100
+
+func TestPickLocalPortParallel(t *testing.T) {
+	tracker := NewTunnelTracker(nil)
+
+	// A narrow range makes two tunnels picking the same port likely without reservations
+	rangeMin, rangeMax := 41000, 41000+2*parallelOperations
+
+	var wg sync.WaitGroup
+	listeners := make(chan net.Listener, parallelOperations)
+	errs := make(chan error, parallelOperations)
+	for i := 0; i < parallelOperations; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port, err := pickLocalPort(tracker, defaultLocalHost, 0, "db.example.internal", 5432, rangeMin, rangeMax)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// Like StartTunnel, the forwarder adopts the listener reserving the port
+			defer tracker.releasePort(port)
+			time.Sleep(time.Millisecond)
+			listener := tracker.takeReservation(port, net.JoinHostPort(defaultLocalHost, strconv.Itoa(port)))
+			if listener == nil {
+				errs <- fmt.Errorf("port %d isn't reserved", port)
+				return
+			}
+			listeners <- listener
+		}()
+	}
+	wg.Wait()
+	close(listeners)
+	close(errs)
+
+	picked := map[string]bool{}
+	for listener := range listeners {
+		if picked[listener.Addr().String()] {
+			t.Errorf("%s picked twice", listener.Addr())
+		}
+		picked[listener.Addr().String()] = true
+		listener.Close()
+	}
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPickLocalPortHoldsPort(t *testing.T) {
+	tracker := NewTunnelTracker(nil)
+
+	port, err := pickLocalPort(tracker, "", 0, "db.example.internal", 5432, defaultLocalPortRangeMin, defaultLocalPortRangeMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort(defaultLocalHost, strconv.Itoa(port))
+	// Other processes can't take the port before the tunnel listens on it
+	if listener, err := net.Listen("tcp", addr); err == nil {
+		listener.Close()
+		t.Fatalf("port %d could be bound while reserved", port)
+	}
+
+	// A forwarder on another address listens itself
+	if listener := tracker.takeReservation(port, net.JoinHostPort("localhost", strconv.Itoa(port))); listener != nil {
+		t.Errorf("got listener on %s adopted for localhost", listener.Addr())
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("port %d is still held after the reservation was taken: %v", port, err)
+	}
+	listener.Close()
+
+	port, err = pickLocalPort(tracker, "", 0, "db.example.internal", 5432, defaultLocalPortRangeMin, defaultLocalPortRangeMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.releasePort(port)
+	listener, err = net.Listen("tcp", net.JoinHostPort(defaultLocalHost, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("port %d is still held after it was released: %v", port, err)
+	}
+	listener.Close()
+}
+
+func TestStartTunnelParallelMock(t *testing.T) {
+	tracker := NewTunnelTracker(nil)
+	tracker.Mock = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelOperations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			port, err := pickLocalPort(tracker, defaultLocalHost, 0, "db.example.internal", 5432, defaultLocalPortRangeMin, defaultLocalPortRangeMax)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tunnel, err := tracker.StartTunnel(context.Background(), TunnelSpec{
+				Id:         strconv.Itoa(i),
+				Target:     "i-123456789",
+				Region:     "us-east-1",
+				RemoteHost: "db.example.internal",
+				RemotePort: 5432,
+				LocalPort:  port,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if tunnel.LocalPort != port {
+				t.Errorf("tunnel %d got local port %d, want %d", i, tunnel.LocalPort, port)
+			}
+			if err := tunnel.Close(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(tracker.reservedPorts) != 0 {
+		t.Errorf("%d ports are still reserved after every tunnel started", len(tracker.reservedPorts))
+	}
+	if err := tracker.CloseAll(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartNamedTunnelsReleasesPorts(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTunnelTracker(nil)
+	tracker.Mock = true
+
+	tunnelType := namedTunnelType.TerraformType(ctx).(tftypes.Object)
+	tunnels := map[string]tftypes.Value{
+		"invalid": objectValue(tunnelType, map[string]tftypes.Value{
+			"target":      tftypes.NewValue(tftypes.String, "not a target"),
+			"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+			"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+		}),
+	}
+	for i := 0; i < 5; i++ {
+		tunnels[fmt.Sprintf("db%d", i)] = objectValue(tunnelType, map[string]tftypes.Value{
+			"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+			"remote_port": tftypes.NewValue(tftypes.Number, 5432+i),
+		})
+	}
+	value, err := types.MapType{ElemType: namedTunnelType}.ValueFromTerraform(ctx, tftypes.NewValue(tftypes.Map{ElementType: tunnelType}, tunnels))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// None is started if one is invalid, so the ports picked for the others are released
+	_, diags := startNamedTunnels(ctx, tracker, &ProvidedConfigData{
+		Target:            "i-0123456789abcdef0",
+		Region:            "us-east-1",
+		LocalPortRangeMin: defaultLocalPortRangeMin,
+		LocalPortRangeMax: defaultLocalPortRangeMax,
+	}, value.(types.Map))
+	if !diags.HasError() {
+		t.Fatal("expected an error for the invalid target")
+	}
+	if len(tracker.reservedPorts) != 0 {
+		t.Errorf("%d ports are still reserved after the tunnels failed to start", len(tracker.reservedPorts))
+	}
+}
+
+func TestAcquireTunnelParallel(t *testing.T) {
+	tracker := NewTunnelTracker(nil)
+	spec := TunnelSpec{
+		Target:     "i-123456789",
+		Region:     "us-east-1",
+		RemoteHost: "db.example.internal",
+		RemotePort: 5432,
+	}
+
+	// Only one caller at a time starts the tunnel, the others wait for it
+	var starting atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < parallelOperations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			spec := spec
+			spec.Id = strconv.Itoa(i)
+			tunnel, release, err := tracker.AcquireTunnel(context.Background(), spec)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			if tunnel != nil {
+				t.Errorf("caller %d got a tunnel, none was started", i)
+				return
+			}
+			if n := starting.Add(1); n != 1 {
+				t.Errorf("%d callers start the same tunnel at once", n)
+			}
+			time.Sleep(time.Millisecond)
+			starting.Add(-1)
+		}(i)
+	}
+	wg.Wait()
+
+	if len(tracker.pending) != 0 {
+		t.Errorf("%d tunnels are still pending after every caller released them", len(tracker.pending))
+	}
+}
+
+func TestClientsForParallel(t *testing.T) {
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}
+	tracker := NewTunnelTracker(ssm.NewFromConfig(cfg))
+	tracker.EC2 = ec2.NewFromConfig(cfg)
+	tracker.AWSConfig = cfg
+
+	regions := []string{"us-east-1", "eu-west-1", "ap-southeast-2"}
+	roles := []string{"", "arn:aws:iam::123456789012:role/one", "arn:aws:iam::123456789012:role/two"}
+
+	var mu sync.Mutex
+	seen := map[clientKey]*ssm.Client{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelOperations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := clientKey{region: regions[i%len(regions)], roleArn: roles[(i/len(regions))%len(roles)]}
+			svc, ec2Client, err := tracker.clientsFor(context.Background(), key.region, key.roleArn, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if svc == nil || ec2Client == nil {
+				t.Errorf("no clients for %v", key)
+				return
+			}
+			if svc.Options().Region != key.region {
+				t.Errorf("client for %v uses region %s", key, svc.Options().Region)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if previous, ok := seen[key]; ok && previous != svc {
+				t.Errorf("clients for %v were created twice", key)
+			}
+			seen[key] = svc
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientsForSharedCredentialsParallel(t *testing.T) {
+	var assumed atomic.Int32
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "AssumeRole" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		assumed.Add(1)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult>
+<Credentials><AccessKeyId>ASIA%d</AccessKeyId><SecretAccessKey>SECRET</SecretAccessKey><SessionToken>TOKEN</SessionToken>
+<Expiration>%s</Expiration></Credentials>
+<AssumedRoleUser><Arn>%s</Arn><AssumedRoleId>AROA:awsssmtunnels</AssumedRoleId></AssumedRoleUser>
+</AssumeRoleResult></AssumeRoleResponse>`, assumed.Load(), time.Now().Add(time.Hour).UTC().Format(time.RFC3339), r.Form.Get("RoleArn"))
+	}))
+	defer sts.Close()
+
+	cfg := aws.Config{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		BaseEndpoint: aws.String(sts.URL),
+	}
+	tracker := NewTunnelTracker(ssm.NewFromConfig(cfg))
+	tracker.EC2 = ec2.NewFromConfig(cfg)
+	tracker.AWSConfig = cfg
+
+	// Tunnels to every region assume the role once for the whole run
+	regions := []string{"us-east-1", "eu-west-1", "ap-southeast-2"}
+	roleArn := "arn:aws:iam::123456789012:role/mfa-protected"
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelOperations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			svc, _, err := tracker.clientsFor(context.Background(), regions[i%len(regions)], roleArn, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			creds, err := svc.Options().Credentials.Retrieve(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if creds.SessionToken != "TOKEN" {
+				t.Errorf("got credentials %s, want the assumed role", creds.AccessKeyID)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := assumed.Load(); n != 1 {
+		t.Errorf("the role was assumed %d times, want once", n)
+	}
+}
+
+func TestClientsForRoleExternalId(t *testing.T) {
+	var externalId string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("Action") != "AssumeRole" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		externalId = r.Form.Get("ExternalId")
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult>
+<Credentials><AccessKeyId>ASIA1</AccessKeyId><SecretAccessKey>SECRET</SecretAccessKey><SessionToken>TOKEN</SessionToken>
+<Expiration>%s</Expiration></Credentials>
+<AssumedRoleUser><Arn>%s</Arn><AssumedRoleId>AROA:awsssmtunnels</AssumedRoleId></AssumedRoleUser>
+</AssumeRoleResult></AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), r.Form.Get("RoleArn"))
+	}))
+	defer sts.Close()
+
+	cfg := aws.Config{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		BaseEndpoint: aws.String(sts.URL),
+	}
+	tracker := NewTunnelTracker(ssm.NewFromConfig(cfg))
+	tracker.EC2 = ec2.NewFromConfig(cfg)
+	tracker.AWSConfig = cfg
+	tracker.RoleExternalId = "partner-4711"
+
+	svc, _, err := tracker.clientsFor(context.Background(), "us-east-1", "arn:aws:iam::210987654321:role/partner", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Options().Credentials.Retrieve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if externalId != "partner-4711" {
+		t.Errorf("assumed the role with external ID %q, want the one of the provider", externalId)
+	}
+}
+
+func TestAcquireSlotParallel(t *testing.T) {
+	tracker := NewTunnelTracker(nil)
+	tracker.MaxConcurrentTunnels = 10
+
+	var open, maxOpen atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < parallelOperations; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := tracker.acquireSlot(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := open.Add(1)
+			for {
+				current := maxOpen.Load()
+				if n <= current || maxOpen.CompareAndSwap(current, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			open.Add(-1)
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if got := maxOpen.Load(); got > int64(tracker.MaxConcurrentTunnels) {
+		t.Errorf("%d tunnels were open at once, want at most %d", got, tracker.MaxConcurrentTunnels)
+	}
+}
+
+func TestPickTargetParallel(t *testing.T) {
+	tracker := NewTunnelTracker(nil)
+	targets := []string{"i-aaaaaaaa", "i-bbbbbbbb", "i-cccccccc"}
+	const tunnels = 60
+
+	var mu sync.Mutex
+	picked := map[string]int{}
+	var wg, starting sync.WaitGroup
+	starting.Add(tunnels)
+	for i := 0; i < tunnels; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			target, done := tracker.pickTarget(targets)
+			mu.Lock()
+			picked[target]++
+			mu.Unlock()
+			// Every tunnel is still starting while the others pick their target
+			starting.Done()
+			starting.Wait()
+			done()
+		}()
+	}
+	wg.Wait()
+
+	for _, target := range targets {
+		if picked[target] != tunnels/len(targets) {
+			t.Errorf("%d tunnels were started on %s, want them spread evenly: %v", picked[target], target, picked)
+		}
+		if tracker.startingOn[target] != 0 {
+			t.Errorf("%d tunnels still count as starting on %s", tracker.startingOn[target], target)
+		}
+	}
+}
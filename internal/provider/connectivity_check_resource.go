@@ -0,0 +1,350 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/booldefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/boolplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64default"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &ConnectivityCheckResource{}
+var _ resource.ResourceWithUpgradeState = &ConnectivityCheckResource{}
+var _ resource.ResourceWithModifyPlan = &ConnectivityCheckResource{}
+
+func NewConnectivityCheckResource() resource.Resource {
+	return &ConnectivityCheckResource{}
+}
+
+// ConnectivityCheckResource defines the resource implementation.
+type ConnectivityCheckResource struct {
+	tracker *TunnelTracker
+	region  string
+	target  string
+	targets []string
+
+	portRangeMin int
+	portRangeMax int
+
+	// accessMatrix is nil unless the provider writes one, see accessMatrix
+	accessMatrix *accessMatrix
+}
+
+// ConnectivityCheckResourceModel describes the resource data model.
+type ConnectivityCheckResourceModel struct {
+	RemoteHost     types.String `tfsdk:"remote_host"`
+	RemotePort     types.Int64  `tfsdk:"remote_port"`
+	Region         types.String `tfsdk:"region"`
+	RoleArn        types.String `tfsdk:"role_arn"`
+	TimeoutSeconds types.Int64  `tfsdk:"timeout_seconds"`
+	FailOnError    types.Bool   `tfsdk:"fail_on_error"`
+	Success        types.Bool   `tfsdk:"success"`
+	LatencyMs      types.Int64  `tfsdk:"latency_ms"`
+	Id             types.String `tfsdk:"id"`
+}
+
+func (d *ConnectivityCheckResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_connectivity_check"
+}
+
+func (d *ConnectivityCheckResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Version: 1,
+
+		MarkdownDescription: "Opens a tunnel to the remote host, connects through it and closes it again. " +
+			"Use it as a dependency of expensive resources so a broken network path fails the apply early.",
+
+		Attributes: map[string]schema.Attribute{
+			"remote_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the remote host. IPv6 addresses can be given with or without brackets",
+				Required:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"remote_port": schema.Int64Attribute{
+				MarkdownDescription: "The port number of the remote host",
+				Required:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "The region of the target. Defaults to the provider region",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"role_arn": schema.StringAttribute{
+				MarkdownDescription: "ARN of a role to assume for starting the session. Defaults to the provider credentials",
+				Optional:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"timeout_seconds": schema.Int64Attribute{
+				MarkdownDescription: "How long to wait for a connection through the tunnel before failing",
+				Optional:            true,
+				Computed:            true,
+				Default:             int64default.StaticInt64(30),
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
+			},
+			"fail_on_error": schema.BoolAttribute{
+				MarkdownDescription: "Fail the apply if no connection can be made through the tunnel. With `false` the resource is " +
+					"created anyway and `success` is `false`, the tunnel itself still has to start. Defaults to `true`",
+				Optional: true,
+				Computed: true,
+				Default:  booldefault.StaticBool(true),
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
+			},
+			"success": schema.BoolAttribute{
+				MarkdownDescription: "Whether a connection through the tunnel was accepted and stayed open for a second. The SSM agent may " +
+					"only connect to the remote host once data is sent, so a remote host refusing connections isn't always noticed",
+				Computed: true,
+			},
+			"latency_ms": schema.Int64Attribute{
+				MarkdownDescription: "Time it took to establish the connection through the tunnel, in milliseconds. Null if none could be made",
+				Computed:            true,
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "Identifier of the check",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *ConnectivityCheckResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tracker = configData.Tracker
+	d.region = configData.Region
+	d.target = configData.Target
+	d.targets = configData.Targets
+	d.portRangeMin = configData.LocalPortRangeMin
+	d.portRangeMax = configData.LocalPortRangeMax
+	d.accessMatrix = configData.AccessMatrix
+}
+
+func (d *ConnectivityCheckResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if !req.Config.Raw.IsNull() {
+		var config ConnectivityCheckResourceModel
+		resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		resp.Diagnostics.Append(validatePort(config.RemotePort, path.Root("remote_port"))...)
+		resp.Diagnostics.Append(validateRegion(config.Region, path.Root("region"))...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	// Every argument requires replacement, so the check only opens a tunnel when it is created
+	if !req.State.Raw.IsNull() || req.Plan.Raw.IsNull() || d.tracker == nil {
+		return
+	}
+
+	var data ConnectivityCheckResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	region := d.region
+	if data.Region.ValueString() != "" {
+		region = data.Region.ValueString()
+	}
+	tunnel := plannedTunnel{
+		target:     targetDescription(d.target, d.targets),
+		region:     region,
+		roleArn:    data.RoleArn.ValueString(),
+		remoteHost: data.RemoteHost,
+		remotePort: data.RemotePort,
+		local:      localEndpoint(defaultLocalHost, types.Int64Null(), d.portRangeMin, d.portRangeMax) + ", closed again after the check",
+	}
+	recordAccess(&resp.Diagnostics, d.accessMatrix, "awsssmtunnels_connectivity_check", "create", tunnel)
+	if !d.tracker.Offline() {
+		addPlannedTunnelWarning(&resp.Diagnostics, tunnel)
+	}
+}
+
+func (d *ConnectivityCheckResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data ConnectivityCheckResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	port, err := pickLocalPort(d.tracker, defaultLocalHost, 0, data.RemoteHost.ValueString(), int(data.RemotePort.ValueInt64()), d.portRangeMin, d.portRangeMax)
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to find open port",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+
+	if data.Region.ValueString() == "" {
+		data.Region = basetypes.NewStringValue(d.region)
+	}
+
+	timeout := time.Duration(data.TimeoutSeconds.ValueInt64()) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tunnelInfo, err := d.tracker.StartTunnel(ctx, TunnelSpec{
+		Target:     d.target,
+		Targets:    d.targets,
+		Region:     data.Region.ValueString(),
+		RoleArn:    data.RoleArn.ValueString(),
+		RemoteHost: data.RemoteHost.ValueString(),
+		RemotePort: int(data.RemotePort.ValueInt64()),
+		LocalHost:  defaultLocalHost,
+		LocalPort:  port,
+	})
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Connectivity check failed",
+			failureDetail(fmt.Sprintf("%s: %s", startTunnelErrorSummary(err), err), err),
+		)
+		return
+	}
+
+	var latency time.Duration
+	if !d.tracker.Offline() {
+		latency, err = checkConnection(ctx, net.JoinHostPort(tunnelInfo.LocalHost, strconv.Itoa(tunnelInfo.LocalPort)))
+	}
+	if closeErr := tunnelInfo.Close(context.Background()); closeErr != nil {
+		resp.Diagnostics.AddWarning(
+			"Failed to close tunnel",
+			fmt.Sprintf("Error: %s", closeErr),
+		)
+	}
+
+	if err != nil && data.FailOnError.ValueBool() {
+		resp.Diagnostics.AddError(
+			"Connectivity check failed",
+			classifiedDetail(fmt.Sprintf("Could not connect to %s through the tunnel: %s", net.JoinHostPort(data.RemoteHost.ValueString(), strconv.Itoa(int(data.RemotePort.ValueInt64()))), err), failureConnect),
+		)
+		return
+	}
+
+	data.Id = basetypes.NewStringValue(uuid.New().String())
+	data.Success = basetypes.NewBoolValue(err == nil)
+	data.LatencyMs = types.Int64Null()
+	if err == nil {
+		data.LatencyMs = basetypes.NewInt64Value(latency.Milliseconds())
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// checkConnection connects to the address until the connection stays open for
+// a second, or the context is done. Connections the SSM agent can't forward
+// are closed right away, but agents which only connect to the remote host once
+// data is sent don't close them, so this doesn't confirm the remote host
+// accepts connections.
+func checkConnection(ctx context.Context, address string) (time.Duration, error) {
+	var dialer net.Dialer
+	lastErr := errors.New("timed out")
+	for {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			// A connection that can't be forwarded gets closed right away
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+
+			var netErr net.Error
+			if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+				return time.Since(start), nil
+			}
+			if errors.Is(err, io.EOF) {
+				err = errors.New("connection closed by the remote side")
+			}
+		}
+		lastErr = err
+
+		select {
+		case <-ctx.Done():
+			return 0, lastErr
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (d *ConnectivityCheckResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data ConnectivityCheckResourceModel
+
+	// The check only runs on create, keep whatever is in state
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *ConnectivityCheckResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data ConnectivityCheckResourceModel
+
+	// All arguments require replacement, so there is nothing to do here
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *ConnectivityCheckResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	// The tunnel is closed as soon as the check has run
+}
+
+func (d *ConnectivityCheckResource) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	return map[int64]resource.StateUpgrader{
+		0: upgradeUnversionedState(),
+	}
+}
@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// parseDrainTimeout returns the drain_timeout of a tunnel, zero if it isn't set.
+func parseDrainTimeout(value types.String, at path.Path) (time.Duration, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	if value.IsNull() || value.IsUnknown() {
+		return 0, diags
+	}
+	duration, err := time.ParseDuration(value.ValueString())
+	if err != nil || duration <= 0 {
+		diags.AddAttributeError(
+			at.AtName("drain_timeout"),
+			"Invalid drain_timeout",
+			fmt.Sprintf("%q is not a positive duration like 30s", value.ValueString()),
+		)
+	}
+	return duration, diags
+}
+
+// DrainTunnelsOn is like CloseTunnelsOn, but the tunnels it closes first stop
+// accepting connections and give those open through them up to drain to
+// finish, so a destroy ordered before the resources still using a tunnel
+// doesn't cut their transfers short. Connections open after that are closed.
+func (t *TunnelTracker) DrainTunnelsOn(ctx context.Context, id string, port int, drain time.Duration) error {
+	return t.closeTunnels(ctx, id, port, drain)
+}
+
+// drainTunnels drains the forwarders of the tunnels at once, waiting at most
+// drain for all of them.
+func drainTunnels(ctx context.Context, tunnels []*OtherTunnelInfo, drain time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, drain)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, tunnel := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			remote := net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort))
+			if active := tunnel.forwarder.Stats().ActiveConnections; active > 0 {
+				log.Printf("Waiting up to %s for %d connections through the tunnel to %q on port %d to finish", drain, active, remote, tunnel.LocalPort)
+			}
+			if !tunnel.forwarder.Drain(ctx) {
+				log.Printf("Closing %d connections still open through the tunnel to %q on port %d after %s", tunnel.forwarder.Stats().ActiveConnections, remote, tunnel.LocalPort, drain)
+			}
+		}()
+	}
+	wg.Wait()
+}
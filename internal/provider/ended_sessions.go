@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"context"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+)
+
+// sessionEnded reports whether the session of a tunnel which needs one to be
+// live ended while its forwarder kept listening, e.g. after the target
+// rebooted or Session Manager timed the session out. Lazy tunnels and tunnels
+// closing idle sessions start a new session on the next connection instead.
+func (i *OtherTunnelInfo) sessionEnded() bool {
+	if i.reconnect == nil || i.spec.Lazy || i.spec.CloseAfterIdle > 0 {
+		return false
+	}
+	select {
+	case <-i.forwarder.Stopped():
+		return false
+	default:
+	}
+	i.mu.Lock()
+	session, closed := i.session, i.closed
+	i.mu.Unlock()
+	if closed || session == nil {
+		return false
+	}
+	select {
+	case <-session.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// reviveTunnel starts a new session for a tunnel whose session ended, keeping
+// its local port, so the resources using the tunnel don't keep a listener
+// which refuses every connection. If that fails, the tunnel is closed, so it
+// can be started from scratch.
+func (t *TunnelTracker) reviveTunnel(tunnel *OtherTunnelInfo) error {
+	remote := net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort))
+	session := tunnel.currentSession()
+	log.Printf("Session %s of the tunnel to %q on port %d ended, starting a new one: %v", session.Id, remote, tunnel.LocalPort, session.Err())
+	err := tunnel.reconnect()
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("Closing the tunnel to %q on port %d, its session could not be started again: %v", remote, tunnel.LocalPort, err)
+	t.mu.Lock()
+	t.started = slices.DeleteFunc(t.started, func(other *OtherTunnelInfo) bool { return other == tunnel })
+	t.mu.Unlock()
+	if session := tunnel.shutdown(); session != nil {
+		if closeErr := session.Close(context.Background()); closeErr != nil {
+			log.Printf("Error closing session %s: %v", session.Id, closeErr)
+		}
+	}
+	tunnel.forwarder.Close()
+	return err
+}
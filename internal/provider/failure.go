@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// Diagnostics only have a summary and a detail, so the classification of a
+// failure is appended to the detail as a line of JSON after failureMarker.
+// Automation reading `terraform apply -json` finds it in diagnostic.detail and
+// decides from it whether to retry the run.
+const failureMarker = "Failure classification: "
+
+// Subsystems a failure can come from.
+const (
+	subsystemSSM    = "ssm"
+	subsystemIAM    = "iam"
+	subsystemLocal  = "local"
+	subsystemProbe  = "probe"
+	subsystemTunnel = "tunnel"
+)
+
+// failureClass is the classification of a failure.
+type failureClass struct {
+	// ErrorCode identifies the failure, e.g. target_offline
+	ErrorCode string `json:"error_code"`
+	// Retryable is whether running again without changes can succeed
+	Retryable bool `json:"retryable"`
+	// Subsystem is where the failure happened
+	Subsystem string `json:"subsystem"`
+}
+
+// classifyFailure classifies an error of starting or running a tunnel.
+func classifyFailure(err error) failureClass {
+	switch {
+	case errors.Is(err, ssmtunnels.ErrTargetOffline):
+		// The agent may be restarting or the instance still booting
+		return failureClass{ErrorCode: "target_offline", Retryable: true, Subsystem: subsystemSSM}
+	case errors.Is(err, ssmtunnels.ErrInvalidTarget):
+		// The target ID is wrong or the instance isn't a managed node
+		return failureClass{ErrorCode: "invalid_target", Retryable: false, Subsystem: subsystemSSM}
+	case errors.Is(err, ssmtunnels.ErrSessionLimit):
+		return failureClass{ErrorCode: "session_limit", Retryable: true, Subsystem: subsystemSSM}
+	case errors.Is(err, ssmtunnels.ErrAccessDenied):
+		return failureClass{ErrorCode: "access_denied", Retryable: false, Subsystem: subsystemIAM}
+	case errors.Is(err, ssmtunnels.ErrPortInUse):
+		// Usually a tunnel of an earlier run which is still closing
+		return failureClass{ErrorCode: "port_in_use", Retryable: true, Subsystem: subsystemLocal}
+	}
+	var limitErr *ssmtunnels.TransferLimitExceededError
+	if errors.As(err, &limitErr) {
+		return failureClass{ErrorCode: "transfer_limit_exceeded", Retryable: false, Subsystem: subsystemTunnel}
+	}
+	var platformErr *ssmtunnels.PlatformMismatchError
+	if errors.As(err, &platformErr) {
+		return failureClass{ErrorCode: "platform_mismatch", Retryable: false, Subsystem: subsystemSSM}
+	}
+	var probeErr *ssmtunnels.ProbeFailedError
+	var healthErr *ssmtunnels.HealthCheckFailedError
+	var httpErr *ssmtunnels.HTTPCheckFailedError
+	var postgresErr *ssmtunnels.PostgresCheckFailedError
+	var mysqlErr *ssmtunnels.MySQLCheckFailedError
+	var tlsErr *ssmtunnels.TLSCheckFailedError
+	if errors.As(err, &probeErr) || errors.As(err, &healthErr) || errors.As(err, &httpErr) ||
+		errors.As(err, &postgresErr) || errors.As(err, &mysqlErr) || errors.As(err, &tlsErr) {
+		return failureClass{ErrorCode: "probe_failed", Retryable: true, Subsystem: subsystemProbe}
+	}
+	var notReadyErr *tunnelNotReadyError
+	if errors.As(err, &notReadyErr) {
+		return failureConnect
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return failureClass{ErrorCode: "timeout", Retryable: true, Subsystem: subsystemTunnel}
+	}
+	return failureClass{ErrorCode: "unknown", Retryable: false, Subsystem: subsystemTunnel}
+}
+
+// failureConnect classifies connections through a tunnel which started but
+// did not reach the service behind it.
+var failureConnect = failureClass{ErrorCode: "connect_failed", Retryable: true, Subsystem: subsystemProbe}
+
+// failureDetail appends the classification of err to the detail of its diagnostic.
+func failureDetail(detail string, err error) string {
+	return classifiedDetail(detail, classifyFailure(err))
+}
+
+// classifiedDetail appends the classification to the detail of a diagnostic.
+func classifiedDetail(detail string, class failureClass) string {
+	encoded, _ := json.Marshal(class)
+	return detail + "\n\n" + failureMarker + string(encoded)
+}
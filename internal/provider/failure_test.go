@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		code      string
+		retryable bool
+	}{
+		{fmt.Errorf("starting session: %w", ssmtunnels.ErrTargetOffline), "target_offline", true},
+		{fmt.Errorf("starting session: %w", ssmtunnels.ErrInvalidTarget), "invalid_target", false},
+		{fmt.Errorf("starting session: %w", ssmtunnels.ErrSessionLimit), "session_limit", true},
+		{fmt.Errorf("starting session: %w", ssmtunnels.ErrAccessDenied), "access_denied", false},
+		{fmt.Errorf("listening: %w", ssmtunnels.ErrPortInUse), "port_in_use", true},
+		{fmt.Errorf("probing: %w", &ssmtunnels.ProbeFailedError{Command: "true"}), "probe_failed", true},
+		{&ssmtunnels.PlatformMismatchError{Target: "i-123456789", Platform: "Windows", Required: "Linux"}, "platform_mismatch", false},
+		{&tunnelNotReadyError{local: "127.0.0.1:16000", remote: "db:5432", timeout: time.Minute, err: errors.New("connection closed by the remote side")}, "connect_failed", true},
+		{fmt.Errorf("waiting for session: %w", context.DeadlineExceeded), "timeout", true},
+		{errors.New("something else"), "unknown", false},
+	} {
+		class := classifyFailure(test.err)
+		if class.ErrorCode != test.code || class.Retryable != test.retryable {
+			t.Errorf("%v: got %+v, want %s, retryable %t", test.err, class, test.code, test.retryable)
+		}
+	}
+}
+
+func TestFailureDetail(t *testing.T) {
+	detail := failureDetail("Error: access denied", ssmtunnels.ErrAccessDenied)
+
+	lines := strings.Split(detail, "\n")
+	if lines[0] != "Error: access denied" {
+		t.Errorf("got detail %q, want it to start with the error", detail)
+	}
+	last := lines[len(lines)-1]
+	if !strings.HasPrefix(last, failureMarker) {
+		t.Fatalf("got detail %q, want it to end with the classification", detail)
+	}
+	var class map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(last, failureMarker)), &class); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"error_code": "access_denied", "retryable": false, "subsystem": "iam"}
+	for key, value := range want {
+		if class[key] != value {
+			t.Errorf("%s: got %v, want %v", key, class[key], value)
+		}
+	}
+}
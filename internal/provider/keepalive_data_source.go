@@ -2,14 +2,20 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
 	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 // Ensure provider defined types fully satisfy framework interfaces.
 var _ datasource.DataSource = &KeepaliveDataSource{}
+var _ datasource.DataSourceWithConfigure = &KeepaliveDataSource{}
 
 func NewKeepaliveDataSource() datasource.DataSource {
 	return &KeepaliveDataSource{}
@@ -17,13 +23,52 @@ func NewKeepaliveDataSource() datasource.DataSource {
 
 // KeepaliveDataSource defines the data source implementation.
 type KeepaliveDataSource struct {
+	tracker      *TunnelTracker
+	portRangeMin int
+	portRangeMax int
 }
 
-// KeepaliveDataSourceModel describes the data source data model.
+// KeepaliveDataSourceModel describes the data source data model. The tunnel
+// stats are recorded here rather than by the tunnel resources, since this data
+// source is the only one read once the tunnels were used.
 type KeepaliveDataSourceModel struct {
-	Id types.String `tfsdk:"id"`
+	Id                 types.String `tfsdk:"id"`
+	LocalPortRangeMin  types.Int64  `tfsdk:"local_port_range_min"`
+	LocalPortRangeMax  types.Int64  `tfsdk:"local_port_range_max"`
+	RecordStatsInState types.Bool   `tfsdk:"record_stats_in_state"`
+	RunnerId           types.String `tfsdk:"runner_id"`
+	TunnelStats        types.List   `tfsdk:"tunnel_stats"`
 }
 
+// TunnelStatsModel describes the stats of a tunnel recorded by the keepalive data source.
+type TunnelStatsModel struct {
+	Id              types.String `tfsdk:"id"`
+	Remote          types.String `tfsdk:"remote"`
+	LocalPort       types.Int64  `tfsdk:"local_port"`
+	BytesSent       types.Int64  `tfsdk:"bytes_sent"`
+	BytesReceived   types.Int64  `tfsdk:"bytes_received"`
+	Connections     types.Int64  `tfsdk:"connections"`
+	Queued          types.Int64  `tfsdk:"queued_connections"`
+	PeakQueued      types.Int64  `tfsdk:"peak_queued_connections"`
+	Rejected        types.Int64  `tfsdk:"rejected_connections"`
+	DurationSeconds types.Int64  `tfsdk:"duration_seconds"`
+	Reconnects      types.Int64  `tfsdk:"reconnects"`
+}
+
+var tunnelStatsType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"id":                      types.StringType,
+	"remote":                  types.StringType,
+	"local_port":              types.Int64Type,
+	"bytes_sent":              types.Int64Type,
+	"bytes_received":          types.Int64Type,
+	"connections":             types.Int64Type,
+	"queued_connections":      types.Int64Type,
+	"peak_queued_connections": types.Int64Type,
+	"rejected_connections":    types.Int64Type,
+	"duration_seconds":        types.Int64Type,
+	"reconnects":              types.Int64Type,
+}}
+
 func (d *KeepaliveDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
 	resp.TypeName = req.ProviderTypeName + "_keepalive"
 }
@@ -38,10 +83,109 @@ func (d *KeepaliveDataSource) Schema(ctx context.Context, req datasource.SchemaR
 				MarkdownDescription: "Example identifier", // TODO: Figure this out
 				Computed:            true,
 			},
+			"record_stats_in_state": schema.BoolAttribute{
+				MarkdownDescription: "Record the stats of every `awsssmtunnels_remote_tunnel` in `tunnel_stats`, so pipelines can " +
+					"collect tunnel usage with `terraform show -json`. The stats are taken when the data source is read, " +
+					"i.e. after everything in its `depends_on` is done. They aren't recorded in the state of the tunnels " +
+					"themselves, which is written when a tunnel is created or refreshed, before anything used it. " +
+					"Defaults to `false`",
+				Optional: true,
+				Computed: true,
+			},
+			"local_port_range_min": schema.Int64Attribute{
+				MarkdownDescription: "The lowest local port picked for tunnels without a `local_port`, the provider's " +
+					"`local_port_range_min` or its default. Provider attributes can't have defaults in the plan, so the range " +
+					"in use is reported here.",
+				Computed: true,
+			},
+			"local_port_range_max": schema.Int64Attribute{
+				MarkdownDescription: "The highest local port picked for tunnels without a `local_port`, the provider's " +
+					"`local_port_range_max` or its default.",
+				Computed: true,
+			},
+			"runner_id": schema.StringAttribute{
+				MarkdownDescription: "The `runner_id` of the provider, which identifies the machine or pipeline job running " +
+					"Terraform in the reason of every session. Provider attributes can't be computed, so it is reported here.",
+				Computed: true,
+			},
+			"tunnel_stats": schema.ListNestedAttribute{
+				MarkdownDescription: "The stats of the tunnels during this run, if `record_stats_in_state` is set",
+				Computed:            true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"id": schema.StringAttribute{
+							MarkdownDescription: "The ID of the tunnel resource",
+							Computed:            true,
+						},
+						"remote": schema.StringAttribute{
+							MarkdownDescription: "The remote host and port of the tunnel",
+							Computed:            true,
+						},
+						"local_port": schema.Int64Attribute{
+							MarkdownDescription: "The local port of the tunnel",
+							Computed:            true,
+						},
+						"bytes_sent": schema.Int64Attribute{
+							MarkdownDescription: "Bytes forwarded to the remote host",
+							Computed:            true,
+						},
+						"bytes_received": schema.Int64Attribute{
+							MarkdownDescription: "Bytes forwarded from the remote host",
+							Computed:            true,
+						},
+						"connections": schema.Int64Attribute{
+							MarkdownDescription: "Local connections accepted by the tunnel",
+							Computed:            true,
+						},
+						"queued_connections": schema.Int64Attribute{
+							MarkdownDescription: "Local connections waiting for a slot of `max_connections` when the stats were taken",
+							Computed:            true,
+						},
+						"peak_queued_connections": schema.Int64Attribute{
+							MarkdownDescription: "The most local connections which waited for a slot of `max_connections` at once",
+							Computed:            true,
+						},
+						"rejected_connections": schema.Int64Attribute{
+							MarkdownDescription: "Local connections closed right away because `max_queued_connections` were waiting",
+							Computed:            true,
+						},
+						"duration_seconds": schema.Int64Attribute{
+							MarkdownDescription: "How long the tunnel has been open",
+							Computed:            true,
+						},
+						"reconnects": schema.Int64Attribute{
+							MarkdownDescription: "How often a session was started again for the tunnel, e.g. when it was read and then updated, " +
+								"or after its session dropped",
+							Computed: true,
+						},
+					},
+				},
+			},
 		},
 	}
 }
 
+func (d *KeepaliveDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tracker = configData.Tracker
+	d.portRangeMin = configData.LocalPortRangeMin
+	d.portRangeMax = configData.LocalPortRangeMax
+}
+
 func (d *KeepaliveDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
 	var data KeepaliveDataSourceModel
 
@@ -52,5 +196,71 @@ func (d *KeepaliveDataSource) Read(ctx context.Context, req datasource.ReadReque
 		return
 	}
 
+	// Fail the run if a tunnel the dependencies relied on was closed underneath them
+	if d.tracker != nil {
+		for _, err := range d.tracker.StoppedErrors() {
+			var limitErr *ssmtunnels.TransferLimitExceededError
+			if errors.As(err, &limitErr) {
+				resp.Diagnostics.AddError(
+					"Tunnel transfer limit exceeded",
+					failureDetail(fmt.Sprintf("Error: %s", err), err),
+				)
+				continue
+			}
+			var lazyErr *lazyStartError
+			if errors.As(err, &lazyErr) {
+				resp.Diagnostics.AddError(
+					startTunnelErrorSummary(err),
+					failureDetail(fmt.Sprintf("Error: %s", err), err),
+				)
+				continue
+			}
+			resp.Diagnostics.AddError(
+				"Tunnel closed unexpectedly",
+				failureDetail(fmt.Sprintf("Error: %s", err), err),
+			)
+		}
+	}
+
+	// Data sources can't have schema defaults, the default is set while reading instead
+	data.RecordStatsInState = types.BoolValue(data.RecordStatsInState.ValueBool())
+	data.LocalPortRangeMin = types.Int64Null()
+	data.LocalPortRangeMax = types.Int64Null()
+	if d.portRangeMin != 0 {
+		data.LocalPortRangeMin = types.Int64Value(int64(d.portRangeMin))
+		data.LocalPortRangeMax = types.Int64Value(int64(d.portRangeMax))
+	}
+
+	data.RunnerId = types.StringNull()
+	if d.tracker != nil && d.tracker.Runner != "" {
+		data.RunnerId = types.StringValue(d.tracker.Runner)
+	}
+
+	data.TunnelStats = types.ListNull(tunnelStatsType)
+	if data.RecordStatsInState.ValueBool() && d.tracker != nil {
+		var stats []TunnelStatsModel
+		for _, tunnel := range d.tracker.TunnelStats() {
+			stats = append(stats, TunnelStatsModel{
+				Id:              types.StringValue(tunnel.Id),
+				Remote:          types.StringValue(tunnel.Remote),
+				LocalPort:       types.Int64Value(int64(tunnel.LocalPort)),
+				BytesSent:       types.Int64Value(tunnel.BytesSent),
+				BytesReceived:   types.Int64Value(tunnel.BytesReceived),
+				Connections:     types.Int64Value(tunnel.Connections),
+				Queued:          types.Int64Value(tunnel.QueuedConnections),
+				PeakQueued:      types.Int64Value(tunnel.PeakQueuedConnections),
+				Rejected:        types.Int64Value(tunnel.RejectedConnections),
+				DurationSeconds: types.Int64Value(int64(tunnel.Duration.Seconds())),
+				Reconnects:      types.Int64Value(int64(tunnel.Reconnects)),
+			})
+		}
+		var diags diag.Diagnostics
+		data.TunnelStats, diags = types.ListValueFrom(ctx, tunnelStatsType, stats)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
@@ -0,0 +1,207 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ports"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// lazyStartTimeout bounds starting the session of a lazy tunnel, which isn't
+// tied to a Terraform operation.
+const lazyStartTimeout = 5 * time.Minute
+
+// lazyStartError is recorded when the session of a lazy tunnel could not be
+// started for a connection, see StoppedErrors.
+type lazyStartError struct {
+	remote string
+	err    error
+}
+
+func (e *lazyStartError) Error() string {
+	return fmt.Sprintf("starting lazy tunnel to %s: %v", e.remote, e.err)
+}
+
+func (e *lazyStartError) Unwrap() error {
+	return e.err
+}
+
+// startLazyTunnel listens on the local port right away and starts the session
+// once the first connection arrives. A session which ended, e.g. after the idle
+// timeout of Session Manager, is started again by the next connection.
+func (t *TunnelTracker) startLazyTunnel(spec TunnelSpec, platform string, localHost, sessionHost string, svc *ssm.Client, ec2Client *ec2.Client) (*OtherTunnelInfo, error) {
+	sessionPort, err := ports.FindEphemeralPort()
+	if err != nil {
+		return nil, err
+	}
+	tunnel := &OtherTunnelInfo{
+		LocalPort: spec.LocalPort,
+		LocalHost: spec.LocalHost,
+
+		tunnelSession: &tunnelSession{port: sessionPort},
+		spec:          spec,
+		users:         []string{spec.Id},
+		platform:      platform,
+	}
+	tunnel.listeners = []*OtherTunnelInfo{tunnel}
+
+	tunnel.reconnect = func() error {
+		return t.connectLazy(tunnel, svc, ec2Client, sessionHost, sessionPort)
+	}
+	cfg := t.forwarderConfig(spec, localHost, sessionPort)
+	cfg.Connect = tunnel.reconnect
+	forwarder, err := ssmtunnels.StartForwarder(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tunnel.forwarder = forwarder
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		// CloseAll already ran and won't see this tunnel
+		forwarder.Close()
+		return nil, errTrackerClosed
+	}
+	tunnel.startedAt = time.Now()
+	t.started = append(t.started, tunnel)
+	if spec.CloseAfterIdle > 0 {
+		go t.closeWhenIdle(tunnel)
+	}
+	return tunnel, nil
+}
+
+// connectLazy starts the session of a lazy tunnel unless it is running.
+// Connections arriving while the session starts wait for it.
+func (t *TunnelTracker) connectLazy(tunnel *OtherTunnelInfo, svc *ssm.Client, ec2Client *ec2.Client, sessionHost string, sessionPort int) error {
+	tunnel.startMu.Lock()
+	defer tunnel.startMu.Unlock()
+
+	tunnel.mu.Lock()
+	closed := tunnel.closed
+	tunnel.mu.Unlock()
+	if closed {
+		return errTrackerClosed
+	}
+	if session := tunnel.currentSession(); session != nil {
+		select {
+		case <-session.Done():
+			log.Printf("Session %s ended, starting a new one: %v", session.Id, session.Err())
+		default:
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lazyStartTimeout)
+	defer cancel()
+	session, err := t.startLazySession(ctx, tunnel.spec, svc, ec2Client, sessionHost, sessionPort)
+	// Reported by the keepalive data source until a session started, there is
+	// no Terraform operation to fail
+	t.mu.Lock()
+	tunnel.startErr = nil
+	if err != nil {
+		tunnel.startErr = &lazyStartError{remote: net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort)), err: err}
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tunnel.mu.Lock()
+	if tunnel.closed {
+		tunnel.mu.Unlock()
+		if err := session.Close(context.Background()); err != nil {
+			log.Printf("Error closing session %s: %v", session.Id, err)
+		}
+		return errTrackerClosed
+	}
+	tunnel.session = session
+	listeners := append([]*OtherTunnelInfo(nil), tunnel.listeners...)
+	tunnel.mu.Unlock()
+
+	for _, listener := range listeners {
+		go t.watchForwarder(listener, session)
+	}
+	go t.keepSession(tunnel, session)
+	return nil
+}
+
+// closeWhenIdle terminates the session of the tunnel whenever no local
+// connection was open for spec.CloseAfterIdle, until the tunnel is closed. The
+// forwarder keeps listening and the next connection starts a new session, see
+// connectLazy, so slow human-paced applies don't hold sessions they don't use.
+func (t *TunnelTracker) closeWhenIdle(tunnel *OtherTunnelInfo) {
+	interval := min(tunnel.spec.CloseAfterIdle/4, time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-tunnel.forwarder.Stopped():
+			return
+		}
+
+		tunnel.mu.Lock()
+		closed := tunnel.closed
+		tunnel.mu.Unlock()
+		if closed {
+			return
+		}
+		t.closeIdleSession(tunnel)
+	}
+}
+
+// closeIdleSession terminates the session of the tunnel if it is idle. New
+// connections wait for it, they start a new session afterwards.
+func (t *TunnelTracker) closeIdleSession(tunnel *OtherTunnelInfo) {
+	tunnel.startMu.Lock()
+	defer tunnel.startMu.Unlock()
+
+	session := tunnel.currentSession()
+	if session == nil {
+		return
+	}
+	select {
+	case <-session.Done():
+		return
+	default:
+	}
+	idle := tunnel.forwarder.IdleFor()
+	if idle < tunnel.spec.CloseAfterIdle {
+		return
+	}
+
+	log.Printf("Closing session %s of the tunnel to %q after %s without connections", session.Id, net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort)), idle.Round(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), lazyStartTimeout)
+	defer cancel()
+	if err := session.Close(ctx); err != nil {
+		log.Printf("Error closing session %s: %v", session.Id, err)
+	}
+}
+
+// startLazySession starts a session for a lazy tunnel, holding a tunnel slot
+// until it ends.
+func (t *TunnelTracker) startLazySession(ctx context.Context, spec TunnelSpec, svc *ssm.Client, ec2Client *ec2.Client, sessionHost string, sessionPort int) (*ssmtunnels.Session, error) {
+	release, err := t.prepareSession(ctx, spec, svc, ec2Client)
+	if err != nil {
+		return nil, err
+	}
+	session, err := t.startSession(ctx, spec, svc, sessionHost, sessionPort)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	go func() {
+		<-session.Done()
+		release()
+	}()
+	return session, nil
+}
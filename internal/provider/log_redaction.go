@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"sync"
+)
+
+// redactor holds the log_redaction_patterns of a configured provider
+// instance, see TunnelTracker.Redactor. The AWS SDK logs of the instance are
+// redacted with its own patterns only.
+type redactor struct {
+	patterns []*regexp.Regexp
+}
+
+func newRedactor(patterns []*regexp.Regexp) *redactor {
+	return &redactor{patterns: patterns}
+}
+
+// Redact replaces every match of the patterns with ***.
+func (r *redactor) Redact(message string) string {
+	if r == nil {
+		return message
+	}
+	for _, pattern := range r.patterns {
+		message = pattern.ReplaceAllString(message, "***")
+	}
+	return message
+}
+
+var (
+	// redactorsMu guards redactors, the redactors of the provider instances
+	// whose tunnels are open. The output of the standard logger is shared by
+	// the whole process, so it is redacted with the patterns of all of them.
+	redactorsMu sync.RWMutex
+	redactors   = map[*redactor]struct{}{}
+
+	installRedaction sync.Once
+)
+
+// register redacts the patterns from the standard logger output, until unregister.
+func (r *redactor) register() {
+	if r == nil || len(r.patterns) == 0 {
+		return
+	}
+
+	redactorsMu.Lock()
+	redactors[r] = struct{}{}
+	redactorsMu.Unlock()
+
+	installRedaction.Do(func() {
+		log.SetOutput(&redactingWriter{w: log.Writer()})
+	})
+}
+
+// unregister stops redacting the patterns from the standard logger output,
+// once the tunnels of the provider instance are closed.
+func (r *redactor) unregister() {
+	redactorsMu.Lock()
+	delete(redactors, r)
+	redactorsMu.Unlock()
+}
+
+// redactingWriter redacts log lines with the patterns of every registered
+// redactor before they are written. The standard logger writes each line
+// with a single call, so matches never span writes.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	message := string(p)
+	redactorsMu.RLock()
+	for r := range redactors {
+		message = r.Redact(message)
+	}
+	redactorsMu.RUnlock()
+
+	if _, err := io.WriteString(rw.w, message); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
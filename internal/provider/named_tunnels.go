@@ -0,0 +1,286 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// NamedTunnelModel describes a tunnel of the tunnels map of the provider.
+type NamedTunnelModel struct {
+	Target     types.String `tfsdk:"target"`
+	Region     types.String `tfsdk:"region"`
+	RoleArn    types.String `tfsdk:"role_arn"`
+	Profile    types.String `tfsdk:"profile"`
+	RemoteHost types.String `tfsdk:"remote_host"`
+	RemotePort types.Int64  `tfsdk:"remote_port"`
+	LocalHost  types.String `tfsdk:"local_host"`
+	LocalPort  types.Int64  `tfsdk:"local_port"`
+	Rewrite    types.List   `tfsdk:"rewrite"`
+
+	WaitForVPCEndpoints types.List   `tfsdk:"wait_for_vpc_endpoints"`
+	WaitForTargetOnline types.Bool   `tfsdk:"wait_for_target_online"`
+	MaxTransferBytes    types.Int64  `tfsdk:"max_transfer_bytes"`
+	MaxConnections      types.Int64  `tfsdk:"max_connections"`
+	MaxQueued           types.Int64  `tfsdk:"max_queued_connections"`
+	BandwidthWeight     types.Int64  `tfsdk:"bandwidth_weight"`
+	Lazy                types.Bool   `tfsdk:"lazy"`
+	CloseAfterIdle      types.String `tfsdk:"close_after_idle"`
+	ProbeCommand        types.String `tfsdk:"probe_command"`
+	ProbeTimeoutSeconds types.Int64  `tfsdk:"probe_timeout_seconds"`
+	Probe               types.Object `tfsdk:"probe"`
+	RequirePlatform     types.String `tfsdk:"require_platform"`
+	DocumentName        types.String `tfsdk:"document_name"`
+	StableLocalPort     types.Bool   `tfsdk:"stable_local_port"`
+}
+
+var namedTunnelType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"target":      types.StringType,
+	"region":      types.StringType,
+	"role_arn":    types.StringType,
+	"profile":     types.StringType,
+	"remote_host": types.StringType,
+	"remote_port": types.Int64Type,
+	"local_host":  types.StringType,
+	"local_port":  types.Int64Type,
+	"rewrite":     types.ListType{ElemType: rewriteRuleType},
+
+	"wait_for_vpc_endpoints": types.ListType{ElemType: types.StringType},
+	"wait_for_target_online": types.BoolType,
+	"max_transfer_bytes":     types.Int64Type,
+	"max_connections":        types.Int64Type,
+	"max_queued_connections": types.Int64Type,
+	"bandwidth_weight":       types.Int64Type,
+	"lazy":                   types.BoolType,
+	"close_after_idle":       types.StringType,
+	"probe_command":          types.StringType,
+	"probe_timeout_seconds":  types.Int64Type,
+	"probe":                  probeType,
+	"require_platform":       types.StringType,
+	"document_name":          types.StringType,
+	"stable_local_port":      types.BoolType,
+}}
+
+// NamedTunnel is a tunnel started when the provider is configured, looked up
+// by name with the awsssmtunnels_tunnel data source. Info is nil while the
+// tunnel is pending, see startNamedTunnels.
+type NamedTunnel struct {
+	Spec TunnelSpec
+	Info *OtherTunnelInfo
+}
+
+// known reports whether every attribute of the tunnel is known.
+func (m NamedTunnelModel) known() bool {
+	for _, value := range []attr.Value{m.Target, m.Region, m.RoleArn, m.Profile, m.RemoteHost, m.RemotePort, m.LocalHost, m.LocalPort, m.Rewrite,
+		m.WaitForVPCEndpoints, m.WaitForTargetOnline, m.MaxTransferBytes, m.MaxConnections, m.MaxQueued, m.BandwidthWeight, m.Lazy, m.CloseAfterIdle,
+		m.ProbeCommand, m.ProbeTimeoutSeconds, m.Probe, m.RequirePlatform, m.DocumentName, m.StableLocalPort} {
+		if !fullyKnown(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// fullyKnown reports whether the value and everything nested in it is known.
+func fullyKnown(value attr.Value) bool {
+	if value.IsUnknown() {
+		return false
+	}
+	var nested []attr.Value
+	switch value := value.(type) {
+	case types.List:
+		nested = value.Elements()
+	case types.Object:
+		for _, attribute := range value.Attributes() {
+			nested = append(nested, attribute)
+		}
+	}
+	for _, value := range nested {
+		if !fullyKnown(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// options returns the attributes the tunnel shares with awsssmtunnels_remote_tunnel.
+func (m NamedTunnelModel) options() tunnelOptionsModel {
+	return tunnelOptionsModel{
+		Rewrite:             m.Rewrite,
+		WaitForVPCEndpoints: m.WaitForVPCEndpoints,
+		WaitForTargetOnline: m.WaitForTargetOnline,
+		MaxTransferBytes:    m.MaxTransferBytes,
+		MaxConnections:      m.MaxConnections,
+		MaxQueued:           m.MaxQueued,
+		BandwidthWeight:     m.BandwidthWeight,
+		Lazy:                m.Lazy,
+		CloseAfterIdle:      m.CloseAfterIdle,
+		ProbeCommand:        m.ProbeCommand,
+		ProbeTimeoutSeconds: m.ProbeTimeoutSeconds,
+		Probe:               m.Probe,
+		RequirePlatform:     m.RequirePlatform,
+		DocumentName:        m.DocumentName,
+	}
+}
+
+// startNamedTunnels starts the tunnels of the provider block in parallel, so
+// the provider doesn't wait for the readiness of each tunnel in turn. Tunnels
+// depending on values which are only known after apply, e.g. the endpoint of a
+// database created in the same run, are left pending while planning. The
+// provider is configured again with the known values for the apply.
+func startNamedTunnels(ctx context.Context, tracker *TunnelTracker, configData *ProvidedConfigData, tunnelsValue types.Map) (map[string]*NamedTunnel, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	if tunnelsValue.IsUnknown() {
+		log.Printf("The tunnels of the provider are only known after apply, not starting them yet")
+		return nil, diags
+	}
+
+	pending := map[string]*NamedTunnel{}
+	specs := make(map[string]TunnelSpec, len(tunnelsValue.Elements()))
+	// Ports picked for the tunnels stay reserved until they are started, see
+	// TunnelTracker.findOpenPort, and are released when none is started
+	var picked []int
+	releasePicked := func() {
+		for _, port := range picked {
+			tracker.releasePort(port)
+		}
+	}
+	for name, element := range tunnelsValue.Elements() {
+		var model NamedTunnelModel
+		if !element.IsUnknown() {
+			diags.Append(element.(types.Object).As(ctx, &model, basetypes.ObjectAsOptions{})...)
+			if diags.HasError() {
+				releasePicked()
+				return nil, diags
+			}
+		}
+		if !element.IsUnknown() {
+			at := path.Root("tunnels").AtMapKey(name)
+			tunnelDiags := validateTunnelConfig(model.RemotePort, model.LocalPort, model.StableLocalPort, model.Lazy, model.Probe, at)
+			tunnelDiags.Append(validateRegion(model.Region, at.AtName("region"))...)
+			if tunnelDiags.HasError() {
+				diags.Append(tunnelDiags...)
+				continue
+			}
+		}
+		// Tunnels without a target of their own go through the target of the provider
+		if element.IsUnknown() || !model.known() || (model.Target.ValueString() == "" && configData.TargetUnknown) {
+			log.Printf("Tunnel %q depends on values only known after apply, not starting it yet", name)
+			pending[name] = &NamedTunnel{}
+			continue
+		}
+		spec := TunnelSpec{
+			Id:         name,
+			Target:     configData.Target,
+			Targets:    configData.Targets,
+			Region:     configData.Region,
+			RemoteHost: model.RemoteHost.ValueString(),
+			RemotePort: int(model.RemotePort.ValueInt64()),
+			LocalHost:  model.LocalHost.ValueString(),
+			RoleArn:    model.RoleArn.ValueString(),
+			Profile:    model.Profile.ValueString(),
+		}
+		if model.Target.ValueString() != "" {
+			target, err := ssmtunnels.NormalizeTarget(model.Target.ValueString())
+			if err != nil {
+				diags.AddAttributeError(
+					path.Root("tunnels").AtMapKey(name).AtName("target"),
+					"Invalid target",
+					fmt.Sprintf("Error: %s", err),
+				)
+				continue
+			}
+			spec.Target = target
+			spec.Targets = nil
+		}
+		if model.Region.ValueString() != "" {
+			spec.Region = model.Region.ValueString()
+		}
+		if spec.LocalHost == "" {
+			spec.LocalHost = defaultLocalHost
+		}
+		if optionDiags := model.options().apply(ctx, &spec, path.Root("tunnels").AtMapKey(name)); optionDiags.HasError() {
+			diags.Append(optionDiags...)
+			continue
+		}
+
+		localPort := int(model.LocalPort.ValueInt64())
+		if model.StableLocalPort.ValueBool() && model.LocalPort.IsNull() {
+			localPort = derivedLocalPort(targetKeyOf(spec.Target, spec.Targets), spec.RemoteHost, spec.RemotePort, configData.LocalPortRangeMin, configData.LocalPortRangeMax)
+		}
+		port, err := pickLocalPort(tracker, spec.LocalHost, localPort, spec.RemoteHost, spec.RemotePort, configData.LocalPortRangeMin, configData.LocalPortRangeMax)
+		if err != nil {
+			diags.AddAttributeError(
+				path.Root("tunnels").AtMapKey(name),
+				"Failed to find open port",
+				fmt.Sprintf("Error: %s", err),
+			)
+			continue
+		}
+		if localPort == 0 {
+			picked = append(picked, port)
+		}
+		spec.LocalPort = port
+		specs[name] = spec
+
+		recordAccess(&diags, configData.AccessMatrix, fmt.Sprintf("provider tunnels[%q]", name), "opened by the provider", plannedTunnel{
+			target:     targetDescription(spec.Target, spec.Targets),
+			region:     spec.Region,
+			roleArn:    spec.RoleArn,
+			profile:    spec.Profile,
+			remoteHost: types.StringValue(spec.RemoteHost),
+			remotePort: types.Int64Value(int64(spec.RemotePort)),
+			local:      net.JoinHostPort(spec.LocalHost, strconv.Itoa(port)),
+		})
+	}
+	if diags.HasError() {
+		releasePicked()
+		return nil, diags
+	}
+
+	// The first tunnel started checks the targets of all of them, see TunnelTracker.preflight
+	if tracker.PreflightChecks {
+		for _, spec := range specs {
+			tracker.PreflightSpecs = append(tracker.PreflightSpecs, spec)
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		tunnels = pending
+	)
+	for name, spec := range specs {
+		wg.Add(1)
+		go func(name string, spec TunnelSpec) {
+			defer wg.Done()
+			info, err := tracker.StartTunnel(ctx, spec)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				diags.AddAttributeError(
+					path.Root("tunnels").AtMapKey(name),
+					startTunnelErrorSummary(err),
+					failureDetail(fmt.Sprintf("Error starting tunnel %q: %s", name, err), err),
+				)
+				return
+			}
+			tunnels[name] = &NamedTunnel{Spec: spec, Info: info}
+		}(name, spec)
+	}
+	wg.Wait()
+
+	return tunnels, diags
+}
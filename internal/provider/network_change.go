@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// networkCheckInterval is how often the network interfaces are compared, see
+// ssmtunnels.WatchNetwork.
+const networkCheckInterval = 2 * time.Second
+
+// watchNetwork checks the sessions of the tunnels whenever the network of the
+// host changes, until the tracker is closed. The session manager plugin keeps
+// its connection to AWS over the route it started with, so after a VPN was
+// connected or disconnected mid-apply the connections through a tunnel would
+// hang until the plugin gives up, without a hint why.
+func (t *TunnelTracker) watchNetwork() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.networkStop = make(chan struct{})
+	go ssmtunnels.WatchNetwork(networkCheckInterval, t.networkStop, t.revalidateSessions)
+}
+
+// revalidateSessions checks the session of every tunnel after the network
+// changed and starts new sessions where needed, see revalidateSession.
+func (t *TunnelTracker) revalidateSessions(changes []string) {
+	t.mu.Lock()
+	// Tunnels sharing a session are checked once
+	var tunnels []*OtherTunnelInfo
+	seen := map[*tunnelSession]bool{}
+	for _, tunnel := range t.started {
+		if !seen[tunnel.tunnelSession] {
+			seen[tunnel.tunnelSession] = true
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	t.mu.Unlock()
+
+	log.Printf("Network changed (%s), e.g. a VPN was connected or disconnected. Checking %d sessions", strings.Join(changes, "; "), len(tunnels))
+	var wg sync.WaitGroup
+	for _, tunnel := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.revalidateSession(tunnel)
+		}()
+	}
+	wg.Wait()
+}
+
+// revalidateSession starts a new session for a tunnel whose session ended or
+// may use a route which is gone. Sessions are checked with the probe of the
+// tunnel if it has one. Without a probe there is no telling whether a session
+// still works, so idle sessions are replaced, while sessions with open
+// connections are kept rather than cutting them.
+func (t *TunnelTracker) revalidateSession(tunnel *OtherTunnelInfo) {
+	session := tunnel.currentSession()
+	if session == nil || tunnel.reconnect == nil {
+		// A lazy tunnel which wasn't connected to yet starts its session on the network it finds
+		return
+	}
+	tunnel.mu.Lock()
+	closed := tunnel.closed
+	tunnel.mu.Unlock()
+	if closed {
+		return
+	}
+	remote := net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort))
+
+	select {
+	case <-session.Done():
+		if tunnel.spec.Lazy || tunnel.spec.CloseAfterIdle > 0 {
+			log.Printf("Session %s of the tunnel to %q ended, the next connection starts a new one", session.Id, remote)
+			return
+		}
+		log.Printf("Session %s of the tunnel to %q ended after the network changed, starting a new one: %v", session.Id, remote, session.Err())
+		if err := tunnel.reconnect(); err != nil {
+			log.Printf("Error starting a new session for the tunnel to %q: %v", remote, err)
+		}
+		return
+	default:
+	}
+
+	if tunnel.spec.Probe != nil {
+		err := t.probeTunnel(context.Background(), tunnel.spec, tunnel.forwarder.Addr().String())
+		if err == nil {
+			log.Printf("Session %s of the tunnel to %q still works after the network changed", session.Id, remote)
+			return
+		}
+		log.Printf("Probe of the tunnel to %q failed after the network changed, starting a new session: %v", remote, err)
+	} else if active := tunnel.activeConnections(); active > 0 {
+		log.Printf("Keeping session %s of the tunnel to %q for its %d open connections. If they hang, the network change cut them and they have to be opened again", session.Id, remote, active)
+		return
+	} else {
+		log.Printf("Replacing idle session %s of the tunnel to %q, it may use a route which is gone since the network changed", session.Id, remote)
+	}
+	t.restartSession(tunnel, session)
+}
+
+// restartSession terminates the session of a tunnel and starts a new one on
+// the same internal port, so the forwarder carries on with it.
+func (t *TunnelTracker) restartSession(tunnel *OtherTunnelInfo, session *ssmtunnels.Session) {
+	remote := net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort))
+	ctx, cancel := context.WithTimeout(context.Background(), lazyStartTimeout)
+	defer cancel()
+
+	tunnel.startMu.Lock()
+	if tunnel.currentSession() == session {
+		if err := session.Close(ctx); err != nil {
+			log.Printf("Error closing session %s: %v", session.Id, err)
+		}
+	}
+	tunnel.startMu.Unlock()
+
+	if err := tunnel.reconnect(); err != nil {
+		log.Printf("Error starting a new session for the tunnel to %q: %v", remote, err)
+		return
+	}
+	if replacement := tunnel.currentSession(); replacement != nil && replacement != session {
+		log.Printf("Tunnel to %q now uses session %s", remote, replacement.Id)
+	}
+}
@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+)
+
+// terminateOrphanedSessions terminates the sessions which earlier runs started
+// with the reason prefix but never terminated, see
+// ssmtunnels.FindOrphanedSessions. Sessions of tunnels open in this process are
+// kept, in case a run lasts longer than olderThan. The run goes on if the
+// sessions can't be cleaned up, e.g. without ssm:DescribeSessions.
+func terminateOrphanedSessions(ctx context.Context, svc *ssm.Client, reasonPrefix string, olderThan time.Duration) diag.Diagnostics {
+	var diags diag.Diagnostics
+	at := path.Root("terminate_orphaned_sessions_after")
+
+	sessionIds, err := ssmtunnels.FindOrphanedSessions(ctx, svc, reasonPrefix, olderThan)
+	if err != nil {
+		diags.AddAttributeWarning(at, "Failed to find orphaned sessions", fmt.Sprintf("Error: %s", err))
+		return diags
+	}
+	open := openSessionIds()
+	orphaned := sessionIds[:0]
+	for _, id := range sessionIds {
+		if !open[id] {
+			orphaned = append(orphaned, id)
+		}
+	}
+	if len(orphaned) == 0 {
+		return diags
+	}
+
+	log.Printf("Terminating %d sessions started by earlier runs more than %s ago: %v", len(orphaned), olderThan, orphaned)
+	if err := ssmtunnels.TerminateSessions(ctx, svc, orphaned); err != nil {
+		diags.AddAttributeWarning(at, "Failed to terminate orphaned sessions", fmt.Sprintf("Error: %s", err))
+	}
+	return diags
+}
+
+// openSessionIds returns the IDs of the sessions of every tunnel open in this
+// process, across provider instances.
+func openSessionIds() map[string]bool {
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+
+	ids := map[string]bool{}
+	for _, tracker := range trackers {
+		tracker.mu.Lock()
+		for _, tunnel := range tracker.started {
+			if session := tunnel.currentSession(); session != nil {
+				ids[session.Id] = true
+			}
+		}
+		tracker.mu.Unlock()
+	}
+	return ids
+}
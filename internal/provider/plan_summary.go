@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// plannedTunnel describes a tunnel the apply of a plan opens, so reviewers
+// approving the plan see the network access it implies.
+type plannedTunnel struct {
+	target     string
+	region     string
+	roleArn    string
+	profile    string
+	remoteHost types.String
+	remotePort types.Int64
+	// local describes where the tunnel listens on the machine running Terraform
+	local string
+}
+
+// targetDescription describes the target a tunnel of the provider goes through.
+func targetDescription(target string, targets []string) string {
+	switch {
+	case target != "":
+		return target
+	case len(targets) > 0:
+		return "one of " + strings.Join(targets, ", ")
+	}
+	return "(known after apply)"
+}
+
+// localEndpoint describes where a tunnel listens, localPort being unknown or
+// null while the port is only picked during the apply.
+func localEndpoint(localHost string, localPort types.Int64, rangeMin int, rangeMax int) string {
+	if localPort.IsUnknown() || localPort.IsNull() || localPort.ValueInt64() == 0 {
+		return fmt.Sprintf("%s, on a free port between %d and %d", localHost, rangeMin, rangeMax)
+	}
+	return net.JoinHostPort(localHost, strconv.FormatInt(localPort.ValueInt64(), 10))
+}
+
+// destination describes the remote endpoint of the tunnel.
+func (t plannedTunnel) destination() string {
+	host := "(known after apply)"
+	if !t.remoteHost.IsUnknown() {
+		host = t.remoteHost.ValueString()
+	}
+	port := "(known after apply)"
+	if !t.remotePort.IsUnknown() {
+		port = strconv.FormatInt(t.remotePort.ValueInt64(), 10)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// credentials describes the credentials the session of the tunnel is started with.
+func (t plannedTunnel) credentials() string {
+	switch {
+	case t.roleArn != "":
+		return "role " + t.roleArn
+	case t.profile != "":
+		return "profile " + t.profile
+	}
+	return "the provider credentials"
+}
+
+// addPlannedTunnelWarning reports the tunnel in a warning of the plan. Each
+// tunnel has its own summary, so Terraform lists them all instead of folding
+// them into one warning.
+func addPlannedTunnelWarning(diags *diag.Diagnostics, tunnel plannedTunnel) {
+	destination := tunnel.destination()
+	detail := []string{
+		"Destination: " + destination,
+		fmt.Sprintf("Target: %s in %s", tunnel.target, tunnel.region),
+		"Credentials: " + tunnel.credentials(),
+		"Local endpoint: " + tunnel.local,
+	}
+	diags.AddWarning(
+		"Apply opens a tunnel to "+destination,
+		strings.Join(detail, "\n"),
+	)
+}
+
+// recordAccess adds the tunnel to the access matrix, if the provider writes
+// one. Failing to write it doesn't fail the plan.
+func recordAccess(diags *diag.Diagnostics, matrix *accessMatrix, declaredBy string, change string, tunnel plannedTunnel) {
+	if err := matrix.record(declaredBy, change, tunnel); err != nil {
+		diags.AddWarning(
+			"Failed to write the access matrix",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+}
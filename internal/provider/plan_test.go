@@ -0,0 +1,1493 @@
+package provider
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// objectValue builds a value of the object type with the given attributes,
+// leaving every other attribute null like an unset argument.
+func objectValue(typ tftypes.Object, values map[string]tftypes.Value) tftypes.Value {
+	attrs := map[string]tftypes.Value{}
+	for name, attrType := range typ.AttributeTypes {
+		if value, ok := values[name]; ok {
+			attrs[name] = value
+			continue
+		}
+		attrs[name] = tftypes.NewValue(attrType, nil)
+	}
+	return tftypes.NewValue(typ, attrs)
+}
+
+func dynamicValue(t *testing.T, typ tftypes.Type, value tftypes.Value) *tfprotov6.DynamicValue {
+	t.Helper()
+	dv, err := tfprotov6.NewDynamicValue(typ, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dv
+}
+
+func diagnosticErrors(diags []*tfprotov6.Diagnostic) []string {
+	var errs []string
+	for _, d := range diags {
+		if d.Severity == tfprotov6.DiagnosticSeverityError {
+			errs = append(errs, d.Summary+": "+d.Detail)
+		}
+	}
+	return errs
+}
+
+// configuredServer returns a mock provider server configured like while
+// planning, when the provider block may contain unknown values.
+func configuredServer(t *testing.T, config map[string]tftypes.Value) (tfprotov6.ProviderServer, *tfprotov6.GetProviderSchemaResponse) {
+	t.Helper()
+	config["mock"] = tftypes.NewValue(tftypes.Bool, true)
+	return configureProvider(t, config)
+}
+
+// configureProvider returns a provider server configured with the provider
+// block, defaulting the target and region.
+func configureProvider(t *testing.T, config map[string]tftypes.Value) (tfprotov6.ProviderServer, *tfprotov6.GetProviderSchemaResponse) {
+	t.Helper()
+	ctx := context.Background()
+
+	server, err := providerserver.NewProtocol6WithError(New("test")())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := server.GetProviderSchema(ctx, &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providerType := schemas.Provider.ValueType().(tftypes.Object)
+	_, hasTarget := config["target"]
+	if _, ok := config["targets"]; !ok && !hasTarget {
+		config["target"] = tftypes.NewValue(tftypes.String, "i-0123456789abcdef0")
+	}
+	if _, ok := config["region"]; !ok {
+		config["region"] = tftypes.NewValue(tftypes.String, "us-east-1")
+	}
+	resp, err := server.ConfigureProvider(ctx, &tfprotov6.ConfigureProviderRequest{
+		Config: dynamicValue(t, providerType, objectValue(providerType, config)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("configuring the provider: %v", errs)
+	}
+	return server, schemas
+}
+
+func TestRemoteTunnelPlanUnknownRemoteHost(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, tftypes.UnknownValue),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+	}))
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+
+	planned, err := resp.PlannedState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrs map[string]tftypes.Value
+	if err := planned.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"remote_host", "local_port", "id", "adopted"} {
+		if attrs[name].IsKnown() {
+			t.Errorf("%s is planned as %v, want unknown", name, attrs[name])
+		}
+	}
+}
+
+func TestNamedTunnelsUnknownWhilePlanning(t *testing.T) {
+	tunnelType := namedTunnelType.TerraformType(context.Background()).(tftypes.Object)
+	server, schemas := configuredServer(t, map[string]tftypes.Value{
+		"tunnels": tftypes.NewValue(tftypes.Map{ElementType: tunnelType}, map[string]tftypes.Value{
+			"db": objectValue(tunnelType, map[string]tftypes.Value{
+				"remote_host": tftypes.NewValue(tftypes.String, tftypes.UnknownValue),
+				"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+			}),
+			"cache": objectValue(tunnelType, map[string]tftypes.Value{
+				"remote_host": tftypes.NewValue(tftypes.String, "cache.example.internal"),
+				"remote_port": tftypes.NewValue(tftypes.Number, 6379),
+			}),
+		}),
+	})
+
+	dataSourceType := schemas.DataSourceSchemas["awsssmtunnels_tunnel"].ValueType().(tftypes.Object)
+	read := func(name string) *tfprotov6.ReadDataSourceResponse {
+		resp, err := server.ReadDataSource(context.Background(), &tfprotov6.ReadDataSourceRequest{
+			TypeName: "awsssmtunnels_tunnel",
+			Config: dynamicValue(t, dataSourceType, objectValue(dataSourceType, map[string]tftypes.Value{
+				"name": tftypes.NewValue(tftypes.String, name),
+			})),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if errs := diagnosticErrors(read("cache").Diagnostics); len(errs) > 0 {
+		t.Errorf("reading a known tunnel: %v", errs)
+	}
+	errs := diagnosticErrors(read("db").Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "only known after apply") {
+		t.Errorf("reading a pending tunnel: got %v, want it to be reported as not started yet", errs)
+	}
+}
+
+func TestNamedTunnelsStableLocalPort(t *testing.T) {
+	tunnelType := namedTunnelType.TerraformType(context.Background()).(tftypes.Object)
+	server, schemas := configuredServer(t, map[string]tftypes.Value{
+		"tunnels": tftypes.NewValue(tftypes.Map{ElementType: tunnelType}, map[string]tftypes.Value{
+			"cache": objectValue(tunnelType, map[string]tftypes.Value{
+				"remote_host":       tftypes.NewValue(tftypes.String, "cache.example.internal"),
+				"remote_port":       tftypes.NewValue(tftypes.Number, 6379),
+				"stable_local_port": tftypes.NewValue(tftypes.Bool, true),
+			}),
+		}),
+	})
+
+	dataSourceType := schemas.DataSourceSchemas["awsssmtunnels_tunnel"].ValueType().(tftypes.Object)
+	resp, err := server.ReadDataSource(context.Background(), &tfprotov6.ReadDataSourceRequest{
+		TypeName: "awsssmtunnels_tunnel",
+		Config: dynamicValue(t, dataSourceType, objectValue(dataSourceType, map[string]tftypes.Value{
+			"name": tftypes.NewValue(tftypes.String, "cache"),
+		})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("reading the tunnel: %v", errs)
+	}
+	state, err := resp.State.Unmarshal(dataSourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The port is derived like the one of a remote_tunnel with stable_local_port
+	want := derivedLocalPort("i-0123456789abcdef0", "cache.example.internal", 6379, defaultLocalPortRangeMin, defaultLocalPortRangeMax)
+	if got := attrInt64(t, state, "local_port"); got != int64(want) {
+		t.Errorf("got local port %d, want %d", got, want)
+	}
+}
+
+func TestNamedTunnelsUnknownTarget(t *testing.T) {
+	tunnelType := namedTunnelType.TerraformType(context.Background()).(tftypes.Object)
+	config := map[string]tftypes.Value{
+		// E.g. the ID of a bastion created in the same run
+		"target": tftypes.NewValue(tftypes.String, tftypes.UnknownValue),
+		"tunnels": tftypes.NewValue(tftypes.Map{ElementType: tunnelType}, map[string]tftypes.Value{
+			"db": objectValue(tunnelType, map[string]tftypes.Value{
+				"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+				"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+			}),
+		}),
+	}
+	server, schemas := configuredServer(t, config)
+
+	dataSourceType := schemas.DataSourceSchemas["awsssmtunnels_tunnel"].ValueType().(tftypes.Object)
+	read := func(server tfprotov6.ProviderServer, deferralAllowed bool) *tfprotov6.ReadDataSourceResponse {
+		resp, err := server.ReadDataSource(context.Background(), &tfprotov6.ReadDataSourceRequest{
+			TypeName: "awsssmtunnels_tunnel",
+			Config: dynamicValue(t, dataSourceType, objectValue(dataSourceType, map[string]tftypes.Value{
+				"name": tftypes.NewValue(tftypes.String, "db"),
+			})),
+			ClientCapabilities: &tfprotov6.ReadDataSourceClientCapabilities{DeferralAllowed: deferralAllowed},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Without deferred actions the tunnel isn't started without a target
+	errs := diagnosticErrors(read(server, false).Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "only known after apply") {
+		t.Errorf("reading without deferral: got %v, want the tunnel to be reported as not started yet", errs)
+	}
+	if resp := read(server, true); resp.Deferred == nil || len(resp.Diagnostics) > 0 {
+		t.Errorf("reading with deferral: got deferred %+v and %v, want the read to be deferred", resp.Deferred, diagnosticErrors(resp.Diagnostics))
+	}
+
+	// With deferred actions the provider defers everything until the target is known
+	server, err := providerserver.NewProtocol6WithError(New("test")())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerType := schemas.Provider.ValueType().(tftypes.Object)
+	configured, err := server.ConfigureProvider(context.Background(), &tfprotov6.ConfigureProviderRequest{
+		Config:             dynamicValue(t, providerType, objectValue(providerType, config)),
+		ClientCapabilities: &tfprotov6.ConfigureProviderClientCapabilities{DeferralAllowed: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(configured.Diagnostics); len(errs) > 0 {
+		t.Fatalf("configuring the provider: %v", errs)
+	}
+	resp := read(server, true)
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("reading with deferral: %v", errs)
+	}
+	if resp.Deferred == nil || resp.Deferred.Reason != tfprotov6.DeferredReasonProviderConfigUnknown {
+		t.Errorf("got deferred %+v, want the read to be deferred until the provider configuration is known", resp.Deferred)
+	}
+}
+
+func TestRemoteTunnelPlanLegacyId(t *testing.T) {
+	const legacyId = "0d9b1f63-2f7a-4c1e-9a51-3c8e5d7b2a10"
+
+	for _, preserve := range []bool{false, true} {
+		server, schemas := configuredServer(t, map[string]tftypes.Value{
+			"preserve_tunnel_ids": tftypes.NewValue(tftypes.Bool, preserve),
+		})
+
+		resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+		values := map[string]tftypes.Value{
+			"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+			"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+			"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+		}
+		config := objectValue(resourceType, values)
+
+		values["id"] = tftypes.NewValue(tftypes.String, legacyId)
+		values["local_host"] = tftypes.NewValue(tftypes.String, defaultLocalHost)
+		values["local_port"] = tftypes.NewValue(tftypes.Number, 16000)
+		values["region"] = tftypes.NewValue(tftypes.String, "us-east-1")
+		values["probe_timeout_seconds"] = tftypes.NewValue(tftypes.Number, defaultProbeTimeoutSeconds)
+		values["adopted"] = tftypes.NewValue(tftypes.Bool, false)
+		state := objectValue(resourceType, values)
+
+		resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+			TypeName:         "awsssmtunnels_remote_tunnel",
+			PriorState:       dynamicValue(t, resourceType, state),
+			ProposedNewState: dynamicValue(t, resourceType, state),
+			Config:           dynamicValue(t, resourceType, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+			t.Fatalf("planning: %v", errs)
+		}
+
+		planned, err := resp.PlannedState.Unmarshal(resourceType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attrs map[string]tftypes.Value
+		if err := planned.As(&attrs); err != nil {
+			t.Fatal(err)
+		}
+		var id string
+		if err := attrs["id"].As(&id); err != nil {
+			t.Fatal(err)
+		}
+
+		want := tunnelIdentity{target: "i-0123456789abcdef0", region: "us-east-1", remoteHost: "db.example.internal", remotePort: 5432}.id()
+		if preserve {
+			want = legacyId
+		}
+		if id != want {
+			t.Errorf("with preserve_tunnel_ids %v the id is planned as %s, want %s", preserve, id, want)
+		}
+	}
+}
+
+func TestTunnelIdentity(t *testing.T) {
+	endpoint := tunnelIdentity{target: "i-0123456789abcdef0", region: "us-east-1", remoteHost: "db.example.internal", remotePort: 5432}
+	// Tunnels without a local endpoint or credentials keep the IDs of earlier versions
+	if id, want := endpoint.id(), "b81044f6-85f2-5283-b7f5-92c985888768"; id != want {
+		t.Errorf("got id %s for the endpoint only, want %s", id, want)
+	}
+	withDefaultHost := endpoint
+	withDefaultHost.localHost = defaultLocalHost
+	if withDefaultHost.id() != endpoint.id() {
+		t.Error("the default local host changes the id")
+	}
+
+	ids := map[string]string{endpoint.id(): "endpoint"}
+	for name, identity := range map[string]tunnelIdentity{
+		"local_host": {target: endpoint.target, region: endpoint.region, remoteHost: endpoint.remoteHost, remotePort: endpoint.remotePort, localHost: "127.0.0.2"},
+		"local_port": {target: endpoint.target, region: endpoint.region, remoteHost: endpoint.remoteHost, remotePort: endpoint.remotePort, localPort: 15432},
+		"role_arn":   {target: endpoint.target, region: endpoint.region, remoteHost: endpoint.remoteHost, remotePort: endpoint.remotePort, roleArn: "arn:aws:iam::123456789012:role/tunnel"},
+		"profile":    {target: endpoint.target, region: endpoint.region, remoteHost: endpoint.remoteHost, remotePort: endpoint.remotePort, profile: "prod"},
+	} {
+		if other, ok := ids[identity.id()]; ok {
+			t.Errorf("tunnels with another %s have the same id as with another %s", name, other)
+		}
+		ids[identity.id()] = name
+	}
+}
+
+func TestRemoteTunnelPlanEndpointChangeReplaces(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	triggers := func(instance string) tftypes.Value {
+		return tftypes.NewValue(tftypes.Map{ElementType: tftypes.String}, map[string]tftypes.Value{
+			"instance": tftypes.NewValue(tftypes.String, instance),
+		})
+	}
+
+	stateId := tunnelIdentity{target: "i-0123456789abcdef0", region: "us-west-2", remoteHost: "db.example.internal", remotePort: 5432}.id()
+	state := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":            tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":           tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port":           tftypes.NewValue(tftypes.Number, 5432),
+		"id":                    tftypes.NewValue(tftypes.String, stateId),
+		"local_host":            tftypes.NewValue(tftypes.String, defaultLocalHost),
+		"local_port":            tftypes.NewValue(tftypes.Number, 16000),
+		"region":                tftypes.NewValue(tftypes.String, "us-west-2"),
+		"probe_timeout_seconds": tftypes.NewValue(tftypes.Number, defaultProbeTimeoutSeconds),
+		"adopted":               tftypes.NewValue(tftypes.Bool, false),
+		"triggers":              triggers("db-1"),
+	})
+	// The region isn't set, so it becomes the provider region us-east-1
+	config := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5433),
+		"triggers":    triggers("db-2"),
+	})
+	proposed := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":            tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":           tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port":           tftypes.NewValue(tftypes.Number, 5433),
+		"id":                    tftypes.NewValue(tftypes.String, stateId),
+		"local_host":            tftypes.NewValue(tftypes.String, defaultLocalHost),
+		"local_port":            tftypes.NewValue(tftypes.Number, 16000),
+		"region":                tftypes.NewValue(tftypes.String, "us-west-2"),
+		"probe_timeout_seconds": tftypes.NewValue(tftypes.Number, defaultProbeTimeoutSeconds),
+		"adopted":               tftypes.NewValue(tftypes.Bool, false),
+		"triggers":              triggers("db-2"),
+	})
+
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       dynamicValue(t, resourceType, state),
+		ProposedNewState: dynamicValue(t, resourceType, proposed),
+		Config:           dynamicValue(t, resourceType, config),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+
+	replaced := map[string]bool{}
+	for _, p := range resp.RequiresReplace {
+		replaced[p.String()] = true
+	}
+	for _, name := range []string{"remote_port", "region", "triggers"} {
+		if !replaced[tftypes.NewAttributePath().WithAttributeName(name).String()] {
+			t.Errorf("changing %s doesn't replace the tunnel, replaced by %v", name, resp.RequiresReplace)
+		}
+	}
+}
+
+// Tunnels are started again by the refresh of every run, planning an
+// unchanged tunnel mustn't show an update
+func TestRemoteTunnelPlanUnchanged(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	config := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+		"region":      tftypes.NewValue(tftypes.String, "us-west-2"),
+	})
+	state := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":            tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":           tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port":           tftypes.NewValue(tftypes.Number, 5432),
+		"region":                tftypes.NewValue(tftypes.String, "us-west-2"),
+		"id":                    tftypes.NewValue(tftypes.String, tunnelIdentity{target: "i-0123456789abcdef0", region: "us-west-2", remoteHost: "db.example.internal", remotePort: 5432}.id()),
+		"local_host":            tftypes.NewValue(tftypes.String, defaultLocalHost),
+		"local_port":            tftypes.NewValue(tftypes.Number, 16000),
+		"probe_timeout_seconds": tftypes.NewValue(tftypes.Number, defaultProbeTimeoutSeconds),
+		"adopted":               tftypes.NewValue(tftypes.Bool, false),
+		"ready":                 tftypes.NewValue(tftypes.Bool, true),
+	})
+
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       dynamicValue(t, resourceType, state),
+		ProposedNewState: dynamicValue(t, resourceType, state),
+		Config:           dynamicValue(t, resourceType, config),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+	planned, err := resp.PlannedState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs, err := state.Diff(planned); err != nil || len(diffs) > 0 {
+		t.Errorf("got changes %v planned for an unchanged tunnel (%v)", diffs, err)
+	}
+}
+
+func TestRemoteTunnelPlanRegion(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	plan := func(prior, proposed, config tftypes.Value) (tftypes.Value, []*tftypes.AttributePath) {
+		resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+			TypeName:         "awsssmtunnels_remote_tunnel",
+			PriorState:       dynamicValue(t, resourceType, prior),
+			ProposedNewState: dynamicValue(t, resourceType, proposed),
+			Config:           dynamicValue(t, resourceType, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+			t.Fatalf("planning: %v", errs)
+		}
+		planned, err := resp.PlannedState.Unmarshal(resourceType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return planned, resp.RequiresReplace
+	}
+	config := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+	})
+
+	// The provider region is known while planning the creation
+	planned, _ := plan(tftypes.NewValue(resourceType, nil), config, config)
+	if got := attrString(t, planned, "region"); got != "us-east-1" {
+		t.Errorf("got region %q planned for a new tunnel, want the provider region", got)
+	}
+
+	// An update keeps the region of the state without replacing the tunnel
+	values := map[string]tftypes.Value{
+		"refresh_id":            tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":           tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port":           tftypes.NewValue(tftypes.Number, 5432),
+		"id":                    tftypes.NewValue(tftypes.String, tunnelIdentity{target: "i-0123456789abcdef0", region: "us-east-1", remoteHost: "db.example.internal", remotePort: 5432}.id()),
+		"local_host":            tftypes.NewValue(tftypes.String, defaultLocalHost),
+		"local_port":            tftypes.NewValue(tftypes.Number, 16000),
+		"region":                tftypes.NewValue(tftypes.String, "us-east-1"),
+		"probe_timeout_seconds": tftypes.NewValue(tftypes.Number, defaultProbeTimeoutSeconds),
+		"adopted":               tftypes.NewValue(tftypes.Bool, false),
+	}
+	state := objectValue(resourceType, values)
+	values["region"] = tftypes.NewValue(tftypes.String, tftypes.UnknownValue)
+	values["lazy"] = tftypes.NewValue(tftypes.Bool, true)
+	updated := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+		"lazy":        tftypes.NewValue(tftypes.Bool, true),
+	})
+	planned, replace := plan(state, objectValue(resourceType, values), updated)
+	if got := attrString(t, planned, "region"); got != "us-east-1" {
+		t.Errorf("got region %q planned for an update, want the one of the state", got)
+	}
+	if len(replace) > 0 {
+		t.Errorf("got the update replacing %v, want it in place", replace)
+	}
+}
+
+func TestRemoteTunnelPlanInvalidTimeout(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	timeoutsType := resourceType.AttributeTypes["timeouts"].(tftypes.Object)
+
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+		"timeouts": objectValue(timeoutsType, map[string]tftypes.Value{
+			"create": tftypes.NewValue(tftypes.String, "2 minutes"),
+		}),
+	}))
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := diagnosticErrors(resp.Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "Invalid timeout") {
+		t.Errorf("got %v, want the create timeout to be rejected", errs)
+	}
+}
+
+func TestRemoteTunnelPlanInvalidCloseAfterIdle(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	for _, value := range []string{"15", "-5m"} {
+		config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+			"refresh_id":       tftypes.NewValue(tftypes.String, "one"),
+			"remote_host":      tftypes.NewValue(tftypes.String, "db.example.internal"),
+			"remote_port":      tftypes.NewValue(tftypes.Number, 5432),
+			"close_after_idle": tftypes.NewValue(tftypes.String, value),
+		}))
+		resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+			TypeName:         "awsssmtunnels_remote_tunnel",
+			PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+			ProposedNewState: config,
+			Config:           config,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := diagnosticErrors(resp.Diagnostics)
+		if len(errs) != 1 || !strings.Contains(errs[0], "Invalid close_after_idle") {
+			t.Errorf("%q: got %v, want it to be rejected", value, errs)
+		}
+	}
+}
+
+func TestRemoteTunnelPlanInvalidRequirePlatform(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	// Platforms are named like Session Manager reports them
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":       tftypes.NewValue(tftypes.String, "one"),
+		"remote_host":      tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port":      tftypes.NewValue(tftypes.Number, 5432),
+		"require_platform": tftypes.NewValue(tftypes.String, "linux"),
+	}))
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := diagnosticErrors(resp.Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "Invalid platform") {
+		t.Errorf("got %v, want linux to be rejected", errs)
+	}
+}
+
+func TestRemoteTunnelPlanInvalidConfig(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+	probeType := resourceType.AttributeTypes["probe"].(tftypes.Object)
+	waitForType := resourceType.AttributeTypes["wait_for"].(tftypes.Object)
+	waitForHTTPType := waitForType.AttributeTypes["http"].(tftypes.Object)
+	waitForPostgresType := waitForType.AttributeTypes["postgres"].(tftypes.Object)
+
+	for name, tt := range map[string]struct {
+		attrs map[string]tftypes.Value
+		want  string
+	}{
+		"remote port": {map[string]tftypes.Value{"remote_port": tftypes.NewValue(tftypes.Number, 65536)}, "Invalid port"},
+		"local port":  {map[string]tftypes.Value{"local_port": tftypes.NewValue(tftypes.Number, 0)}, "Invalid port"},
+		"region":      {map[string]tftypes.Value{"region": tftypes.NewValue(tftypes.String, "us-east-1a")}, "Invalid region"},
+		"ready timeout": {map[string]tftypes.Value{
+			"wait_for_ready_timeout": tftypes.NewValue(tftypes.String, "soon"),
+		}, "Invalid wait_for_ready_timeout"},
+		"drain timeout": {map[string]tftypes.Value{
+			"drain_timeout": tftypes.NewValue(tftypes.String, "0s"),
+		}, "Invalid drain_timeout"},
+		"wait for http status": {map[string]tftypes.Value{
+			"wait_for": objectValue(waitForType, map[string]tftypes.Value{
+				"http": objectValue(waitForHTTPType, map[string]tftypes.Value{
+					"expected_status": tftypes.NewValue(tftypes.Number, 42),
+				}),
+			}),
+		}, "Invalid expected_status"},
+		"wait for postgres timeout": {map[string]tftypes.Value{
+			"wait_for": objectValue(waitForType, map[string]tftypes.Value{
+				"postgres": objectValue(waitForPostgresType, map[string]tftypes.Value{
+					"timeout": tftypes.NewValue(tftypes.String, "forever"),
+				}),
+			}),
+		}, "Invalid timeout"},
+		"stable and fixed local port": {map[string]tftypes.Value{
+			"local_port":        tftypes.NewValue(tftypes.Number, 16000),
+			"stable_local_port": tftypes.NewValue(tftypes.Bool, true),
+		}, "Conflicting local port"},
+		"lazy with probe": {map[string]tftypes.Value{
+			"lazy": tftypes.NewValue(tftypes.Bool, true),
+			"probe": objectValue(probeType, map[string]tftypes.Value{
+				"type": tftypes.NewValue(tftypes.String, probeTypeGRPC),
+			}),
+		}, "Invalid probe"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			attrs := map[string]tftypes.Value{
+				"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+				"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+				"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+			}
+			for k, v := range tt.attrs {
+				attrs[k] = v
+			}
+			config := dynamicValue(t, resourceType, objectValue(resourceType, attrs))
+			resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+				TypeName:         "awsssmtunnels_remote_tunnel",
+				PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+				ProposedNewState: config,
+				Config:           config,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			errs := diagnosticErrors(resp.Diagnostics)
+			if len(errs) != 1 || !strings.Contains(errs[0], tt.want) {
+				t.Errorf("got %v, want the plan to fail with %q", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeTypeValidation(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	validate := func(typeName string, attrs map[string]tftypes.Value) []string {
+		resourceType := schemas.ResourceSchemas[typeName].ValueType().(tftypes.Object)
+		resp, err := server.ValidateResourceConfig(context.Background(), &tfprotov6.ValidateResourceConfigRequest{
+			TypeName: typeName,
+			Config:   dynamicValue(t, resourceType, objectValue(resourceType, attrs)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diagnosticErrors(resp.Diagnostics)
+	}
+	probe := func(typeName string, probeType string) tftypes.Value {
+		objectType := schemas.ResourceSchemas[typeName].ValueType().(tftypes.Object).AttributeTypes["probe"].(tftypes.Object)
+		return objectValue(objectType, map[string]tftypes.Value{"type": tftypes.NewValue(tftypes.String, probeType)})
+	}
+
+	for name, tt := range map[string]struct {
+		typeName  string
+		probeType string
+		wantErr   bool
+	}{
+		"remote tunnel grpc": {typeName: "awsssmtunnels_remote_tunnel", probeType: probeTypeGRPC},
+		"remote tunnel tcp":  {typeName: "awsssmtunnels_remote_tunnel", probeType: probeTypeTCP, wantErr: true},
+		"wait for tcp":       {typeName: "awsssmtunnels_wait_for", probeType: probeTypeTCP},
+		"wait for grpc":      {typeName: "awsssmtunnels_wait_for", probeType: probeTypeGRPC},
+		"wait for http":      {typeName: "awsssmtunnels_wait_for", probeType: "http", wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			attrs := map[string]tftypes.Value{"probe": probe(tt.typeName, tt.probeType)}
+			if tt.typeName == "awsssmtunnels_remote_tunnel" {
+				attrs["remote_host"] = tftypes.NewValue(tftypes.String, "db.example.internal")
+				attrs["remote_port"] = tftypes.NewValue(tftypes.Number, 5432)
+				attrs["refresh_id"] = tftypes.NewValue(tftypes.String, "1")
+			} else {
+				attrs["local_port"] = tftypes.NewValue(tftypes.Number, 16000)
+			}
+			errs := validate(tt.typeName, attrs)
+			if tt.wantErr != (len(errs) == 1 && strings.Contains(errs[0], "Invalid probe type")) || (!tt.wantErr && len(errs) > 0) {
+				t.Errorf("got %v, want an invalid probe type: %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoteTunnelPlanStableLocalPort(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	planLocalPort := func(remotePort int) tftypes.Value {
+		t.Helper()
+		config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+			"refresh_id":        tftypes.NewValue(tftypes.String, "one"),
+			"remote_host":       tftypes.NewValue(tftypes.String, "db.example.internal"),
+			"remote_port":       tftypes.NewValue(tftypes.Number, remotePort),
+			"stable_local_port": tftypes.NewValue(tftypes.Bool, true),
+		}))
+		resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+			TypeName:         "awsssmtunnels_remote_tunnel",
+			PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+			ProposedNewState: config,
+			Config:           config,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+			t.Fatalf("planning: %v", errs)
+		}
+		plan, err := resp.PlannedState.Unmarshal(resourceType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attrs map[string]tftypes.Value
+		if err := plan.As(&attrs); err != nil {
+			t.Fatal(err)
+		}
+		return attrs["local_port"]
+	}
+
+	// The port is known while planning and the same in every run
+	port := planLocalPort(5432)
+	if !port.IsKnown() || port.IsNull() {
+		t.Fatalf("got local port %v, want it known while planning", port)
+	}
+	if again := planLocalPort(5432); !again.Equal(port) {
+		t.Errorf("got local port %v, then %v", port, again)
+	}
+	var n big.Float
+	if err := port.As(&n); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := n.Int64(); p < defaultLocalPortRangeMin || p > defaultLocalPortRangeMax {
+		t.Errorf("got local port %d, want it in the local port range", p)
+	}
+	if other := planLocalPort(5433); other.Equal(port) {
+		t.Errorf("got local port %v for another remote port too", other)
+	}
+}
+
+func TestRemoteTunnelImportUnusualValues(t *testing.T) {
+	// Targets and import IDs pasted with whitespace around them
+	server, schemas := configuredServer(t, map[string]tftypes.Value{
+		"target": tftypes.NewValue(tftypes.String, " i-0123456789abcdef0\n"),
+	})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	importID := func(id string) (map[string]tftypes.Value, []string) {
+		resp, err := server.ImportResourceState(context.Background(), &tfprotov6.ImportResourceStateRequest{
+			TypeName: "awsssmtunnels_remote_tunnel",
+			ID:       id,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+			return nil, errs
+		}
+		state, err := resp.ImportedResources[0].State.Unmarshal(resourceType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var attrs map[string]tftypes.Value
+		if err := state.As(&attrs); err != nil {
+			t.Fatal(err)
+		}
+		return attrs, nil
+	}
+
+	attrs, errs := importID(" i-0123456789abcdef0 , DB_Primary.Example.internal:5432\n")
+	if len(errs) > 0 {
+		t.Fatalf("importing: %v", errs)
+	}
+	var remoteHost, id string
+	if err := attrs["remote_host"].As(&remoteHost); err != nil {
+		t.Fatal(err)
+	}
+	if err := attrs["id"].As(&id); err != nil {
+		t.Fatal(err)
+	}
+	if remoteHost != "DB_Primary.Example.internal" {
+		t.Errorf("imported remote host %q, want it as given without the whitespace", remoteHost)
+	}
+	if want := (tunnelIdentity{target: "i-0123456789abcdef0", region: "us-east-1", remoteHost: "DB_Primary.Example.internal", remotePort: 5432}).id(); id != want {
+		t.Errorf("imported id %s, want %s", id, want)
+	}
+	if !attrs["local_port"].IsNull() {
+		t.Errorf("imported local port %v, want it left to the configuration", attrs["local_port"])
+	}
+
+	// IDs of older provider versions still import, with the local endpoint
+	attrs, errs = importID(" DB_Primary.Example.internal | 5432 | 16000 | 127.0.0.1\n")
+	if len(errs) > 0 {
+		t.Fatalf("importing a legacy ID: %v", errs)
+	}
+	if got := attrInt64(t, tftypes.NewValue(resourceType, attrs), "local_port"); got != 16000 {
+		t.Errorf("imported local port %d from a legacy ID, want 16000", got)
+	}
+
+	for _, invalid := range []string{
+		"i-0123456789abcdef0,db example.internal:5432",
+		"i-0123456789abcdef0,db.example.internal:65536",
+		"i-0123456789abcdef0,db.example.internal:postgres",
+		"i-0123456789abcdef0,db.example.internal",
+		"i-0123456789abcdef0,db.example.internal:5432,",
+		"i-0fedcba9876543210,db.example.internal:5432",
+		"db.example.internal:5432",
+		"db example.internal|5432|16000|127.0.0.1",
+		"db.example.internal|5432|160000|127.0.0.1",
+		"db.example.internal|postgres|16000|127.0.0.1",
+		"db.example.internal|5432|16000",
+	} {
+		if _, errs := importID(invalid); len(errs) != 1 || !strings.Contains(errs[0], "Invalid import ID") {
+			t.Errorf("importing %q: got %v, want it to be rejected", invalid, errs)
+		}
+	}
+}
+
+func TestRemoteTunnelImportAttributeErrors(t *testing.T) {
+	server, _ := configuredServer(t, map[string]tftypes.Value{})
+
+	resp, err := server.ImportResourceState(context.Background(), &tfprotov6.ImportResourceStateRequest{
+		TypeName: "awsssmtunnels_remote_tunnel",
+		ID:       "i-0123456789abcdef0,db example.internal:0,eu west 1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every malformed part is reported on its attribute
+	var attributes []string
+	for _, d := range resp.Diagnostics {
+		if d.Severity == tfprotov6.DiagnosticSeverityError && d.Attribute != nil {
+			attributes = append(attributes, d.Attribute.String())
+		}
+	}
+	want := []string{
+		tftypes.NewAttributePath().WithAttributeName("remote_host").String(),
+		tftypes.NewAttributePath().WithAttributeName("remote_port").String(),
+		tftypes.NewAttributePath().WithAttributeName("region").String(),
+	}
+	if !slices.Equal(attributes, want) {
+		t.Errorf("got errors on %v, want %v", attributes, want)
+	}
+}
+
+func TestRemoteTunnelPlanInvalidRemoteHost(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal:5432"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+	}))
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_remote_tunnel",
+		PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := diagnosticErrors(resp.Diagnostics)
+	if len(errs) != 1 || !strings.Contains(errs[0], "Invalid remote host") {
+		t.Errorf("got %v, want the remote host to be rejected", errs)
+	}
+}
+
+func TestRemoteTunnelUpgradeUnversionedState(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	// A state written before the schema was versioned, with an attribute
+	// which no longer exists and without the ones added since
+	resp, err := server.UpgradeResourceState(context.Background(), &tfprotov6.UpgradeResourceStateRequest{
+		TypeName: "awsssmtunnels_remote_tunnel",
+		Version:  0,
+		RawState: &tfprotov6.RawState{JSON: []byte(`{
+			"id": "db.example.internal|5432|16000|localhost",
+			"refresh_id": "one",
+			"remote_host": "db.example.internal",
+			"remote_port": 5432,
+			"local_port": 16000,
+			"local_host": "localhost",
+			"removed_attribute": "value"
+		}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("upgrading: %v", errs)
+	}
+
+	state, err := resp.UpgradedState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrs map[string]tftypes.Value
+	if err := state.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	var remoteHost string
+	if err := attrs["remote_host"].As(&remoteHost); err != nil {
+		t.Fatal(err)
+	}
+	if remoteHost != "db.example.internal" {
+		t.Errorf("remote_host: got %q, want it kept", remoteHost)
+	}
+	if probeTimeout := attrInt64(t, state, "probe_timeout_seconds"); probeTimeout != defaultProbeTimeoutSeconds {
+		t.Errorf("probe_timeout_seconds: got %d, want the default %d", probeTimeout, defaultProbeTimeoutSeconds)
+	}
+	if !attrs["timeouts"].IsNull() {
+		t.Errorf("timeouts: got %v, want null", attrs["timeouts"])
+	}
+}
+
+func TestRemoteTunnelPlanWarnsAboutTunnels(t *testing.T) {
+	server, schemas := configureProvider(t, map[string]tftypes.Value{
+		"local_port_range_min": tftypes.NewValue(tftypes.Number, 16000),
+		"local_port_range_max": tftypes.NewValue(tftypes.Number, 16999),
+	})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	plan := func(remoteHost tftypes.Value) []*tfprotov6.Diagnostic {
+		config := objectValue(resourceType, map[string]tftypes.Value{
+			"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+			"remote_host": remoteHost,
+			"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+			"role_arn":    tftypes.NewValue(tftypes.String, "arn:aws:iam::123456789012:role/tunnels"),
+		})
+		resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+			TypeName:         "awsssmtunnels_remote_tunnel",
+			PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+			ProposedNewState: dynamicValue(t, resourceType, config),
+			Config:           dynamicValue(t, resourceType, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+			t.Fatalf("planning: %v", errs)
+		}
+		return resp.Diagnostics
+	}
+
+	diags := plan(tftypes.NewValue(tftypes.String, "db.example.internal"))
+	if len(diags) != 1 || diags[0].Severity != tfprotov6.DiagnosticSeverityWarning {
+		t.Fatalf("got %v, want one warning about the tunnel", diags)
+	}
+	if diags[0].Summary != "Apply opens a tunnel to db.example.internal:5432" {
+		t.Errorf("got summary %q", diags[0].Summary)
+	}
+	for _, want := range []string{
+		"Target: i-0123456789abcdef0 in us-east-1",
+		"Credentials: role arn:aws:iam::123456789012:role/tunnels",
+		"Local endpoint: 127.0.0.1, on a free port between 16000 and 16999",
+	} {
+		if !strings.Contains(diags[0].Detail, want) {
+			t.Errorf("got detail %q, want it to contain %q", diags[0].Detail, want)
+		}
+	}
+
+	// The destination may only be known after apply
+	diags = plan(tftypes.NewValue(tftypes.String, tftypes.UnknownValue))
+	if len(diags) != 1 || !strings.Contains(diags[0].Summary, "(known after apply):5432") {
+		t.Errorf("got %v, want a warning about a tunnel to a destination known after apply", diags)
+	}
+}
+
+func TestPlanWritesAccessMatrix(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.md")
+	if err := os.WriteFile(file, []byte("matrix of an earlier run"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server, schemas := configuredServer(t, map[string]tftypes.Value{
+		"access_matrix_file": tftypes.NewValue(tftypes.String, file),
+		"runner_id":          tftypes.NewValue(tftypes.String, "https://ci.example.com/jobs/42"),
+	})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+
+	matrix := func() string {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	if got := matrix(); strings.Contains(got, "earlier run") || !strings.Contains(got, "https://ci.example.com/jobs/42") {
+		t.Fatalf("got matrix %q after configuring, want an empty one of the runner", got)
+	}
+
+	plan := func(prior, config tftypes.Value) {
+		resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+			TypeName:         "awsssmtunnels_remote_tunnel",
+			PriorState:       dynamicValue(t, resourceType, prior),
+			ProposedNewState: dynamicValue(t, resourceType, config),
+			Config:           dynamicValue(t, resourceType, config),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Diagnostics) > 0 {
+			t.Fatalf("planning: %v", resp.Diagnostics)
+		}
+	}
+	null := tftypes.NewValue(resourceType, nil)
+	plan(null, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+		"role_arn":    tftypes.NewValue(tftypes.String, "arn:aws:iam::123456789012:role/tunnels"),
+	}))
+	plan(objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+		"remote_host": tftypes.NewValue(tftypes.String, "cache|old.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 6379),
+		"local_host":  tftypes.NewValue(tftypes.String, defaultLocalHost),
+		"local_port":  tftypes.NewValue(tftypes.Number, 16002),
+		"region":      tftypes.NewValue(tftypes.String, "eu-west-1"),
+	}), null)
+
+	got := matrix()
+	for _, want := range []string{
+		"| 127.0.0.1:16002 | i-0123456789abcdef0 in eu-west-1 | cache\\|old.example.internal:6379 | the provider credentials | awsssmtunnels_remote_tunnel | destroy |",
+		"| 127.0.0.1, on a free port between 16000 and 26000 | i-0123456789abcdef0 in us-east-1 | db.example.internal:5432 | role arn:aws:iam::123456789012:role/tunnels | awsssmtunnels_remote_tunnel | create |",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got matrix\n%s\nwant it to contain\n%s", got, want)
+		}
+	}
+	// Rows are sorted by destination
+	if strings.Index(got, "cache") > strings.Index(got, "db.example") {
+		t.Errorf("got matrix\n%s\nwant the rows sorted by destination", got)
+	}
+}
+
+// tunnelSetForwards builds the forward blocks of an awsssmtunnels_tunnel_set.
+func tunnelSetForwards(resourceType tftypes.Object, forwards ...map[string]tftypes.Value) tftypes.Value {
+	listType := resourceType.AttributeTypes["forward"].(tftypes.List)
+	elements := make([]tftypes.Value, len(forwards))
+	for i, forward := range forwards {
+		elements[i] = objectValue(listType.ElementType.(tftypes.Object), forward)
+	}
+	return tftypes.NewValue(listType, elements)
+}
+
+func TestTunnelSetId(t *testing.T) {
+	d := &TunnelSetResource{target: "i-0123456789abcdef0", region: "us-east-1"}
+	forward := func(remoteHost string, remotePort int64) TunnelSetForwardModel {
+		return TunnelSetForwardModel{RemoteHost: types.StringValue(remoteHost), RemotePort: types.Int64Value(remotePort)}
+	}
+	data := TunnelSetResourceModel{LocalHost: types.StringValue(defaultLocalHost)}
+	db, cache := forward("db.example.internal", 5432), forward("cache.example.internal", 6379)
+
+	id := d.tunnelSetId(data, []TunnelSetForwardModel{db, cache})
+	if other := d.tunnelSetId(data, []TunnelSetForwardModel{cache, db}); other != id {
+		t.Errorf("got id %s for the forwards in another order, want %s", other, id)
+	}
+	ids := map[string]string{id: "set"}
+	for name, other := range map[string]string{
+		"forwards": d.tunnelSetId(data, []TunnelSetForwardModel{db}),
+		"region":   d.tunnelSetId(TunnelSetResourceModel{LocalHost: data.LocalHost, Region: types.StringValue("eu-west-1")}, []TunnelSetForwardModel{db, cache}),
+		"role_arn": d.tunnelSetId(TunnelSetResourceModel{LocalHost: data.LocalHost, RoleArn: types.StringValue("arn:aws:iam::123456789012:role/tunnel")}, []TunnelSetForwardModel{db, cache}),
+		"tunnel":   tunnelIdentity{target: d.target, region: d.region, remoteHost: "db.example.internal", remotePort: 5432}.id(),
+	} {
+		if same, ok := ids[other]; ok {
+			t.Errorf("a set with other %s has the same id as the %s", name, same)
+		}
+		ids[other] = name
+	}
+}
+
+func TestTunnelSetPlanKeepsLocalPorts(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_tunnel_set"].ValueType().(tftypes.Object)
+
+	forward := func(host string, port int, localPort tftypes.Value) map[string]tftypes.Value {
+		return map[string]tftypes.Value{
+			"remote_host": tftypes.NewValue(tftypes.String, host),
+			"remote_port": tftypes.NewValue(tftypes.Number, port),
+			"local_port":  localPort,
+		}
+	}
+	null := tftypes.NewValue(tftypes.Number, nil)
+	state := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id": tftypes.NewValue(tftypes.String, "one"),
+		"local_host": tftypes.NewValue(tftypes.String, defaultLocalHost),
+		"id":         tftypes.NewValue(tftypes.String, "5f1c7d2e-3a4b-4c5d-8e9f-0a1b2c3d4e5f"),
+		"target":     tftypes.NewValue(tftypes.String, "i-0123456789abcdef0"),
+		"forward": tunnelSetForwards(resourceType,
+			forward("db.example.internal", 5432, tftypes.NewValue(tftypes.Number, 16001)),
+			forward("cache.example.internal", 6379, tftypes.NewValue(tftypes.Number, 16002)),
+		),
+		"endpoints": tftypes.NewValue(tftypes.Map{ElementType: tftypes.String}, map[string]tftypes.Value{
+			"db.example.internal:5432":    tftypes.NewValue(tftypes.String, "127.0.0.1:16001"),
+			"cache.example.internal:6379": tftypes.NewValue(tftypes.String, "127.0.0.1:16002"),
+		}),
+	})
+	// The cache moves to the front and an API is added
+	config := objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id": tftypes.NewValue(tftypes.String, "one"),
+		"forward": tunnelSetForwards(resourceType,
+			forward("cache.example.internal", 6379, null),
+			forward("db.example.internal", 5432, null),
+			forward("api.example.internal", 443, null),
+		),
+	})
+
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_tunnel_set",
+		PriorState:       dynamicValue(t, resourceType, state),
+		ProposedNewState: dynamicValue(t, resourceType, config),
+		Config:           dynamicValue(t, resourceType, config),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("planning: %v", errs)
+	}
+
+	planned, err := resp.PlannedState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrs map[string]tftypes.Value
+	if err := planned.As(&attrs); err != nil {
+		t.Fatal(err)
+	}
+	var forwards []tftypes.Value
+	if err := attrs["forward"].As(&forwards); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int64{16002, 16001} {
+		if got := attrInt64(t, forwards[i], "local_port"); got != want {
+			t.Errorf("forward %d has local port %d planned, want %d of the state", i, got, want)
+		}
+	}
+	var apiForward map[string]tftypes.Value
+	if err := forwards[2].As(&apiForward); err != nil {
+		t.Fatal(err)
+	}
+	if apiForward["local_port"].IsKnown() {
+		t.Errorf("the local port of the new forward is planned as %v, want it unknown", apiForward["local_port"])
+	}
+	if attrs["endpoints"].IsKnown() || attrString(t, planned, "id") != "5f1c7d2e-3a4b-4c5d-8e9f-0a1b2c3d4e5f" {
+		t.Errorf("got endpoints %v and id %v, want unknown endpoints and the id of the state", attrs["endpoints"], attrs["id"])
+	}
+}
+
+func TestTunnelSetPlanDuplicateForward(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_tunnel_set"].ValueType().(tftypes.Object)
+
+	forward := map[string]tftypes.Value{
+		"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+		"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+	}
+	config := dynamicValue(t, resourceType, objectValue(resourceType, map[string]tftypes.Value{
+		"refresh_id": tftypes.NewValue(tftypes.String, "one"),
+		"forward":    tunnelSetForwards(resourceType, forward, forward),
+	}))
+	resp, err := server.PlanResourceChange(context.Background(), &tfprotov6.PlanResourceChangeRequest{
+		TypeName:         "awsssmtunnels_tunnel_set",
+		PriorState:       dynamicValue(t, resourceType, tftypes.NewValue(resourceType, nil)),
+		ProposedNewState: config,
+		Config:           config,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := diagnosticErrors(resp.Diagnostics)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0], "Duplicate forward: db.example.internal:5432") {
+		t.Errorf("got %v, want the second forward rejected as duplicate", errs)
+	}
+}
+
+func TestTunnelSetUpgradeUnversionedState(t *testing.T) {
+	server, schemas := configuredServer(t, map[string]tftypes.Value{})
+	resourceType := schemas.ResourceSchemas["awsssmtunnels_tunnel_set"].ValueType().(tftypes.Object)
+
+	// A state written before the schema was versioned, without local_host
+	resp, err := server.UpgradeResourceState(context.Background(), &tfprotov6.UpgradeResourceStateRequest{
+		TypeName: "awsssmtunnels_tunnel_set",
+		Version:  0,
+		RawState: &tfprotov6.RawState{JSON: []byte(`{
+			"id": "2f1f6a0e-3c4d-4b5a-9e8f-7a6b5c4d3e2f",
+			"refresh_id": "one",
+			"forward": [{"remote_host": "db.example.internal", "remote_port": 5432, "local_port": 16000}],
+			"endpoints": {"db.example.internal:5432": "127.0.0.1:16000"}
+		}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+		t.Fatalf("upgrading: %v", errs)
+	}
+
+	state, err := resp.UpgradedState.Unmarshal(resourceType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := attrString(t, state, "id"); id != "2f1f6a0e-3c4d-4b5a-9e8f-7a6b5c4d3e2f" {
+		t.Errorf("id: got %q, want it kept", id)
+	}
+	if localHost := attrString(t, state, "local_host"); localHost != defaultLocalHost {
+		t.Errorf("local_host: got %q, want the default %q", localHost, defaultLocalHost)
+	}
+}
+
+func TestProviderFIPSRefusesFallbacks(t *testing.T) {
+	ctx := context.Background()
+	server, err := providerserver.NewProtocol6WithError(New("test")())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := server.GetProviderSchema(ctx, &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerType := schemas.Provider.ValueType().(tftypes.Object)
+	resp, err := server.ConfigureProvider(ctx, &tfprotov6.ConfigureProviderRequest{
+		Config: dynamicValue(t, providerType, objectValue(providerType, map[string]tftypes.Value{
+			"target":               tftypes.NewValue(tftypes.String, "i-0123456789abcdef0"),
+			"region":               tftypes.NewValue(tftypes.String, "us-east-1"),
+			"fips":                 tftypes.NewValue(tftypes.Bool, true),
+			"insecure":             tftypes.NewValue(tftypes.Bool, true),
+			"ssmmessages_endpoint": tftypes.NewValue(tftypes.String, "ssmmessages.us-east-1.api.aws"),
+		})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Conflicting TLS settings", "Invalid ssmmessages_endpoint"}
+	if !ssmtunnels.FIPSCrypto() {
+		// Tests are built with the standard Go cryptography unless GOEXPERIMENT=boringcrypto is set
+		want = append([]string{"FIPS mode unavailable"}, want...)
+	}
+	errs := diagnosticErrors(resp.Diagnostics)
+	if len(errs) != len(want) {
+		t.Fatalf("got %v, want errors %v", errs, want)
+	}
+	for i, summary := range want {
+		if !strings.HasPrefix(errs[i], summary+":") {
+			t.Errorf("got %q, want %q", errs[i], summary)
+		}
+	}
+}
+
+func TestKeepaliveDefaults(t *testing.T) {
+	for name, tt := range map[string]struct {
+		config  map[string]tftypes.Value
+		wantMin int64
+		wantMax int64
+	}{
+		"defaults": {config: map[string]tftypes.Value{}, wantMin: defaultLocalPortRangeMin, wantMax: defaultLocalPortRangeMax},
+		"range": {
+			config: map[string]tftypes.Value{
+				"local_port_range_min": tftypes.NewValue(tftypes.Number, 40000),
+				"local_port_range_max": tftypes.NewValue(tftypes.Number, 40100),
+			},
+			wantMin: 40000,
+			wantMax: 40100,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, schemas := configuredServer(t, tt.config)
+			dataSourceType := schemas.DataSourceSchemas["awsssmtunnels_keepalive"].ValueType().(tftypes.Object)
+			resp, err := server.ReadDataSource(context.Background(), &tfprotov6.ReadDataSourceRequest{
+				TypeName: "awsssmtunnels_keepalive",
+				Config:   dynamicValue(t, dataSourceType, objectValue(dataSourceType, map[string]tftypes.Value{})),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if errs := diagnosticErrors(resp.Diagnostics); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			keepalive, err := resp.State.Unmarshal(dataSourceType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := attrInt64(t, keepalive, "local_port_range_min"); got != tt.wantMin {
+				t.Errorf("got local_port_range_min %d, want %d", got, tt.wantMin)
+			}
+			if got := attrInt64(t, keepalive, "local_port_range_max"); got != tt.wantMax {
+				t.Errorf("got local_port_range_max %d, want %d", got, tt.wantMax)
+			}
+			var attrs map[string]tftypes.Value
+			if err := keepalive.As(&attrs); err != nil {
+				t.Fatal(err)
+			}
+			if want := tftypes.NewValue(tftypes.Bool, false); !attrs["record_stats_in_state"].Equal(want) {
+				t.Errorf("got record_stats_in_state %v, want false", attrs["record_stats_in_state"])
+			}
+		})
+	}
+}
+
+func TestMockValidatesConfig(t *testing.T) {
+	ctx := context.Background()
+	server, err := providerserver.NewProtocol6WithError(New("test")())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := server.GetProviderSchema(ctx, &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerType := schemas.Provider.ValueType().(tftypes.Object)
+
+	for _, flag := range []string{"mock", "disable_tunnels"} {
+		for name, value := range map[string]tftypes.Value{
+			"max_retries": tftypes.NewValue(tftypes.Number, -1),
+			"retry_mode":  tftypes.NewValue(tftypes.String, "sometimes"),
+			"ca_bundle":   tftypes.NewValue(tftypes.String, filepath.Join(t.TempDir(), "missing.pem")),
+		} {
+			resp, err := server.ConfigureProvider(ctx, &tfprotov6.ConfigureProviderRequest{
+				Config: dynamicValue(t, providerType, objectValue(providerType, map[string]tftypes.Value{
+					"target": tftypes.NewValue(tftypes.String, "i-0123456789abcdef0"),
+					"region": tftypes.NewValue(tftypes.String, "us-east-1"),
+					flag:     tftypes.NewValue(tftypes.Bool, true),
+					name:     value,
+				})),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if errs := diagnosticErrors(resp.Diagnostics); len(errs) != 1 || !strings.HasPrefix(errs[0], "Invalid "+name+":") {
+				t.Errorf("got %v with %s, want %s to be invalid", errs, flag, name)
+			}
+		}
+	}
+}
+
+func TestLogRedactionPatternsUnregistered(t *testing.T) {
+	ctx := context.Background()
+	server, err := providerserver.NewProtocol6WithError(New("test")())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := server.GetProviderSchema(ctx, &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerType := schemas.Provider.ValueType().(tftypes.Object)
+	patterns := tftypes.NewValue(tftypes.List{ElementType: tftypes.String}, []tftypes.Value{
+		tftypes.NewValue(tftypes.String, `db\.corp\.example`),
+	})
+	registered := func() int {
+		redactorsMu.RLock()
+		defer redactorsMu.RUnlock()
+		return len(redactors)
+	}
+	before := registered()
+
+	// A rejected configuration leaves no tracker to unregister the patterns
+	resp, err := server.ConfigureProvider(ctx, &tfprotov6.ConfigureProviderRequest{
+		Config: dynamicValue(t, providerType, objectValue(providerType, map[string]tftypes.Value{
+			"target":                 tftypes.NewValue(tftypes.String, "i-0123456789abcdef0"),
+			"region":                 tftypes.NewValue(tftypes.String, "us-east-1"),
+			"mock":                   tftypes.NewValue(tftypes.Bool, true),
+			"retry_mode":             tftypes.NewValue(tftypes.String, "sometimes"),
+			"log_redaction_patterns": patterns,
+		})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := diagnosticErrors(resp.Diagnostics); len(errs) != 1 {
+		t.Fatalf("got %v, want retry_mode to be invalid", errs)
+	}
+	if got := registered(); got != before {
+		t.Errorf("got %d registered redactors after a rejected configuration, want %d", got, before)
+	}
+
+	// Offline, the patterns apply until the tunnels of the instance are closed
+	configureProvider(t, map[string]tftypes.Value{
+		"mock":                   tftypes.NewValue(tftypes.Bool, true),
+		"log_redaction_patterns": patterns,
+	})
+	if got := registered(); got != before+1 {
+		t.Errorf("got %d registered redactors, want %d", got, before+1)
+	}
+	trackersMu.Lock()
+	tracker := trackers[len(trackers)-1]
+	trackersMu.Unlock()
+	if err := tracker.CloseAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := registered(); got != before {
+		t.Errorf("got %d registered redactors once the tunnels are closed, want %d", got, before)
+	}
+}
+
+func TestPlaceholderPort(t *testing.T) {
+	// Stable across runs, within the range, also for a range of one port
+	if a, b := placeholderPort("db.example.internal", 5432, 20000, 30000), placeholderPort("db.example.internal", 5432, 20000, 30000); a != b {
+		t.Errorf("got ports %d and %d for the same endpoint, want the same", a, b)
+	}
+	for _, remotePort := range []int{22, 443, 5432, 6379} {
+		if port := placeholderPort("db.example.internal", remotePort, 20000, 20009); port < 20000 || port > 20009 {
+			t.Errorf("got port %d for %d, want one in 20000-20009", port, remotePort)
+		}
+	}
+	if port := placeholderPort("db.example.internal", 5432, 20000, 20000); port != 20000 {
+		t.Errorf("got port %d, want the only port of the range", port)
+	}
+	if placeholderPort("db.example.internal", 5432, 20000, 30000) == placeholderPort("cache.example.internal", 6379, 20000, 30000) {
+		t.Error("got the same port for different endpoints")
+	}
+
+	// Tunnels of disable_tunnels get it, the same in every run
+	var ports []int64
+	for run := 0; run < 2; run++ {
+		server, schemas := configureProvider(t, map[string]tftypes.Value{
+			"disable_tunnels": tftypes.NewValue(tftypes.Bool, true),
+		})
+		resourceType := schemas.ResourceSchemas["awsssmtunnels_remote_tunnel"].ValueType().(tftypes.Object)
+		state := testAccApply(t, server, schemas, "awsssmtunnels_remote_tunnel", tftypes.NewValue(resourceType, nil), objectValue(resourceType, map[string]tftypes.Value{
+			"refresh_id":  tftypes.NewValue(tftypes.String, "one"),
+			"remote_host": tftypes.NewValue(tftypes.String, "db.example.internal"),
+			"remote_port": tftypes.NewValue(tftypes.Number, 5432),
+		}))
+		var port big.Float
+		if err := state["local_port"].As(&port); err != nil {
+			t.Fatal(err)
+		}
+		n, _ := port.Int64()
+		ports = append(ports, n)
+	}
+	want := int64(placeholderPort("db.example.internal", 5432, defaultLocalPortRangeMin, defaultLocalPortRangeMax))
+	if ports[0] != want || ports[1] != want {
+		t.Errorf("got local ports %v, want %d in every run", ports, want)
+	}
+}
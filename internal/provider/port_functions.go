@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/hashicorp/terraform-plugin-framework/function"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ function.Function = &PortFromKeyFunction{}
+
+func NewPortFromKeyFunction() function.Function {
+	return &PortFromKeyFunction{}
+}
+
+// PortFromKeyFunction derives a local port in a range from a key. Terraform
+// requires functions to return the same result while planning and applying, so
+// the port is derived like the one of stable_local_port instead of probing for
+// a free port, which would differ between the two.
+type PortFromKeyFunction struct{}
+
+func (f *PortFromKeyFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "port_from_key"
+}
+
+func (f *PortFromKeyFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+	resp.Definition = function.Definition{
+		Summary: "Derive a local port in a range from a key",
+		MarkdownDescription: "Returns a port in the range, inclusive, derived from the key like the port of `stable_local_port`, " +
+			"so it is the same in every plan and apply and on every machine. Whether something listens on the port isn't " +
+			"checked, as that would change the result between plan and apply. Pick a range outside the provider's " +
+			"`local_port_range_min` to `local_port_range_max` and distinct keys, ports of different keys may still collide in small ranges.",
+		Parameters: []function.Parameter{
+			function.StringParameter{
+				Name:                "key",
+				MarkdownDescription: "What the port is for, e.g. the name of the service",
+			},
+			function.Int64Parameter{
+				Name:                "range_start",
+				MarkdownDescription: "Lowest port to pick",
+			},
+			function.Int64Parameter{
+				Name:                "range_end",
+				MarkdownDescription: "Highest port to pick",
+			},
+		},
+		Return: function.Int64Return{},
+	}
+}
+
+func (f *PortFromKeyFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var key string
+	var rangeStart, rangeEnd int64
+
+	resp.Error = function.ConcatFuncErrors(req.Arguments.Get(ctx, &key, &rangeStart, &rangeEnd))
+	if resp.Error != nil {
+		return
+	}
+
+	if rangeStart < 1 || rangeStart > 65535 {
+		resp.Error = function.NewArgumentFuncError(1, fmt.Sprintf("Port %d must be within 1-65535", rangeStart))
+		return
+	}
+	if rangeEnd < rangeStart || rangeEnd > 65535 {
+		resp.Error = function.NewArgumentFuncError(2, fmt.Sprintf("Port %d must be within %d-65535", rangeEnd, rangeStart))
+		return
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Result.Set(ctx, int64(portFromKey(key, int(rangeStart), int(rangeEnd)))))
+}
+
+// portFromKey hashes the key into the range of ports, inclusive.
+func portFromKey(key string, rangeMin int, rangeMax int) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return rangeMin + int(hash.Sum32()%uint32(rangeMax-rangeMin+1))
+}
@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// preflightKey identifies a target checked by preflight, along with the
+// region, credentials and session document sessions are started on it with.
+type preflightKey struct {
+	target       string
+	region       string
+	roleArn      string
+	profile      string
+	documentName string
+}
+
+// preflightCheck is the check of one target, which passes or fails once per
+// run. A check given up on, e.g. for the timeouts of a resource, runs again.
+type preflightCheck struct {
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+// preflightKeys returns the targets sessions of the spec may be started on.
+func preflightKeys(spec TunnelSpec) []preflightKey {
+	targets := spec.Targets
+	if spec.Target != "" {
+		targets = []string{spec.Target}
+	}
+	keys := make([]preflightKey, 0, len(targets))
+	for _, target := range targets {
+		keys = append(keys, preflightKey{
+			target:       target,
+			region:       spec.Region,
+			roleArn:      spec.RoleArn,
+			profile:      spec.Profile,
+			documentName: spec.DocumentName,
+		})
+	}
+	return keys
+}
+
+// preflight checks that sessions can be started on the targets of the
+// PreflightSpecs and of the spec, see ssmtunnels.PreflightCheck. StartTunnel
+// calls it before starting a session, so the first tunnel of a run checks the
+// tunnels of the provider too, whether it is started by a refresh, the tunnel
+// data source, the ephemeral resource or a resource. Each target is checked
+// once per run, and not at all once a tunnel started a session on it.
+func (t *TunnelTracker) preflight(ctx context.Context, spec TunnelSpec) error {
+	if !t.PreflightChecks || t.Offline() {
+		return nil
+	}
+	for _, provided := range append(t.PreflightSpecs, spec) {
+		for _, key := range preflightKeys(provided) {
+			if err := t.preflightCheck(key).run(ctx, t, key, provided); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// preflightPassed records that a session was started for the spec, which
+// makes checking its target pointless.
+func (t *TunnelTracker) preflightPassed(spec TunnelSpec) {
+	for _, key := range preflightKeys(spec) {
+		check := t.preflightCheck(key)
+		check.mu.Lock()
+		check.done = true
+		check.mu.Unlock()
+	}
+}
+
+func (t *TunnelTracker) preflightCheck(key preflightKey) *preflightCheck {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	check, ok := t.preflights[key]
+	if !ok {
+		if t.preflights == nil {
+			t.preflights = map[preflightKey]*preflightCheck{}
+		}
+		check = &preflightCheck{}
+		t.preflights[key] = check
+	}
+	return check
+}
+
+func (c *preflightCheck) run(ctx context.Context, t *TunnelTracker, key preflightKey, spec TunnelSpec) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return c.err
+	}
+	svc, _, err := t.clientsFor(ctx, key.region, key.roleArn, key.profile)
+	if err == nil {
+		err = ssmtunnels.PreflightCheck(ctx, ssmtunnels.PreflightConfig{
+			Client:       svc,
+			Target:       key.target,
+			DocumentName: key.documentName,
+			RemoteHost:   spec.RemoteHost,
+			RemotePort:   spec.RemotePort,
+			ReasonPrefix: t.SessionReasonPrefix,
+			Runner:       t.Runner,
+		})
+	}
+	if err != nil {
+		err = fmt.Errorf("preflight check of %s failed: %w", key.target, err)
+		// The caller gave up, the next one checks again
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	c.done = true
+	c.err = err
+	return err
+}
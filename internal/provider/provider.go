@@ -5,91 +5,1217 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/audit"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/pac"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ports"
 	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
 	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
-type TunnelInfo struct {
-	IsRunning   bool
-	LocalPort   int
-	ReadySignal chan bool // Used to signal when the tunnel is ready
+type OtherTunnelInfo struct {
+	LocalPort int
+	LocalHost string
+
+	forwarder *ssmtunnels.Forwarder
+	// tunnelSession is the session the forwarder relays to, which may be shared
+	// with tunnels forwarding differently, see startSharedListener. Nil for
+	// tunnels which are only simulated.
+	*tunnelSession
+
+	// spec is the tunnel as started, see LiveTunnel and TunnelStats
+	spec      TunnelSpec
+	startedAt time.Time
+	// platform is the platform of the target, empty if it couldn't be detected, see targetPlatform
+	platform string
+	// users are the IDs the tunnel is shared by, guarded by the mutex of the
+	// tracker, see AcquireTunnel and CloseTunnels
+	users []string
 }
 
-type OtherTunnelInfo struct {
-	LocalPort   int
-	LocalHost   string
-	ReadySignal chan bool // Used to signal when the tunnel is ready
+// Target returns the target serving the tunnel.
+func (i *OtherTunnelInfo) Target() string {
+	return i.spec.Target
+}
+
+// Platform returns the platform of the target serving the tunnel, e.g. Linux,
+// or an empty string if it is unknown.
+func (i *OtherTunnelInfo) Platform() string {
+	return i.platform
 }
 
+// Stats returns a snapshot of the connections going through the tunnel.
+func (i *OtherTunnelInfo) Stats() ssmtunnels.ForwarderStats {
+	if i.forwarder == nil {
+		return ssmtunnels.ForwarderStats{}
+	}
+	return i.forwarder.Stats()
+}
+
+// Close terminates the SSM session, unless other tunnels still use it, and
+// frees the local port.
+func (i *OtherTunnelInfo) Close(ctx context.Context) error {
+	// Tunnels of a mock provider have nothing to close
+	if i.forwarder == nil {
+		return nil
+	}
+	session := i.shutdown()
+	i.forwarder.Close()
+	if session == nil {
+		return nil
+	}
+	return session.Close(ctx)
+}
+
+// currentSession returns the session of the tunnel, nil while a lazy tunnel
+// wasn't connected to yet.
+func (i *OtherTunnelInfo) currentSession() *ssmtunnels.Session {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.session
+}
+
+// shutdown stops the tunnel from using its session. Once no tunnel uses the
+// session anymore, it keeps lazy tunnels from starting sessions and returns the
+// current session, if any, for the caller to close. While other tunnels still
+// use it, it returns nil.
+func (i *OtherTunnelInfo) shutdown() *ssmtunnels.Session {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.listeners = slices.DeleteFunc(i.listeners, func(l *OtherTunnelInfo) bool { return l == i })
+	if len(i.listeners) > 0 {
+		return nil
+	}
+	i.closed = true
+	return i.session
+}
+
+// sourceIdentityPattern is what STS accepts as source identity.
+var sourceIdentityPattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// externalIdPattern is what STS accepts as external ID, which is also 2 to 1224 characters long.
+var externalIdPattern = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+
+// defaultMaxConcurrentStarts keeps parallel StartSession calls below the rate at which they are throttled.
+const defaultMaxConcurrentStarts = 5
+
 type TunnelTracker struct {
-	mu      sync.Mutex
-	Tunnels map[string]*TunnelInfo
-	Svc     *ssm.Client
+	mu  sync.Mutex
+	Svc *ssm.Client
+	EC2 *ec2.Client
+
+	// AWSConfig is the base configuration for clients of other regions and roles, see clientsFor
+	AWSConfig   aws.Config
+	clients     map[clientKey]*awsClients
+	credentials map[credentialsKey]aws.CredentialsProvider
+
+	// Proxy is used for the data channel of every session
+	Proxy ssmtunnels.ProxyConfig
+	// TLS is used for the data channel of every session
+	TLS ssmtunnels.TLSConfig
+	// MessagesEndpoint overrides the data channel host of every session
+	MessagesEndpoint string
+	// SessionReasonPrefix is set on every session, so they can be told apart from interactive ones
+	SessionReasonPrefix string
+	// Runner identifies the machine or CI job running Terraform in the reason of every session, see defaultRunnerID
+	Runner string
+	// SharedConfigFiles are read for the profile of a tunnel instead of the default files
+	SharedConfigFiles []string
+	// SourceIdentity is set when assuming the role_arn of a tunnel, so CloudTrail records who started it
+	SourceIdentity string
+	// RoleExternalId is set when assuming the role_arn of a tunnel, for roles of third parties requiring one
+	RoleExternalId string
+	// AttachOperatorSessions reuses port forwarding sessions of the operator, see OperatorTunnel
+	AttachOperatorSessions bool
+	// STSRegion is the region of the STS endpoint used to assume roles, instead of the region of the tunnel
+	STSRegion string
+	// WaitForTarget is how long sessions are started again while their target isn't connected to
+	// Session Manager, see startRemoteTunnel. Zero fails right away.
+	WaitForTarget time.Duration
+	// PreflightChecks enables preflight, which checks the targets of the PreflightSpecs,
+	// the tunnels of the provider, along with the target of the first tunnel started
+	PreflightChecks bool
+	PreflightSpecs  []TunnelSpec
+	preflights      map[preflightKey]*preflightCheck
+
+	// started holds every tunnel opened by this tracker, so they can be closed together
+	started []*OtherTunnelInfo
+	// pending are the tunnels being started after AcquireTunnel found none to share
+	pending []*pendingTunnel
+	// startingSessions are the sessions being started after startSharedListener found none to share
+	startingSessions []*pendingTunnel
+	// closed is set by CloseAll, tunnels becoming ready afterwards are closed right away
+	closed bool
+	// reservedPorts are local ports picked for tunnels which aren't listening yet, held by a
+	// listener until the forwarder of the tunnel adopts it, see findOpenPort
+	reservedPorts map[int]net.Listener
+	// startingOn counts the tunnels being started per target, see pickTarget
+	startingOn map[string]int
+	// stoppedErrs holds why tunnels were closed by the provider while in use
+	stoppedErrs []error
+	// scheduler shares the network fairly between the tunnels
+	scheduler *ssmtunnels.FairScheduler
+	// networkStop ends watching the network interfaces once the tracker is closed, see watchNetwork
+	networkOnce sync.Once
+	networkStop chan struct{}
+
+	// MaxConcurrentTunnels caps how many tunnels are open at once, further
+	// tunnels wait for one to close. Zero means no limit.
+	MaxConcurrentTunnels int
+	slots                chan struct{}
+
+	// MaxConcurrentStarts caps the sessions being started at once, so many
+	// tunnels created in parallel don't trip the throttling of StartSession.
+	// Zero means no limit.
+	MaxConcurrentStarts int
+	startSlots          chan struct{}
+
+	// OnConnectionClosed is called for every connection forwarded through any tunnel
+	OnConnectionClosed func(ssmtunnels.ConnectionRecord)
+
+	// AuditLogger receives the connection records when audit_log_group is set,
+	// CloseAll sends the records it still queues
+	AuditLogger *audit.CloudWatchLogger
+
+	// Redactor holds the log_redaction_patterns, it is unregistered by CloseAll
+	Redactor *redactor
+
+	// Resolver resolves remote hosts before the session is started, instead of the target
+	Resolver *ssmtunnels.Resolver
+
+	// Mock makes StartTunnel return the local endpoint without calling AWS or listening on it,
+	// for both mock and disable_tunnels
+	Mock bool
+	// PlaceholderPorts picks the local port of tunnels without local_port from their remote
+	// endpoint instead of a free one, see placeholderPort. Only disable_tunnels sets it.
+	PlaceholderPorts bool
 }
 
 func NewTunnelTracker(svc *ssm.Client) *TunnelTracker {
 	return &TunnelTracker{
-		Tunnels: make(map[string]*TunnelInfo),
-		Svc:     svc,
+		Svc:       svc,
+		scheduler: ssmtunnels.NewFairScheduler(),
 	}
 }
 
-// Ignore the tracker for now
-func (t *TunnelTracker) StartTunnel(ctx context.Context, id string, target string, remoteHost string, remotePort int, localPort int, region string) (*OtherTunnelInfo, error) {
+// TunnelSpec describes the tunnel to start.
+type TunnelSpec struct {
+	Id     string
+	Target string
+	// Targets are equivalent targets, the tunnel is started on the least busy one
+	// of them when Target is empty, see pickTarget
+	Targets    []string
+	Region     string
+	RemoteHost string
+	RemotePort int
+	LocalHost  string
+	LocalPort  int
+	Rewrites   []ssmtunnels.RewriteRule
+
+	// RoleArn is assumed to start the session, instead of using the provider credentials
+	RoleArn string
+	// Profile is the shared config profile whose credentials start the session, instead of the provider credentials
+	Profile string
+	// WaitForVPCEndpoints are VPC endpoint IDs that must be available before the session is started
+	WaitForVPCEndpoints []string
+	// WaitForTargetOnline waits for the SSM agent of the target to be online before the session is started
+	WaitForTargetOnline bool
+	// MaxTransferBytes closes the tunnel once this many bytes were forwarded, zero means no limit
+	MaxTransferBytes int64
+	// MaxConnections queues local connections beyond this many, zero means no limit
+	MaxConnections int
+	// MaxQueuedConnections closes local connections while this many are queued, zero means no limit
+	MaxQueuedConnections int
+	// BandwidthWeight is the share of the network the tunnel gets relative to the others while it is saturated, see ssmtunnels.FairScheduler
+	BandwidthWeight int
+	// ProbeCommand is run on the target until it succeeds before the tunnel is started, see ssmtunnels.WaitForProbe
+	ProbeCommand string
+	ProbeTimeout time.Duration
+	// Probe is checked through the tunnel once it is up, before the tunnel is handed out
+	Probe *TunnelProbe
+	// Lazy listens on the local port right away but only starts the session on the first connection
+	Lazy bool
+	// CloseAfterIdle terminates the session once no local connection was open for this long, keeping the
+	// local port, and the next connection starts a new session, see closeWhenIdle. Zero keeps the session.
+	CloseAfterIdle time.Duration
+	// RequirePlatform fails the tunnel before its session is started unless the target runs this
+	// platform, one of ssmtunnels.Platforms. Empty accepts any platform.
+	RequirePlatform string
+	// DocumentName is the session document the session is started with, e.g. of a
+	// SessionDocumentResource. Empty uses AWS-StartPortForwardingSessionToRemoteHost.
+	DocumentName string
+}
+
+// probeTypeGRPC checks a tunnel with the standard gRPC health checking protocol.
+const probeTypeGRPC = "grpc"
+
+// TunnelProbe describes the readiness check done through a tunnel.
+type TunnelProbe struct {
+	Type    string
+	Service string
+	TLS     bool
+	// CABundle is trusted with TLS in addition to the system's certificates
+	CABundle string
+	Timeout  time.Duration
+}
+
+// errTrackerClosed is returned by StartTunnel once the provider is shutting down.
+var errTrackerClosed = errors.New("the provider is shutting down")
+
+// Offline reports whether tunnels are only simulated, see Mock.
+func (t *TunnelTracker) Offline() bool {
+	return t.Mock
+}
+
+func (t *TunnelTracker) StartTunnel(ctx context.Context, spec TunnelSpec) (*OtherTunnelInfo, error) {
+	if spec.LocalHost == "" {
+		spec.LocalHost = defaultLocalHost
+	}
+	// Once this returns the port is either listened on or free to pick again
+	defer t.releasePort(spec.LocalPort)
+	if !t.Offline() {
+		tunnel, done, err := t.startSharedListener(ctx, spec)
+		if tunnel != nil || err != nil {
+			return tunnel, err
+		}
+		defer done()
+	}
+	if spec.Target == "" && len(spec.Targets) > 0 {
+		var done func()
+		spec.Target, done = t.pickTarget(spec.Targets)
+		defer done()
+	}
+	if t.Offline() {
+		return &OtherTunnelInfo{LocalPort: spec.LocalPort, LocalHost: spec.LocalHost, spec: spec}, nil
+	}
+	// The local host is kept as configured for the state, only the listener needs it normalized
+	localHost, err := ssmtunnels.NormalizeHost(spec.LocalHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local host: %w", err)
+	}
+	remoteHost, err := ssmtunnels.NormalizeHost(spec.RemoteHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote host: %w", err)
+	}
+	spec.RemoteHost = remoteHost
+	sessionHost := remoteHost
+	if t.Resolver != nil {
+		if sessionHost, err = t.Resolver.Resolve(ctx, remoteHost); err != nil {
+			return nil, err
+		}
+	}
+	if spec.Region == "" {
+		return nil, fmt.Errorf("no region configured, set region on the provider or the resource, or set AWS_REGION")
+	}
+	if err := t.preflight(ctx, spec); err != nil {
+		return nil, err
+	}
+	svc, ec2Client, err := t.clientsFor(ctx, spec.Region, spec.RoleArn, spec.Profile)
+	if err != nil {
+		return nil, err
+	}
+	// Instances which just booted aren't registered yet, so their platform is only known once they are online
+	if spec.WaitForTargetOnline {
+		if err := ssmtunnels.WaitForTargetOnline(ctx, svc, spec.Target); err != nil {
+			return nil, err
+		}
+	}
+	platform, err := t.targetPlatform(ctx, spec, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	t.networkOnce.Do(t.watchNetwork)
+
+	if spec.Lazy {
+		return t.startLazyTunnel(spec, platform, localHost, sessionHost, svc, ec2Client)
+	}
+
+	release, err := t.prepareSession(ctx, spec, svc, ec2Client)
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			release()
+		}
+	}()
+
+	// The session manager plugin listens on an internal port, the user facing
+	// port is served by a forwarder so that we can observe the connections
+	sessionPort, err := ports.FindEphemeralPort()
+	if err != nil {
+		return nil, err
+	}
 	tunnel := &OtherTunnelInfo{
-		LocalPort: localPort,
-		LocalHost: "127.0.0.1",
+		LocalPort: spec.LocalPort,
+		LocalHost: spec.LocalHost,
+
+		tunnelSession: &tunnelSession{port: sessionPort},
+		spec:          spec,
+		users:         []string{spec.Id},
+		platform:      platform,
+	}
+	tunnel.listeners = []*OtherTunnelInfo{tunnel}
+
+	cfg := t.forwarderConfig(spec, localHost, sessionPort)
+	firstSession := make(chan struct{})
+	tunnel.reconnect = func() error {
+		return t.connectLazy(tunnel, svc, ec2Client, sessionHost, sessionPort)
+	}
+	// Connections arriving before the first session is up wait for it instead of
+	// being dropped, e.g. of providers destroying resources while the tunnels of
+	// the provider are started at the beginning of a destroy
+	cfg.Connect = func() error {
+		<-firstSession
+		if tunnel.sessionEnded() {
+			// Wait for the new session keepSession starts, rather than relaying into the dead one
+			return tunnel.reconnect()
+		}
+		return nil
+	}
+	if spec.CloseAfterIdle > 0 {
+		// Connections after the session was closed for being idle start a new one, like for lazy tunnels
+		cfg.Connect = func() error {
+			<-firstSession
+			return tunnel.reconnect()
+		}
+	}
+	forwarder, err := ssmtunnels.StartForwarder(cfg)
+	if err != nil {
+		return nil, err
 	}
+	tunnel.forwarder = forwarder
 
-	errChan := make(chan error, 1)
-	// Start the tunnel in a separate goroutine
+	session, err := t.startSession(ctx, spec, svc, sessionHost, sessionPort)
+	if err != nil {
+		tunnel.shutdown()
+		close(firstSession)
+		forwarder.Close()
+		return nil, err
+	}
+	tunnel.mu.Lock()
+	tunnel.session = session
+	tunnel.mu.Unlock()
+	close(firstSession)
+
+	if spec.Probe != nil {
+		if err := t.probeTunnel(ctx, spec, net.JoinHostPort(localHost, strconv.Itoa(spec.LocalPort))); err != nil {
+			forwarder.Close()
+			if closeErr := session.Close(context.Background()); closeErr != nil {
+				log.Printf("Error closing session %s: %v", session.Id, closeErr)
+			}
+			return nil, err
+		}
+	}
+	t.mu.Lock()
+	if t.closed {
+		// CloseAll already ran and won't see this tunnel
+		t.mu.Unlock()
+		forwarder.Close()
+		if err := session.Close(context.Background()); err != nil {
+			log.Printf("Error closing session %s: %v", session.Id, err)
+		}
+		return nil, errTrackerClosed
+	}
+	tunnel.startedAt = time.Now()
+	t.started = append(t.started, tunnel)
+	t.mu.Unlock()
+	started = true
 	go func() {
-		// Attempt to start the tunnel
-		err := ssmtunnels.StartRemoteTunnel(context.Background(), ssmtunnels.RemoteTunnelConfig{
-			Client:     t.Svc,
-			Target:     target,
-			Region:     region,
-			RemoteHost: remoteHost,
-			RemotePort: remotePort,
-			LocalPort:  localPort,
-		})
-		errChan <- err
+		<-session.Done()
+		release()
 	}()
+	go t.watchForwarder(tunnel, session)
+	go t.keepSession(tunnel, session)
+	if spec.CloseAfterIdle > 0 {
+		go t.closeWhenIdle(tunnel)
+	}
+	return tunnel, nil
+}
 
-	// Wait for either an error to happen, or assume "up" after 10 seconds
-	select {
-	case err := <-errChan:
+// targetPlatform detects the platform of the target of the spec and checks it,
+// see checkPlatform. Tunnels which don't require a platform still start if it
+// can't be detected, e.g. without permission to ssm:DescribeInstanceInformation.
+func (t *TunnelTracker) targetPlatform(ctx context.Context, spec TunnelSpec, svc *ssm.Client) (string, error) {
+	platform, err := ssmtunnels.TargetPlatform(ctx, svc, spec.Target)
+	if err != nil {
+		if spec.RequirePlatform != "" {
+			return "", fmt.Errorf("detecting the platform of %s: %w", spec.Target, err)
+		}
+		log.Printf("Could not detect the platform of %s: %v", spec.Target, err)
+		return "", nil
+	}
+	return platform, checkPlatform(spec, platform)
+}
+
+// checkPlatform checks that the tunnel of the spec can run on the platform of
+// its target, an empty platform being unknown.
+func checkPlatform(spec TunnelSpec, platform string) error {
+	if spec.RequirePlatform != "" && platform != spec.RequirePlatform {
+		return &ssmtunnels.PlatformMismatchError{Target: spec.Target, Platform: platform, Required: spec.RequirePlatform}
+	}
+	// The probe command is run with AWS-RunShellScript, which Windows doesn't have
+	if spec.ProbeCommand != "" && platform == ssmtunnels.PlatformWindows {
+		return &ssmtunnels.PlatformMismatchError{Target: spec.Target, Platform: platform, Required: "Linux or MacOS to run probe_command"}
+	}
+	return nil
+}
+
+// sessionReadyTimeout bounds waiting for the plugin to open the data channel
+// of a session and listen on its port, see ssmtunnels.Session.Ready.
+const sessionReadyTimeout = 2 * time.Minute
+
+// prepareSession waits for a free tunnel slot, the VPC endpoints and the
+// probe command of the spec. The returned function frees the slot again.
+func (t *TunnelTracker) prepareSession(ctx context.Context, spec TunnelSpec, svc *ssm.Client, ec2Client *ec2.Client) (func(), error) {
+	release, err := t.acquireSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ssmtunnels.WaitForVPCEndpoints(ctx, ec2Client, spec.WaitForVPCEndpoints); err != nil {
+		release()
+		return nil, err
+	}
+	if spec.ProbeCommand != "" {
+		probeCtx, cancel := context.WithTimeout(ctx, spec.ProbeTimeout)
+		err := ssmtunnels.WaitForProbe(probeCtx, svc, spec.Target, spec.ProbeCommand)
+		cancel()
 		if err != nil {
-			// Failed to start the tunnel, handle the error
-			log.Printf("Error starting tunnel: %v", err)
-			close(errChan) // Ensure we signal that the attempt has concluded, even in failure
+			release()
 			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// forwarderConfig describes the forwarder of a tunnel relaying the local port
+// to the plugin listening on sessionPort.
+func (t *TunnelTracker) forwarderConfig(spec TunnelSpec, localHost string, sessionPort int) ssmtunnels.ForwarderConfig {
+	listenAddr := net.JoinHostPort(localHost, strconv.Itoa(spec.LocalPort))
+	cfg := ssmtunnels.ForwarderConfig{
+		ListenAddr:           listenAddr,
+		Listener:             t.takeReservation(spec.LocalPort, listenAddr),
+		UpstreamAddr:         net.JoinHostPort("127.0.0.1", strconv.Itoa(sessionPort)),
+		Target:               spec.Target,
+		RemoteHost:           spec.RemoteHost,
+		RemotePort:           spec.RemotePort,
+		Rewrites:             spec.Rewrites,
+		MaxTransferBytes:     spec.MaxTransferBytes,
+		MaxConnections:       spec.MaxConnections,
+		MaxQueuedConnections: spec.MaxQueuedConnections,
+		OnConnectionClosed:   t.OnConnectionClosed,
+	}
+	// Only tunnels with a weight take turns, the others write right away
+	if spec.BandwidthWeight > 0 {
+		cfg.Flow = t.scheduler.Flow(spec.BandwidthWeight)
+	}
+	return cfg
+}
+
+// startSession starts the session of a tunnel with the plugin listening on
+// sessionPort, and waits until it is up.
+func (t *TunnelTracker) startSession(ctx context.Context, spec TunnelSpec, svc *ssm.Client, sessionHost string, sessionPort int) (*ssmtunnels.Session, error) {
+	session, err := t.startRemoteTunnel(ctx, ssmtunnels.RemoteTunnelConfig{
+		Client:     svc,
+		Target:     spec.Target,
+		Region:     spec.Region,
+		RemoteHost: sessionHost,
+		RemotePort: spec.RemotePort,
+		LocalPort:  sessionPort,
+		Proxy:      t.Proxy,
+		TLS:        t.TLS,
+
+		ReasonPrefix:     t.SessionReasonPrefix,
+		Runner:           t.Runner,
+		MessagesEndpoint: t.MessagesEndpoint,
+		DocumentName:     spec.DocumentName,
+	})
+	if err != nil {
+		log.Printf("Error starting tunnel: %v", err)
+		return nil, err
+	}
+
+	// Wait for the data channel to be open, or the session to end
+	select {
+	case <-session.Ready():
+		t.preflightPassed(spec)
+		return session, nil
+	case <-session.Done():
+		// Failed to start the tunnel, handle the error
+		err := session.Err()
+		log.Printf("Error starting tunnel: %v", err)
+		return nil, err
+	case <-ctx.Done():
+		// E.g. the timeouts of the resource, don't leave the session running
+		if err := session.Close(context.Background()); err != nil {
+			log.Printf("Error closing session %s: %v", session.Id, err)
+		}
+		return nil, fmt.Errorf("waiting for session %s to be ready: %w", session.Id, ctx.Err())
+	case <-time.After(sessionReadyTimeout):
+		if err := session.Close(context.Background()); err != nil {
+			log.Printf("Error closing session %s: %v", session.Id, err)
+		}
+		return nil, fmt.Errorf("the data channel of session %s did not open within %s", session.Id, sessionReadyTimeout)
+	}
+}
+
+// probeTunnel runs the probe of the spec through the tunnel listening on addr.
+func (t *TunnelTracker) probeTunnel(ctx context.Context, spec TunnelSpec, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, spec.Probe.Timeout)
+	defer cancel()
+
+	switch spec.Probe.Type {
+	case probeTypeGRPC:
+		// The provider's TLS settings are meant for AWS, not the remote host
+		tlsConfig, err := ssmtunnels.TLSConfig{CABundle: spec.Probe.CABundle}.ClientConfig()
+		if err != nil {
+			return err
+		}
+		return ssmtunnels.WaitForGRPCHealth(ctx, ssmtunnels.GRPCHealthConfig{
+			Addr:       addr,
+			Service:    spec.Probe.Service,
+			TLS:        spec.Probe.TLS,
+			ServerName: spec.RemoteHost,
+			TLSConfig:  tlsConfig,
+		})
+	}
+	return fmt.Errorf("unsupported probe type %q", spec.Probe.Type)
+}
+
+// startTunnelErrorSummary returns the diagnostic summary for an error of StartTunnel.
+func startTunnelErrorSummary(err error) string {
+	switch {
+	case errors.Is(err, ssmtunnels.ErrTargetOffline):
+		return "Target is not connected to Session Manager"
+	case errors.Is(err, ssmtunnels.ErrInvalidTarget):
+		return "Target is not managed by Session Manager"
+	case errors.Is(err, ssmtunnels.ErrPortInUse):
+		return "Local port is already in use"
+	case errors.Is(err, ssmtunnels.ErrSessionLimit):
+		return "Session Manager session limit reached"
+	case errors.Is(err, ssmtunnels.ErrAccessDenied):
+		return "Access denied starting remote tunnel"
+	}
+	var probeErr *ssmtunnels.ProbeFailedError
+	var healthErr *ssmtunnels.HealthCheckFailedError
+	var httpErr *ssmtunnels.HTTPCheckFailedError
+	var postgresErr *ssmtunnels.PostgresCheckFailedError
+	var mysqlErr *ssmtunnels.MySQLCheckFailedError
+	var tlsErr *ssmtunnels.TLSCheckFailedError
+	if errors.As(err, &probeErr) || errors.As(err, &healthErr) || errors.As(err, &httpErr) ||
+		errors.As(err, &postgresErr) || errors.As(err, &mysqlErr) || errors.As(err, &tlsErr) {
+		return "Remote tunnel probe failed"
+	}
+	var platformErr *ssmtunnels.PlatformMismatchError
+	if errors.As(err, &platformErr) {
+		return "Target runs an unsupported platform"
+	}
+	var notReadyErr *tunnelNotReadyError
+	if errors.As(err, &notReadyErr) {
+		return "Tunnel not ready"
+	}
+	// E.g. the timeouts of the resource passed
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "Timed out starting remote tunnel"
+	}
+	return "Failed to start remote tunnel"
+}
+
+// acquireSlot waits until fewer than MaxConcurrentTunnels tunnels are open.
+// The returned function frees the slot again.
+func (t *TunnelTracker) acquireSlot(ctx context.Context) (func(), error) {
+	if t.MaxConcurrentTunnels <= 0 {
+		return func() {}, nil
+	}
+
+	t.mu.Lock()
+	if t.slots == nil {
+		t.slots = make(chan struct{}, t.MaxConcurrentTunnels)
+	}
+	slots := t.slots
+	t.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("%d tunnels are open, waiting for one to close", t.MaxConcurrentTunnels)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for a free tunnel slot: %w", ctx.Err())
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// acquireStartSlot waits until fewer than MaxConcurrentStarts sessions are
+// being started. The returned function frees the slot again.
+func (t *TunnelTracker) acquireStartSlot(ctx context.Context) (func(), error) {
+	if t.MaxConcurrentStarts <= 0 {
+		return func() {}, nil
+	}
+
+	t.mu.Lock()
+	if t.startSlots == nil {
+		t.startSlots = make(chan struct{}, t.MaxConcurrentStarts)
+	}
+	startSlots := t.startSlots
+	t.mu.Unlock()
+
+	select {
+	case startSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting to start the session: %w", ctx.Err())
+	}
+	return func() { <-startSlots }, nil
+}
+
+// findOpenPort picks a free local port in the range and keeps listening on it
+// on localHost until the tunnel using it is started, whose forwarder adopts
+// the listener, see forwarderConfig. Neither tunnels created in parallel nor
+// other processes can take the port in the meantime.
+func (t *TunnelTracker) findOpenPort(localHost string, rangeMin, rangeMax int) (int, error) {
+	if localHost == "" {
+		localHost = defaultLocalHost
+	}
+	host, err := ssmtunnels.NormalizeHost(localHost)
+	if err != nil {
+		return 0, fmt.Errorf("invalid local host: %w", err)
+	}
+
+	// The ports are probed without holding the lock, which tunnels being
+	// started and closed need as well
+	for {
+		t.mu.Lock()
+		reserved := make(map[int]bool, len(t.reservedPorts))
+		for port := range t.reservedPorts {
+			reserved[port] = true
+		}
+		t.mu.Unlock()
+
+		listener, err := ports.ReservePort(host, rangeMin, rangeMax, func(port int) bool {
+			return reserved[port]
+		})
+		if err != nil {
+			return 0, err
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+
+		t.mu.Lock()
+		if _, taken := t.reservedPorts[port]; !taken {
+			if t.reservedPorts == nil {
+				t.reservedPorts = map[int]net.Listener{}
+			}
+			t.reservedPorts[port] = listener
+			t.mu.Unlock()
+			return port, nil
+		}
+		t.mu.Unlock()
+		// Reserved on another local host in the meantime, pick again
+		listener.Close()
+	}
+}
+
+// takeReservation returns the listener holding the port reserved by
+// findOpenPort, to be adopted by a forwarder listening on addr, or nil if
+// the port isn't reserved. A listener on another address is closed, so the
+// forwarder can listen on addr itself.
+func (t *TunnelTracker) takeReservation(port int, addr string) net.Listener {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	listener := t.reservedPorts[port]
+	delete(t.reservedPorts, port)
+	if listener != nil && listener.Addr().String() != addr {
+		listener.Close()
+		return nil
+	}
+	return listener
+}
+
+// pickTarget returns the target with the fewest open and starting tunnels,
+// preferring the earlier ones on a tie. The tunnel counts as starting on the
+// target until the returned function is called, so tunnels started in
+// parallel are spread as well.
+func (t *TunnelTracker) pickTarget(targets []string) (string, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	load := map[string]int{}
+	for _, tunnel := range t.started {
+		if tunnel.live() {
+			load[tunnel.spec.Target]++
+		}
+	}
+	target := targets[0]
+	for _, candidate := range targets[1:] {
+		if load[candidate]+t.startingOn[candidate] < load[target]+t.startingOn[target] {
+			target = candidate
+		}
+	}
+
+	if t.startingOn == nil {
+		t.startingOn = map[string]int{}
+	}
+	t.startingOn[target]++
+	log.Printf("Starting tunnel on target %q, which has %d open tunnels", target, load[target])
+	return target, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.startingOn[target]--
+	}
+}
+
+// MoveTunnel moves a running tunnel to another local port. Only its listener
+// moves, the session and the connections going through it stay open.
+func (t *TunnelTracker) MoveTunnel(tunnel *OtherTunnelInfo, port int) error {
+	if !t.Offline() {
+		localHost, err := ssmtunnels.NormalizeHost(tunnel.LocalHost)
+		if err != nil {
+			return fmt.Errorf("invalid local host: %w", err)
+		}
+		if err := tunnel.forwarder.Rebind(net.JoinHostPort(localHost, strconv.Itoa(port))); err != nil {
+			return err
+		}
+		log.Printf("Moved tunnel to %q from port %d to port %d", net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort)), tunnel.LocalPort, port)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tunnel.LocalPort = port
+	tunnel.spec.LocalPort = port
+	return nil
+}
+
+// servedBy reports whether a tunnel on target can serve the spec.
+func (s TunnelSpec) servedBy(target string) bool {
+	if s.Target == "" && len(s.Targets) > 0 {
+		return slices.Contains(s.Targets, target)
+	}
+	return target == s.Target
+}
+
+// releasePort makes a port picked by findOpenPort available again, closing
+// its listener unless a forwarder adopted it.
+func (t *TunnelTracker) releasePort(port int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if listener := t.reservedPorts[port]; listener != nil {
+		listener.Close()
+	}
+	delete(t.reservedPorts, port)
+}
+
+// watchForwarder terminates the session of a tunnel whose forwarder stopped
+// on its own, unless other tunnels still use it, and remembers why so it can
+// be reported, see StoppedErrors.
+func (t *TunnelTracker) watchForwarder(tunnel *OtherTunnelInfo, session *ssmtunnels.Session) {
+	select {
+	case <-session.Done():
+		return
+	case <-tunnel.forwarder.Stopped():
+	}
+
+	err := tunnel.forwarder.Err()
+	log.Printf("Closing tunnel: %v", err)
+	t.mu.Lock()
+	t.stoppedErrs = append(t.stoppedErrs, err)
+	t.mu.Unlock()
+
+	if session = tunnel.shutdown(); session == nil {
+		return
+	}
+	if closeErr := session.Close(context.Background()); closeErr != nil {
+		log.Printf("Error closing session %s: %v", session.Id, closeErr)
+	}
+}
+
+// StoppedErrors returns why tunnels were closed by the provider while in use,
+// e.g. because a transfer limit was reached, and why tunnels which are still
+// open have no session, the last error starting one for each.
+func (t *TunnelTracker) StoppedErrors() []error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	errs := append([]error(nil), t.stoppedErrs...)
+	// watchForwarder may not have recorded a forwarder which just stopped yet
+	for _, tunnel := range t.started {
+		if err := tunnel.forwarder.Err(); err != nil && !slices.Contains(errs, err) {
+			errs = append(errs, err)
+		}
+	}
+	seen := map[*tunnelSession]bool{}
+	for _, tunnel := range t.started {
+		if tunnel.tunnelSession == nil || seen[tunnel.tunnelSession] {
+			continue
+		}
+		seen[tunnel.tunnelSession] = true
+		if tunnel.startErr != nil {
+			errs = append(errs, tunnel.startErr)
+		}
+	}
+	return errs
+}
+
+// TransferLimitExceeded returns the error of a tunnel matching the spec which
+// was closed for reaching its max_transfer_bytes, or nil. A zero LocalPort in
+// the spec matches any local port.
+func (t *TunnelTracker) TransferLimitExceeded(spec TunnelSpec) error {
+	if spec.LocalHost == "" {
+		spec.LocalHost = defaultLocalHost
+	}
+	if remoteHost, err := ssmtunnels.NormalizeHost(spec.RemoteHost); err == nil {
+		spec.RemoteHost = remoteHost
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tunnel := range t.started {
+		if !sameTunnel(tunnel.spec, spec) {
+			continue
+		}
+		select {
+		case <-tunnel.forwarder.Stopped():
+		default:
+			continue
+		}
+		var limitErr *ssmtunnels.TransferLimitExceededError
+		if err := tunnel.forwarder.Err(); errors.As(err, &limitErr) {
+			return err
+		}
+	}
+	return nil
+}
+
+// LiveTunnel returns a running tunnel started by this tracker which matches
+// the spec, or nil. A zero LocalPort in the spec matches any local port.
+func (t *TunnelTracker) LiveTunnel(spec TunnelSpec) *OtherTunnelInfo {
+	if spec.LocalHost == "" {
+		spec.LocalHost = defaultLocalHost
+	}
+	remoteHost, err := ssmtunnels.NormalizeHost(spec.RemoteHost)
+	if err != nil {
+		return nil
+	}
+	spec.RemoteHost = remoteHost
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tunnel := range t.started {
+		if !tunnel.live() || !sameTunnel(tunnel.spec, spec) {
+			continue
+		}
+		return tunnel
+	}
+	return nil
+}
+
+// OperatorTunnel returns the local endpoint of a live port forwarding session
+// which the operator opened to the remote host of the spec, or nil. The session
+// isn't tracked, so it is neither closed by the provider nor adopted by other
+// tunnels. A zero LocalPort in the spec matches any local port.
+func (t *TunnelTracker) OperatorTunnel(ctx context.Context, spec TunnelSpec) *OtherTunnelInfo {
+	// Sessions of the operator are only found for the default document
+	if !t.AttachOperatorSessions || t.Offline() || spec.DocumentName != "" {
+		return nil
+	}
+	if spec.LocalHost == "" {
+		spec.LocalHost = defaultLocalHost
+	}
+	remoteHost, err := ssmtunnels.NormalizeHost(spec.RemoteHost)
+	if err != nil {
+		return nil
+	}
+
+	sessions, err := ssmtunnels.FindOperatorSessions()
+	if err != nil {
+		log.Printf("Error finding sessions of the operator: %v", err)
+		return nil
+	}
+	for _, session := range sessions {
+		host, err := ssmtunnels.NormalizeHost(session.RemoteHost)
+		if err != nil || host != remoteHost || !spec.servedBy(session.Target) || session.RemotePort != spec.RemotePort ||
+			(spec.LocalPort != 0 && session.LocalPort != spec.LocalPort) {
+			continue
+		}
+		svc, _, err := t.clientsFor(ctx, spec.Region, spec.RoleArn, spec.Profile)
+		if err != nil {
+			return nil
+		}
+		if !session.Live(ctx, svc, spec.LocalHost) {
+			continue
+		}
+		attached := spec
+		attached.Target = session.Target
+		platform, err := t.targetPlatform(ctx, attached, svc)
+		if err != nil {
+			log.Printf("Not attaching to session %s of the operator: %v", session.SessionId, err)
+			continue
+		}
+		log.Printf("Attaching to session %s of the operator listening on port %d", session.SessionId, session.LocalPort)
+		return &OtherTunnelInfo{LocalPort: session.LocalPort, LocalHost: spec.LocalHost, spec: attached, platform: platform}
+	}
+	return nil
+}
+
+// live reports whether the session and forwarder of the tunnel are still
+// running. Lazy tunnels and tunnels closing idle sessions are live without a
+// session, they start one when used.
+func (i *OtherTunnelInfo) live() bool {
+	select {
+	case <-i.forwarder.Stopped():
+		return false
+	default:
+	}
+	if i.spec.Lazy || i.spec.CloseAfterIdle > 0 {
+		return true
+	}
+	select {
+	case <-i.currentSession().Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// sameTunnel reports whether a tunnel started for running can stand in for
+// wanted. Everything but the ID, readiness checks and, if wanted has none,
+// the local port has to match. Lazy tunnels only stand in for lazy ones, as
+// their session wasn't started yet.
+func sameTunnel(running, wanted TunnelSpec) bool {
+	if !wanted.servedBy(running.Target) || running.Region != wanted.Region || running.RoleArn != wanted.RoleArn || running.Profile != wanted.Profile ||
+		running.RemoteHost != wanted.RemoteHost || running.RemotePort != wanted.RemotePort ||
+		running.LocalHost != wanted.LocalHost || (wanted.LocalPort != 0 && running.LocalPort != wanted.LocalPort) ||
+		running.MaxTransferBytes != wanted.MaxTransferBytes || running.MaxConnections != wanted.MaxConnections ||
+		running.MaxQueuedConnections != wanted.MaxQueuedConnections ||
+		running.BandwidthWeight != wanted.BandwidthWeight || (running.Lazy && !wanted.Lazy) || running.CloseAfterIdle != wanted.CloseAfterIdle ||
+		running.DocumentName != wanted.DocumentName || len(running.Rewrites) != len(wanted.Rewrites) {
+		return false
+	}
+	for i, rule := range running.Rewrites {
+		other := wanted.Rewrites[i]
+		if rule.Direction != other.Direction || rule.Match != other.Match || rule.Replace != other.Replace || rule.Regex != other.Regex {
+			return false
+		}
+	}
+	return true
+}
+
+// TunnelStats describes the use of a tunnel during this run.
+type TunnelStats struct {
+	Id            string
+	Remote        string
+	LocalPort     int
+	BytesSent     int64
+	BytesReceived int64
+	Connections   int64
+	// QueuedConnections wait for a slot of max_connections right now, and
+	// PeakQueuedConnections is the most which waited at once
+	QueuedConnections     int64
+	PeakQueuedConnections int64
+	// RejectedConnections were closed because max_queued_connections were waiting
+	RejectedConnections int64
+	Duration            time.Duration
+	// Reconnects counts the sessions started again for the same tunnel, e.g.
+	// when it is read and then updated in the same run
+	Reconnects int
+}
+
+// TunnelStats returns the stats of the tunnels started during this run,
+// summed up per tunnel ID. Tunnels without an ID, like those of connectivity
+// checks, are left out.
+func (t *TunnelTracker) TunnelStats() []TunnelStats {
+	t.mu.Lock()
+	tunnels := append([]*OtherTunnelInfo(nil), t.started...)
+	t.mu.Unlock()
+
+	var stats []TunnelStats
+	index := map[string]int{}
+	for _, tunnel := range tunnels {
+		if tunnel.spec.Id == "" {
+			continue
+		}
+		forwarderStats := tunnel.Stats()
+		i, ok := index[tunnel.spec.Id]
+		if !ok {
+			i = len(stats)
+			index[tunnel.spec.Id] = i
+			stats = append(stats, TunnelStats{
+				Id:       tunnel.spec.Id,
+				Duration: time.Since(tunnel.startedAt),
+			})
 		} else {
-			// Tunnel started without error, consider it "up"
-			return tunnel, nil
+			stats[i].Reconnects++
 		}
-	case <-time.After(10 * time.Second):
-		// No error within 10 seconds, consider the tunnel "up"
-		return tunnel, nil
+		stats[i].Remote = net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort))
+		stats[i].LocalPort = tunnel.LocalPort
+		stats[i].BytesSent += forwarderStats.BytesSent
+		stats[i].BytesReceived += forwarderStats.BytesReceived
+		stats[i].Connections += forwarderStats.TotalConnections
+		stats[i].QueuedConnections += forwarderStats.QueuedConnections
+		stats[i].PeakQueuedConnections = max(stats[i].PeakQueuedConnections, forwarderStats.PeakQueuedConnections)
+		stats[i].RejectedConnections += forwarderStats.RejectedConnections
 	}
+	return stats
+}
+
+// CloseAll closes every tunnel opened by the tracker. Session termination is
+// batched and retried; sessions which could not be terminated are listed in
+// the returned *ssmtunnels.UnterminatedSessionsError.
+func (t *TunnelTracker) CloseAll(ctx context.Context) error {
+	defer t.Redactor.unregister()
+
+	t.mu.Lock()
+	tunnels := t.started
+	t.started = nil
+	if !t.closed && t.networkStop != nil {
+		close(t.networkStop)
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	sessions := make([]*ssmtunnels.Session, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		if session := tunnel.shutdown(); session != nil {
+			sessions = append(sessions, session)
+		}
+		tunnel.forwarder.Close()
+	}
+	err := ssmtunnels.CloseSessions(ctx, sessions)
+	t.AuditLogger.Close(ctx)
+	return err
+}
+
+// CloseTunnels stops using the tunnels used under the ID once and closes those
+// left without users, terminating their sessions and freeing their local ports.
+// Shared tunnels keep running for their remaining users, see AcquireTunnel.
+func (t *TunnelTracker) CloseTunnels(ctx context.Context, id string) error {
+	return t.closeTunnels(ctx, id, 0, 0)
+}
+
+// CloseTunnelsOn is like CloseTunnels, but only for the tunnel listening on the
+// local port if one is used under the ID, so tunnels to the same endpoint which
+// forward differently keep running, see startSharedListener.
+func (t *TunnelTracker) CloseTunnelsOn(ctx context.Context, id string, port int) error {
+	return t.closeTunnels(ctx, id, port, 0)
+}
+
+// closeTunnels implements CloseTunnels and, with a non-zero port,
+// CloseTunnelsOn. With a non-zero drain, the tunnels are drained first, see
+// DrainTunnelsOn.
+func (t *TunnelTracker) closeTunnels(ctx context.Context, id string, port int, drain time.Duration) error {
+	t.mu.Lock()
+	if port != 0 && !slices.ContainsFunc(t.started, func(tunnel *OtherTunnelInfo) bool {
+		return tunnel.LocalPort == port && slices.Contains(tunnel.users, id)
+	}) {
+		port = 0
+	}
+	var tunnels []*OtherTunnelInfo
+	remaining := t.started[:0]
+	for _, tunnel := range t.started {
+		if (port != 0 && tunnel.LocalPort != port) || !tunnel.removeUser(id) {
+			remaining = append(remaining, tunnel)
+		} else if len(tunnel.users) > 0 {
+			log.Printf("Keeping tunnel to %q open for %s", net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort)), strings.Join(tunnel.users, ", "))
+			remaining = append(remaining, tunnel)
+		} else {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	t.started = remaining
+	t.mu.Unlock()
+
+	if drain > 0 {
+		drainTunnels(ctx, tunnels, drain)
+	}
+	sessions := make([]*ssmtunnels.Session, 0, len(tunnels))
+	var sharing []*OtherTunnelInfo
+	for _, tunnel := range tunnels {
+		if session := tunnel.shutdown(); session != nil {
+			sessions = append(sessions, session)
+		} else if tunnel.currentSession() != nil {
+			sharing = append(sharing, tunnel)
+		}
+	}
+	// Terminating the sessions first ends connections still in use, which the forwarders wait for
+	err := ssmtunnels.CloseSessions(ctx, sessions)
+	for _, tunnel := range tunnels {
+		if slices.Contains(sharing, tunnel) {
+			// The session stays up for the other tunnels, so the connections are cut instead
+			tunnel.forwarder.Abort()
+			continue
+		}
+		tunnel.forwarder.Close()
+	}
+	return err
+}
+
+var (
+	trackersMu sync.Mutex
+	trackers   []*TunnelTracker
+)
+
+// registerTracker remembers the tracker so CloseAllTunnels can reach it.
+func registerTracker(tracker *TunnelTracker) {
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+	trackers = append(trackers, tracker)
+}
+
+// CloseAllTunnels closes the tunnels of every configured provider instance.
+func CloseAllTunnels(ctx context.Context) error {
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+
+	var errs []error
+	for _, tracker := range trackers {
+		if err := tracker.CloseAll(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
-// NOOP CHANGE
 // Ensure AwsSSMTunnelsProvider satisfies various provider interfaces.
 var _ provider.Provider = &AwsSSMTunnelsProvider{}
+var _ provider.ProviderWithFunctions = &AwsSSMTunnelsProvider{}
+var _ provider.ProviderWithEphemeralResources = &AwsSSMTunnelsProvider{}
 
 // AwsSSMTunnelsProvider defines the provider implementation.
 type AwsSSMTunnelsProvider struct {
@@ -103,17 +1229,80 @@ type ProvidedConfigData struct {
 	Tracker *TunnelTracker
 	Region  string
 	Target  string
+	// Targets are equivalent targets tunnels are spread across when Target is empty, see TunnelTracker.pickTarget
+	Targets []string
+	// TargetUnknown is set while planning when the target is only known after apply, e.g. the ID of an instance
+	// created in the same run, and Terraform doesn't support deferred actions
+	TargetUnknown bool
+
+	// LocalPortRangeMin and LocalPortRangeMax bound the local ports picked for tunnels without local_port
+	LocalPortRangeMin int
+	LocalPortRangeMax int
+
+	// PreserveTunnelIds keeps the IDs of remote tunnels in the state, see RemoteTunnelResource.ModifyPlan
+	PreserveTunnelIds bool
+
+	// Tunnels are the tunnels of the provider block by name, see TunnelDataSource
+	Tunnels map[string]*NamedTunnel
+
+	// AccessMatrix is nil unless access_matrix_file is set
+	AccessMatrix *accessMatrix
+}
+
+// ResolverModel describes the resolver block of the provider.
+type ResolverModel struct {
+	Nameservers   []types.String `tfsdk:"nameservers"`
+	SearchDomains []types.String `tfsdk:"search_domains"`
 }
 
 // AwsSSMTunnelsProviderModel describes the provider data model.
 type AwsSSMTunnelsProviderModel struct {
-	Region            types.String   `tfsdk:"region"`
-	AccessKey         types.String   `tfsdk:"access_key"`
-	SecretKey         types.String   `tfsdk:"secret_key"`
-	SessionToken      types.String   `tfsdk:"token"`
-	SharedConfigFiles []types.String `tfsdk:"shared_config_files"`
-	Profile           types.String   `tfsdk:"profile"`
-	Target            types.String   `tfsdk:"target"`
+	Region                 types.String   `tfsdk:"region"`
+	AccessKey              types.String   `tfsdk:"access_key"`
+	SecretKey              types.String   `tfsdk:"secret_key"`
+	SessionToken           types.String   `tfsdk:"token"`
+	SharedConfigFiles      []types.String `tfsdk:"shared_config_files"`
+	Profile                types.String   `tfsdk:"profile"`
+	Target                 types.String   `tfsdk:"target"`
+	Targets                []types.String `tfsdk:"targets"`
+	AuditLogGroup          types.String   `tfsdk:"audit_log_group"`
+	AccessMatrixFile       types.String   `tfsdk:"access_matrix_file"`
+	AttachOperatorSessions types.Bool     `tfsdk:"attach_operator_sessions"`
+	MaxRetries             types.Int64    `tfsdk:"max_retries"`
+	RetryMode              types.String   `tfsdk:"retry_mode"`
+	WaitForTarget          types.String   `tfsdk:"wait_for_target_timeout"`
+	HTTPProxy              types.String   `tfsdk:"http_proxy"`
+	HTTPSProxy             types.String   `tfsdk:"https_proxy"`
+	NoProxy                types.String   `tfsdk:"no_proxy"`
+	ProxyPACURL            types.String   `tfsdk:"proxy_pac_url"`
+	CABundle               types.String   `tfsdk:"ca_bundle"`
+	Insecure               types.Bool     `tfsdk:"insecure"`
+	FIPS                   types.Bool     `tfsdk:"fips"`
+	UserAgentSuffix        types.String   `tfsdk:"user_agent_suffix"`
+	LogAWSRequests         types.Bool     `tfsdk:"log_aws_requests"`
+	SSMMessagesEndpoint    types.String   `tfsdk:"ssmmessages_endpoint"`
+	RunnerId               types.String   `tfsdk:"runner_id"`
+	SessionReasonPrefix    types.String   `tfsdk:"session_reason_prefix"`
+	TerminateOrphaned      types.String   `tfsdk:"terminate_orphaned_sessions_after"`
+	SourceIdentity         types.String   `tfsdk:"source_identity"`
+	RoleExternalId         types.String   `tfsdk:"role_external_id"`
+	STSRegion              types.String   `tfsdk:"sts_region"`
+	PreflightChecks        types.Bool     `tfsdk:"preflight_checks"`
+	PreserveTunnelIds      types.Bool     `tfsdk:"preserve_tunnel_ids"`
+	Mock                   types.Bool     `tfsdk:"mock"`
+	DisableTunnels         types.Bool     `tfsdk:"disable_tunnels"`
+	LocalPortRangeMin      types.Int64    `tfsdk:"local_port_range_min"`
+	LocalPortRangeMax      types.Int64    `tfsdk:"local_port_range_max"`
+	MaxConcurrentTunnels   types.Int64    `tfsdk:"max_concurrent_tunnels"`
+	MaxConcurrentStarts    types.Int64    `tfsdk:"max_concurrent_session_starts"`
+	Resolver               *ResolverModel `tfsdk:"resolver"`
+
+	Tunnels types.Map `tfsdk:"tunnels"`
+
+	EC2MetadataServiceEndpoint types.String `tfsdk:"ec2_metadata_service_endpoint"`
+	SkipMetadataAPICheck       types.Bool   `tfsdk:"skip_metadata_api_check"`
+
+	LogRedactionPatterns []types.String `tfsdk:"log_redaction_patterns"`
 }
 
 func (p *AwsSSMTunnelsProvider) Metadata(ctx context.Context, req provider.MetadataRequest, resp *provider.MetadataResponse) {
@@ -124,39 +1313,447 @@ func (p *AwsSSMTunnelsProvider) Metadata(ctx context.Context, req provider.Metad
 func (p *AwsSSMTunnelsProvider) Schema(ctx context.Context, req provider.SchemaRequest, resp *provider.SchemaResponse) {
 	// TODO: Figure out how to support more auth modes. Maybe import from the AWS provider
 	resp.Schema = schema.Schema{
+		MarkdownDescription: "Every tunnel is an SSM session with its own session manager plugin process. Resources are safe to " +
+			"create in parallel, including with `terraform apply -parallelism` above the default of 10: local ports picked " +
+			"for parallel tunnels never collide, and clients for other regions and roles are shared between tunnels.\n\n" +
+			"The limits to keep in mind are the account's quota of concurrent SSM sessions, use `max_concurrent_tunnels` " +
+			"to stay below it, and the single data channel of each session, use `max_connections` on a tunnel to queue " +
+			"bursts of connections. Sessions are started at most `max_concurrent_session_starts` at a time, 5 by default, " +
+			"to avoid throttling, and terminated in batches of 5 when the provider shuts down.\n\n" +
+			"Sessions are terminated whenever the provider goes away: when Terraform stops it, e.g. after Ctrl+C, when it " +
+			"exits at the end of the run, when it receives SIGTERM and when Terraform itself was killed. A session which ends " +
+			"while the provider keeps listening, e.g. because the SSM agent restarted or the target rebooted, is started " +
+			"again on the same local port with exponential backoff up to every 30 seconds, for as long as " +
+			"`wait_for_target_timeout`, or 5 minutes without it. Connections arriving meanwhile wait for it, and " +
+			"`awsssmtunnels_keepalive` fails the run if it can't be started. Once the network changed, e.g. a VPN connected, " +
+			"ended and idle sessions are replaced and tunnels with a `probe` are probed. Tunnels to the same remote endpoint " +
+			"which forward differently share one session, apart from `lazy` tunnels and tunnels with `close_after_idle`.\n\n" +
+			"Expiring credentials, e.g. of a `role_arn` or a profile using SSO, don't end sessions. The data channel of a " +
+			"session authenticates with a token of its own, only resuming it after the data channel was interrupted calls AWS " +
+			"again, with credentials the session manager plugin fetches from the provider. Assumed roles are refreshed 10 " +
+			"minutes ahead of their expiry.\n\n" +
+			"Like the AWS CLI, the endpoints of the AWS APIs can be overridden with the `AWS_ENDPOINT_URL` and " +
+			"`AWS_ENDPOINT_URL_<SERVICE>` environment variables, e.g. `AWS_ENDPOINT_URL_SSM`, or `endpoint_url` in the shared config.\n\n" +
+			"Errors of starting and using tunnels end with a line like `Failure classification: " +
+			"{\"error_code\":\"target_offline\",\"retryable\":true,\"subsystem\":\"ssm\"}` in their detail, so automation " +
+			"reading `terraform apply -json` can decide whether to retry the run. The subsystem is one of `ssm`, `iam`, `local`, " +
+			"`probe` and `tunnel`.\n\n" +
+			"Plans warn about every tunnel their apply opens, with its destination, target, credentials and local endpoint, so " +
+			"reviewers approving a plan see the network access it implies.",
 		Attributes: map[string]schema.Attribute{
 			"region": schema.StringAttribute{
-				Required: true,
+				Optional: true,
 				Description: "The region where AWS operations will take place. Examples\n" +
-					"are us-east-1, us-west-2, etc.",
+					"are us-east-1, us-west-2, etc. Defaults to the AWS_REGION environment variable or\n" +
+					"the region of the profile. Resources can override it.",
+			},
+			"access_key": schema.StringAttribute{
+				Optional: true,
+				Description: "The access key for API operations. You can retrieve this\n" +
+					"from the 'Security & Credentials' section of the AWS console.",
+			},
+			"secret_key": schema.StringAttribute{
+				Optional: true,
+				Description: "The secret key for API operations. You can retrieve this\n" +
+					"from the 'Security & Credentials' section of the AWS console.",
+			},
+			"token": schema.StringAttribute{
+				Optional: true,
+				Description: "session token. A session token is only required if you are\n" +
+					"using temporary security credentials.",
+			},
+			"shared_config_files": schema.ListAttribute{
+				ElementType: types.StringType,
+				Optional:    true,
+				Description: "List of paths to shared config files. If not set, defaults to [~/.aws/config].",
+			},
+			"profile": schema.StringAttribute{
+				Optional:    true,
+				Description: "The AWS profile to use",
+			},
+			"target": schema.StringAttribute{
+				Optional: true,
+				Description: "The target to start the remote tunnel, such as an instance ID. Either target or targets is required.\n" +
+					"It may be the ID of an instance created in the same run: Terraform supporting deferred actions then plans the tunnels\n" +
+					"once the instance exists.",
+			},
+			"targets": schema.ListAttribute{
+				ElementType: types.StringType,
+				Optional:    true,
+				Description: "Several equivalent targets, e.g. bastions in the same network, instead of target. Each tunnel\n" +
+					"is started on the target with the fewest tunnels of the provider, so a large apply doesn't saturate\n" +
+					"the agent of a single target. The target serving a tunnel is reported by its target attribute.",
+			},
+			"access_matrix_file": schema.StringAttribute{
+				Optional: true,
+				Description: "Write every tunnel declared in the configuration to this file while planning, as a Markdown\n" +
+					"table of the local endpoint, the target and region the tunnel goes through, the remote endpoint and\n" +
+					"the credentials, with the type of the resource declaring it and the planned change, e.g. to attach it\n" +
+					"to the review of the change. It is the only file the provider writes. Applies and refreshes write it\n" +
+					"again, so publish the one written while planning, e.g. as an artifact of the CI job. Provider\n" +
+					"configurations run in processes of their own, so give each alias a file of its own.",
+			},
+			"audit_log_group": schema.StringAttribute{
+				Optional: true,
+				Description: "Name of an existing CloudWatch Logs log group. When set, the source/destination\n" +
+					"and duration of every connection forwarded through a tunnel is written to it. The records are sent in\n" +
+					"batches every 5 seconds and when the tunnels are closed.",
 			},
-			"access_key": schema.StringAttribute{
+			"attach_operator_sessions": schema.BoolAttribute{
 				Optional: true,
-				Description: "The access key for API operations. You can retrieve this\n" +
-					"from the 'Security & Credentials' section of the AWS console.",
+				Description: "Reuse a port forwarding session to the same remote host which the operator opened\n" +
+					"with the AWS CLI on this machine, instead of starting a second session. The session is only used\n" +
+					"if it is active and its local port accepts connections, and it is never closed by the provider.\n" +
+					"Not supported on Windows.",
 			},
-			"secret_key": schema.StringAttribute{
+			"max_retries": schema.Int64Attribute{
 				Optional: true,
-				Description: "The secret key for API operations. You can retrieve this\n" +
-					"from the 'Security & Credentials' section of the AWS console.",
+				Description: "The maximum number of times an AWS API call is retried when a retryable\n" +
+					"error such as throttling occurs. Defaults to the AWS SDK default.",
 			},
-			"token": schema.StringAttribute{
+			"retry_mode": schema.StringAttribute{
 				Optional: true,
-				Description: "session token. A session token is only required if you are\n" +
-					"using temporary security credentials.",
+				Description: "Specifies how retries are attempted. Valid values are `standard` and `adaptive`.\n" +
+					"Defaults to the AWS SDK default.",
 			},
-			"shared_config_files": schema.ListAttribute{
+			"wait_for_target_timeout": schema.StringAttribute{
+				Optional: true,
+				Description: "Keep starting sessions while Session Manager reports their target as not connected, e.g. an\n" +
+					"instance which just booted or whose SSM agent restarts, as a duration like \"5m\". Attempts\n" +
+					"back off exponentially up to 30 seconds apart. Without it, tunnels to such targets fail right\n" +
+					"away. The timeouts of a resource still bound how long starting its tunnel takes.",
+			},
+			"http_proxy": schema.StringAttribute{
+				Optional: true,
+				Description: "URL of a proxy to use for HTTP requests to AWS. Can also be set with the\n" +
+					"HTTP_PROXY environment variable.",
+			},
+			"https_proxy": schema.StringAttribute{
+				Optional: true,
+				Description: "URL of a proxy to use for HTTPS requests to AWS, including the session data channel.\n" +
+					"Can also be set with the HTTPS_PROXY environment variable.",
+			},
+			"no_proxy": schema.StringAttribute{
+				Optional: true,
+				Description: "Comma-separated list of hosts which should not go through the proxy. Can also be\n" +
+					"set with the NO_PROXY environment variable.",
+			},
+			"proxy_pac_url": schema.StringAttribute{
+				Optional: true,
+				Description: "URL (http, https or file) of a proxy auto-config file used to pick the proxy for the\n" +
+					"session data channel. Takes precedence over the static proxy settings for the data channel.\n" +
+					"The file is run with an embedded ECMAScript 5.1 engine, which provides the standard PAC\n" +
+					"helpers except weekdayRange, dateRange and timeRange.",
+			},
+			"ca_bundle": schema.StringAttribute{
+				Optional: true,
+				Description: "Path to a PEM encoded file with additional CA certificates to trust, for example\n" +
+					"those of a TLS intercepting proxy.",
+			},
+			"insecure": schema.BoolAttribute{
+				Optional:    true,
+				Description: "Skip TLS certificate verification for AWS API calls and the session data channel. Not recommended.",
+			},
+			"fips": schema.BoolAttribute{
+				Optional: true,
+				Description: "Use the FIPS endpoints of every AWS service, including ssmmessages-fips for the session data\n" +
+					"channel, and refuse settings which would bypass them: endpoint overrides like AWS_ENDPOINT_URL,\n" +
+					"insecure, and an ssmmessages_endpoint which isn't a FIPS endpoint. Needs a provider binary built\n" +
+					"with GOEXPERIMENT=boringcrypto, whose TLS is then restricted to FIPS 140 approved settings.",
+			},
+			"user_agent_suffix": schema.StringAttribute{
+				Optional: true,
+				Description: "Text appended to the User-Agent of every AWS API call, for example a team name or\n" +
+					"pipeline ID, so the calls can be attributed in CloudTrail.",
+			},
+			"ec2_metadata_service_endpoint": schema.StringAttribute{
+				Optional: true,
+				Description: "Address of the EC2 instance metadata service used for credentials when no other credentials are\n" +
+					"configured, e.g. http://[fd00:ec2::254] on IPv6-only instances. Can also be set with the\n" +
+					"AWS_EC2_METADATA_SERVICE_ENDPOINT environment variable. IMDSv2 tokens are used, with a fallback to IMDSv1.",
+			},
+			"skip_metadata_api_check": schema.BoolAttribute{
+				Optional: true,
+				Description: "Don't look up credentials from the EC2 instance metadata service, to avoid waiting for it to\n" +
+					"time out outside of EC2. Can also be set with AWS_EC2_METADATA_DISABLED=true.",
+			},
+			"log_redaction_patterns": schema.ListAttribute{
 				ElementType: types.StringType,
 				Optional:    true,
-				Description: "List of paths to shared config files. If not set, defaults to [~/.aws/config].",
+				Description: "Regular expressions whose matches are replaced with *** in all log output of the provider,\n" +
+					"including the AWS SDK and session logs, e.g. to keep internal hostnames out of CI logs. The patterns\n" +
+					"apply from the moment the provider is configured.",
 			},
-			"profile": schema.StringAttribute{
+			"log_aws_requests": schema.BoolAttribute{
+				Optional: true,
+				Description: "Log every AWS API request and response, with credentials masked, to the Terraform log at the\n" +
+					"DEBUG level, e.g. to diagnose failing StartSession calls. Shown with TF_LOG=DEBUG, or\n" +
+					"TF_LOG_PROVIDER_AWSSSMTUNNELS_AWS_SDK=DEBUG for only these logs.",
+			},
+			"disable_tunnels": schema.BoolAttribute{
+				Optional: true,
+				Description: "Like mock, but tunnels without a local_port get a port derived from their remote host and\n" +
+					"port instead of a free one, so the placeholder endpoints are the same in every plan. Meant for\n" +
+					"plan-only pipelines, e.g. pull request validation, without access to AWS.",
+			},
+			"mock": schema.BoolAttribute{
+				Optional: true,
+				Description: "Don't call AWS at all. Tunnels report their local endpoint without opening it and\n" +
+					"connectivity checks always succeed, so configurations consuming tunnel outputs can be\n" +
+					"planned and tested without AWS access. The rest of the provider configuration is still validated.",
+			},
+			"preflight_checks": schema.BoolAttribute{
+				Optional: true,
+				Description: "Check that the credentials can start and terminate sessions on the targets before the first\n" +
+					"session of a run is started, so missing permissions or an offline target fail while the tunnels are\n" +
+					"refreshed, before the apply changed anything. The first tunnel started, by the provider's tunnels, a\n" +
+					"refresh, the tunnel data source, the ephemeral resource or a resource, checks the targets of the\n" +
+					"provider's tunnels and its own, each by starting and immediately terminating a session with the region,\n" +
+					"credentials, session document, remote host and port of the tunnel. Every target is checked once per run,\n" +
+					"and not at all once a tunnel started a session on it.",
+			},
+			"preserve_tunnel_ids": schema.BoolAttribute{
+				Optional: true,
+				Description: "Keep the id of remote tunnels which is in the state, e.g. an imported id or the random id of\n" +
+					"an older provider version, instead of replacing it with the id derived from the endpoint of the tunnel.\n" +
+					"Without it such ids are replaced once, in the next plan.",
+			},
+			"runner_id": schema.StringAttribute{
+				Optional: true,
+				Description: "Identifies the machine or pipeline job running Terraform, e.g. the URL of the CI job. It is\n" +
+					"appended to the reason of every session and logged, so a session found in the Session Manager\n" +
+					"history can be traced to the job which opened it, and is reported by awsssmtunnels_keepalive.\n" +
+					"Defaults to the URL of the job or run on GitHub Actions, GitLab CI, Buildkite, CircleCI and\n" +
+					"Jenkins, the run ID on HCP Terraform, and the hostname elsewhere. Set it to \"\" to leave it out.",
+			},
+			"session_reason_prefix": schema.StringAttribute{
+				Optional: true,
+				Description: "Text prepended to the reason of every session the provider starts, e.g. \"terraform\".\n" +
+					"The reason is shown in the Session Manager history and the session start events, so\n" +
+					"sessions opened by Terraform can be told apart from interactive ones.",
+			},
+			"terminate_orphaned_sessions_after": schema.StringAttribute{
+				Optional: true,
+				Description: "Terminate the sessions started with session_reason_prefix more than this long ago, e.g. \"12h\",\n" +
+					"when the provider is configured. They were left behind by runs which were killed before\n" +
+					"terminating them, and would otherwise keep running until the idle timeout of Session\n" +
+					"Manager. Pick a duration longer than any run, sessions of runs still going are terminated\n" +
+					"as well. Only sessions in the region of the provider are found, which needs\n" +
+					"ssm:DescribeSessions. Requires session_reason_prefix.",
+			},
+			"role_external_id": schema.StringAttribute{
+				Optional:  true,
+				Sensitive: true,
+				Description: "External ID set when assuming the role_arn of tunnels, for roles in accounts of third parties\n" +
+					"whose trust policy requires the sts:ExternalId condition key. Terraform never stores the\n" +
+					"configuration of providers, so unlike an argument of a resource it doesn't end up in the state.",
+			},
+			"source_identity": schema.StringAttribute{
+				Optional: true,
+				Description: "Source identity set when assuming the role_arn of tunnels, e.g. the user or pipeline running\n" +
+					"Terraform. CloudTrail records it for the sessions started with the role, and it can be required with\n" +
+					"the sts:SourceIdentity condition key. The role must allow sts:SetSourceIdentity.",
+			},
+			"ssmmessages_endpoint": schema.StringAttribute{
+				Optional: true,
+				Description: "Hostname of the ssmmessages endpoint used for the session data channel, for example\n" +
+					"ssmmessages-fips.us-east-1.amazonaws.com or the dual-stack ssmmessages.us-east-1.api.aws, for networks\n" +
+					"which only allow those. Only the data channel is affected, API calls use the regular endpoints.",
+			},
+			"sts_region": schema.StringAttribute{
+				Optional: true,
+				Description: "Region of the STS endpoint used to assume the role_arn of tunnels, e.g. for runners which can\n" +
+					"only reach the STS VPC endpoint of one region. Defaults to the region of each tunnel. The endpoint can be\n" +
+					"overridden further with AWS_ENDPOINT_URL_STS.",
+			},
+			"max_concurrent_tunnels": schema.Int64Attribute{
+				Optional: true,
+				Description: "The maximum number of tunnels kept open at the same time. Further tunnels wait until\n" +
+					"one is closed. Use it to stay below the account's quota of concurrent SSM sessions.",
+			},
+			"max_concurrent_session_starts": schema.Int64Attribute{
+				Optional: true,
+				Description: fmt.Sprintf("The maximum number of sessions being started at the same time. Tunnels created in\n"+
+					"parallel beyond it wait for their turn, so a high -parallelism doesn't trip the throttling of\n"+
+					"StartSession. Defaults to %d, 0 means no limit.", defaultMaxConcurrentStarts),
+			},
+			"local_port_range_min": schema.Int64Attribute{
+				Optional: true,
+				Description: "Lowest local port picked for tunnels without a local_port. Defaults to 16000.\n" +
+					"Change it to avoid collisions with other software, e.g. on shared CI runners. The range in use\n" +
+					"is reported by awsssmtunnels_keepalive.",
+			},
+			"local_port_range_max": schema.Int64Attribute{
 				Optional:    true,
-				Description: "The AWS profile to use",
+				Description: "Highest local port picked for tunnels without a local_port. Defaults to 26000.",
 			},
-			"target": schema.StringAttribute{
-				Required:    true,
-				Description: "The target to start the remote tunnel, such as an instance ID",
+			"tunnels": schema.MapNestedAttribute{
+				Optional: true,
+				Description: "Tunnels started once when the provider is configured, by name. Use the awsssmtunnels_tunnel\n" +
+					"data source to look them up, so many modules can share a tunnel without declaring it again.\n" +
+					"They take the same settings as awsssmtunnels_remote_tunnel, apart from its lifecycle. They are\n" +
+					"also started at the start of a destroy, which only configures the provider if it has resources\n" +
+					"left, so with a fixed local_port or stable_local_port other providers can reach them while their\n" +
+					"resources are destroyed. Connections arriving before the session started wait for it.",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"target": schema.StringAttribute{
+							Optional:    true,
+							Description: "The target to start the tunnel on. Defaults to the provider target.",
+						},
+						"region": schema.StringAttribute{
+							Optional:    true,
+							Description: "The region of the target. Defaults to the provider region.",
+						},
+						"role_arn": schema.StringAttribute{
+							Optional:    true,
+							Description: "ARN of a role to assume for starting the session. Defaults to the provider credentials.",
+						},
+						"profile": schema.StringAttribute{
+							Optional:    true,
+							Description: "Shared config profile whose credentials start the session. Defaults to the provider credentials.",
+						},
+						"remote_host": schema.StringAttribute{
+							Required:    true,
+							Description: "The DNS name or IP address of the remote host.",
+						},
+						"remote_port": schema.Int64Attribute{
+							Required:    true,
+							Description: "The port number of the remote host.",
+						},
+						"local_host": schema.StringAttribute{
+							Optional:    true,
+							Description: "The local host to listen on. Defaults to 127.0.0.1.",
+						},
+						"local_port": schema.Int64Attribute{
+							Optional:    true,
+							Description: "The local port to listen on. Defaults to a free port in the local port range.",
+						},
+						"stable_local_port": schema.BoolAttribute{
+							Optional:    true,
+							Description: "Derive the local port from the target and remote endpoint, so it stays the same between runs.",
+						},
+						"rewrite": schema.ListNestedAttribute{
+							Optional:    true,
+							Description: "Rules rewriting the data forwarded through the tunnel, like the rewrite of awsssmtunnels_remote_tunnel.",
+							NestedObject: schema.NestedAttributeObject{
+								Attributes: map[string]schema.Attribute{
+									"direction": schema.StringAttribute{
+										Optional:    true,
+										Description: "request or response. Defaults to response.",
+									},
+									"match": schema.StringAttribute{
+										Required:    true,
+										Description: "The text to replace, or a regular expression if regex is true.",
+									},
+									"replace": schema.StringAttribute{
+										Required:    true,
+										Description: "The replacement.",
+									},
+									"regex": schema.BoolAttribute{
+										Optional:    true,
+										Description: "Whether match is a regular expression.",
+									},
+								},
+							},
+						},
+						"wait_for_vpc_endpoints": schema.ListAttribute{
+							ElementType: types.StringType,
+							Optional:    true,
+							Description: "IDs of VPC endpoints to wait for before starting the tunnel.",
+						},
+						"wait_for_target_online": schema.BoolAttribute{
+							Optional:    true,
+							Description: "Wait for the SSM agent of the target to be online before starting the tunnel.",
+						},
+						"max_transfer_bytes": schema.Int64Attribute{
+							Optional:    true,
+							Description: "Close the tunnel once this many bytes were forwarded through it.",
+						},
+						"max_connections": schema.Int64Attribute{
+							Optional:    true,
+							Description: "The maximum number of local connections forwarded at the same time.",
+						},
+						"max_queued_connections": schema.Int64Attribute{
+							Optional:    true,
+							Description: "The maximum number of local connections waiting for a slot of max_connections, further ones are closed.",
+						},
+						"bandwidth_weight": schema.Int64Attribute{
+							Optional:    true,
+							Description: "The share of the network the tunnel gets while it is saturated, between 1 and 8. Only tunnels with a weight take turns.",
+						},
+						"lazy": schema.BoolAttribute{
+							Optional:    true,
+							Description: "Only start the session once the first connection arrives.",
+						},
+						"close_after_idle": schema.StringAttribute{
+							Optional:    true,
+							Description: "Terminate the session once no local connection was open for this long, like 15m.",
+						},
+						"probe_command": schema.StringAttribute{
+							Optional:    true,
+							Description: "Shell command run on the target until it succeeds before the tunnel is started.",
+						},
+						"probe_timeout_seconds": schema.Int64Attribute{
+							Optional:    true,
+							Description: "How long to retry probe_command before failing. Defaults to 300.",
+						},
+						"probe": schema.SingleNestedAttribute{
+							Optional:    true,
+							Description: "Readiness check done through the tunnel once it is up, like the probe of awsssmtunnels_remote_tunnel.",
+							Attributes: map[string]schema.Attribute{
+								"type": schema.StringAttribute{
+									Required:    true,
+									Description: "grpc to call the standard gRPC health checking protocol.",
+									Validators:  []validator.String{oneOf{summary: "Invalid probe type", values: []string{probeTypeGRPC}}},
+								},
+								"service": schema.StringAttribute{
+									Optional:    true,
+									Description: "The service to check. Defaults to the server as a whole.",
+								},
+								"tls": schema.BoolAttribute{
+									Optional:    true,
+									Description: "Connect with TLS.",
+								},
+								"ca_bundle": schema.StringAttribute{
+									Optional:    true,
+									Description: "Path to a PEM file with certificates trusted with tls in addition to the system's.",
+								},
+								"timeout_seconds": schema.Int64Attribute{
+									Optional:    true,
+									Description: "How long to retry the check before failing. Defaults to 300.",
+								},
+							},
+						},
+						"require_platform": schema.StringAttribute{
+							Optional:    true,
+							Description: "Fail before starting the session unless the target runs this platform, Linux, Windows or MacOS.",
+						},
+						"document_name": schema.StringAttribute{
+							Optional:    true,
+							Description: "Name of the session document the session is started with.",
+						},
+					},
+				},
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"resolver": schema.SingleNestedBlock{
+				Description: "Resolve remote hosts on the machine running Terraform with these nameservers, instead\n" +
+					"of letting the target resolve them. For names that only resolve on a corporate DNS server,\n" +
+					"e.g. one reachable through a VPN, without changing the system resolver.",
+				Attributes: map[string]schema.Attribute{
+					"nameservers": schema.ListAttribute{
+						ElementType: types.StringType,
+						Optional:    true,
+						Description: "Nameservers to query in order, as IP address or address:port. The next one is only asked if a query fails, not if the name doesn't exist.",
+					},
+					"search_domains": schema.ListAttribute{
+						ElementType: types.StringType,
+						Optional:    true,
+						Description: "Domains appended to remote hosts without a dot.",
+					},
+				},
 			},
 		},
 	}
@@ -171,34 +1768,118 @@ func (p *AwsSSMTunnelsProvider) Configure(ctx context.Context, req provider.Conf
 		return
 	}
 
-	var awsCfg aws.Config
-	var err error
-	if len(data.SharedConfigFiles) > 0 {
-		sharedConfigFilesAsString := []string{}
-		for _, path := range data.SharedConfigFiles {
-			sharedConfigFilesAsString = append(sharedConfigFilesAsString, path.ValueString())
+	var redactionPatterns []*regexp.Regexp
+	for i, pattern := range data.LogRedactionPatterns {
+		compiled, err := regexp.Compile(pattern.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("log_redaction_patterns").AtListIndex(i),
+				"Invalid log redaction pattern",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		redactionPatterns = append(redactionPatterns, compiled)
+	}
+	// Before anything else is logged. CloseAll of the tracker unregisters it, or
+	// this if the configuration is deferred or rejected before there is one.
+	redactor := newRedactor(redactionPatterns)
+	redactor.register()
+	registered := false
+	defer func() {
+		if !registered {
+			redactor.unregister()
+		}
+	}()
+
+	// The target is only known after apply when it is e.g. the ID of an instance created in the same run.
+	// Terraform supporting deferred actions plans the tunnels again once it is known, instead of reading
+	// them now without a target.
+	targetUnknown := data.Target.IsUnknown()
+	for _, value := range data.Targets {
+		targetUnknown = targetUnknown || value.IsUnknown()
+	}
+	if targetUnknown && req.ClientCapabilities.DeferralAllowed {
+		log.Printf("The target of the provider is only known after apply, deferring its resources and data sources")
+		resp.Deferred = &provider.Deferred{Reason: provider.DeferredReasonProviderConfigUnknown}
+		return
+	}
+
+	// Targets are often pasted from the console or CLI output with whitespace around them
+	if data.Target.ValueString() != "" {
+		target, err := ssmtunnels.NormalizeTarget(data.Target.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("target"),
+				"Invalid target",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		data.Target = types.StringValue(target)
+	}
+	var targets []string
+	for i, value := range data.Targets {
+		if value.IsUnknown() {
+			continue
 		}
+		target, err := ssmtunnels.NormalizeTarget(value.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("targets").AtListIndex(i),
+				"Invalid target",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		targets = append(targets, target)
+	}
+	if data.Target.ValueString() != "" && len(targets) > 0 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("targets"),
+			"Conflicting targets",
+			"Set either target or targets, not both",
+		)
+		return
+	}
+	if data.Target.ValueString() == "" && !targetUnknown && len(targets) == 0 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("target"),
+			"Missing target",
+			"Set target, or targets to spread tunnels across several equivalent targets",
+		)
+		return
+	}
+
+	// A typo in a region would only surface as failing API calls during the apply
+	resp.Diagnostics.Append(validateRegion(data.Region, path.Root("region"))...)
+	resp.Diagnostics.Append(validateRegion(data.STSRegion, path.Root("sts_region"))...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var loadOptions []func(*config.LoadOptions) error
+
+	if data.Region.ValueString() != "" {
+		loadOptions = append(loadOptions, config.WithRegion(data.Region.ValueString()))
+	}
+
+	sharedConfigFilesAsString := []string{}
+	for _, file := range data.SharedConfigFiles {
+		sharedConfigFilesAsString = append(sharedConfigFilesAsString, file.ValueString())
+	}
+	if len(data.SharedConfigFiles) > 0 {
 
 		profile := "default"
 		if data.Profile.ValueString() != "" {
 			profile = data.Profile.ValueString()
 		}
-		awsCfg, err = config.LoadDefaultConfig(ctx,
-			config.WithRegion(data.Region.ValueString()),
+		loadOptions = append(loadOptions,
 			config.WithSharedConfigFiles(sharedConfigFilesAsString),
 			config.WithSharedConfigProfile(profile),
 		)
-
-		if err != nil {
-			resp.Diagnostics.AddError(
-				"Failed to load AWS configuration",
-				fmt.Sprintf("Error: %s", err),
-			)
-			return
-		}
-	} else {
-		awsCfg, err = config.LoadDefaultConfig(ctx,
-			config.WithRegion(data.Region.ValueString()),
+	} else if data.AccessKey.ValueString() != "" {
+		loadOptions = append(loadOptions,
 			config.WithCredentialsProvider(
 				credentials.NewStaticCredentialsProvider(
 					data.AccessKey.ValueString(),
@@ -207,9 +1888,301 @@ func (p *AwsSSMTunnelsProvider) Configure(ctx context.Context, req provider.Conf
 				),
 			),
 		)
+	} else if data.Profile.ValueString() != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(data.Profile.ValueString()))
+	}
+	// Without static credentials the default chain is used: environment, shared config, then
+	// the container or instance metadata credentials, e.g. when Terraform runs on an EC2 runner
+
+	if data.SkipMetadataAPICheck.ValueBool() {
+		// Avoids waiting for the metadata service to time out on machines outside of EC2
+		loadOptions = append(loadOptions, config.WithEC2IMDSClientEnableState(imds.ClientDisabled))
+	}
+	if data.EC2MetadataServiceEndpoint.ValueString() != "" {
+		endpoint, err := url.Parse(data.EC2MetadataServiceEndpoint.ValueString())
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("ec2_metadata_service_endpoint"),
+				"Invalid ec2_metadata_service_endpoint",
+				"ec2_metadata_service_endpoint must be an http or https URL, e.g. http://[fd00:ec2::254]",
+			)
+			return
+		}
+		loadOptions = append(loadOptions, config.WithEC2IMDSEndpoint(endpoint.String()))
+	}
+
+	// Provider schemas can't have defaults, the range in use is reported by awsssmtunnels_keepalive
+	portRangeMin, portRangeMax := int64(defaultLocalPortRangeMin), int64(defaultLocalPortRangeMax)
+	if !data.LocalPortRangeMin.IsNull() {
+		portRangeMin = data.LocalPortRangeMin.ValueInt64()
+	}
+	if !data.LocalPortRangeMax.IsNull() {
+		portRangeMax = data.LocalPortRangeMax.ValueInt64()
+	}
+	if portRangeMin < 1 || portRangeMax > 65535 || portRangeMin > portRangeMax {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("local_port_range_min"),
+			"Invalid local port range",
+			fmt.Sprintf("The local port range %d-%d must be within 1-65535 and local_port_range_min must not be greater than local_port_range_max", portRangeMin, portRangeMax),
+		)
+		return
+	}
+
+	if data.SSMMessagesEndpoint.ValueString() != "" {
+		if _, err := ssmtunnels.EndpointHost(data.SSMMessagesEndpoint.ValueString()); err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("ssmmessages_endpoint"),
+				"Invalid ssmmessages_endpoint",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+	}
+
+	if data.FIPS.ValueBool() {
+		resp.Diagnostics.Append(checkFIPSSettings(data)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		loadOptions = append(loadOptions, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+
+	if data.MaxConcurrentTunnels.ValueInt64() < 0 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("max_concurrent_tunnels"),
+			"Invalid max_concurrent_tunnels",
+			"max_concurrent_tunnels must not be negative",
+		)
+		return
+	}
+
+	if data.SourceIdentity.ValueString() != "" && !sourceIdentityPattern.MatchString(data.SourceIdentity.ValueString()) {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("source_identity"),
+			"Invalid source_identity",
+			"source_identity must be 2 to 64 characters of letters, digits and any of _+=,.@-",
+		)
+		return
+	}
+
+	if externalId := data.RoleExternalId.ValueString(); externalId != "" && (len(externalId) < 2 || len(externalId) > 1224 || !externalIdPattern.MatchString(externalId)) {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("role_external_id"),
+			"Invalid role_external_id",
+			"role_external_id must be 2 to 1224 characters of letters, digits and any of _+=,.@:/-",
+		)
+		return
+	}
+
+	maxConcurrentStarts := int64(defaultMaxConcurrentStarts)
+	if !data.MaxConcurrentStarts.IsNull() {
+		maxConcurrentStarts = data.MaxConcurrentStarts.ValueInt64()
+	}
+	if maxConcurrentStarts < 0 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("max_concurrent_session_starts"),
+			"Invalid max_concurrent_session_starts",
+			"max_concurrent_session_starts must not be negative",
+		)
+		return
+	}
+
+	var resolver *ssmtunnels.Resolver
+	if data.Resolver != nil {
+		var nameservers, searchDomains []string
+		for _, nameserver := range data.Resolver.Nameservers {
+			nameservers = append(nameservers, nameserver.ValueString())
+		}
+		for _, domain := range data.Resolver.SearchDomains {
+			searchDomains = append(searchDomains, domain.ValueString())
+		}
+		var err error
+		if resolver, err = ssmtunnels.NewResolver(nameservers, searchDomains); err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("resolver"),
+				"Invalid resolver",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+	}
+
+	var orphanedSessionAge time.Duration
+	if value := data.TerminateOrphaned; !value.IsNull() && !value.IsUnknown() {
+		age, err := time.ParseDuration(value.ValueString())
+		if err != nil || age <= 0 {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("terminate_orphaned_sessions_after"),
+				"Invalid terminate_orphaned_sessions_after",
+				fmt.Sprintf("%q is not a positive duration like 12h", value.ValueString()),
+			)
+			return
+		}
+		if data.SessionReasonPrefix.ValueString() == "" {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("session_reason_prefix"),
+				"Missing session reason prefix",
+				"terminate_orphaned_sessions_after only terminates sessions whose reason starts with session_reason_prefix, "+
+					"so the sessions of others are left alone. Set session_reason_prefix.",
+			)
+			return
+		}
+		orphanedSessionAge = age
+	}
+
+	var waitForTarget time.Duration
+	if value := data.WaitForTarget; !value.IsNull() && !value.IsUnknown() {
+		timeout, err := time.ParseDuration(value.ValueString())
+		if err != nil || timeout <= 0 {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("wait_for_target_timeout"),
+				"Invalid wait_for_target_timeout",
+				fmt.Sprintf("%q is not a positive duration like 5m", value.ValueString()),
+			)
+			return
+		}
+		waitForTarget = timeout
+	}
+
+	runner := defaultRunnerID(os.Getenv)
+	if !data.RunnerId.IsNull() && !data.RunnerId.IsUnknown() {
+		runner = data.RunnerId.ValueString()
+	}
+	if runner != "" {
+		log.Printf("Sessions are started by runner %q", runner)
+	}
+
+	var matrix *accessMatrix
+	if file := data.AccessMatrixFile.ValueString(); file != "" {
+		var err error
+		if matrix, err = newAccessMatrix(file, runner); err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("access_matrix_file"),
+				"Failed to write access matrix",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+	}
+
+	if !data.MaxRetries.IsNull() {
+		if data.MaxRetries.ValueInt64() < 0 {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("max_retries"),
+				"Invalid max_retries",
+				"max_retries must not be negative",
+			)
+			return
+		}
+		loadOptions = append(loadOptions, config.WithRetryMaxAttempts(int(data.MaxRetries.ValueInt64())+1))
+	}
+
+	if !data.RetryMode.IsNull() {
+		retryMode, err := aws.ParseRetryMode(data.RetryMode.ValueString())
 		if err != nil {
-			resp.Diagnostics.AddError(
-				"Failed to load AWS configuration",
+			resp.Diagnostics.AddAttributeError(
+				path.Root("retry_mode"),
+				"Invalid retry_mode",
+				fmt.Sprintf("retry_mode must be one of %q or %q", aws.RetryModeStandard, aws.RetryModeAdaptive),
+			)
+			return
+		}
+		loadOptions = append(loadOptions, config.WithRetryMode(retryMode))
+	}
+
+	if data.UserAgentSuffix.ValueString() != "" {
+		loadOptions = append(loadOptions, config.WithAPIOptions([]func(*middleware.Stack) error{
+			awsmiddleware.AddUserAgentKey(data.UserAgentSuffix.ValueString()),
+		}))
+	}
+
+	if data.LogAWSRequests.ValueBool() {
+		loadOptions = append(loadOptions,
+			config.WithClientLogMode(aws.LogRetries|aws.LogRequestWithBody|aws.LogResponseWithBody),
+			config.WithLogger(tflogLogger{redactor: redactor}.WithContext(ctx)),
+		)
+	}
+
+	proxy := ssmtunnels.ProxyConfig{
+		HTTPProxy:  data.HTTPProxy.ValueString(),
+		HTTPSProxy: data.HTTPSProxy.ValueString(),
+		NoProxy:    data.NoProxy.ValueString(),
+		PACURL:     data.ProxyPACURL.ValueString(),
+	}
+	tlsSettings := ssmtunnels.TLSConfig{
+		CABundle: data.CABundle.ValueString(),
+		Insecure: data.Insecure.ValueBool(),
+	}
+	tlsConfig, err := tlsSettings.ClientConfig()
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("ca_bundle"),
+			"Invalid ca_bundle",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+
+	// Offline the configuration is validated like otherwise, only nothing that needs AWS or
+	// the network, e.g. loading the AWS configuration or the proxy auto-config file
+	if data.Mock.ValueBool() || data.DisableTunnels.ValueBool() {
+		tracker := NewTunnelTracker(nil)
+		registerTracker(tracker)
+		registered = true
+		tracker.Redactor = redactor
+		tracker.Mock = true
+		tracker.PlaceholderPorts = data.DisableTunnels.ValueBool()
+		tracker.Runner = runner
+		configData := &ProvidedConfigData{
+			Tracker:       tracker,
+			Region:        data.Region.ValueString(),
+			Target:        data.Target.ValueString(),
+			Targets:       targets,
+			TargetUnknown: targetUnknown,
+
+			LocalPortRangeMin: int(portRangeMin),
+			LocalPortRangeMax: int(portRangeMax),
+
+			PreserveTunnelIds: data.PreserveTunnelIds.ValueBool(),
+
+			AccessMatrix: matrix,
+		}
+		tunnels, diags := startNamedTunnels(ctx, tracker, configData, data.Tunnels)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		configData.Tunnels = tunnels
+		resp.DataSourceData = configData
+		resp.ResourceData = configData
+		resp.EphemeralResourceData = configData
+		return
+	}
+
+	loadOptions = append(loadOptions, config.WithHTTPClient(
+		awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+			transport.Proxy = proxy.ProxyFunc()
+			if tlsConfig != nil {
+				transport.TLSClientConfig = tlsConfig
+			}
+		}),
+	))
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to load AWS configuration",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+
+	if proxy.PACURL != "" {
+		// Catch unreachable or unsupported PAC files now instead of when the first tunnel starts
+		if _, err := pac.Load(ctx, &http.Client{Transport: &http.Transport{Proxy: proxy.ProxyFunc(), TLSClientConfig: tlsConfig}}, proxy.PACURL); err != nil {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("proxy_pac_url"),
+				"Failed to load proxy auto-config file",
 				fmt.Sprintf("Error: %s", err),
 			)
 			return
@@ -217,28 +2190,111 @@ func (p *AwsSSMTunnelsProvider) Configure(ctx context.Context, req provider.Conf
 	}
 
 	svc := ssm.NewFromConfig(awsCfg)
+	ec2Client := ec2.NewFromConfig(awsCfg)
+	if data.FIPS.ValueBool() {
+		// Overridden endpoints are called as they are, FIPS or not
+		for _, endpoint := range []*string{awsCfg.BaseEndpoint, svc.Options().BaseEndpoint, ec2Client.Options().BaseEndpoint} {
+			if aws.ToString(endpoint) != "" {
+				resp.Diagnostics.AddAttributeError(
+					path.Root("fips"),
+					"Endpoint override in FIPS mode",
+					fmt.Sprintf("The AWS endpoint is overridden with %s, e.g. by AWS_ENDPOINT_URL or endpoint_url in the shared config, "+
+						"which fips doesn't allow since it can't ensure the endpoint is a FIPS endpoint", aws.ToString(endpoint)),
+				)
+				return
+			}
+		}
+	}
 	tracker := NewTunnelTracker(svc)
-	// NOTE: We should make a "client" struct which hides the SSM client, and has a method to start a tunnel and it keeps track of the tunnel session
-	// It should also handle the cancellation via context signalling
+	registerTracker(tracker)
+	registered = true
+	tracker.Redactor = redactor
+	tracker.EC2 = ec2Client
+	tracker.AWSConfig = awsCfg
+	tracker.Proxy = proxy
+	tracker.TLS = tlsSettings
+	tracker.MaxConcurrentTunnels = int(data.MaxConcurrentTunnels.ValueInt64())
+	tracker.MaxConcurrentStarts = int(maxConcurrentStarts)
+	tracker.MessagesEndpoint = data.SSMMessagesEndpoint.ValueString()
+	tracker.SessionReasonPrefix = data.SessionReasonPrefix.ValueString()
+	tracker.Runner = runner
+	tracker.SharedConfigFiles = sharedConfigFilesAsString
+	tracker.SourceIdentity = data.SourceIdentity.ValueString()
+	tracker.RoleExternalId = data.RoleExternalId.ValueString()
+	tracker.STSRegion = data.STSRegion.ValueString()
+	tracker.WaitForTarget = waitForTarget
+	tracker.AttachOperatorSessions = data.AttachOperatorSessions.ValueBool()
+	tracker.Resolver = resolver
+
+	if data.AuditLogGroup.ValueString() != "" {
+		auditLogger, err := audit.NewCloudWatchLogger(ctx, cloudwatchlogs.NewFromConfig(awsCfg), data.AuditLogGroup.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddError(
+				"Failed to create audit log stream",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		tracker.AuditLogger = auditLogger
+		tracker.OnConnectionClosed = auditLogger.LogConnection
+	}
+	if orphanedSessionAge > 0 {
+		resp.Diagnostics.Append(terminateOrphanedSessions(ctx, svc, tracker.SessionReasonPrefix, orphanedSessionAge)...)
+	}
+	// The checks run before the first session is started, see TunnelTracker.preflight
+	tracker.PreflightChecks = data.PreflightChecks.ValueBool()
 
 	configData := &ProvidedConfigData{
-		Tracker: tracker,
-		Region:  data.Region.ValueString(),
-		Target:  data.Target.ValueString(),
+		Tracker:       tracker,
+		Region:        awsCfg.Region,
+		Target:        data.Target.ValueString(),
+		Targets:       targets,
+		TargetUnknown: targetUnknown,
+
+		LocalPortRangeMin: int(portRangeMin),
+		LocalPortRangeMax: int(portRangeMax),
+
+		PreserveTunnelIds: data.PreserveTunnelIds.ValueBool(),
+
+		AccessMatrix: matrix,
+	}
+	tunnels, diags := startNamedTunnels(ctx, tracker, configData, data.Tunnels)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
+	configData.Tunnels = tunnels
 	resp.DataSourceData = configData
 	resp.ResourceData = configData
+	resp.EphemeralResourceData = configData
 }
 
 func (p *AwsSSMTunnelsProvider) Resources(ctx context.Context) []func() resource.Resource {
 	return []func() resource.Resource{
 		NewRemoteTunnelResource,
+		NewConnectivityCheckResource,
+		NewWaitForResource,
+		NewTunnelSetResource,
+		NewSessionDocumentResource,
+	}
+}
+
+func (p *AwsSSMTunnelsProvider) EphemeralResources(ctx context.Context) []func() ephemeral.EphemeralResource {
+	return []func() ephemeral.EphemeralResource{
+		NewRemoteTunnelEphemeralResource,
 	}
 }
 
 func (p *AwsSSMTunnelsProvider) DataSources(ctx context.Context) []func() datasource.DataSource {
 	return []func() datasource.DataSource{
 		NewKeepaliveDataSource,
+		NewTunnelDataSource,
+	}
+}
+
+func (p *AwsSSMTunnelsProvider) Functions(ctx context.Context) []func() function.Function {
+	return []func() function.Function{
+		NewPortFromKeyFunction,
 	}
 }
 
@@ -249,3 +2305,35 @@ func New(version string) func() provider.Provider {
 		}
 	}
 }
+
+// checkFIPSSettings rejects a provider configuration with fips which would
+// fall back to cryptography or endpoints outside of FIPS 140.
+func checkFIPSSettings(data AwsSSMTunnelsProviderModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !ssmtunnels.FIPSCrypto() {
+		diags.AddAttributeError(
+			path.Root("fips"),
+			"FIPS mode unavailable",
+			"fips needs a provider binary built with GOEXPERIMENT=boringcrypto, which uses the FIPS 140 validated "+
+				"BoringCrypto module. This binary uses the standard Go cryptography.",
+		)
+	}
+	if data.Insecure.ValueBool() {
+		diags.AddAttributeError(
+			path.Root("insecure"),
+			"Conflicting TLS settings",
+			"insecure can't be combined with fips, TLS certificates are always verified in FIPS mode",
+		)
+	}
+	if endpoint := data.SSMMessagesEndpoint.ValueString(); endpoint != "" {
+		if host, err := ssmtunnels.EndpointHost(endpoint); err == nil && !strings.HasPrefix(host, "ssmmessages-fips.") {
+			diags.AddAttributeError(
+				path.Root("ssmmessages_endpoint"),
+				"Invalid ssmmessages_endpoint",
+				fmt.Sprintf("%s isn't a FIPS endpoint, with fips the data channel uses ssmmessages-fips.<region> unless "+
+					"ssmmessages_endpoint is another ssmmessages-fips endpoint", host),
+			)
+		}
+	}
+	return diags
+}
@@ -4,10 +4,35 @@
 package provider
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // testAccProtoV6ProviderFactories are used to instantiate a provider during
@@ -18,8 +43,576 @@ var testAccProtoV6ProviderFactories = map[string]func() (tfprotov6.ProviderServe
 	"awsssmtunnels": providerserver.NewProtocol6WithError(New("test")()),
 }
 
+func TestMain(m *testing.M) {
+	// Sessions started by the tests run in the test binary, like in the provider binary
+	if ssmtunnels.IsPluginProcess() {
+		ssmtunnels.RunPlugin()
+		log.Fatal("session manager plugin exited")
+	}
+	os.Exit(m.Run())
+}
+
+func TestDefaultRunnerID(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := map[string]struct {
+		env  map[string]string
+		want string
+	}{
+		"github actions": {
+			env: map[string]string{
+				"GITHUB_ACTIONS":     "true",
+				"GITHUB_SERVER_URL":  "https://github.com",
+				"GITHUB_REPOSITORY":  "example/infra",
+				"GITHUB_RUN_ID":      "42",
+				"GITHUB_RUN_ATTEMPT": "2",
+			},
+			want: "https://github.com/example/infra/actions/runs/42/attempts/2",
+		},
+		"gitlab": {
+			env:  map[string]string{"CI_JOB_URL": "https://gitlab.example.com/infra/-/jobs/7"},
+			want: "https://gitlab.example.com/infra/-/jobs/7",
+		},
+		"buildkite": {
+			env:  map[string]string{"BUILDKITE_BUILD_URL": "https://buildkite.com/example/infra/builds/3", "BUILDKITE_JOB_ID": "abc"},
+			want: "https://buildkite.com/example/infra/builds/3#abc",
+		},
+		"jenkins": {
+			env:  map[string]string{"BUILD_URL": "https://jenkins.example.com/job/infra/5/"},
+			want: "https://jenkins.example.com/job/infra/5/",
+		},
+		"hcp terraform": {
+			env:  map[string]string{"TFC_RUN_ID": "run-abc"},
+			want: "tfc run run-abc",
+		},
+		"elsewhere": {
+			want: hostname,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := defaultRunnerID(func(key string) string { return test.env[key] }); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// testAccPreCheck skips acceptance tests unless TF_ACC is set. They run
+// against the Session Manager fake, see testAccFake, and need no AWS account.
 func testAccPreCheck(t *testing.T) {
-	// You can add code here to run prior to any test case execution, for example assertions
-	// about the appropriate environment variables being set are common to see in a pre-check
-	// function.
+	t.Helper()
+	if os.Getenv("TF_ACC") == "" {
+		t.Skip("Acceptance tests skipped unless env 'TF_ACC' set")
+	}
+}
+
+// waitForBlock returns a wait_for with only the given block, attributes
+// missing from values and the other blocks are null
+func waitForBlock(block string, values map[string]attr.Value) types.Object {
+	blocks := map[string]attr.Value{}
+	for name, blockType := range waitForType.AttrTypes {
+		blockType := blockType.(types.ObjectType)
+		if name != block {
+			blocks[name] = types.ObjectNull(blockType.AttrTypes)
+			continue
+		}
+		attrs := map[string]attr.Value{}
+		for name, attrType := range blockType.AttrTypes {
+			if value, ok := values[name]; ok {
+				attrs[name] = value
+				continue
+			}
+			null, err := attrType.ValueFromTerraform(context.Background(), tftypes.NewValue(attrType.TerraformType(context.Background()), nil))
+			if err != nil {
+				panic(err)
+			}
+			attrs[name] = null
+		}
+		blocks[name] = types.ObjectValueMust(blockType.AttrTypes, attrs)
+	}
+	return types.ObjectValueMust(waitForType.AttrTypes, blocks)
+}
+
+func TestWaitForReady(t *testing.T) {
+	resource := &RemoteTunnelResource{tracker: NewTunnelTracker(nil)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	listening := &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: listener.Addr().(*net.TCPAddr).Port}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	refusing := &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: closed.Addr().(*net.TCPAddr).Port}
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != "db.example.internal:5432" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer healthy.Close()
+	serving := &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: healthy.Listener.Addr().(*net.TCPAddr).Port}
+	waitFor := func(path string, status int64) types.Object {
+		return waitForBlock("http", map[string]attr.Value{
+			"path":            types.StringValue(path),
+			"expected_status": types.Int64Value(status),
+			"timeout":         types.StringValue("500ms"),
+		})
+	}
+
+	// postgresServer answers startup messages like a PostgreSQL server, with
+	// an authentication request or the error of a server starting up
+	postgresServer := func(starting bool) *OtherTunnelInfo {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					var length uint32
+					if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+						return
+					}
+					if _, err := io.CopyN(io.Discard, conn, int64(length)-4); err != nil {
+						return
+					}
+					if starting {
+						body := "SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00"
+						_, _ = conn.Write(append([]byte{'E', 0, 0, 0, byte(4 + len(body))}, body...))
+						return
+					}
+					// AuthenticationMD5Password with its salt
+					_, _ = conn.Write([]byte{'R', 0, 0, 0, 12, 0, 0, 0, 5, 1, 2, 3, 4})
+					_, _ = io.Copy(io.Discard, conn)
+				}()
+			}
+		}()
+		return &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: listener.Addr().(*net.TCPAddr).Port}
+	}
+	waitForPostgres := waitForBlock("postgres", map[string]attr.Value{
+		"user":    types.StringValue("app"),
+		"timeout": types.StringValue("500ms"),
+	})
+
+	// mysqlServer greets like a MySQL server, with a handshake or the error of
+	// a server shutting down
+	mysqlServer := func(greeting []byte) *OtherTunnelInfo {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(append([]byte{byte(len(greeting)), 0, 0, 0}, greeting...))
+				conn.Close()
+			}
+		}()
+		return &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: listener.Addr().(*net.TCPAddr).Port}
+	}
+	waitForMySQL := waitForBlock("mysql", map[string]attr.Value{
+		"timeout": types.StringValue("500ms"),
+	})
+
+	// The certificate of httptest is valid for example.com
+	secure := httptest.NewTLSServer(http.NotFoundHandler())
+	defer secure.Close()
+	handshaking := &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: secure.Listener.Addr().(*net.TCPAddr).Port}
+	waitForTLS := func(serverName string) types.Object {
+		return waitForBlock("tls", map[string]attr.Value{
+			"server_name": types.StringValue(serverName),
+			"verify_name": types.BoolValue(true),
+			"timeout":     types.StringValue("500ms"),
+		})
+	}
+
+	grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("billing", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go func() { _ = grpcServer.Serve(grpcListener) }()
+	defer grpcServer.Stop()
+	servingGRPC := &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: grpcListener.Addr().(*net.TCPAddr).Port}
+
+	// The same health service with the certificate of secure, for example.com.
+	// The provider's insecure only applies to AWS, so the certificate has to
+	// be trusted by the ca_bundle of the check.
+	resource.tracker.TLS = ssmtunnels.TLSConfig{Insecure: true}
+	secureGRPCListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secureGRPCServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: secure.TLS.Certificates})))
+	healthpb.RegisterHealthServer(secureGRPCServer, healthServer)
+	go func() { _ = secureGRPCServer.Serve(secureGRPCListener) }()
+	defer secureGRPCServer.Stop()
+	servingSecureGRPC := &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: secureGRPCListener.Addr().(*net.TCPAddr).Port}
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitForSecureGRPC := func(caBundle types.String) types.Object {
+		return waitForBlock("grpc", map[string]attr.Value{
+			"tls":       types.BoolValue(true),
+			"ca_bundle": caBundle,
+			"timeout":   types.StringValue("500ms"),
+		})
+	}
+
+	// The same goes for HTTPS, with the certificate of httptest too
+	healthySecure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != "example.com:5432" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer healthySecure.Close()
+	servingSecure := &OtherTunnelInfo{LocalHost: "127.0.0.1", LocalPort: healthySecure.Listener.Addr().(*net.TCPAddr).Port}
+	waitForSecureHTTP := func(caBundle types.String) types.Object {
+		return waitForBlock("http", map[string]attr.Value{
+			"path":            types.StringValue("/healthz"),
+			"expected_status": types.Int64Value(204),
+			"tls":             types.BoolValue(true),
+			"ca_bundle":       caBundle,
+			"timeout":         types.StringValue("500ms"),
+		})
+	}
+
+	waitForGRPC := func(service string) types.Object {
+		return waitForBlock("grpc", map[string]attr.Value{
+			"service": types.StringValue(service),
+			"timeout": types.StringValue("500ms"),
+		})
+	}
+
+	for name, tt := range map[string]struct {
+		tunnel     *OtherTunnelInfo
+		remoteHost string
+		timeout    types.String
+		lazy       bool
+		waitFor    types.Object
+		want       types.Bool
+		wantErr    string
+	}{
+		"http": {tunnel: serving, timeout: types.StringNull(), waitFor: waitFor("/healthz", 204), want: types.BoolValue(true)},
+		"http ca_bundle": {tunnel: servingSecure, remoteHost: "example.com", timeout: types.StringNull(),
+			waitFor: waitForSecureHTTP(types.StringValue(caBundle)), want: types.BoolValue(true)},
+		"http untrusted": {tunnel: servingSecure, remoteHost: "example.com", timeout: types.StringNull(),
+			waitFor: waitForSecureHTTP(types.StringNull()), want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"http status":       {tunnel: serving, timeout: types.StringNull(), waitFor: waitFor("/", 200), want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"postgres":          {tunnel: postgresServer(false), timeout: types.StringNull(), waitFor: waitForPostgres, want: types.BoolValue(true)},
+		"postgres starting": {tunnel: postgresServer(true), timeout: types.StringNull(), waitFor: waitForPostgres, want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"mysql":             {tunnel: mysqlServer([]byte("\x0a8.0.35\x00")), timeout: types.StringNull(), waitFor: waitForMySQL, want: types.BoolValue(true)},
+		"mysql shutting down": {tunnel: mysqlServer([]byte("\xff\x1d\x04#08S01Server shutdown in progress")), timeout: types.StringNull(),
+			waitFor: waitForMySQL, want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"tls":              {tunnel: handshaking, timeout: types.StringNull(), waitFor: waitForTLS("example.com"), want: types.BoolValue(true)},
+		"tls name":         {tunnel: handshaking, timeout: types.StringNull(), waitFor: waitForTLS("db.example.internal"), want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"tls plain":        {tunnel: listening, timeout: types.StringNull(), waitFor: waitForTLS("example.com"), want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"grpc":             {tunnel: servingGRPC, timeout: types.StringNull(), waitFor: waitForGRPC(""), want: types.BoolValue(true)},
+		"grpc not serving": {tunnel: servingGRPC, timeout: types.StringNull(), waitFor: waitForGRPC("billing"), want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"grpc ca_bundle": {tunnel: servingSecureGRPC, remoteHost: "example.com", timeout: types.StringNull(),
+			waitFor: waitForSecureGRPC(types.StringValue(caBundle)), want: types.BoolValue(true)},
+		"grpc untrusted": {tunnel: servingSecureGRPC, remoteHost: "example.com", timeout: types.StringNull(),
+			waitFor: waitForSecureGRPC(types.StringNull()), want: types.BoolNull(), wantErr: "Remote tunnel probe failed"},
+		"lazy with http":    {tunnel: serving, timeout: types.StringNull(), lazy: true, waitFor: waitFor("/healthz", 204), want: types.BoolValue(true)},
+		"accepting":         {tunnel: listening, timeout: types.StringNull(), want: types.BoolValue(true)},
+		"refusing":          {tunnel: refusing, timeout: types.StringValue("500ms"), want: types.BoolNull(), wantErr: "Tunnel not ready"},
+		"lazy":              {tunnel: refusing, timeout: types.StringNull(), lazy: true, want: types.BoolValue(false)},
+		"lazy with timeout": {tunnel: listening, timeout: types.StringValue("5s"), lazy: true, want: types.BoolValue(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			remoteHost := "db.example.internal"
+			if tt.remoteHost != "" {
+				remoteHost = tt.remoteHost
+			}
+			ready, diags := resource.waitForReady(context.Background(), SSMRemoteTunnelResourceModel{
+				Id:                  types.StringValue("db"),
+				RemoteHost:          types.StringValue(remoteHost),
+				RemotePort:          types.Int64Value(5432),
+				Lazy:                types.BoolValue(tt.lazy),
+				WaitForReadyTimeout: tt.timeout,
+				WaitFor:             tt.waitFor,
+			}, tt.tunnel)
+			if !ready.Equal(tt.want) {
+				t.Errorf("got ready %v, want %v", ready, tt.want)
+			}
+			if errs := diags.Errors(); (len(errs) > 0) != (tt.wantErr != "") || (len(errs) > 0 && errs[0].Summary() != tt.wantErr) {
+				t.Errorf("got errors %v, want %q", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckConnection(t *testing.T) {
+	// serve accepts connections and hands them to handle
+	serve := func(handle func(net.Conn)) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go handle(conn)
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	// A connection which stays open counts, whether the remote host answers or not
+	silent := serve(func(conn net.Conn) {
+		time.Sleep(2 * time.Second)
+		conn.Close()
+	})
+	if _, err := checkConnection(context.Background(), silent); err != nil {
+		t.Errorf("got %v for a connection which stays open", err)
+	}
+
+	// Like the plugin does with connections the SSM agent can't forward
+	closing := serve(func(conn net.Conn) { conn.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := checkConnection(ctx, closing); err == nil || !strings.Contains(err.Error(), "connection closed by the remote side") {
+		t.Errorf("got %v, want connections closed right away to fail", err)
+	}
+}
+
+func TestPortFromKeyFunction(t *testing.T) {
+	server, err := providerserver.NewProtocol6WithError(New("test")())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(key string, rangeStart, rangeEnd int64) (int64, *tfprotov6.FunctionError) {
+		t.Helper()
+		resp, err := server.CallFunction(context.Background(), &tfprotov6.CallFunctionRequest{
+			Name: "port_from_key",
+			Arguments: []*tfprotov6.DynamicValue{
+				dynamicValue(t, tftypes.String, tftypes.NewValue(tftypes.String, key)),
+				dynamicValue(t, tftypes.Number, tftypes.NewValue(tftypes.Number, rangeStart)),
+				dynamicValue(t, tftypes.Number, tftypes.NewValue(tftypes.Number, rangeEnd)),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != nil {
+			return 0, resp.Error
+		}
+		result, err := resp.Result.Unmarshal(tftypes.Number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var port big.Float
+		if err := result.As(&port); err != nil {
+			t.Fatal(err)
+		}
+		value, _ := port.Int64()
+		return value, nil
+	}
+
+	// Plan and apply run in separate processes, they have to agree on the port
+	first, funcErr := call("metrics", 9100, 9199)
+	if funcErr != nil {
+		t.Fatal(funcErr.Text)
+	}
+	if first < 9100 || first > 9199 {
+		t.Errorf("got port %d, want one within 9100-9199", first)
+	}
+	// Taking the port doesn't change the result
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.FormatInt(first, 10)))
+	if err == nil {
+		defer listener.Close()
+	}
+	for i := 0; i < 10; i++ {
+		if again, _ := call("metrics", 9100, 9199); again != first {
+			t.Fatalf("got port %d, then %d for the same key", first, again)
+		}
+	}
+	if single, _ := call("metrics", 9100, 9100); single != 9100 {
+		t.Errorf("got port %d from a range of one port, want 9100", single)
+	}
+
+	for name, tt := range map[string]struct {
+		rangeStart, rangeEnd int64
+		argument             int64
+	}{
+		"start too low":   {rangeStart: 0, rangeEnd: 9199, argument: 1},
+		"end too high":    {rangeStart: 9100, rangeEnd: 65536, argument: 2},
+		"end below start": {rangeStart: 9199, rangeEnd: 9100, argument: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, funcErr := call("metrics", tt.rangeStart, tt.rangeEnd)
+			if funcErr == nil || funcErr.FunctionArgument == nil || *funcErr.FunctionArgument != tt.argument {
+				t.Errorf("got error %+v, want one for argument %d", funcErr, tt.argument)
+			}
+		})
+	}
+}
+
+func TestSanitizeSDKLog(t *testing.T) {
+	for name, tt := range map[string]struct {
+		message string
+		want    string
+	}{
+		"authorization header": {
+			message: "POST / HTTP/1.1\r\nHost: ssm.us-east-1.amazonaws.com\r\nAuthorization: AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/20240101/us-east-1/ssm/aws4_request, Signature=abc123\r\n",
+			want:    "POST / HTTP/1.1\r\nHost: ssm.us-east-1.amazonaws.com\r\nAuthorization: ***\r\n",
+		},
+		"security token header": {
+			message: "Content-Type: application/x-amz-json-1.1\nx-amz-security-token: IQoJb3JpZ2luX2VjE\nX-Amz-Target: AmazonSSM.StartSession",
+			want:    "Content-Type: application/x-amz-json-1.1\nx-amz-security-token: ***\nX-Amz-Target: AmazonSSM.StartSession",
+		},
+		"start session response": {
+			message: `{"SessionId":"ops-0123","StreamUrl":"wss://ssmmessages.us-east-1.amazonaws.com/v1/data-channel/ops-0123","TokenValue":"AAEAAb7p+token"}`,
+			want:    `{"SessionId":"ops-0123","StreamUrl":"wss://ssmmessages.us-east-1.amazonaws.com/v1/data-channel/ops-0123","TokenValue":"***"}`,
+		},
+		"assume role json credentials": {
+			message: `{"Credentials": {"AccessKeyId": "ASIAEXAMPLE", "SecretAccessKey" : "wJalrXUtnFEMI", "SessionToken":"FwoGZXIvYXdz"}}`,
+			want:    `{"Credentials": {"AccessKeyId": "ASIAEXAMPLE", "SecretAccessKey" : "***", "SessionToken":"***"}}`,
+		},
+		"assume role xml credentials": {
+			message: "<Credentials><AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>wJalrXUtnFEMI</SecretAccessKey><SessionToken>FwoGZXIvYXdz</SessionToken></Credentials>",
+			want:    "<Credentials><AccessKeyId>ASIAEXAMPLE</AccessKeyId><SecretAccessKey>***</SecretAccessKey><SessionToken>***</SessionToken></Credentials>",
+		},
+		"presigned query string": {
+			message: "GET /?Action=GetCallerIdentity&X-Amz-Credential=AKIAEXAMPLE%2F20240101&X-Amz-Security-Token=IQoJb3&X-Amz-Signature=abc123 HTTP/1.1",
+			want:    "GET /?Action=GetCallerIdentity&X-Amz-Credential=***&X-Amz-Security-Token=***&X-Amz-Signature=*** HTTP/1.1",
+		},
+		"stream url query string": {
+			message: "wss://ssmmessages.us-east-1.amazonaws.com/v1/data-channel/ops-0123?x-amz-security-token=IQoJb3",
+			want:    "wss://ssmmessages.us-east-1.amazonaws.com/v1/data-channel/ops-0123?x-amz-security-token=***",
+		},
+		"nothing sensitive": {
+			message: `{"InstanceInformationList":[{"InstanceId":"i-0123456789abcdef0","PingStatus":"Online"}]}`,
+			want:    `{"InstanceInformationList":[{"InstanceId":"i-0123456789abcdef0","PingStatus":"Online"}]}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := sanitizeSDKLog(tt.message); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	hosts := newRedactor([]*regexp.Regexp{regexp.MustCompile(`db\.corp\.example`)})
+	accounts := newRedactor([]*regexp.Regexp{regexp.MustCompile(`\d{12}`)})
+	message := "Starting tunnel to db.corp.example in 123456789012\n"
+
+	// The AWS SDK logs of a provider instance are redacted with its own patterns only
+	if got, want := hosts.Redact(message), "Starting tunnel to *** in 123456789012\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := accounts.Redact(message), "Starting tunnel to db.corp.example in ***\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	var none *redactor
+	if got := none.Redact(message); got != message {
+		t.Errorf("got %q without patterns, want the message unchanged", got)
+	}
+
+	// The standard logger is redacted with the patterns of every instance, until its tunnels are closed
+	var buf bytes.Buffer
+	writer := &redactingWriter{w: &buf}
+	hosts.register()
+	accounts.register()
+	defer hosts.unregister()
+	defer accounts.unregister()
+	if _, err := writer.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	accounts.unregister()
+	if _, err := writer.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "Starting tunnel to *** in ***\nStarting tunnel to *** in 123456789012\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	tracker := NewTunnelTracker(nil)
+	tracker.Redactor = hosts
+	if err := tracker.CloseAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	redactorsMu.RLock()
+	_, registered := redactors[hosts]
+	redactorsMu.RUnlock()
+	if registered {
+		t.Error("the patterns still apply once the tunnels of the instance are closed")
+	}
+}
+
+func TestProbeTunnel(t *testing.T) {
+	// A gRPC health service with the certificate of an httptest server, for example.com
+	secure := httptest.NewTLSServer(http.NotFoundHandler())
+	defer secure.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: secure.TLS.Certificates})))
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go func() { _ = grpcServer.Serve(listener) }()
+	defer grpcServer.Stop()
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider's insecure is for AWS and doesn't make the probe skip verification
+	tracker := NewTunnelTracker(nil)
+	tracker.TLS = ssmtunnels.TLSConfig{Insecure: true}
+	for name, tt := range map[string]struct {
+		probe   TunnelProbe
+		wantErr bool
+	}{
+		"ca_bundle":     {probe: TunnelProbe{Type: probeTypeGRPC, TLS: true, CABundle: caBundle, Timeout: 5 * time.Second}},
+		"untrusted":     {probe: TunnelProbe{Type: probeTypeGRPC, TLS: true, Timeout: time.Second}, wantErr: true},
+		"plain to tls":  {probe: TunnelProbe{Type: probeTypeGRPC, Timeout: time.Second}, wantErr: true},
+		"missing ca":    {probe: TunnelProbe{Type: probeTypeGRPC, TLS: true, CABundle: filepath.Join(t.TempDir(), "missing.pem"), Timeout: time.Second}, wantErr: true},
+		"unknown probe": {probe: TunnelProbe{Type: "http", Timeout: time.Second}, wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tracker.probeTunnel(context.Background(), TunnelSpec{RemoteHost: "example.com", Probe: &tt.probe}, listener.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want one: %v", err, tt.wantErr)
+			}
+		})
+	}
 }
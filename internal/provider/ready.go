@@ -0,0 +1,470 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// defaultReadyTimeout bounds the end-to-end check of tunnels without wait_for_ready_timeout.
+const defaultReadyTimeout = time.Minute
+
+// defaultWaitForTimeout bounds the checks of wait_for without their timeout.
+const defaultWaitForTimeout = 5 * time.Minute
+
+// defaultPostgresUser is the user the postgres check of wait_for starts up as.
+const defaultPostgresUser = "postgres"
+
+// WaitForModel describes the wait_for block of a tunnel.
+type WaitForModel struct {
+	HTTP     types.Object `tfsdk:"http"`
+	Postgres types.Object `tfsdk:"postgres"`
+	MySQL    types.Object `tfsdk:"mysql"`
+	TLS      types.Object `tfsdk:"tls"`
+	GRPC     types.Object `tfsdk:"grpc"`
+}
+
+// WaitForHTTPModel describes the http block of wait_for.
+type WaitForHTTPModel struct {
+	Path           types.String `tfsdk:"path"`
+	ExpectedStatus types.Int64  `tfsdk:"expected_status"`
+	Timeout        types.String `tfsdk:"timeout"`
+	TLS            types.Bool   `tfsdk:"tls"`
+	CABundle       types.String `tfsdk:"ca_bundle"`
+}
+
+// WaitForMySQLModel describes the mysql block of wait_for.
+type WaitForMySQLModel struct {
+	Timeout types.String `tfsdk:"timeout"`
+}
+
+// WaitForTLSModel describes the tls block of wait_for.
+type WaitForTLSModel struct {
+	ServerName types.String `tfsdk:"server_name"`
+	VerifyName types.Bool   `tfsdk:"verify_name"`
+	Timeout    types.String `tfsdk:"timeout"`
+}
+
+// WaitForGRPCModel describes the grpc block of wait_for.
+type WaitForGRPCModel struct {
+	Service  types.String `tfsdk:"service"`
+	TLS      types.Bool   `tfsdk:"tls"`
+	CABundle types.String `tfsdk:"ca_bundle"`
+	Timeout  types.String `tfsdk:"timeout"`
+}
+
+// WaitForPostgresModel describes the postgres block of wait_for.
+type WaitForPostgresModel struct {
+	User     types.String `tfsdk:"user"`
+	Database types.String `tfsdk:"database"`
+	Timeout  types.String `tfsdk:"timeout"`
+}
+
+var waitForHTTPType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"path":            types.StringType,
+	"expected_status": types.Int64Type,
+	"timeout":         types.StringType,
+	"tls":             types.BoolType,
+	"ca_bundle":       types.StringType,
+}}
+
+var waitForPostgresType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"user":     types.StringType,
+	"database": types.StringType,
+	"timeout":  types.StringType,
+}}
+
+var waitForMySQLType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"timeout": types.StringType,
+}}
+
+var waitForTLSType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"server_name": types.StringType,
+	"verify_name": types.BoolType,
+	"timeout":     types.StringType,
+}}
+
+var waitForGRPCType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"service":   types.StringType,
+	"tls":       types.BoolType,
+	"ca_bundle": types.StringType,
+	"timeout":   types.StringType,
+}}
+
+var waitForType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"http":     waitForHTTPType,
+	"postgres": waitForPostgresType,
+	"mysql":    waitForMySQLType,
+	"tls":      waitForTLSType,
+	"grpc":     waitForGRPCType,
+}}
+
+// waitForChecks are the checks of the wait_for block of a tunnel, see
+// parseWaitFor. A nil check isn't done.
+type waitForChecks struct {
+	http     *httpCheck
+	postgres *postgresCheck
+	// mysql is the timeout of the mysql check
+	mysql *time.Duration
+	tls   *tlsCheck
+	grpc  *grpcCheck
+}
+
+// httpCheck is the HTTP request a tunnel waits to succeed.
+type httpCheck struct {
+	path           string
+	expectedStatus int
+	timeout        time.Duration
+	tls            bool
+	caBundle       string
+}
+
+// postgresCheck is the PostgreSQL server a tunnel waits to accept connections.
+type postgresCheck struct {
+	user     string
+	database string
+	timeout  time.Duration
+}
+
+// tlsCheck is the TLS handshake a tunnel waits to succeed.
+type tlsCheck struct {
+	// serverName is empty for the remote host of the tunnel
+	serverName string
+	verifyName bool
+	timeout    time.Duration
+}
+
+// grpcCheck is the gRPC service a tunnel waits to report SERVING.
+type grpcCheck struct {
+	service  string
+	tls      bool
+	caBundle string
+	timeout  time.Duration
+}
+
+// none returns whether there are no checks to do.
+func (c waitForChecks) none() bool {
+	return c.http == nil && c.postgres == nil && c.mysql == nil && c.tls == nil && c.grpc == nil
+}
+
+// parseWaitFor returns the checks of the wait_for block of a tunnel, leaving
+// out those which aren't set or known yet.
+func parseWaitFor(ctx context.Context, waitFor types.Object) (waitForChecks, diag.Diagnostics) {
+	var checks waitForChecks
+	var diags diag.Diagnostics
+	if waitFor.IsNull() || waitFor.IsUnknown() {
+		return checks, diags
+	}
+	var block WaitForModel
+	diags.Append(waitFor.As(ctx, &block, basetypes.ObjectAsOptions{})...)
+	if diags.HasError() {
+		return checks, diags
+	}
+
+	if !block.HTTP.IsNull() && !block.HTTP.IsUnknown() {
+		var http WaitForHTTPModel
+		diags.Append(block.HTTP.As(ctx, &http, basetypes.ObjectAsOptions{})...)
+		if diags.HasError() {
+			return checks, diags
+		}
+		at := path.Root("wait_for").AtName("http")
+		checks.http = &httpCheck{path: "/", expectedStatus: 200, tls: http.TLS.ValueBool(), caBundle: http.CABundle.ValueString()}
+		if !http.Path.IsNull() {
+			checks.http.path = http.Path.ValueString()
+			if !http.Path.IsUnknown() && !strings.HasPrefix(checks.http.path, "/") {
+				diags.AddAttributeError(
+					at.AtName("path"),
+					"Invalid path",
+					fmt.Sprintf("%q must start with /", checks.http.path),
+				)
+			}
+		}
+		if !http.ExpectedStatus.IsNull() {
+			checks.http.expectedStatus = int(http.ExpectedStatus.ValueInt64())
+			if !http.ExpectedStatus.IsUnknown() && (checks.http.expectedStatus < 100 || checks.http.expectedStatus > 599) {
+				diags.AddAttributeError(
+					at.AtName("expected_status"),
+					"Invalid expected_status",
+					fmt.Sprintf("%d is not an HTTP status code", checks.http.expectedStatus),
+				)
+			}
+		}
+		var timeoutDiags diag.Diagnostics
+		checks.http.timeout, timeoutDiags = parseWaitForTimeout(http.Timeout, at)
+		diags.Append(timeoutDiags...)
+	}
+
+	if !block.Postgres.IsNull() && !block.Postgres.IsUnknown() {
+		var postgres WaitForPostgresModel
+		diags.Append(block.Postgres.As(ctx, &postgres, basetypes.ObjectAsOptions{})...)
+		if diags.HasError() {
+			return checks, diags
+		}
+		checks.postgres = &postgresCheck{user: defaultPostgresUser, database: postgres.Database.ValueString()}
+		if !postgres.User.IsNull() && postgres.User.ValueString() != "" {
+			checks.postgres.user = postgres.User.ValueString()
+		}
+		var timeoutDiags diag.Diagnostics
+		checks.postgres.timeout, timeoutDiags = parseWaitForTimeout(postgres.Timeout, path.Root("wait_for").AtName("postgres"))
+		diags.Append(timeoutDiags...)
+	}
+
+	if !block.MySQL.IsNull() && !block.MySQL.IsUnknown() {
+		var mysql WaitForMySQLModel
+		diags.Append(block.MySQL.As(ctx, &mysql, basetypes.ObjectAsOptions{})...)
+		if diags.HasError() {
+			return checks, diags
+		}
+		timeout, timeoutDiags := parseWaitForTimeout(mysql.Timeout, path.Root("wait_for").AtName("mysql"))
+		diags.Append(timeoutDiags...)
+		checks.mysql = &timeout
+	}
+
+	if !block.TLS.IsNull() && !block.TLS.IsUnknown() {
+		var tls WaitForTLSModel
+		diags.Append(block.TLS.As(ctx, &tls, basetypes.ObjectAsOptions{})...)
+		if diags.HasError() {
+			return checks, diags
+		}
+		checks.tls = &tlsCheck{serverName: tls.ServerName.ValueString(), verifyName: tls.VerifyName.ValueBool()}
+		var timeoutDiags diag.Diagnostics
+		checks.tls.timeout, timeoutDiags = parseWaitForTimeout(tls.Timeout, path.Root("wait_for").AtName("tls"))
+		diags.Append(timeoutDiags...)
+	}
+
+	if !block.GRPC.IsNull() && !block.GRPC.IsUnknown() {
+		var grpc WaitForGRPCModel
+		diags.Append(block.GRPC.As(ctx, &grpc, basetypes.ObjectAsOptions{})...)
+		if diags.HasError() {
+			return checks, diags
+		}
+		checks.grpc = &grpcCheck{service: grpc.Service.ValueString(), tls: grpc.TLS.ValueBool(), caBundle: grpc.CABundle.ValueString()}
+		var timeoutDiags diag.Diagnostics
+		checks.grpc.timeout, timeoutDiags = parseWaitForTimeout(grpc.Timeout, path.Root("wait_for").AtName("grpc"))
+		diags.Append(timeoutDiags...)
+	}
+	return checks, diags
+}
+
+// parseWaitForTimeout returns the timeout of a check of wait_for, the default if it isn't set.
+func parseWaitForTimeout(value types.String, at path.Path) (time.Duration, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	if value.IsNull() || value.IsUnknown() {
+		return defaultWaitForTimeout, diags
+	}
+	timeout, err := time.ParseDuration(value.ValueString())
+	if err != nil || timeout <= 0 {
+		diags.AddAttributeError(
+			at.AtName("timeout"),
+			"Invalid timeout",
+			fmt.Sprintf("%q is not a positive duration like 2m", value.ValueString()),
+		)
+	}
+	return timeout, diags
+}
+
+// parseReadyTimeout returns the wait_for_ready_timeout of a tunnel, zero if it isn't set.
+func parseReadyTimeout(value types.String, at path.Path) (time.Duration, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	if value.IsNull() || value.IsUnknown() {
+		return 0, diags
+	}
+	duration, err := time.ParseDuration(value.ValueString())
+	if err != nil || duration <= 0 {
+		diags.AddAttributeError(
+			at.AtName("wait_for_ready_timeout"),
+			"Invalid wait_for_ready_timeout",
+			fmt.Sprintf("%q is not a positive duration like 2m", value.ValueString()),
+		)
+	}
+	return duration, diags
+}
+
+// waitForReady connects through the tunnel until a connection stays open, see
+// checkConnection, so resources depending on ready don't race
+// the data channel of the session coming up, and then until the checks of
+// wait_for succeed. A tunnel failing the checks is closed, unless other
+// resources use it. Lazy tunnels are only checked with wait_for_ready_timeout
+// or wait_for, as the check starts their session. Tunnels of offline providers
+// are always ready.
+func (d *RemoteTunnelResource) waitForReady(ctx context.Context, data SSMRemoteTunnelResourceModel, tunnel *OtherTunnelInfo) (types.Bool, diag.Diagnostics) {
+	timeout, diags := parseReadyTimeout(data.WaitForReadyTimeout, path.Empty())
+	checks, checkDiags := parseWaitFor(ctx, data.WaitFor)
+	diags.Append(checkDiags...)
+	if diags.HasError() {
+		return types.BoolNull(), diags
+	}
+	if d.tracker.Offline() {
+		return basetypes.NewBoolValue(true), diags
+	}
+	if timeout == 0 {
+		if data.Lazy.ValueBool() && checks.none() {
+			return basetypes.NewBoolValue(false), diags
+		}
+		timeout = defaultReadyTimeout
+	}
+
+	remote := net.JoinHostPort(data.RemoteHost.ValueString(), strconv.FormatInt(data.RemotePort.ValueInt64(), 10))
+	err := checkTunnel(ctx, tunnel, remote, timeout)
+	if err == nil && checks.http != nil {
+		err = d.checkHTTP(ctx, data, tunnel, *checks.http)
+	}
+	if err == nil && checks.postgres != nil {
+		err = checkPostgres(ctx, tunnel, *checks.postgres)
+	}
+	if err == nil && checks.mysql != nil {
+		err = checkMySQL(ctx, tunnel, *checks.mysql)
+	}
+	if err == nil && checks.tls != nil {
+		err = checkTLS(ctx, data, tunnel, *checks.tls)
+	}
+	if err == nil && checks.grpc != nil {
+		err = d.checkGRPC(ctx, data, tunnel, *checks.grpc)
+	}
+	if err != nil {
+		diags.AddError(
+			startTunnelErrorSummary(err),
+			failureDetail(fmt.Sprintf("Error: %s", err), err),
+		)
+		if closeErr := d.tracker.CloseTunnelsOn(context.Background(), data.Id.ValueString(), tunnel.LocalPort); closeErr != nil {
+			log.Printf("Error closing the tunnel to %q which isn't ready: %v", remote, closeErr)
+		}
+		return types.BoolNull(), diags
+	}
+	return basetypes.NewBoolValue(true), diags
+}
+
+// checkHTTP requests the path of the check through the tunnel until it
+// answers with the expected status, see ssmtunnels.WaitForHTTP. Like
+// checkGRPC, the certificate is verified against the system roots and the
+// ca_bundle of the check only.
+func (d *RemoteTunnelResource) checkHTTP(ctx context.Context, data SSMRemoteTunnelResourceModel, tunnel *OtherTunnelInfo, check httpCheck) error {
+	tlsConfig, err := ssmtunnels.TLSConfig{CABundle: check.caBundle}.ClientConfig()
+	if err != nil {
+		return err
+	}
+	remoteHost, err := ssmtunnels.NormalizeHost(data.RemoteHost.ValueString())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	return ssmtunnels.WaitForHTTP(ctx, ssmtunnels.HTTPHealthConfig{
+		Addr:           net.JoinHostPort(tunnel.LocalHost, strconv.Itoa(tunnel.LocalPort)),
+		RemoteHost:     remoteHost,
+		RemotePort:     int(data.RemotePort.ValueInt64()),
+		Path:           check.path,
+		ExpectedStatus: check.expectedStatus,
+		TLS:            check.tls,
+		TLSConfig:      tlsConfig,
+	})
+}
+
+// checkPostgres starts up as the user of the check through the tunnel until
+// the server accepts connections, see ssmtunnels.WaitForPostgres.
+func checkPostgres(ctx context.Context, tunnel *OtherTunnelInfo, check postgresCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	return ssmtunnels.WaitForPostgres(ctx, ssmtunnels.PostgresHealthConfig{
+		Addr:     net.JoinHostPort(tunnel.LocalHost, strconv.Itoa(tunnel.LocalPort)),
+		User:     check.user,
+		Database: check.database,
+	})
+}
+
+// checkMySQL connects through the tunnel until the server greets with its
+// handshake, see ssmtunnels.WaitForMySQL.
+func checkMySQL(ctx context.Context, tunnel *OtherTunnelInfo, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return ssmtunnels.WaitForMySQL(ctx, ssmtunnels.MySQLHealthConfig{
+		Addr: net.JoinHostPort(tunnel.LocalHost, strconv.Itoa(tunnel.LocalPort)),
+	})
+}
+
+// checkTLS completes TLS handshakes through the tunnel until one succeeds,
+// see ssmtunnels.WaitForTLSHandshake.
+func checkTLS(ctx context.Context, data SSMRemoteTunnelResourceModel, tunnel *OtherTunnelInfo, check tlsCheck) error {
+	serverName := check.serverName
+	if serverName == "" {
+		var err error
+		if serverName, err = ssmtunnels.NormalizeHost(data.RemoteHost.ValueString()); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	return ssmtunnels.WaitForTLSHandshake(ctx, ssmtunnels.TLSHandshakeConfig{
+		Addr:       net.JoinHostPort(tunnel.LocalHost, strconv.Itoa(tunnel.LocalPort)),
+		ServerName: serverName,
+		VerifyName: check.verifyName,
+	})
+}
+
+// checkGRPC calls the standard gRPC health checking protocol through the
+// tunnel until the service reports SERVING, see ssmtunnels.WaitForGRPCHealth.
+// The certificate is verified against the system roots and the ca_bundle of
+// the check, never the provider's TLS settings, which are meant for AWS.
+func (d *RemoteTunnelResource) checkGRPC(ctx context.Context, data SSMRemoteTunnelResourceModel, tunnel *OtherTunnelInfo, check grpcCheck) error {
+	tlsConfig, err := ssmtunnels.TLSConfig{CABundle: check.caBundle}.ClientConfig()
+	if err != nil {
+		return err
+	}
+	remoteHost, err := ssmtunnels.NormalizeHost(data.RemoteHost.ValueString())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	return ssmtunnels.WaitForGRPCHealth(ctx, ssmtunnels.GRPCHealthConfig{
+		Addr:       net.JoinHostPort(tunnel.LocalHost, strconv.Itoa(tunnel.LocalPort)),
+		Service:    check.service,
+		TLS:        check.tls,
+		ServerName: remoteHost,
+		TLSConfig:  tlsConfig,
+	})
+}
+
+// tunnelNotReadyError means no connection through a tunnel stayed open in
+// time, although the session started.
+type tunnelNotReadyError struct {
+	local   string
+	remote  string
+	timeout time.Duration
+	err     error
+}
+
+func (e *tunnelNotReadyError) Error() string {
+	return fmt.Sprintf("could not connect to %s through the tunnel on %s within %s: %s", e.remote, e.local, e.timeout, e.err)
+}
+
+func (e *tunnelNotReadyError) Unwrap() error {
+	return e.err
+}
+
+// checkTunnel connects through the local listener of the tunnel until a
+// connection stays open, see checkConnection for what that confirms. A listener
+// alone only means the session started, connections may still be reset until
+// its data channel is up.
+func checkTunnel(ctx context.Context, tunnel *OtherTunnelInfo, remote string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	local := net.JoinHostPort(tunnel.LocalHost, strconv.Itoa(tunnel.LocalPort))
+	latency, err := checkConnection(ctx, local)
+	if err != nil {
+		return &tunnelNotReadyError{local: local, remote: remote, timeout: timeout, err: err}
+	}
+	log.Printf("Tunnel to %q on port %d is ready, connecting took %s", remote, tunnel.LocalPort, latency)
+	return nil
+}
@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 30 * time.Second
+	// defaultReconnectTimeout bounds starting a new session without the
+	// provider's wait_for_target_timeout
+	defaultReconnectTimeout = 5 * time.Minute
+)
+
+// keepSession starts a new session once the session of a tunnel which needs
+// one to be live ended, e.g. after the SSM agent restarted or the data channel
+// dropped in a network blip, so the local port keeps carrying connections
+// instead of refusing them until the next resource asks for the tunnel. Failed
+// attempts are retried with exponential backoff until one succeeds, the tunnel
+// is closed, or WaitForTarget passed, defaultReconnectTimeout if it isn't set.
+// The error of the last attempt is reported by the keepalive data source until
+// a session started, e.g. by the next connection. Lazy tunnels and tunnels
+// closing idle sessions start a new session on the next connection instead.
+func (t *TunnelTracker) keepSession(tunnel *OtherTunnelInfo, session *ssmtunnels.Session) {
+	if tunnel.reconnect == nil || tunnel.spec.Lazy || tunnel.spec.CloseAfterIdle > 0 {
+		return
+	}
+	<-session.Done()
+
+	remote := net.JoinHostPort(tunnel.spec.RemoteHost, strconv.Itoa(tunnel.spec.RemotePort))
+	deadline := time.Now().Add(cmp.Or(t.WaitForTarget, defaultReconnectTimeout))
+	delay := reconnectBaseDelay
+	for attempt := 1; tunnel.sessionEnded(); attempt++ {
+		log.Printf("Session %s of the tunnel to %q on port %d ended, starting a new one (attempt %d): %v", session.Id, remote, tunnel.LocalPort, attempt, session.Err())
+		// The new session is kept by the keepSession connectLazy starts for it
+		err := tunnel.reconnect()
+		if err == nil || errors.Is(err, errTrackerClosed) {
+			return
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			log.Printf("Error starting a new session for the tunnel to %q, giving up until the next connection: %v", remote, err)
+			return
+		}
+		wait := min(delay, remaining)
+		log.Printf("Error starting a new session for the tunnel to %q, retrying in %s: %v", remote, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-tunnel.forwarder.Stopped():
+			return
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
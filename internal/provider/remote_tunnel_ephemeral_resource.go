@@ -0,0 +1,370 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// ephemeralRenewInterval is how often Terraform renews an open ephemeral
+// tunnel, well within the idle session timeout of Session Manager.
+const ephemeralRenewInterval = 5 * time.Minute
+
+// ephemeralTunnelKey is the key of the private data of an open ephemeral tunnel.
+const ephemeralTunnelKey = "tunnel"
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ ephemeral.EphemeralResource = &RemoteTunnelEphemeralResource{}
+var _ ephemeral.EphemeralResourceWithConfigure = &RemoteTunnelEphemeralResource{}
+var _ ephemeral.EphemeralResourceWithRenew = &RemoteTunnelEphemeralResource{}
+var _ ephemeral.EphemeralResourceWithClose = &RemoteTunnelEphemeralResource{}
+
+func NewRemoteTunnelEphemeralResource() ephemeral.EphemeralResource {
+	return &RemoteTunnelEphemeralResource{}
+}
+
+// RemoteTunnelEphemeralResource opens a tunnel for the run only. Its endpoint
+// never lands in the state, and Terraform closes it once nothing needs it.
+type RemoteTunnelEphemeralResource struct {
+	tracker *TunnelTracker
+	region  string
+	target  string
+	targets []string
+
+	portRangeMin int
+	portRangeMax int
+
+	// targetUnknown is set while planning when the provider target is only known after apply
+	targetUnknown bool
+}
+
+// RemoteTunnelEphemeralResourceModel describes the ephemeral resource data model.
+type RemoteTunnelEphemeralResourceModel struct {
+	RemoteHost          types.String `tfsdk:"remote_host"`
+	RemotePort          types.Int64  `tfsdk:"remote_port"`
+	LocalHost           types.String `tfsdk:"local_host"`
+	LocalPort           types.Int64  `tfsdk:"local_port"`
+	Region              types.String `tfsdk:"region"`
+	RoleArn             types.String `tfsdk:"role_arn"`
+	Profile             types.String `tfsdk:"profile"`
+	WaitForReadyTimeout types.String `tfsdk:"wait_for_ready_timeout"`
+	Target              types.String `tfsdk:"target"`
+	Platform            types.String `tfsdk:"platform"`
+	Id                  types.String `tfsdk:"id"`
+}
+
+// ephemeralTunnel is the private data of an open ephemeral tunnel, which
+// Renew and Close get instead of its configuration.
+type ephemeralTunnel struct {
+	Id        string `json:"id"`
+	LocalPort int    `json:"local_port"`
+}
+
+func (d *RemoteTunnelEphemeralResource) Metadata(ctx context.Context, req ephemeral.MetadataRequest, resp *ephemeral.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_remote_tunnel"
+}
+
+func (d *RemoteTunnelEphemeralResource) Schema(ctx context.Context, req ephemeral.SchemaRequest, resp *ephemeral.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Opens a tunnel for the run only, needs Terraform 1.10 or later. The tunnel is opened when a provider " +
+			"or resource refers to it, renewed during long applies and closed once nothing needs it anymore, so its endpoint " +
+			"never lands in the state. Providers configured from it don't need `depends_on` on `awsssmtunnels_keepalive`. " +
+			"A session which ended is started again on the same local port when the tunnel is renewed. Tunnels to the same " +
+			"endpoint as an `awsssmtunnels_remote_tunnel` share its session.",
+
+		Attributes: map[string]schema.Attribute{
+			"remote_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the remote host. IPv6 addresses can be given with or without brackets",
+				Required:            true,
+			},
+			"remote_port": schema.Int64Attribute{
+				MarkdownDescription: "The port number of the remote host",
+				Required:            true,
+			},
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the local host. Defaults to `127.0.0.1`",
+				Optional:            true,
+				Computed:            true,
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: "The local port number to use for the tunnel. Defaults to a free port of the provider's local port range",
+				Optional:            true,
+				Computed:            true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "The region of the target. Defaults to the provider region",
+				Optional:            true,
+				Computed:            true,
+			},
+			"role_arn": schema.StringAttribute{
+				MarkdownDescription: "ARN of a role to assume for starting the session, e.g. for a target in another account. " +
+					"Defaults to the provider credentials",
+				Optional: true,
+			},
+			"profile": schema.StringAttribute{
+				MarkdownDescription: "Named profile of the shared config files whose credentials start the session. Combined with " +
+					"`role_arn`, the role is assumed with the profile credentials. Defaults to the provider credentials",
+				Optional: true,
+			},
+			"wait_for_ready_timeout": schema.StringAttribute{
+				MarkdownDescription: "How long to connect through the tunnel until a connection stays open, before failing, as a " +
+					"duration like `2m`. Defaults to `1m`",
+				Optional: true,
+			},
+			"target": schema.StringAttribute{
+				MarkdownDescription: "The target serving the tunnel, one of the provider's `targets` if it has several",
+				Computed:            true,
+			},
+			"platform": schema.StringAttribute{
+				MarkdownDescription: "The platform of the target as detected by its SSM agent, `Linux`, `Windows` or `MacOS`. Null if it couldn't be detected",
+				Computed:            true,
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "Identifier of the tunnel, derived like the one of `awsssmtunnels_remote_tunnel`",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *RemoteTunnelEphemeralResource) Configure(ctx context.Context, req ephemeral.ConfigureRequest, resp *ephemeral.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Ephemeral Resource Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tracker = configData.Tracker
+	d.region = configData.Region
+	d.target = configData.Target
+	d.targets = configData.Targets
+	d.portRangeMin = configData.LocalPortRangeMin
+	d.portRangeMax = configData.LocalPortRangeMax
+	d.targetUnknown = configData.TargetUnknown
+}
+
+func (d *RemoteTunnelEphemeralResource) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
+	var data RemoteTunnelEphemeralResourceModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(validatePort(data.RemotePort, path.Root("remote_port"))...)
+	resp.Diagnostics.Append(validateRegion(data.Region, path.Root("region"))...)
+	timeout, diags := parseReadyTimeout(data.WaitForReadyTimeout, path.Empty())
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if timeout == 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	if d.targetUnknown {
+		// Terraform supporting deferred actions opens the tunnel again once the target is known
+		if req.ClientCapabilities.DeferralAllowed {
+			resp.Deferred = &ephemeral.Deferred{Reason: ephemeral.DeferredReasonProviderConfigUnknown}
+			return
+		}
+		resp.Diagnostics.AddError(
+			"Target not known yet",
+			"The target of the provider is only known after apply, so the tunnel can't be opened while planning.",
+		)
+		return
+	}
+
+	if data.LocalHost.IsNull() {
+		data.LocalHost = basetypes.NewStringValue(defaultLocalHost)
+	}
+	if data.Region.IsNull() {
+		data.Region = basetypes.NewStringValue(d.region)
+	}
+	data.Id = basetypes.NewStringValue(tunnelIdentity{
+		target:     targetKeyOf(d.target, d.targets),
+		region:     data.Region.ValueString(),
+		remoteHost: data.RemoteHost.ValueString(),
+		remotePort: int(data.RemotePort.ValueInt64()),
+		localHost:  data.LocalHost.ValueString(),
+		localPort:  int(data.LocalPort.ValueInt64()),
+		roleArn:    data.RoleArn.ValueString(),
+		profile:    data.Profile.ValueString(),
+	}.id())
+	spec := TunnelSpec{
+		Id:         data.Id.ValueString(),
+		Target:     d.target,
+		Targets:    d.targets,
+		Region:     data.Region.ValueString(),
+		RemoteHost: data.RemoteHost.ValueString(),
+		RemotePort: int(data.RemotePort.ValueInt64()),
+		LocalHost:  data.LocalHost.ValueString(),
+		LocalPort:  int(data.LocalPort.ValueInt64()),
+		RoleArn:    data.RoleArn.ValueString(),
+		Profile:    data.Profile.ValueString(),
+	}
+
+	// Share a matching tunnel, e.g. of an awsssmtunnels_remote_tunnel, like Create does
+	tunnelInfo, release, err := d.tracker.AcquireTunnel(ctx, spec)
+	defer release()
+	if err != nil {
+		resp.Diagnostics.AddError(
+			startTunnelErrorSummary(err),
+			failureDetail(fmt.Sprintf("Error: %s", err), err),
+		)
+		return
+	}
+	if tunnelInfo == nil {
+		port, err := pickLocalPort(d.tracker, spec.LocalHost, spec.LocalPort, spec.RemoteHost, spec.RemotePort, d.portRangeMin, d.portRangeMax)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				"Failed to find open port",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		spec.LocalPort = port
+
+		tunnelInfo, err = d.tracker.StartTunnel(ctx, spec)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				startTunnelErrorSummary(err),
+				failureDetail(fmt.Sprintf("Error: %s", err), err),
+			)
+			return
+		}
+	}
+
+	if !d.tracker.Offline() {
+		remote := net.JoinHostPort(spec.RemoteHost, strconv.Itoa(spec.RemotePort))
+		if err := checkTunnel(ctx, tunnelInfo, remote, timeout); err != nil {
+			resp.Diagnostics.AddError(
+				startTunnelErrorSummary(err),
+				failureDetail(fmt.Sprintf("Error: %s", err), err),
+			)
+			if closeErr := d.tracker.CloseTunnelsOn(context.Background(), spec.Id, tunnelInfo.LocalPort); closeErr != nil {
+				resp.Diagnostics.AddWarning(
+					"Failed to close tunnel",
+					fmt.Sprintf("Error: %s", closeErr),
+				)
+			}
+			return
+		}
+	}
+
+	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
+	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
+	data.Target = basetypes.NewStringValue(tunnelInfo.Target())
+	data.Platform = platformValue(tunnelInfo)
+
+	private, _ := json.Marshal(ephemeralTunnel{Id: spec.Id, LocalPort: tunnelInfo.LocalPort})
+	resp.Diagnostics.Append(resp.Private.SetKey(ctx, ephemeralTunnelKey, private)...)
+	resp.RenewAt = time.Now().Add(ephemeralRenewInterval)
+
+	resp.Diagnostics.Append(resp.Result.Set(ctx, &data)...)
+}
+
+// Renew starts a new session on the same local port if the session of the
+// tunnel ended, e.g. after the idle session timeout of Session Manager.
+func (d *RemoteTunnelEphemeralResource) Renew(ctx context.Context, req ephemeral.RenewRequest, resp *ephemeral.RenewResponse) {
+	opened, diags := d.openedTunnel(ctx, req.Private)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tunnel := d.tracker.usedTunnelOn(opened.Id, opened.LocalPort)
+	if tunnel == nil {
+		// Tunnels of offline providers aren't tracked, there is nothing to renew
+		if d.tracker.Offline() {
+			return
+		}
+		resp.Diagnostics.AddError(
+			"Tunnel closed",
+			fmt.Sprintf("The tunnel on port %d was closed by the provider, see the provider log for why.", opened.LocalPort),
+		)
+		return
+	}
+	if tunnel.sessionEnded() {
+		if err := d.tracker.reviveTunnel(tunnel); err != nil {
+			resp.Diagnostics.AddError(
+				startTunnelErrorSummary(err),
+				failureDetail(fmt.Sprintf("Error: %s", err), err),
+			)
+			return
+		}
+	}
+	resp.RenewAt = time.Now().Add(ephemeralRenewInterval)
+}
+
+// Close stops using the tunnel, closing it unless resources still share it.
+func (d *RemoteTunnelEphemeralResource) Close(ctx context.Context, req ephemeral.CloseRequest, resp *ephemeral.CloseResponse) {
+	opened, diags := d.openedTunnel(ctx, req.Private)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if err := d.tracker.CloseTunnelsOn(ctx, opened.Id, opened.LocalPort); err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to close remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+}
+
+// privateData is the private data Renew and Close get from the framework.
+type privateData interface {
+	GetKey(ctx context.Context, key string) ([]byte, diag.Diagnostics)
+}
+
+// openedTunnel reads which tunnel Open opened from the private data.
+func (d *RemoteTunnelEphemeralResource) openedTunnel(ctx context.Context, private privateData) (ephemeralTunnel, diag.Diagnostics) {
+	var opened ephemeralTunnel
+	value, diags := private.GetKey(ctx, ephemeralTunnelKey)
+	if diags.HasError() {
+		return opened, diags
+	}
+	if err := json.Unmarshal(value, &opened); err != nil {
+		diags.AddError(
+			"Invalid private data",
+			fmt.Sprintf("Error reading the tunnel opened by the ephemeral resource: %s. Please report this issue to the provider developers.", err),
+		)
+	}
+	return opened, diags
+}
+
+// usedTunnelOn returns the tunnel listening on the local port which the ID
+// uses, or nil.
+func (t *TunnelTracker) usedTunnelOn(id string, port int) *OtherTunnelInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tunnel := range t.started {
+		if tunnel.LocalPort == port && slices.Contains(tunnel.users, id) {
+			return tunnel
+		}
+	}
+	return nil
+}
@@ -1,22 +1,47 @@
 package provider
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"log"
+	"net"
 	"strconv"
 	"strings"
+	"unicode"
 
-	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ports"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
 	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/booldefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64default"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 )
 
+const (
+	defaultLocalHost         = "127.0.0.1"
+	defaultLocalPortRangeMin = 16000
+	defaultLocalPortRangeMax = 26000
+
+	defaultProbeTimeoutSeconds = 300
+)
+
 // Ensure provider defined types fully satisfy framework interfaces.
 var _ resource.Resource = &RemoteTunnelResource{}
 var _ resource.ResourceWithImportState = &RemoteTunnelResource{}
+var _ resource.ResourceWithModifyPlan = &RemoteTunnelResource{}
+var _ resource.ResourceWithUpgradeState = &RemoteTunnelResource{}
 
 func NewRemoteTunnelResource() resource.Resource {
 	return &RemoteTunnelResource{}
@@ -27,52 +52,461 @@ type RemoteTunnelResource struct {
 	tracker *TunnelTracker
 	region  string
 	target  string
+	targets []string
+
+	portRangeMin int
+	portRangeMax int
+
+	// accessMatrix is nil unless the provider writes one, see accessMatrix
+	accessMatrix *accessMatrix
+
+	preserveIds bool
+	// targetUnknown is set while planning when the provider target is only known after apply
+	targetUnknown bool
 }
 
 // SSMRemoteTunnelDataSourceModel describes the data source data model.
 type SSMRemoteTunnelResourceModel struct {
 	RefreshId  types.String `tfsdk:"refresh_id"`
+	Triggers   types.Map    `tfsdk:"triggers"`
 	RemoteHost types.String `tfsdk:"remote_host"`
 	RemotePort types.Int64  `tfsdk:"remote_port"`
 	LocalPort  types.Int64  `tfsdk:"local_port"`
 	LocalHost  types.String `tfsdk:"local_host"`
 	Id         types.String `tfsdk:"id"`
+	Target     types.String `tfsdk:"target"`
+	Region     types.String `tfsdk:"region"`
+	RoleArn    types.String `tfsdk:"role_arn"`
+	Profile    types.String `tfsdk:"profile"`
+	Rewrite    types.List   `tfsdk:"rewrite"`
+
+	WaitForVPCEndpoints types.List   `tfsdk:"wait_for_vpc_endpoints"`
+	WaitForTargetOnline types.Bool   `tfsdk:"wait_for_target_online"`
+	MaxTransferBytes    types.Int64  `tfsdk:"max_transfer_bytes"`
+	MaxConnections      types.Int64  `tfsdk:"max_connections"`
+	MaxQueued           types.Int64  `tfsdk:"max_queued_connections"`
+	BandwidthWeight     types.Int64  `tfsdk:"bandwidth_weight"`
+	Lazy                types.Bool   `tfsdk:"lazy"`
+	CloseAfterIdle      types.String `tfsdk:"close_after_idle"`
+	ProbeCommand        types.String `tfsdk:"probe_command"`
+	ProbeTimeoutSeconds types.Int64  `tfsdk:"probe_timeout_seconds"`
+	Probe               types.Object `tfsdk:"probe"`
+	Adopted             types.Bool   `tfsdk:"adopted"`
+	RequirePlatform     types.String `tfsdk:"require_platform"`
+	Platform            types.String `tfsdk:"platform"`
+	DocumentName        types.String `tfsdk:"document_name"`
+	StableLocalPort     types.Bool   `tfsdk:"stable_local_port"`
+	WaitForReadyTimeout types.String `tfsdk:"wait_for_ready_timeout"`
+	Ready               types.Bool   `tfsdk:"ready"`
+	DrainTimeout        types.String `tfsdk:"drain_timeout"`
+	WaitFor             types.Object `tfsdk:"wait_for"`
+	Timeouts            types.Object `tfsdk:"timeouts"`
+}
+
+// ProbeModel describes the probe of a tunnel.
+type ProbeModel struct {
+	Type           types.String `tfsdk:"type"`
+	Service        types.String `tfsdk:"service"`
+	TLS            types.Bool   `tfsdk:"tls"`
+	CABundle       types.String `tfsdk:"ca_bundle"`
+	TimeoutSeconds types.Int64  `tfsdk:"timeout_seconds"`
 }
 
+var probeType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"type":            types.StringType,
+	"service":         types.StringType,
+	"tls":             types.BoolType,
+	"ca_bundle":       types.StringType,
+	"timeout_seconds": types.Int64Type,
+}}
+
+// RewriteRuleModel describes a rewrite rule of a tunnel.
+type RewriteRuleModel struct {
+	Direction types.String `tfsdk:"direction"`
+	Match     types.String `tfsdk:"match"`
+	Replace   types.String `tfsdk:"replace"`
+	Regex     types.Bool   `tfsdk:"regex"`
+}
+
+var rewriteRuleType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"direction": types.StringType,
+	"match":     types.StringType,
+	"replace":   types.StringType,
+	"regex":     types.BoolType,
+}}
+
 func (d *RemoteTunnelResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
 	resp.TypeName = req.ProviderTypeName + "_remote_tunnel"
 }
 
 func (d *RemoteTunnelResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
+		Version: 1,
+
 		MarkdownDescription: "AWSM SSM Remote Tunnel data source",
 
 		Attributes: map[string]schema.Attribute{
 			"refresh_id": schema.StringAttribute{
-				MarkdownDescription: "Any value as this will trigger a refresh",
+				MarkdownDescription: "Any value, changing it starts the tunnel again",
 				Required:            true,
 			},
+			"triggers": schema.MapAttribute{
+				MarkdownDescription: "Arbitrary values which replace the tunnel when they change, like the `triggers` of `null_resource`, " +
+					"e.g. the ID of the RDS instance behind `remote_host`, so its session is started again once the instance was " +
+					"replaced. A tunnel shared with other resources keeps its session while they use it",
+				ElementType: types.StringType,
+				Optional:    true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
 			"remote_host": schema.StringAttribute{
-				MarkdownDescription: "The DNS name or IP address of the remote host",
-				Required:            true,
+				MarkdownDescription: "The DNS name or IP address of the remote host. IPv6 addresses can be given with or without brackets. " +
+					"Changing it replaces the tunnel",
+				Required: true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
 			},
 			"remote_port": schema.Int64Attribute{
-				MarkdownDescription: "The port number of the remote host",
+				MarkdownDescription: "The port number of the remote host. Changing it replaces the tunnel",
 				Required:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
 			},
 			"local_host": schema.StringAttribute{
 				MarkdownDescription: "The DNS name or IP address of the local host",
+				Optional:            true,
 				Computed:            true,
+				Default:             stringdefault.StaticString(defaultLocalHost),
 			},
 			"local_port": schema.Int64Attribute{
-				MarkdownDescription: "The local port number to use for the tunnel",
+				MarkdownDescription: "The local port number to use for the tunnel. Changing only it moves the running tunnel " +
+					"to the new port, keeping its session and open connections",
+				Optional: true,
+				Computed: true,
+			},
+			"wait_for_ready_timeout": schema.StringAttribute{
+				MarkdownDescription: "How long to connect through the tunnel until a connection stays open, before " +
+					"failing, as a duration like `2m`. Defaults to `1m`. `lazy` tunnels are only checked if it is set, as the check " +
+					"starts their session",
+				Optional: true,
+			},
+			"ready": schema.BoolAttribute{
+				MarkdownDescription: "True once a connection through the tunnel was accepted and stayed open for a second, checked " +
+					"whenever the tunnel is started, including at the start of every run. The SSM agent may only connect to the remote " +
+					"host once data is sent, so only `wait_for` confirms that the remote host answers. It is only known after the " +
+					"check, so resources referring to it " +
+					"wait for the tunnel to carry connections. With `wait_for`, its checks have to succeed as well. False for `lazy` " +
+					"tunnels without `wait_for_ready_timeout` or `wait_for`",
+				Computed: true,
+			},
+			"drain_timeout": schema.StringAttribute{
+				MarkdownDescription: "How long destroying the tunnel waits for connections open through it to finish, as a duration " +
+					"like `30s`, refusing new ones meanwhile, so resources still using the tunnel while it is destroyed aren't " +
+					"cut off mid-transfer. Connections still open afterwards are closed. Without it, they are closed right away. " +
+					"Tunnels shared with other resources keep running for them",
+				Optional: true,
+			},
+			"stable_local_port": schema.BoolAttribute{
+				MarkdownDescription: "Without `local_port`, derive the local port from the target and the remote endpoint " +
+					"instead of picking a free one, so it is known while planning and the same in every run. The port is " +
+					"in the provider's local port range. Tunnels whose ports collide, or a port taken by another process, " +
+					"fail to start, set `local_port` for them instead. Can't be combined with `local_port`.",
+				Optional: true,
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "Identifier of the tunnel, derived from the target, region, remote host and remote port, and the " +
+					"local host, local port, role ARN and profile if they are configured. " +
+					"The provider's `preserve_tunnel_ids` keeps the ID of the state instead, e.g. one given as last part of the import ID",
+				Computed: true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "The region of the target. Defaults to the provider region. Changing it, or the provider " +
+					"region it defaults to, replaces the tunnel",
+				Optional: true,
+				Computed: true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"role_arn": schema.StringAttribute{
+				MarkdownDescription: "ARN of a role to assume for starting the session, e.g. for a target in another account. " +
+					"Defaults to the provider credentials",
+				Optional: true,
+			},
+			"profile": schema.StringAttribute{
+				MarkdownDescription: "Named profile of the shared config files whose credentials start the session, so tunnels " +
+					"with different profiles don't need provider aliases. Combined with `role_arn`, the role is assumed with " +
+					"the profile credentials. Defaults to the provider credentials",
+				Optional: true,
+			},
+			"rewrite": schema.ListNestedAttribute{
+				MarkdownDescription: "Rules rewriting the data forwarded through the tunnel, applied in order. Meant for " +
+					"text protocols, e.g. rewriting absolute redirect URLs of a private web console to the local endpoint. " +
+					"Matches split across reads are rewritten too, regular expressions only match within a line. Nothing is " +
+					"parsed, so replacing text in an HTTP body with text of another length breaks its `Content-Length`: " +
+					"rewrite headers, like `Location`, instead.",
+				Optional: true,
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"direction": schema.StringAttribute{
+							MarkdownDescription: "`request` to rewrite data sent to the remote host, `response` to rewrite data received from it",
+							Optional:            true,
+							Computed:            true,
+							Default:             stringdefault.StaticString(string(ssmtunnels.RewriteResponse)),
+						},
+						"match": schema.StringAttribute{
+							MarkdownDescription: "The text to replace, or a regular expression if `regex` is true",
+							Required:            true,
+						},
+						"replace": schema.StringAttribute{
+							MarkdownDescription: "The replacement. With `regex`, `$1` style references to capture groups are expanded",
+							Required:            true,
+						},
+						"regex": schema.BoolAttribute{
+							MarkdownDescription: "Whether `match` is a regular expression",
+							Optional:            true,
+							Computed:            true,
+							Default:             booldefault.StaticBool(false),
+						},
+					},
+				},
+			},
+			"max_connections": schema.Int64Attribute{
+				MarkdownDescription: "The maximum number of local connections forwarded at the same time. Further connections " +
+					"are accepted but wait for a free slot, so bursts of connections, e.g. from many parallel kubernetes " +
+					"resources, don't overwhelm the single data channel of the session. How long a connection waited is " +
+					"included in the audit log as `queued_ns`.",
+				Optional: true,
+			},
+			"max_queued_connections": schema.Int64Attribute{
+				MarkdownDescription: "The maximum number of local connections waiting for a slot of `max_connections`. Further " +
+					"connections are closed right away, so clients fail and retry instead of piling up behind a saturated " +
+					"tunnel. The queue is reported in the `tunnel_stats` of `awsssmtunnels_keepalive`. Defaults to no limit",
+				Optional: true,
+			},
+			"lazy": schema.BoolAttribute{
+				MarkdownDescription: "Listen on the local port right away but only start the session once the first connection " +
+					"arrives, so configurations declaring many tunnels only open those a run actually uses. `wait_for_vpc_endpoints` " +
+					"and `probe_command` are then checked by the first connection too, and failures to start the session are " +
+					"reported by `awsssmtunnels_keepalive`. Can't be combined with `probe`.",
+				Optional: true,
+			},
+			"close_after_idle": schema.StringAttribute{
+				MarkdownDescription: "Terminate the session once no local connection was open for this long, as a duration like " +
+					"`15m`, while the tunnel stays in the state and keeps listening on the local port. The next connection starts " +
+					"a new session like for `lazy` tunnels, so slow, human-paced applies don't hold sessions they don't use.",
+				Optional: true,
+			},
+			"bandwidth_weight": schema.Int64Attribute{
+				MarkdownDescription: "The share of the network this tunnel gets, relative to the other tunnels of the provider with " +
+					"a weight, while their transfers saturate it, between `1` and `8`. Writes of those tunnels take turns in small pieces, so a " +
+					"bulk transfer through one tunnel doesn't starve the API calls going through another even at equal weights. Tunnels " +
+					"without it write right away and don't take turns.",
+				Optional: true,
+			},
+			"max_transfer_bytes": schema.Int64Attribute{
+				MarkdownDescription: "Close the tunnel once this many bytes were forwarded through it, counting both " +
+					"directions over all connections. Exceeding the limit fails the apply through `awsssmtunnels_keepalive`, " +
+					"and refreshing the tunnel until it is replaced or the next run.",
+				Optional: true,
+			},
+			"probe": schema.SingleNestedAttribute{
+				MarkdownDescription: "Readiness check done through the tunnel once it is up. The tunnel is only handed out, " +
+					"and the apply continues, once the check succeeded, for services which are provisioned and then configured in one apply.",
+				Optional: true,
+				DeprecationMessage: "Use the grpc block of wait_for instead, which checks the same and verifies the certificate " +
+					"against its own ca_bundle. probe will be removed in the next major version.",
+				Attributes: map[string]schema.Attribute{
+					"type": schema.StringAttribute{
+						MarkdownDescription: "`grpc` to call the standard gRPC health checking protocol (`grpc.health.v1.Health/Check`) until it reports `SERVING`",
+						Required:            true,
+						Validators:          []validator.String{oneOf{summary: "Invalid probe type", values: []string{probeTypeGRPC}}},
+					},
+					"service": schema.StringAttribute{
+						MarkdownDescription: "The service to check. Defaults to the server as a whole",
+						Optional:            true,
+					},
+					"tls": schema.BoolAttribute{
+						MarkdownDescription: "Connect with TLS, verifying the certificate against `remote_host`",
+						Optional:            true,
+					},
+					"ca_bundle": schema.StringAttribute{
+						MarkdownDescription: "Path to a PEM file with certificates trusted with `tls` in addition to the system's. " +
+							"The provider's `ca_bundle` and `insecure` only apply to AWS",
+						Optional: true,
+					},
+					"timeout_seconds": schema.Int64Attribute{
+						MarkdownDescription: "How long to retry the check before failing. Defaults to 300",
+						Optional:            true,
+					},
+				},
+			},
+			"probe_command": schema.StringAttribute{
+				MarkdownDescription: "Shell command run on the target with SSM Run Command (`AWS-RunShellScript`, Linux targets only) " +
+					"before the tunnel is started, e.g. `pg_isready -h <remote_host>`. It is retried until it exits with 0, " +
+					"for services whose readiness can't be judged from a TCP connect.",
+				Optional: true,
+			},
+			"probe_timeout_seconds": schema.Int64Attribute{
+				MarkdownDescription: "How long to retry `probe_command` before failing. Defaults to 300",
 				Optional:            true,
 				Computed:            true,
+				Default:             int64default.StaticInt64(defaultProbeTimeoutSeconds),
 			},
-			"id": schema.StringAttribute{
-				MarkdownDescription: "Example identifier", // TODO: Figure this out
+			"target": schema.StringAttribute{
+				MarkdownDescription: "The target serving the tunnel, one of the provider's `targets` when it spreads tunnels across several",
 				Computed:            true,
 			},
+			"platform": schema.StringAttribute{
+				MarkdownDescription: "The platform of the target as detected by its SSM agent, `Linux`, `Windows` or `MacOS`. Null if " +
+					"it couldn't be detected, e.g. for ECS tasks or without permission to `ssm:DescribeInstanceInformation`",
+				Computed: true,
+			},
+			"document_name": schema.StringAttribute{
+				MarkdownDescription: "Name of the session document the session is started with, e.g. of an " +
+					"`awsssmtunnels_session_document` only allowing the hosts and ports the tunnels need. Defaults to " +
+					"`AWS-StartPortForwardingSessionToRemoteHost`",
+				Optional: true,
+			},
+			"require_platform": schema.StringAttribute{
+				MarkdownDescription: "Fail before starting the session unless the target runs this platform, `Linux`, `Windows` " +
+					"or `MacOS`, for commands and documents which only exist there. Requires `ssm:DescribeInstanceInformation`. " +
+					"Targets running Windows are always refused for `probe_command`.",
+				Optional: true,
+			},
+			"adopted": schema.BoolAttribute{
+				MarkdownDescription: "Whether creating the resource adopted a matching tunnel which was already running in the " +
+					"provider, e.g. a tunnel of the provider's `tunnels` or of another resource with the same settings, or a session " +
+					"of the operator with `attach_operator_sessions`, instead of starting a new session. A tunnel shared by " +
+					"several resources stays open until the last of them is destroyed",
+				Computed: true,
+			},
+			"wait_for_vpc_endpoints": schema.ListAttribute{
+				MarkdownDescription: "IDs of VPC endpoints (`ssm`, `ssmmessages`, `ec2messages`) to wait for before starting the tunnel. " +
+					"Useful when the endpoints are created in the same apply as the tunnel. Waits up to 10 minutes.",
+				ElementType: types.StringType,
+				Optional:    true,
+			},
+			"wait_for_target_online": schema.BoolAttribute{
+				MarkdownDescription: "Wait for the SSM agent of the target to report it online before starting the tunnel, polling " +
+					"`ssm:DescribeInstanceInformation`, for instances created in the same apply as the tunnel which are still booting. " +
+					"Also lets `require_platform` check the platform of such instances. Waits up to 10 minutes.",
+				Optional: true,
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeoutsBlock(),
+			"wait_for": schema.SingleNestedBlock{
+				MarkdownDescription: "Checks through the tunnel which have to succeed, after the connection check of `ready`, " +
+					"before the tunnel is handed out and `ready`, e.g. for internal load balancers, admin APIs and databases which " +
+					"accept connections before they serve requests",
+				Blocks: map[string]schema.Block{
+					"http": schema.SingleNestedBlock{
+						MarkdownDescription: "Request a path with GET until it answers with the expected status. The request is " +
+							"sent with `remote_host` as Host header, and redirects aren't followed",
+						Attributes: map[string]schema.Attribute{
+							"path": schema.StringAttribute{
+								MarkdownDescription: "The path to request, e.g. `/healthz`. Defaults to `/`",
+								Optional:            true,
+							},
+							"expected_status": schema.Int64Attribute{
+								MarkdownDescription: "The status code to wait for. Defaults to `200`",
+								Optional:            true,
+							},
+							"timeout": schema.StringAttribute{
+								MarkdownDescription: "How long to retry the request before failing, as a duration like `2m`. Defaults to `5m`",
+								Optional:            true,
+							},
+							"tls": schema.BoolAttribute{
+								MarkdownDescription: "Request with HTTPS, verifying the certificate against `remote_host`",
+								Optional:            true,
+							},
+							"ca_bundle": schema.StringAttribute{
+								MarkdownDescription: "Path to a PEM file with certificates trusted with `tls` in addition to the system's. " +
+									"The provider's `ca_bundle` and `insecure` only apply to AWS",
+								Optional: true,
+							},
+						},
+					},
+					"postgres": schema.SingleNestedBlock{
+						MarkdownDescription: "Start up a PostgreSQL connection until the server accepts connections, instead of " +
+							"answering that the database system is starting up, shutting down or in recovery. The check stops " +
+							"at the authentication request and never sends a password, so errors about the user, database or " +
+							"`pg_hba.conf` count as accepting connections too",
+						Attributes: map[string]schema.Attribute{
+							"user": schema.StringAttribute{
+								MarkdownDescription: "The user sent in the startup message. Defaults to `postgres`",
+								Optional:            true,
+							},
+							"database": schema.StringAttribute{
+								MarkdownDescription: "The database sent in the startup message. Defaults to the database of the user",
+								Optional:            true,
+							},
+							"timeout": schema.StringAttribute{
+								MarkdownDescription: "How long to retry the check before failing, as a duration like `2m`. Defaults to `5m`",
+								Optional:            true,
+							},
+						},
+					},
+					"mysql": schema.SingleNestedBlock{
+						MarkdownDescription: "Connect until the MySQL server greets with its handshake, instead of an error about " +
+							"too many connections, shutting down or being unavailable, e.g. while Aurora fails over. The check " +
+							"closes the connection after the greeting and never authenticates, so an error about the host not " +
+							"being allowed counts as accepting connections too",
+						Attributes: map[string]schema.Attribute{
+							"timeout": schema.StringAttribute{
+								MarkdownDescription: "How long to retry the check before failing, as a duration like `2m`. Defaults to `5m`",
+								Optional:            true,
+							},
+						},
+					},
+					"tls": schema.SingleNestedBlock{
+						MarkdownDescription: "Complete a TLS handshake until it succeeds, e.g. for OpenSearch domains and internal " +
+							"HTTPS services whose certificates are still provisioning. The certificate chain isn't verified",
+						Attributes: map[string]schema.Attribute{
+							"server_name": schema.StringAttribute{
+								MarkdownDescription: "The name sent with SNI. Defaults to `remote_host`",
+								Optional:            true,
+							},
+							"verify_name": schema.BoolAttribute{
+								MarkdownDescription: "Require the certificate to be valid for `server_name`, by its subject alternative names, " +
+									"or its common name if it has none",
+								Optional: true,
+							},
+							"timeout": schema.StringAttribute{
+								MarkdownDescription: "How long to retry the check before failing, as a duration like `2m`. Defaults to `5m`",
+								Optional:            true,
+							},
+						},
+					},
+					"grpc": schema.SingleNestedBlock{
+						MarkdownDescription: "Call the standard gRPC health checking protocol (`grpc.health.v1.Health/Check`) until " +
+							"it reports `SERVING`",
+						Attributes: map[string]schema.Attribute{
+							"service": schema.StringAttribute{
+								MarkdownDescription: "The service to check. Defaults to the server as a whole",
+								Optional:            true,
+							},
+							"tls": schema.BoolAttribute{
+								MarkdownDescription: "Connect with TLS, verifying the certificate against `remote_host`",
+								Optional:            true,
+							},
+							"ca_bundle": schema.StringAttribute{
+								MarkdownDescription: "Path to a PEM file with certificates trusted with `tls` in addition to the system's. " +
+									"The provider's `ca_bundle` and `insecure` only apply to AWS",
+								Optional: true,
+							},
+							"timeout": schema.StringAttribute{
+								MarkdownDescription: "How long to retry the check before failing, as a duration like `2m`. Defaults to `5m`",
+								Optional:            true,
+							},
+						},
+					},
+				},
+			},
 		},
 	}
 }
@@ -96,23 +530,379 @@ func (d *RemoteTunnelResource) Configure(ctx context.Context, req resource.Confi
 	d.tracker = configData.Tracker
 	d.region = configData.Region
 	d.target = configData.Target
+	d.targets = configData.Targets
+	d.portRangeMin = configData.LocalPortRangeMin
+	d.portRangeMax = configData.LocalPortRangeMax
+	d.accessMatrix = configData.AccessMatrix
+	d.preserveIds = configData.PreserveTunnelIds
+	d.targetUnknown = configData.TargetUnknown
+}
+
+// tunnelIDNamespace is the namespace of the name based UUIDs used as tunnel IDs.
+var tunnelIDNamespace = uuid.MustParse("5b0f3c1e-8d4a-4f7e-9c2b-6a1d7e3f9b20")
+
+// tunnelIdentity is what the ID of a tunnel is derived from.
+type tunnelIdentity struct {
+	target     string
+	region     string
+	remoteHost string
+	remotePort int
+
+	// The local endpoint and credentials as configured. They only go into the
+	// ID if they are set, so tunnels without them keep the IDs of earlier
+	// versions.
+	localHost string
+	localPort int
+	roleArn   string
+	profile   string
+}
+
+// id derives the ID of a tunnel from its identity, so the same tunnel keeps
+// its ID across runs, refreshes and imports, and tunnels to the same endpoint
+// on other local ports or with other credentials don't share one.
+func (i tunnelIdentity) id() string {
+	remoteHost := i.remoteHost
+	if normalized, err := ssmtunnels.NormalizeHost(remoteHost); err == nil {
+		remoteHost = normalized
+	}
+	parts := []string{i.target, i.region, net.JoinHostPort(remoteHost, strconv.Itoa(i.remotePort))}
+	if i.localHost != "" && i.localHost != defaultLocalHost {
+		parts = append(parts, "local_host="+i.localHost)
+	}
+	if i.localPort != 0 {
+		parts = append(parts, "local_port="+strconv.Itoa(i.localPort))
+	}
+	if i.roleArn != "" {
+		parts = append(parts, "role_arn="+i.roleArn)
+	}
+	if i.profile != "" {
+		parts = append(parts, "profile="+i.profile)
+	}
+	return uuid.NewSHA1(tunnelIDNamespace, []byte(strings.Join(parts, "|"))).String()
+}
+
+// identityOf returns the identity of the tunnel configured by config.
+func (d *RemoteTunnelResource) identityOf(config SSMRemoteTunnelResourceModel) tunnelIdentity {
+	return tunnelIdentity{
+		target:     d.targetKey(),
+		region:     d.regionOf(config),
+		remoteHost: config.RemoteHost.ValueString(),
+		remotePort: int(config.RemotePort.ValueInt64()),
+		localHost:  config.LocalHost.ValueString(),
+		localPort:  int(config.LocalPort.ValueInt64()),
+		roleArn:    config.RoleArn.ValueString(),
+		profile:    config.Profile.ValueString(),
+	}
+}
+
+// platformValue is the platform of the target of the tunnel, null if it is unknown.
+func platformValue(tunnel *OtherTunnelInfo) types.String {
+	if tunnel.Platform() == "" {
+		return types.StringNull()
+	}
+	return types.StringValue(tunnel.Platform())
+}
+
+// targetKey returns the target the ID of a tunnel is derived from. Tunnels
+// spread across targets keep their ID whichever of them serves the tunnel.
+func (d *RemoteTunnelResource) targetKey() string {
+	return targetKeyOf(d.target, d.targets)
+}
+
+// targetKeyOf returns the target, or the targets a tunnel is spread across.
+func targetKeyOf(target string, targets []string) string {
+	if target == "" {
+		return strings.Join(targets, ",")
+	}
+	return target
+}
+
+// regionOf returns the region of the tunnel, defaulting to the provider region.
+func (d *RemoteTunnelResource) regionOf(data SSMRemoteTunnelResourceModel) string {
+	if data.Region.ValueString() != "" {
+		return data.Region.ValueString()
+	}
+	return d.region
+}
+
+// pickLocalPort returns the configured local port, or picks one in the range.
+// A picked port is reserved on localHost until the tunnel is started, see
+// TunnelTracker.StartTunnel.
+func pickLocalPort(tracker *TunnelTracker, localHost string, localPort int, remoteHost string, remotePort int, rangeMin int, rangeMax int) (int, error) {
+	if localPort != 0 {
+		return localPort, nil
+	}
+	if tracker.PlaceholderPorts {
+		return placeholderPort(remoteHost, remotePort, rangeMin, rangeMax), nil
+	}
+	return tracker.findOpenPort(localHost, rangeMin, rangeMax)
+}
+
+// placeholderPort derives a port in the range from the remote endpoint, so
+// placeholder endpoints stay the same between runs.
+func placeholderPort(remoteHost string, remotePort int, rangeMin int, rangeMax int) int {
+	return portFromKey(net.JoinHostPort(remoteHost, strconv.Itoa(remotePort)), rangeMin, rangeMax)
+}
+
+// stableLocalPort returns the local port of a tunnel with stable_local_port and
+// without local_port, derived like its ID from the target and remote endpoint.
+// It reports false if the tunnel has none, or it isn't known yet.
+func (d *RemoteTunnelResource) stableLocalPort(data SSMRemoteTunnelResourceModel) (int, bool) {
+	if !data.StableLocalPort.ValueBool() || !data.LocalPort.IsNull() || data.RemoteHost.IsUnknown() || data.RemotePort.IsUnknown() || d.targetUnknown {
+		return 0, false
+	}
+	return derivedLocalPort(d.targetKey(), data.RemoteHost.ValueString(), int(data.RemotePort.ValueInt64()), d.portRangeMin, d.portRangeMax), true
+}
+
+// derivedLocalPort derives a port in the range from the target and remote
+// endpoint of a tunnel, see stable_local_port.
+func derivedLocalPort(targetKey string, remoteHost string, remotePort int, rangeMin int, rangeMax int) int {
+	if normalized, err := ssmtunnels.NormalizeHost(remoteHost); err == nil {
+		remoteHost = normalized
+	}
+	return portFromKey(targetKey+"|"+net.JoinHostPort(remoteHost, strconv.Itoa(remotePort)), rangeMin, rangeMax)
+}
+
+// configuredPort returns the local port the configuration asks for, zero to pick a free one.
+func (d *RemoteTunnelResource) configuredPort(data SSMRemoteTunnelResourceModel) int {
+	if port, ok := d.stableLocalPort(data); ok {
+		return port
+	}
+	return int(data.LocalPort.ValueInt64())
+}
+
+// tunnelSpec builds the tunnel to start from the resource data.
+func (d *RemoteTunnelResource) tunnelSpec(ctx context.Context, data SSMRemoteTunnelResourceModel, port int) (TunnelSpec, diag.Diagnostics) {
+	spec := TunnelSpec{
+		Id:         data.Id.ValueString(),
+		Target:     d.target,
+		Targets:    d.targets,
+		Region:     d.region,
+		RemoteHost: data.RemoteHost.ValueString(),
+		RemotePort: int(data.RemotePort.ValueInt64()),
+		LocalHost:  data.LocalHost.ValueString(),
+		LocalPort:  port,
+		RoleArn:    data.RoleArn.ValueString(),
+		Profile:    data.Profile.ValueString(),
+	}
+	if spec.RemoteHost == "" {
+		var diags diag.Diagnostics
+		diags.AddAttributeError(
+			path.Root("remote_host"),
+			"Invalid remote host",
+			"remote_host must not be empty",
+		)
+		return spec, diags
+	}
+	if data.Region.ValueString() != "" {
+		spec.Region = data.Region.ValueString()
+	}
+
+	diags := data.options().apply(ctx, &spec, path.Empty())
+	return spec, diags
+}
+
+// options returns the attributes the resource shares with the tunnels of the provider.
+func (data SSMRemoteTunnelResourceModel) options() tunnelOptionsModel {
+	return tunnelOptionsModel{
+		Rewrite:             data.Rewrite,
+		WaitForVPCEndpoints: data.WaitForVPCEndpoints,
+		WaitForTargetOnline: data.WaitForTargetOnline,
+		MaxTransferBytes:    data.MaxTransferBytes,
+		MaxConnections:      data.MaxConnections,
+		MaxQueued:           data.MaxQueued,
+		BandwidthWeight:     data.BandwidthWeight,
+		Lazy:                data.Lazy,
+		CloseAfterIdle:      data.CloseAfterIdle,
+		ProbeCommand:        data.ProbeCommand,
+		ProbeTimeoutSeconds: data.ProbeTimeoutSeconds,
+		Probe:               data.Probe,
+		RequirePlatform:     data.RequirePlatform,
+		DocumentName:        data.DocumentName,
+	}
+}
+
+// ModifyPlan plans the region and ID of updated tunnels. A tunnel to another
+// region is replaced, like one to another remote host or port, so its old
+// session is closed by Delete. The ID is the one derived from the endpoint,
+// which also replaces the random IDs of older provider versions and imported
+// IDs exactly once, unless preserve_tunnel_ids keeps the ID of the state.
+func (d *RemoteTunnelResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// Invalid remote hosts, ports and timeouts would only fail the apply, or be
+	// rejected by Session Manager with a less helpful error
+	if !req.Config.Raw.IsNull() {
+		var config SSMRemoteTunnelResourceModel
+		resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		if !config.RemoteHost.IsNull() && !config.RemoteHost.IsUnknown() {
+			if _, err := ssmtunnels.NormalizeHost(config.RemoteHost.ValueString()); err != nil {
+				resp.Diagnostics.AddAttributeError(
+					path.Root("remote_host"),
+					"Invalid remote host",
+					fmt.Sprintf("Error: %s", err),
+				)
+			}
+		}
+		_, diags := parseTimeouts(ctx, config.Timeouts)
+		resp.Diagnostics.Append(diags...)
+		_, diags = parseCloseAfterIdle(config.CloseAfterIdle, path.Empty())
+		resp.Diagnostics.Append(diags...)
+		resp.Diagnostics.Append(validatePlatform(config.RequirePlatform, path.Empty())...)
+		_, diags = parseReadyTimeout(config.WaitForReadyTimeout, path.Empty())
+		resp.Diagnostics.Append(diags...)
+		_, diags = parseDrainTimeout(config.DrainTimeout, path.Empty())
+		resp.Diagnostics.Append(diags...)
+		_, diags = parseWaitFor(ctx, config.WaitFor)
+		resp.Diagnostics.Append(diags...)
+		resp.Diagnostics.Append(validateRegion(config.Region, path.Root("region"))...)
+		resp.Diagnostics.Append(validateTunnelConfig(config.RemotePort, config.LocalPort, config.StableLocalPort, config.Lazy, config.Probe, path.Empty())...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	// Stable local ports are known while planning, so consumers don't see them change during the apply
+	if !req.Plan.Raw.IsNull() && !req.Config.Raw.IsNull() {
+		var config SSMRemoteTunnelResourceModel
+		resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		if port, ok := d.stableLocalPort(config); ok {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("local_port"), int64(port))...)
+		}
+
+		// The region is computed from the provider region when it isn't set.
+		// UseStateForUnknown keeps the region of the state, so it is planned
+		// here too, to replace tunnels whose provider region changed.
+		if !config.Region.IsUnknown() {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("region"), d.regionOf(config))...)
+		}
+	}
+
+	// Creating the tunnel or changing it opens a new session, except for offline providers
+	if !req.Plan.Raw.IsNull() && !req.Plan.Raw.Equal(req.State.Raw) && d.tracker != nil && !d.tracker.Offline() {
+		var plan SSMRemoteTunnelResourceModel
+		resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		addPlannedTunnelWarning(&resp.Diagnostics, d.plannedTunnel(plan))
+	}
+
+	// The access matrix lists every tunnel, also those kept or destroyed
+	if d.accessMatrix != nil {
+		var data SSMRemoteTunnelResourceModel
+		if req.Plan.Raw.IsNull() {
+			resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+		} else {
+			resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+		}
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		recordAccess(&resp.Diagnostics, d.accessMatrix, "awsssmtunnels_remote_tunnel", plannedChange(req.State, req.Plan), d.plannedTunnel(data))
+	}
+
+	// Nothing else to do on create and destroy
+	if req.State.Raw.IsNull() || req.Plan.Raw.IsNull() {
+		return
+	}
+
+	var state, config SSMRemoteTunnelResourceModel
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The region planned above, unknown while the configured one is
+	var region types.String
+	resp.Diagnostics.Append(resp.Plan.GetAttribute(ctx, path.Root("region"), &region)...)
+	if state.Region.ValueString() != "" && !region.Equal(state.Region) {
+		resp.RequiresReplace = append(resp.RequiresReplace, path.Root("region"))
+	}
+
+	id := state.Id
+	if !d.preserveIds {
+		if config.RemoteHost.IsUnknown() || config.RemotePort.IsUnknown() || config.Region.IsUnknown() || config.LocalHost.IsUnknown() ||
+			config.LocalPort.IsUnknown() || config.RoleArn.IsUnknown() || config.Profile.IsUnknown() {
+			id = types.StringUnknown()
+		} else {
+			id = basetypes.NewStringValue(d.identityOf(config).id())
+		}
+	}
+	if !id.IsUnknown() && id.ValueString() != state.Id.ValueString() {
+		log.Printf("Replacing ID %s of the tunnel to %q with %s derived from its endpoint", state.Id.ValueString(), config.RemoteHost.ValueString(), id.ValueString())
+	}
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("id"), id)...)
+}
+
+// plannedTunnel describes the tunnel of data for the plan, see addPlannedTunnelWarning.
+func (d *RemoteTunnelResource) plannedTunnel(data SSMRemoteTunnelResourceModel) plannedTunnel {
+	region := d.region
+	if !data.Region.IsUnknown() {
+		region = d.regionOf(data)
+	}
+	return plannedTunnel{
+		target:     targetDescription(d.target, d.targets),
+		region:     region,
+		roleArn:    data.RoleArn.ValueString(),
+		profile:    data.Profile.ValueString(),
+		remoteHost: data.RemoteHost,
+		remotePort: data.RemotePort,
+		local:      localEndpoint(data.LocalHost.ValueString(), data.LocalPort, d.portRangeMin, d.portRangeMax),
+	}
 }
 
 func (d *RemoteTunnelResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
-	var data SSMRemoteTunnelResourceModel
+	var data, config SSMRemoteTunnelResourceModel
 
-	// Read Terraform configuration data into the model
-	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	// Read the plan into the model, so the state keeps the defaults of the
+	// schema. The ID and local port are derived from the configuration, like
+	// while planning.
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
+	ctx, cancel, diags := withTimeout(ctx, data.Timeouts, timeoutCreate)
+	defer cancel()
+	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
 
-	var port int
-	var err error
-	port = int(data.LocalPort.ValueInt64())
-	if port == 0 {
-		port, err = ports.FindOpenPort(16000, 26000)
+	// The ID is set first so the tunnel is reported under it, see TunnelTracker.TunnelStats
+	data.Id = basetypes.NewStringValue(d.identityOf(config).id())
+	spec, diags := d.tunnelSpec(ctx, data, d.configuredPort(config))
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Adopt a matching tunnel which is already running, or being started for
+	// another resource, instead of failing to bind its port or opening a second
+	// session to the same endpoint
+	tunnelInfo, release, err := d.tracker.AcquireTunnel(ctx, spec)
+	defer release()
+	if err != nil {
+		resp.Diagnostics.AddError(
+			startTunnelErrorSummary(err),
+			failureDetail(fmt.Sprintf("Error: %s", err), err),
+		)
+		return
+	}
+	if tunnelInfo == nil {
+		tunnelInfo = d.tracker.OperatorTunnel(ctx, spec)
+	}
+	data.Adopted = basetypes.NewBoolValue(tunnelInfo != nil)
+	if tunnelInfo == nil {
+		port, err := pickLocalPort(d.tracker, spec.LocalHost, spec.LocalPort, spec.RemoteHost, spec.RemotePort, d.portRangeMin, d.portRangeMax)
 		if err != nil {
 			resp.Diagnostics.AddError(
 				"Failed to find open port",
@@ -120,29 +910,28 @@ func (d *RemoteTunnelResource) Create(ctx context.Context, req resource.CreateRe
 			)
 			return
 		}
-	}
-
-	tunnelInfo, err := d.tracker.StartTunnel(
-		ctx,
-		data.Id.ValueString(),
-		d.target,
-		data.RemoteHost.ValueString(),
-		int(data.RemotePort.ValueInt64()),
-		port,
-		d.region,
-	)
+		spec.LocalPort = port
 
-	if err != nil {
-		resp.Diagnostics.AddError(
-			"Failed to start remote tunnel",
-			fmt.Sprintf("Error: %s", err),
-		)
-		return
+		tunnelInfo, err = d.tracker.StartTunnel(ctx, spec)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				startTunnelErrorSummary(err),
+				failureDetail(fmt.Sprintf("Error: %s", err), err),
+			)
+			return
+		}
 	}
 
-	data.Id = basetypes.NewStringValue(uuid.New().String())
 	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
 	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
+	data.Target = basetypes.NewStringValue(tunnelInfo.Target())
+	data.Platform = platformValue(tunnelInfo)
+	data.Region = basetypes.NewStringValue(spec.Region)
+	data.Ready, diags = d.waitForReady(ctx, data, tunnelInfo)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
@@ -157,11 +946,49 @@ func (d *RemoteTunnelResource) Read(ctx context.Context, req resource.ReadReques
 		return
 	}
 
-	var port int
-	var err error
-	port = int(data.LocalPort.ValueInt64())
-	if port == 0 {
-		port, err = ports.FindOpenPort(16000, 26000)
+	ctx, cancel, diags := withTimeout(ctx, data.Timeouts, timeoutRead)
+	defer cancel()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	spec, diags := d.tunnelSpec(ctx, data, d.configuredPort(data))
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// A tunnel closed for reaching its transfer limit isn't started again,
+	// which would reset the limit, until it is replaced or the next run
+	if err := d.tracker.TransferLimitExceeded(spec); err != nil {
+		resp.Diagnostics.AddError(
+			"Tunnel transfer limit exceeded",
+			failureDetail(fmt.Sprintf("Error: %s", err), err),
+		)
+		return
+	}
+
+	// A live tunnel, e.g. started by Create earlier in this run or by another
+	// resource to the same endpoint, is kept. The tunnel is only started again
+	// if it is gone, like at the start of every run since tunnels don't outlive
+	// the provider process, and gets a new session on the same local port if its
+	// session ended, e.g. after the target rebooted. The ID never changes, so
+	// refreshing doesn't cause a diff.
+	tunnelInfo, release, err := d.tracker.AcquireTunnel(ctx, spec)
+	defer release()
+	if err != nil {
+		resp.Diagnostics.AddError(
+			startTunnelErrorSummary(err),
+			failureDetail(fmt.Sprintf("Error: %s", err), err),
+		)
+		return
+	}
+	if tunnelInfo == nil {
+		tunnelInfo = d.tracker.OperatorTunnel(ctx, spec)
+	}
+	if tunnelInfo == nil {
+		port, err := pickLocalPort(d.tracker, spec.LocalHost, spec.LocalPort, spec.RemoteHost, spec.RemotePort, d.portRangeMin, d.portRangeMax)
 		if err != nil {
 			resp.Diagnostics.AddError(
 				"Failed to find open port",
@@ -169,82 +996,172 @@ func (d *RemoteTunnelResource) Read(ctx context.Context, req resource.ReadReques
 			)
 			return
 		}
-	}
-
-	tunnelInfo, err := d.tracker.StartTunnel(
-		ctx,
-		data.Id.ValueString(),
-		d.target,
-		data.RemoteHost.ValueString(),
-		int(data.RemotePort.ValueInt64()),
-		port,
-		d.region,
-	)
+		spec.LocalPort = port
 
-	if err != nil {
-		resp.Diagnostics.AddError(
-			"Failed to start remote tunnel",
-			fmt.Sprintf("Error: %s", err),
-		)
-		return
+		tunnelInfo, err = d.tracker.StartTunnel(ctx, spec)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				startTunnelErrorSummary(err),
+				failureDetail(fmt.Sprintf("Error: %s", err), err),
+			)
+			return
+		}
 	}
 
-	data.RefreshId = basetypes.NewStringValue(uuid.New().String()) // NOTE: We always change this in order to force an update
 	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
 	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
+	data.Target = basetypes.NewStringValue(tunnelInfo.Target())
+	data.Platform = platformValue(tunnelInfo)
+	data.Region = basetypes.NewStringValue(spec.Region)
+	data.Ready, diags = d.waitForReady(ctx, data, tunnelInfo)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
 
 func (d *RemoteTunnelResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
-	var data SSMRemoteTunnelResourceModel
+	var data, config SSMRemoteTunnelResourceModel
 
-	// Read Terraform configuration data into the model
-	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	// Read the plan into the model, see Create
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
 
 	if resp.Diagnostics.HasError() {
 		return
 	}
 
-	var port int
-	var err error
-	port = int(data.LocalPort.ValueInt64())
-	if port == 0 {
-		port, err = ports.FindOpenPort(16000, 26000)
-		if err != nil {
+	var state SSMRemoteTunnelResourceModel
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	ctx, cancel, diags := withTimeout(ctx, data.Timeouts, timeoutUpdate)
+	defer cancel()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Only the local port changes, move the listener so the resources using
+	// the tunnel aren't interrupted by a new session
+	if tunnel := d.movableTunnel(ctx, state, config, data.Id); tunnel != nil {
+		if err := d.tracker.MoveTunnel(tunnel, int(data.LocalPort.ValueInt64())); err != nil {
 			resp.Diagnostics.AddError(
-				"Failed to find open port",
-				fmt.Sprintf("Error: %s", err),
+				startTunnelErrorSummary(err),
+				failureDetail(fmt.Sprintf("Error moving the tunnel to local port %d: %s", data.LocalPort.ValueInt64(), err), err),
 			)
 			return
 		}
+
+		data.Id = state.Id
+		data.LocalPort = basetypes.NewInt64Value(int64(tunnel.LocalPort))
+		data.LocalHost = basetypes.NewStringValue(tunnel.LocalHost)
+		data.Region = basetypes.NewStringValue(tunnel.spec.Region)
+		data.Target = basetypes.NewStringValue(tunnel.Target())
+		data.Platform = platformValue(tunnel)
+		data.Adopted = state.Adopted
+		data.Ready, diags = d.waitForReady(ctx, data, tunnel)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+
+		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+		return
 	}
 
-	tunnelInfo, err := d.tracker.StartTunnel(
-		ctx,
-		data.Id.ValueString(),
-		d.target,
-		data.RemoteHost.ValueString(),
-		int(data.RemotePort.ValueInt64()),
-		port,
-		d.region,
-	)
+	// The tunnel is started again with the new settings, close the one of the
+	// state first so it doesn't keep running next to it, or holds on to its port,
+	// unless other resources still use it
+	if err := d.tracker.CloseTunnelsOn(ctx, state.Id.ValueString(), int(state.LocalPort.ValueInt64())); err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to close remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+
+	// The ID is set first so the tunnel is reported under it, see TunnelTracker.TunnelStats.
+	// The plan has the ID of ModifyPlan, it is only unknown if the endpoint was.
+	if data.Id.IsUnknown() || data.Id.IsNull() {
+		data.Id = basetypes.NewStringValue(d.identityOf(config).id())
+	}
+	spec, diags := d.tunnelSpec(ctx, data, d.configuredPort(config))
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
+	// Other resources may already use a tunnel with the new settings
+	tunnelInfo, release, err := d.tracker.AcquireTunnel(ctx, spec)
+	defer release()
 	if err != nil {
 		resp.Diagnostics.AddError(
-			"Failed to start remote tunnel",
-			fmt.Sprintf("Error: %s", err),
+			startTunnelErrorSummary(err),
+			failureDetail(fmt.Sprintf("Error: %s", err), err),
 		)
 		return
 	}
+	data.Adopted = basetypes.NewBoolValue(tunnelInfo != nil)
+	if tunnelInfo == nil {
+		port, err := pickLocalPort(d.tracker, spec.LocalHost, spec.LocalPort, spec.RemoteHost, spec.RemotePort, d.portRangeMin, d.portRangeMax)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				"Failed to find open port",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		spec.LocalPort = port
+
+		tunnelInfo, err = d.tracker.StartTunnel(ctx, spec)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				startTunnelErrorSummary(err),
+				failureDetail(fmt.Sprintf("Error: %s", err), err),
+			)
+			return
+		}
+	}
 
-	data.Id = basetypes.NewStringValue(uuid.New().String())
 	data.LocalPort = basetypes.NewInt64Value(int64(tunnelInfo.LocalPort))
 	data.LocalHost = basetypes.NewStringValue(tunnelInfo.LocalHost)
+	data.Target = basetypes.NewStringValue(tunnelInfo.Target())
+	data.Platform = platformValue(tunnelInfo)
+	data.Region = basetypes.NewStringValue(spec.Region)
+	data.Ready, diags = d.waitForReady(ctx, data, tunnelInfo)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
 
+// movableTunnel returns the tunnel started for the state if the update only
+// changes its local port, so it can be moved instead of started again, see
+// TunnelTracker.MoveTunnel. Tunnels adopted from elsewhere are never moved.
+func (d *RemoteTunnelResource) movableTunnel(ctx context.Context, state, config SSMRemoteTunnelResourceModel, planId types.String) *OtherTunnelInfo {
+	if config.LocalPort.IsNull() || config.LocalPort.Equal(state.LocalPort) || !config.RefreshId.Equal(state.RefreshId) || !planId.Equal(state.Id) {
+		return nil
+	}
+	// The tunnel with the new settings, at the port of the state
+	wanted, diags := d.tunnelSpec(ctx, config, int(state.LocalPort.ValueInt64()))
+	if diags.HasError() {
+		return nil
+	}
+	// Moving a tunnel shared with other resources would move it for them too
+	tunnel := d.tracker.LiveTunnel(wanted)
+	if tunnel == nil || !d.tracker.UsedOnlyBy(tunnel, state.Id.ValueString()) {
+		return nil
+	}
+	return tunnel
+}
+
 func (d *RemoteTunnelResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
 	var data SSMRemoteTunnelResourceModel
 
@@ -254,46 +1171,222 @@ func (d *RemoteTunnelResource) Delete(ctx context.Context, req resource.DeleteRe
 	if resp.Diagnostics.HasError() {
 		return
 	}
+
+	// A drain_timeout of the state which doesn't parse, e.g. of a broken import, closes connections right away
+	drain, _ := parseDrainTimeout(data.DrainTimeout, path.Empty())
+
+	// The tunnel was started under the ID of the state by Create, Update or the refresh before the destroy
+	if err := d.tracker.DrainTunnelsOn(ctx, data.Id.ValueString(), int(data.LocalPort.ValueInt64()), drain); err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to close remote tunnel",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
 }
 
+// ImportState imports a tunnel from an ID like `target,remote_host:remote_port`,
+// optionally followed by `,region`. The target has to be the one of the
+// provider, or one of its targets, as the tunnel is started on it.
 func (r *RemoteTunnelResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	if strings.Contains(req.ID, "|") {
+		r.importLegacyState(ctx, req, resp)
+		return
+	}
+
+	parts := strings.Split(req.ID, ",")
+	if len(parts) != 2 && len(parts) != 3 {
+		resp.Diagnostics.AddError(
+			"Invalid import ID",
+			fmt.Sprintf("Import ID must be in the format `target,remote_host:remote_port`, optionally followed by `,region`, got %q", req.ID),
+		)
+		return
+	}
+	// Import IDs are often assembled by hand or with interpolation, tolerate whitespace around the parts
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	target, err := ssmtunnels.NormalizeTarget(parts[0])
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("target"),
+			"Invalid import ID",
+			fmt.Sprintf("Invalid target: %s", err),
+		)
+	} else if provider := (TunnelSpec{Target: r.target, Targets: r.targets}); !r.targetUnknown && !provider.servedBy(target) {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("target"),
+			"Invalid import ID",
+			fmt.Sprintf("Target %s is not the target of the provider, %s", target, r.targetKey()),
+		)
+	}
+
+	remoteHost, remotePort, err := net.SplitHostPort(parts[1])
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("remote_host"),
+			"Invalid import ID",
+			fmt.Sprintf("Expected remote_host:remote_port, got %q", parts[1]),
+		)
+		return
+	}
+	if _, err := ssmtunnels.NormalizeHost(remoteHost); err != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("remote_host"),
+			"Invalid import ID",
+			fmt.Sprintf("Invalid remote host: %s", err),
+		)
+	}
+	remotePortInt, err := strconv.Atoi(remotePort)
+	if err != nil || remotePortInt < 1 || remotePortInt > 65535 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("remote_port"),
+			"Invalid import ID",
+			fmt.Sprintf("Remote port must be a port number, got %q", remotePort),
+		)
+	}
+
+	region := types.StringNull()
+	if len(parts) == 3 {
+		if parts[2] == "" || strings.ContainsFunc(parts[2], unicode.IsSpace) {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("region"),
+				"Invalid import ID",
+				fmt.Sprintf("Invalid region %q", parts[2]),
+			)
+		}
+		region = types.StringValue(parts[2])
+	}
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	data := importedTunnel(tunnelIdentity{
+		target:     r.targetKey(),
+		region:     cmp.Or(region.ValueString(), r.region),
+		remoteHost: remoteHost,
+		remotePort: remotePortInt,
+	}.id(), remoteHost, remotePortInt)
+	data.Region = region
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// importLegacyState imports a tunnel from an ID in the format of older
+// provider versions, `remote_host|remote_port|local_port|local_host`
+// optionally followed by `|id`.
+func (r *RemoteTunnelResource) importLegacyState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
 	parts := strings.Split(req.ID, "|")
-	// TODO: Decide if we need the local_host set. Also do we need the local_port?
-	if len(parts) != 4 {
+	if len(parts) != 4 && len(parts) != 5 {
 		resp.Diagnostics.AddError(
 			"Invalid import ID",
-			"Import ID must be in the format `remote_host|remote_port|local_port|local_host`",
+			fmt.Sprintf("Import ID must be in the format `target,remote_host:remote_port`, optionally followed by `,region`, got %q", req.ID),
 		)
 		return
 	}
+	resp.Diagnostics.AddWarning(
+		"Deprecated import ID",
+		fmt.Sprintf("Import IDs like %q are deprecated, use `target,remote_host:remote_port` optionally followed by `,region` instead", req.ID),
+	)
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
 	remoteHost := parts[0]
 	remotePort := parts[1]
 	localPort := parts[2]
 	localHost := parts[3]
 
+	if _, err := ssmtunnels.NormalizeHost(remoteHost); err != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("remote_host"),
+			"Invalid import ID",
+			fmt.Sprintf("Invalid remote host: %s", err),
+		)
+	}
+	if _, err := ssmtunnels.NormalizeHost(localHost); err != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("local_host"),
+			"Invalid import ID",
+			fmt.Sprintf("Invalid local host: %s", err),
+		)
+	}
 	localPortInt, err := strconv.Atoi(localPort)
-	if err != nil {
-		resp.Diagnostics.AddError(
+	if err != nil || localPortInt < 1 || localPortInt > 65535 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("local_port"),
 			"Invalid import ID",
-			"Local port must be a valid integer",
+			fmt.Sprintf("Local port must be a port number, got %q", localPort),
 		)
-		return
 	}
 	remotePortInt, err := strconv.Atoi(remotePort)
-	if err != nil {
-		resp.Diagnostics.AddError(
+	if err != nil || remotePortInt < 1 || remotePortInt > 65535 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("remote_port"),
 			"Invalid import ID",
-			"Remote port must be a valid integer",
+			fmt.Sprintf("Remote port must be a port number, got %q", remotePort),
 		)
+	}
+	if resp.Diagnostics.HasError() {
 		return
 	}
 
-	resp.State.Set(ctx, &SSMRemoteTunnelResourceModel{
-		// TODO: Figure out if we need to set the ID here
-		Id:         basetypes.NewStringValue(uuid.New().String()),
+	// An ID given with the import is kept with preserve_tunnel_ids, see ModifyPlan
+	id := tunnelIdentity{
+		target:     r.targetKey(),
+		region:     r.region,
+		remoteHost: remoteHost,
+		remotePort: remotePortInt,
+	}.id()
+	if len(parts) == 5 && parts[4] != "" {
+		id = parts[4]
+	}
+
+	data := importedTunnel(id, remoteHost, remotePortInt)
+	data.LocalPort = basetypes.NewInt64Value(int64(localPortInt))
+	data.LocalHost = basetypes.NewStringValue(localHost)
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// importedTunnel returns the state of an imported tunnel, which Read then
+// starts. Everything but the endpoint is left to the configuration.
+func importedTunnel(id string, remoteHost string, remotePort int) SSMRemoteTunnelResourceModel {
+	return SSMRemoteTunnelResourceModel{
+		Id:         basetypes.NewStringValue(id),
+		Triggers:   types.MapNull(types.StringType),
+		Ready:      types.BoolNull(),
 		RemoteHost: basetypes.NewStringValue(remoteHost),
-		RemotePort: basetypes.NewInt64Value(int64(remotePortInt)),
-		LocalPort:  basetypes.NewInt64Value(int64(localPortInt)),
-		LocalHost:  basetypes.NewStringValue(localHost),
-	})
+		RemotePort: basetypes.NewInt64Value(int64(remotePort)),
+		LocalPort:  types.Int64Null(),
+		LocalHost:  basetypes.NewStringValue(defaultLocalHost),
+		Region:     types.StringNull(),
+		RoleArn:    types.StringNull(),
+		Profile:    types.StringNull(),
+		Rewrite:    types.ListNull(rewriteRuleType),
+
+		WaitForVPCEndpoints: types.ListNull(types.StringType),
+		WaitForTargetOnline: types.BoolNull(),
+		MaxTransferBytes:    types.Int64Null(),
+		MaxConnections:      types.Int64Null(),
+		MaxQueued:           types.Int64Null(),
+		BandwidthWeight:     types.Int64Null(),
+		Lazy:                types.BoolNull(),
+		CloseAfterIdle:      types.StringNull(),
+		ProbeCommand:        types.StringNull(),
+		ProbeTimeoutSeconds: types.Int64Value(defaultProbeTimeoutSeconds),
+		Probe:               types.ObjectNull(probeType.AttrTypes),
+		Adopted:             types.BoolValue(false),
+		RequirePlatform:     types.StringNull(),
+		Platform:            types.StringNull(),
+		DocumentName:        types.StringNull(),
+		StableLocalPort:     types.BoolNull(),
+		Target:              types.StringNull(),
+		Timeouts:            types.ObjectNull(timeoutsType.AttrTypes),
+		WaitFor:             types.ObjectNull(waitForType.AttrTypes),
+	}
+}
+
+func (d *RemoteTunnelResource) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	return map[int64]resource.StateUpgrader{
+		0: upgradeUnversionedState(),
+	}
 }
@@ -0,0 +1,41 @@
+package provider
+
+import (
+	"os"
+	"strings"
+)
+
+// defaultRunnerID identifies the machine running Terraform, for the reason of
+// its sessions: the URL of the CI job if the CI system is known, otherwise
+// the hostname. getenv is os.Getenv outside of tests.
+func defaultRunnerID(getenv func(string) string) string {
+	switch {
+	case getenv("GITHUB_ACTIONS") == "true" && getenv("GITHUB_RUN_ID") != "":
+		// The URL of the job isn't known to the job, the run and its attempt are
+		url := strings.Join([]string{getenv("GITHUB_SERVER_URL"), getenv("GITHUB_REPOSITORY"), "actions/runs", getenv("GITHUB_RUN_ID")}, "/")
+		if attempt := getenv("GITHUB_RUN_ATTEMPT"); attempt != "" {
+			url += "/attempts/" + attempt
+		}
+		return url
+	case getenv("CI_JOB_URL") != "":
+		// GitLab CI
+		return getenv("CI_JOB_URL")
+	case getenv("BUILDKITE_BUILD_URL") != "":
+		if job := getenv("BUILDKITE_JOB_ID"); job != "" {
+			return getenv("BUILDKITE_BUILD_URL") + "#" + job
+		}
+		return getenv("BUILDKITE_BUILD_URL")
+	case getenv("CIRCLE_BUILD_URL") != "":
+		return getenv("CIRCLE_BUILD_URL")
+	case getenv("BUILD_URL") != "":
+		// Jenkins
+		return getenv("BUILD_URL")
+	case getenv("TFC_RUN_ID") != "":
+		// HCP Terraform and Terraform Enterprise agents
+		return "tfc run " + getenv("TFC_RUN_ID")
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return ""
+}
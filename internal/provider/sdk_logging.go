@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/smithy-go/logging"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// sdkLogSubsystem is the tflog subsystem AWS SDK requests are logged to. Its
+// level can be set on its own with TF_LOG_PROVIDER_AWSSSMTUNNELS_AWS_SDK.
+const sdkLogSubsystem = "aws_sdk"
+
+// sensitivePatterns match credentials in logged requests and responses,
+// e.g. signed headers, presigned query strings and the token of StartSession.
+var sensitivePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?im)^((?:Authorization|X-Amz-Security-Token):[ \t]*)[^\r\n]*`),
+	regexp.MustCompile(`(?i)([?&]X-Amz-(?:Security-Token|Signature|Credential)=)[^&\s"]*`),
+	regexp.MustCompile(`("(?:TokenValue|SessionToken|SecretAccessKey|Token)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`(<(?:SessionToken|SecretAccessKey)>)[^<]*`),
+}
+
+// sanitizeSDKLog masks credentials in a message logged by the AWS SDK.
+func sanitizeSDKLog(message string) string {
+	for _, pattern := range sensitivePatterns {
+		message = pattern.ReplaceAllString(message, "${1}***")
+	}
+	return message
+}
+
+// tflogLogger routes the logs of the AWS SDK into Terraform's log stream. The
+// SDK hands it the context of each request through WithContext, which carries
+// the logger of the Terraform operation.
+type tflogLogger struct {
+	ctx context.Context
+	// redactor holds the log_redaction_patterns of the provider instance
+	redactor *redactor
+}
+
+func (l tflogLogger) Logf(classification logging.Classification, format string, v ...interface{}) {
+	message := l.redactor.Redact(sanitizeSDKLog(fmt.Sprintf(format, v...)))
+	if classification == logging.Warn {
+		tflog.SubsystemWarn(l.ctx, sdkLogSubsystem, message)
+		return
+	}
+	tflog.SubsystemDebug(l.ctx, sdkLogSubsystem, message)
+}
+
+func (l tflogLogger) WithContext(ctx context.Context) logging.Logger {
+	return tflogLogger{
+		ctx:      tflog.NewSubsystem(ctx, sdkLogSubsystem, tflog.WithLevelFromEnv("TF_LOG_PROVIDER_AWSSSMTUNNELS", sdkLogSubsystem)),
+		redactor: l.redactor,
+	}
+}
@@ -0,0 +1,412 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &SessionDocumentResource{}
+var _ resource.ResourceWithModifyPlan = &SessionDocumentResource{}
+var _ resource.ResourceWithImportState = &SessionDocumentResource{}
+var _ resource.ResourceWithUpgradeState = &SessionDocumentResource{}
+
+func NewSessionDocumentResource() resource.Resource {
+	return &SessionDocumentResource{}
+}
+
+// documentNamePattern are the names SSM accepts for documents. Names starting
+// with AWS or Amazon are reserved for documents of AWS.
+var documentNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,128}$`)
+
+// SessionDocumentResource defines the resource implementation.
+type SessionDocumentResource struct {
+	tracker *TunnelTracker
+	region  string
+}
+
+// SessionDocumentResourceModel describes the resource data model.
+type SessionDocumentResourceModel struct {
+	Name         types.String `tfsdk:"name"`
+	Description  types.String `tfsdk:"description"`
+	AllowedHosts types.List   `tfsdk:"allowed_hosts"`
+	AllowedPorts types.List   `tfsdk:"allowed_ports"`
+	Region       types.String `tfsdk:"region"`
+	RoleArn      types.String `tfsdk:"role_arn"`
+	Profile      types.String `tfsdk:"profile"`
+	Id           types.String `tfsdk:"id"`
+	Version      types.String `tfsdk:"document_version"`
+}
+
+func (d *SessionDocumentResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_session_document"
+}
+
+func (d *SessionDocumentResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Version: 1,
+
+		MarkdownDescription: "A custom port forwarding session document which only allows the listed remote hosts and ports. " +
+			"Tunnels start their sessions with it through their `document_name`, and granting `ssm:StartSession` on the " +
+			"document instead of on `AWS-StartPortForwardingSessionToRemoteHost` keeps sessions from reaching anything else.",
+
+		Attributes: map[string]schema.Attribute{
+			"name": schema.StringAttribute{
+				MarkdownDescription: "Name of the document. Names starting with `AWS` or `Amazon` are reserved. Changing it replaces the document",
+				Required:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"description": schema.StringAttribute{
+				MarkdownDescription: "Description of the document",
+				Optional:            true,
+			},
+			"allowed_hosts": schema.ListAttribute{
+				MarkdownDescription: "The remote hosts sessions with the document may forward to, exactly as the `remote_host` of the tunnels",
+				ElementType:         types.StringType,
+				Required:            true,
+			},
+			"allowed_ports": schema.ListAttribute{
+				MarkdownDescription: "The ports of the remote hosts sessions with the document may forward to",
+				ElementType:         types.Int64Type,
+				Required:            true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "The region of the document, which has to be the region of the tunnels using it. " +
+					"Defaults to the provider region. Changing it replaces the document",
+				Optional: true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"role_arn": schema.StringAttribute{
+				MarkdownDescription: "ARN of a role to assume for managing the document, e.g. for targets in another account. Defaults to the provider credentials",
+				Optional:            true,
+			},
+			"profile": schema.StringAttribute{
+				MarkdownDescription: "Named profile of the shared config files whose credentials manage the document. Defaults to the provider credentials",
+				Optional:            true,
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "The name of the document",
+				Computed:            true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"document_version": schema.StringAttribute{
+				MarkdownDescription: "The default version of the document, which sessions use. Every change adds a version",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *SessionDocumentResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tracker = configData.Tracker
+	d.region = configData.Region
+}
+
+func (d *SessionDocumentResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// Session Manager would only reject these during the apply
+	if req.Config.Raw.IsNull() {
+		return
+	}
+	var config SessionDocumentResourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if name := config.Name.ValueString(); !config.Name.IsUnknown() {
+		if !documentNamePattern.MatchString(name) || strings.HasPrefix(strings.ToLower(name), "aws") || strings.HasPrefix(strings.ToLower(name), "amazon") {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("name"),
+				"Invalid document name",
+				fmt.Sprintf("%q must be 3 to 128 letters, digits, _, - and ., and not start with AWS or Amazon", name),
+			)
+		}
+	}
+	if !config.AllowedHosts.IsUnknown() {
+		var hosts []types.String
+		resp.Diagnostics.Append(config.AllowedHosts.ElementsAs(ctx, &hosts, false)...)
+		for i, host := range hosts {
+			if host.IsUnknown() {
+				continue
+			}
+			if _, err := ssmtunnels.NormalizeHost(host.ValueString()); err != nil {
+				resp.Diagnostics.AddAttributeError(
+					path.Root("allowed_hosts").AtListIndex(i),
+					"Invalid allowed host",
+					fmt.Sprintf("Error: %s", err),
+				)
+			}
+		}
+	}
+	if !config.AllowedPorts.IsUnknown() {
+		var ports []types.Int64
+		resp.Diagnostics.Append(config.AllowedPorts.ElementsAs(ctx, &ports, false)...)
+		for i, port := range ports {
+			if !port.IsUnknown() && (port.ValueInt64() < 1 || port.ValueInt64() > 65535) {
+				resp.Diagnostics.AddAttributeError(
+					path.Root("allowed_ports").AtListIndex(i),
+					"Invalid allowed port",
+					fmt.Sprintf("%d is not a port number", port.ValueInt64()),
+				)
+			}
+		}
+	}
+	resp.Diagnostics.Append(validateRegion(config.Region, path.Root("region"))...)
+}
+
+// regionOf returns the region of the document, defaulting to the provider region.
+func (d *SessionDocumentResource) regionOf(data SessionDocumentResourceModel) string {
+	if data.Region.ValueString() != "" {
+		return data.Region.ValueString()
+	}
+	return d.region
+}
+
+// client returns the SSM client managing the document.
+func (d *SessionDocumentResource) client(ctx context.Context, data SessionDocumentResourceModel) (*ssm.Client, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	region := d.regionOf(data)
+	if region == "" {
+		diags.AddError(
+			"Missing region",
+			"No region configured, set region on the provider or the resource, or set AWS_REGION",
+		)
+		return nil, diags
+	}
+	svc, _, err := d.tracker.clientsFor(ctx, region, data.RoleArn.ValueString(), data.Profile.ValueString())
+	if err != nil {
+		diags.AddError(
+			"Failed to create SSM client",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+	return svc, diags
+}
+
+// document returns the document described by data.
+func document(ctx context.Context, data SessionDocumentResourceModel) (ssmtunnels.PortForwardingDocument, diag.Diagnostics) {
+	doc := ssmtunnels.PortForwardingDocument{Description: data.Description.ValueString()}
+	diags := data.AllowedHosts.ElementsAs(ctx, &doc.Hosts, false)
+	var ports []int64
+	diags.Append(data.AllowedPorts.ElementsAs(ctx, &ports, false)...)
+	for _, port := range ports {
+		doc.Ports = append(doc.Ports, int(port))
+	}
+	return doc, diags
+}
+
+// normalizedHosts returns the hosts as they are written to the document, see
+// ssmtunnels.PortForwardingDocument.Content.
+func normalizedHosts(hosts []string) []string {
+	normalized := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if n, err := ssmtunnels.NormalizeHost(host); err == nil {
+			host = n
+		}
+		normalized = append(normalized, host)
+	}
+	return normalized
+}
+
+func (d *SessionDocumentResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data SessionDocumentResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	doc, diags := document(ctx, data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	data.Id = data.Name
+	data.Version = basetypes.NewStringValue("1")
+	// Documents of an offline provider are only kept in the state
+	if !d.tracker.Offline() {
+		svc, diags := d.client(ctx, data)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		version, err := ssmtunnels.CreateDocument(ctx, svc, data.Name.ValueString(), doc)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				"Failed to create session document",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		data.Version = basetypes.NewStringValue(version)
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *SessionDocumentResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data SessionDocumentResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if d.tracker.Offline() {
+		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+		return
+	}
+
+	svc, diags := d.client(ctx, data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	doc, version, err := ssmtunnels.GetDocument(ctx, svc, data.Id.ValueString())
+	if errors.Is(err, ssmtunnels.ErrDocumentNotFound) {
+		// Deleted outside of Terraform, plan to create it again
+		resp.State.RemoveResource(ctx)
+		return
+	}
+	if err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to read session document",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+
+	// Changes made outside of Terraform show up as a diff
+	data.Name = data.Id
+	if doc.Description != "" || !data.Description.IsNull() {
+		data.Description = basetypes.NewStringValue(doc.Description)
+	}
+	// The document has the hosts normalized, which isn't a change of the configured ones
+	if current, _ := document(ctx, data); !slices.Equal(normalizedHosts(current.Hosts), doc.Hosts) {
+		hosts, diags := types.ListValueFrom(ctx, types.StringType, doc.Hosts)
+		resp.Diagnostics.Append(diags...)
+		data.AllowedHosts = hosts
+	}
+	ports, diags := types.ListValueFrom(ctx, types.Int64Type, doc.Ports)
+	resp.Diagnostics.Append(diags...)
+	data.AllowedPorts = ports
+	data.Version = basetypes.NewStringValue(version)
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *SessionDocumentResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data, state SessionDocumentResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	doc, diags := document(ctx, data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	data.Id = state.Id
+	data.Version = state.Version
+	if !d.tracker.Offline() {
+		svc, diags := d.client(ctx, data)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		// Only changing the credentials leaves the content as it is
+		version, err := ssmtunnels.UpdateDocument(ctx, svc, data.Id.ValueString(), doc)
+		if err != nil {
+			resp.Diagnostics.AddError(
+				"Failed to update session document",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+		data.Version = basetypes.NewStringValue(version)
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *SessionDocumentResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data SessionDocumentResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() || d.tracker.Offline() {
+		return
+	}
+
+	svc, diags := d.client(ctx, data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if err := ssmtunnels.DeleteDocument(ctx, svc, data.Id.ValueString()); err != nil {
+		resp.Diagnostics.AddError(
+			"Failed to delete session document",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+}
+
+func (d *SessionDocumentResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	// The document is read by its name, Read fills in the rest
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("id"), req.ID)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("name"), req.ID)...)
+}
+
+func (d *SessionDocumentResource) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	return map[int64]resource.StateUpgrader{
+		0: upgradeUnversionedState(),
+	}
+}
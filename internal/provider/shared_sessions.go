@@ -0,0 +1,210 @@
+package provider
+
+import (
+	"context"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// Resources asking for the same remote endpoint but forwarding differently,
+// e.g. with other rewrite rules, a transfer limit or a probe speaking TLS,
+// can't share a tunnel, see sameTunnel. They share its session instead: each
+// gets a listener of its own relaying to the internal port of the session
+// manager plugin, and the session is only terminated once the last of them is
+// closed, see OtherTunnelInfo.shutdown. Lazy tunnels and tunnels closing idle
+// sessions start and end their sessions on their own, so they keep theirs.
+
+// tunnelSession is the session of one or more tunnels.
+type tunnelSession struct {
+	// mu guards the session, which lazy tunnels start on the first connection, see startLazyTunnel
+	mu      sync.Mutex
+	session *ssmtunnels.Session
+	closed  bool
+	// listeners are the tunnels relaying to the session, guarded by mu
+	listeners []*OtherTunnelInfo
+	startMu   sync.Mutex
+	// reconnect starts a new session once the current one ended, see connectLazy
+	// and revalidateSessions
+	reconnect func() error
+	// port is the internal port the session manager plugin listens on
+	port int
+	// startErr is why the last attempt to start a session failed, nil once one
+	// started, guarded by the mu of the tracker, see StoppedErrors
+	startErr error
+}
+
+// activeConnections returns the connections open through every tunnel of the session.
+func (s *tunnelSession) activeConnections() int64 {
+	s.mu.Lock()
+	listeners := append([]*OtherTunnelInfo(nil), s.listeners...)
+	s.mu.Unlock()
+
+	var active int64
+	for _, listener := range listeners {
+		active += listener.Stats().ActiveConnections
+	}
+	return active
+}
+
+// sharesSessions reports whether the tunnel of the spec may share its session
+// with other tunnels.
+func (s TunnelSpec) sharesSessions() bool {
+	return !s.Lazy && s.CloseAfterIdle == 0
+}
+
+// sameSession reports whether the session started for running can carry the
+// tunnel wanted: both reach the same remote endpoint through the same target,
+// with the same credentials and session document.
+func sameSession(running, wanted TunnelSpec) bool {
+	return running.sharesSessions() && wanted.sharesSessions() &&
+		wanted.servedBy(running.Target) && running.Region == wanted.Region && running.RoleArn == wanted.RoleArn && running.Profile == wanted.Profile &&
+		running.RemoteHost == wanted.RemoteHost && running.RemotePort == wanted.RemotePort && running.DocumentName == wanted.DocumentName
+}
+
+// samePendingSession is like sameSession for a session being started, whose
+// target isn't picked yet, so both have to ask for the same targets.
+func samePendingSession(pending, wanted TunnelSpec) bool {
+	if pending.Target != wanted.Target || !slices.Equal(pending.Targets, wanted.Targets) {
+		return false
+	}
+	pending.Targets, wanted.Targets = nil, nil
+	return sameSession(pending, wanted)
+}
+
+// startSharedListener starts the tunnel of the spec on the session of a live
+// tunnel which can carry it, waiting for such a session if one is being
+// started. Without one it returns a nil tunnel and the caller is expected to
+// start the session, calling the returned function once it did or failed to:
+// until then, tunnels which could share it wait.
+func (t *TunnelTracker) startSharedListener(ctx context.Context, spec TunnelSpec) (*OtherTunnelInfo, func(), error) {
+	localHost, err := ssmtunnels.NormalizeHost(spec.LocalHost)
+	if err != nil || !spec.sharesSessions() {
+		// Invalid hosts are reported by StartTunnel
+		return nil, func() {}, nil
+	}
+	remoteHost, err := ssmtunnels.NormalizeHost(spec.RemoteHost)
+	if err != nil {
+		return nil, func() {}, nil
+	}
+	spec.RemoteHost = remoteHost
+
+	for {
+		t.mu.Lock()
+		if tunnel := t.joinSession(spec); tunnel != nil {
+			t.mu.Unlock()
+			return t.startListener(ctx, tunnel, localHost)
+		}
+		var starting chan struct{}
+		for _, pending := range t.startingSessions {
+			if samePendingSession(pending.spec, spec) {
+				starting = pending.done
+				break
+			}
+		}
+		if starting == nil {
+			pending := &pendingTunnel{spec: spec, done: make(chan struct{})}
+			t.startingSessions = append(t.startingSessions, pending)
+			t.mu.Unlock()
+
+			var once sync.Once
+			return nil, func() {
+				once.Do(func() {
+					t.mu.Lock()
+					t.startingSessions = slices.DeleteFunc(t.startingSessions, func(p *pendingTunnel) bool { return p == pending })
+					t.mu.Unlock()
+					close(pending.done)
+				})
+			}, nil
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-starting:
+			// Join the session if it started, or start one if it failed to
+		case <-ctx.Done():
+			return nil, func() {}, ctx.Err()
+		}
+	}
+}
+
+// joinSession returns a tunnel for the spec added to the listeners of the
+// session of a live tunnel which can carry it, or nil. The caller holds the
+// mutex of the tracker.
+func (t *TunnelTracker) joinSession(spec TunnelSpec) *OtherTunnelInfo {
+	for _, running := range t.started {
+		if !sameSession(running.spec, spec) || !running.live() || checkPlatform(spec, running.platform) != nil {
+			continue
+		}
+		running.mu.Lock()
+		if running.closed {
+			running.mu.Unlock()
+			continue
+		}
+		spec.Target = running.spec.Target
+		tunnel := &OtherTunnelInfo{
+			LocalPort: spec.LocalPort,
+			LocalHost: spec.LocalHost,
+
+			tunnelSession: running.tunnelSession,
+			spec:          spec,
+			users:         []string{spec.Id},
+			platform:      running.platform,
+		}
+		running.listeners = append(running.listeners, tunnel)
+		running.mu.Unlock()
+		return tunnel
+	}
+	return nil
+}
+
+// startListener starts the forwarder of a tunnel which joined a session, see
+// joinSession.
+func (t *TunnelTracker) startListener(ctx context.Context, tunnel *OtherTunnelInfo, localHost string) (*OtherTunnelInfo, func(), error) {
+	spec := tunnel.spec
+	remote := net.JoinHostPort(spec.RemoteHost, strconv.Itoa(spec.RemotePort))
+	// Leaving the session terminates it if the other tunnels were closed in the meantime
+	leave := func() {
+		if session := tunnel.shutdown(); session != nil {
+			if err := session.Close(context.Background()); err != nil {
+				log.Printf("Error closing session %s: %v", session.Id, err)
+			}
+		}
+	}
+
+	forwarder, err := ssmtunnels.StartForwarder(t.forwarderConfig(spec, localHost, tunnel.port))
+	if err != nil {
+		leave()
+		return nil, func() {}, err
+	}
+	tunnel.forwarder = forwarder
+
+	if spec.Probe != nil {
+		if err := t.probeTunnel(ctx, spec, net.JoinHostPort(localHost, strconv.Itoa(spec.LocalPort))); err != nil {
+			forwarder.Close()
+			leave()
+			return nil, func() {}, err
+		}
+	}
+	t.mu.Lock()
+	if t.closed {
+		// CloseAll already ran and won't see this tunnel
+		t.mu.Unlock()
+		forwarder.Close()
+		leave()
+		return nil, func() {}, errTrackerClosed
+	}
+	tunnel.startedAt = time.Now()
+	t.started = append(t.started, tunnel)
+	t.mu.Unlock()
+
+	session := tunnel.currentSession()
+	log.Printf("Tunnel to %q on port %d shares session %s with the other tunnels to it", remote, spec.LocalPort, session.Id)
+	go t.watchForwarder(tunnel, session)
+	return tunnel, func() {}, nil
+}
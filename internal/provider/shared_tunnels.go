@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+// Resources of different modules often ask for the same tunnel, e.g. two
+// modules each declaring a tunnel to the same database. The tunnel is started
+// once and shared: each resource using it is one of its users, and the tunnel
+// is only closed once the last of them is gone, see CloseTunnels. Resources
+// of the same endpoint have the same ID, see tunnelID, so an ID is a user as
+// many times as it was acquired.
+
+// pendingTunnel is a tunnel being started, which resources asking for the
+// same tunnel wait for instead of starting another session.
+type pendingTunnel struct {
+	spec TunnelSpec
+	done chan struct{}
+}
+
+// AcquireTunnel returns a live tunnel matching the spec, whose target runs the
+// platform it requires, and adds spec.Id to its users, to be removed again by
+// CloseTunnels. A matching tunnel whose session ended, e.g. because the target
+// rebooted, gets a new session on the same local port, see reviveTunnel. If a
+// matching tunnel is being started, it waits for it. Without
+// one it returns nil and the caller is expected to start the tunnel, calling
+// the returned function once it did or failed to: until then, other callers
+// asking for the same tunnel wait for it.
+func (t *TunnelTracker) AcquireTunnel(ctx context.Context, spec TunnelSpec) (*OtherTunnelInfo, func(), error) {
+	if spec.LocalHost == "" {
+		spec.LocalHost = defaultLocalHost
+	}
+	if remoteHost, err := ssmtunnels.NormalizeHost(spec.RemoteHost); err == nil {
+		spec.RemoteHost = remoteHost
+	}
+
+	for {
+		t.mu.Lock()
+		var ended *OtherTunnelInfo
+		for _, tunnel := range t.started {
+			if !sameTunnel(tunnel.spec, spec) || checkPlatform(spec, tunnel.platform) != nil {
+				continue
+			}
+			if tunnel.live() {
+				tunnel.users = append(tunnel.users, spec.Id)
+				t.mu.Unlock()
+				return tunnel, func() {}, nil
+			}
+			if ended == nil && tunnel.sessionEnded() {
+				ended = tunnel
+			}
+		}
+		if ended != nil {
+			t.mu.Unlock()
+			if err := t.reviveTunnel(ended); err != nil {
+				// Start the tunnel from scratch instead, which reports why it can't be
+				continue
+			}
+			t.mu.Lock()
+			ended.users = append(ended.users, spec.Id)
+			t.mu.Unlock()
+			return ended, func() {}, nil
+		}
+		var starting chan struct{}
+		for _, pending := range t.pending {
+			if samePendingTunnel(pending.spec, spec) {
+				starting = pending.done
+				break
+			}
+		}
+		if starting == nil {
+			pending := &pendingTunnel{spec: spec, done: make(chan struct{})}
+			t.pending = append(t.pending, pending)
+			t.mu.Unlock()
+
+			var once sync.Once
+			return nil, func() {
+				once.Do(func() {
+					t.mu.Lock()
+					t.pending = slices.DeleteFunc(t.pending, func(p *pendingTunnel) bool { return p == pending })
+					t.mu.Unlock()
+					close(pending.done)
+				})
+			}, nil
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-starting:
+			// Share the tunnel if it started, or start it if it failed to
+		case <-ctx.Done():
+			return nil, func() {}, ctx.Err()
+		}
+	}
+}
+
+// samePendingTunnel reports whether the tunnel being started for pending can
+// be shared with wanted. Its target isn't picked yet, so both have to ask
+// for the same targets.
+func samePendingTunnel(pending, wanted TunnelSpec) bool {
+	if pending.Target != wanted.Target || !slices.Equal(pending.Targets, wanted.Targets) {
+		return false
+	}
+	pending.Targets, wanted.Targets = nil, nil
+	return sameTunnel(pending, wanted)
+}
+
+// UsedOnlyBy reports whether the ID is the only user of the tunnel, and only once.
+func (t *TunnelTracker) UsedOnlyBy(tunnel *OtherTunnelInfo, id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(tunnel.users) == 1 && tunnel.users[0] == id
+}
+
+// UsedBy reports whether the ID is one of the users of the tunnel.
+func (t *TunnelTracker) UsedBy(tunnel *OtherTunnelInfo, id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Contains(tunnel.users, id)
+}
+
+// removeUser removes the ID once from the users of the tunnel, reporting
+// whether it was one. The caller holds the mutex of the tracker.
+func (i *OtherTunnelInfo) removeUser(id string) bool {
+	n := slices.Index(i.users, id)
+	if n < 0 {
+		return false
+	}
+	i.users = slices.Delete(i.users, n, n+1)
+	return true
+}
@@ -0,0 +1,47 @@
+package provider
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+)
+
+// shutdownTimeout bounds terminating the sessions when the provider is stopped.
+// Terraform kills the provider a few seconds after asking it to exit, but
+// sessions left behind keep running until the idle timeout of Session Manager.
+const shutdownTimeout = time.Minute
+
+// NewServer returns the server of the provider for tf6server.Serve. Unlike the
+// server of providerserver, it closes the tunnels of every provider instance
+// when Terraform stops the provider, which it does when the run is
+// interrupted, e.g. with Ctrl+C.
+func NewServer(version string) func() tfprotov6.ProviderServer {
+	return func() tfprotov6.ProviderServer {
+		return stoppingServer{ProviderServer: providerserver.NewProtocol6(New(version)())()}
+	}
+}
+
+// stoppingServer closes all tunnels on StopProvider.
+type stoppingServer struct {
+	tfprotov6.ProviderServer
+}
+
+func (s stoppingServer) StopProvider(ctx context.Context, req *tfprotov6.StopProviderRequest) (*tfprotov6.StopProviderResponse, error) {
+	resp, err := s.ProviderServer.StopProvider(ctx, req)
+	Shutdown("Terraform is stopping the provider")
+	return resp, err
+}
+
+// Shutdown terminates the sessions of every provider instance and closes their
+// listeners, logging why. Tunnels can't be started afterwards.
+func Shutdown(reason string) {
+	log.Printf("%s, closing all tunnels", reason)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := CloseAllTunnels(ctx); err != nil {
+		log.Printf("Error closing tunnels: %v", err)
+	}
+}
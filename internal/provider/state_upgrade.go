@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/defaults"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// The schemas of the resources are versioned starting with 1. A change which
+// renames, removes or retypes an attribute bumps the version of the resource
+// and adds an upgrader from the previous version to its UpgradeState, so
+// existing states keep working without removing and importing them again.
+
+// upgradeUnversionedState upgrades states written before the schemas were
+// versioned. Which attributes they have depends on the provider release that
+// wrote them: attributes removed since are dropped, attributes added since get
+// their default, or are left null if they have none.
+func upgradeUnversionedState() resource.StateUpgrader {
+	return resource.StateUpgrader{
+		StateUpgrader: func(ctx context.Context, req resource.UpgradeStateRequest, resp *resource.UpgradeStateResponse) {
+			raw, err := req.RawState.UnmarshalWithOpts(resp.State.Schema.Type().TerraformType(ctx), tfprotov6.UnmarshalOpts{
+				ValueFromJSONOpts: tftypes.ValueFromJSONOpts{IgnoreUndefinedAttributes: true},
+			})
+			if err != nil {
+				resp.Diagnostics.AddError(
+					"Failed to upgrade state",
+					fmt.Sprintf("Error: %s", err),
+				)
+				return
+			}
+			var values map[string]tftypes.Value
+			if err := raw.As(&values); err != nil {
+				resp.Diagnostics.AddError(
+					"Failed to upgrade state",
+					fmt.Sprintf("Error: %s", err),
+				)
+				return
+			}
+
+			resp.State.Raw = raw
+			for name, attribute := range resp.State.Schema.GetAttributes() {
+				if !values[name].IsNull() {
+					continue
+				}
+				if value := attributeDefault(ctx, attribute); value != nil {
+					resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root(name), value)...)
+				}
+			}
+		},
+	}
+}
+
+// attributeDefault returns the default of a top level attribute, or nil if it has none.
+func attributeDefault(ctx context.Context, attribute schema.Attribute) attr.Value {
+	switch a := attribute.(type) {
+	case schema.StringAttribute:
+		if a.Default != nil {
+			var resp defaults.StringResponse
+			a.Default.DefaultString(ctx, defaults.StringRequest{}, &resp)
+			return resp.PlanValue
+		}
+	case schema.Int64Attribute:
+		if a.Default != nil {
+			var resp defaults.Int64Response
+			a.Default.DefaultInt64(ctx, defaults.Int64Request{}, &resp)
+			return resp.PlanValue
+		}
+	case schema.BoolAttribute:
+		if a.Default != nil {
+			var resp defaults.BoolResponse
+			a.Default.DefaultBool(ctx, defaults.BoolRequest{}, &resp)
+			return resp.PlanValue
+		}
+	}
+	return nil
+}
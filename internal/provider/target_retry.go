@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+)
+
+const (
+	targetRetryBaseDelay = time.Second
+	targetRetryMaxDelay  = 30 * time.Second
+)
+
+// startRemoteTunnel starts a session with ssmtunnels.StartRemoteTunnel, holding
+// a start slot for each attempt. While Session Manager reports the target as
+// not connected, e.g. an instance which just booted or whose agent restarts,
+// it tries again with exponential backoff until WaitForTarget passed, instead
+// of failing the apply right away.
+func (t *TunnelTracker) startRemoteTunnel(ctx context.Context, cfg ssmtunnels.RemoteTunnelConfig) (*ssmtunnels.Session, error) {
+	deadline := time.Now().Add(t.WaitForTarget)
+	delay := targetRetryBaseDelay
+	for {
+		releaseStart, err := t.acquireStartSlot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		session, err := ssmtunnels.StartRemoteTunnel(ctx, cfg)
+		releaseStart()
+		if err == nil || !ssmtunnels.IsTargetNotConnected(err) {
+			return session, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, err
+		}
+
+		wait := min(delay, remaining)
+		log.Printf("Target %s is not connected to Session Manager, starting the session again in %s: %v", cfg.Target, wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w, gave up waiting for it to connect: %w", err, ctx.Err())
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, targetRetryMaxDelay)
+	}
+}
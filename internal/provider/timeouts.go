@@ -0,0 +1,101 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Operations which can be bounded by the timeouts block of a tunnel.
+const (
+	timeoutCreate = "create"
+	timeoutRead   = "read"
+	timeoutUpdate = "update"
+)
+
+// TimeoutsModel describes the timeouts block of a tunnel.
+type TimeoutsModel struct {
+	Create types.String `tfsdk:"create"`
+	Read   types.String `tfsdk:"read"`
+	Update types.String `tfsdk:"update"`
+}
+
+var timeoutsType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	timeoutCreate: types.StringType,
+	timeoutRead:   types.StringType,
+	timeoutUpdate: types.StringType,
+}}
+
+// timeoutsBlock is the schema of the timeouts block of a tunnel resource.
+func timeoutsBlock() schema.SingleNestedBlock {
+	operation := func(description string) schema.StringAttribute {
+		return schema.StringAttribute{
+			MarkdownDescription: description + ", as a duration like `30s` or `2m`. Defaults to no limit",
+			Optional:            true,
+		}
+	}
+	return schema.SingleNestedBlock{
+		MarkdownDescription: "How long the provider waits for the session of the tunnel to start and be ready, including " +
+			"`wait_for_vpc_endpoints`, `wait_for_target_online`, `probe_command` and `probe`, before failing",
+		Attributes: map[string]schema.Attribute{
+			timeoutCreate: operation("Bounds starting the tunnel when it is created"),
+			timeoutRead:   operation("Bounds starting the tunnel again when it is refreshed, e.g. at the start of every run"),
+			timeoutUpdate: operation("Bounds starting the tunnel again when its settings change"),
+		},
+	}
+}
+
+// parseTimeouts returns the timeouts set in the timeouts block by operation.
+func parseTimeouts(ctx context.Context, timeouts types.Object) (map[string]time.Duration, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	parsed := map[string]time.Duration{}
+	if timeouts.IsNull() || timeouts.IsUnknown() {
+		return parsed, diags
+	}
+
+	var data TimeoutsModel
+	diags.Append(timeouts.As(ctx, &data, basetypes.ObjectAsOptions{})...)
+	if diags.HasError() {
+		return parsed, diags
+	}
+
+	for operation, value := range map[string]types.String{
+		timeoutCreate: data.Create,
+		timeoutRead:   data.Read,
+		timeoutUpdate: data.Update,
+	} {
+		if value.IsNull() || value.IsUnknown() {
+			continue
+		}
+		timeout, err := time.ParseDuration(value.ValueString())
+		if err != nil || timeout <= 0 {
+			diags.AddAttributeError(
+				path.Root("timeouts").AtName(operation),
+				"Invalid timeout",
+				fmt.Sprintf("%q is not a positive duration like 30s or 2m", value.ValueString()),
+			)
+			continue
+		}
+		parsed[operation] = timeout
+	}
+	return parsed, diags
+}
+
+// withTimeout bounds ctx by the timeout of the operation in the timeouts
+// block. Without one the context is returned as is.
+func withTimeout(ctx context.Context, timeouts types.Object, operation string) (context.Context, context.CancelFunc, diag.Diagnostics) {
+	parsed, diags := parseTimeouts(ctx, timeouts)
+	timeout, ok := parsed[operation]
+	if diags.HasError() || !ok {
+		return ctx, func() {}, diags
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, cancel, diags
+}
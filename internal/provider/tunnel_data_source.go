@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &TunnelDataSource{}
+var _ datasource.DataSourceWithConfigure = &TunnelDataSource{}
+
+func NewTunnelDataSource() datasource.DataSource {
+	return &TunnelDataSource{}
+}
+
+// TunnelDataSource looks up a tunnel of the tunnels map of the provider.
+type TunnelDataSource struct {
+	tunnels map[string]*NamedTunnel
+}
+
+// TunnelDataSourceModel describes the data source data model.
+type TunnelDataSourceModel struct {
+	Name       types.String `tfsdk:"name"`
+	Target     types.String `tfsdk:"target"`
+	Region     types.String `tfsdk:"region"`
+	RemoteHost types.String `tfsdk:"remote_host"`
+	RemotePort types.Int64  `tfsdk:"remote_port"`
+	LocalHost  types.String `tfsdk:"local_host"`
+	LocalPort  types.Int64  `tfsdk:"local_port"`
+	Platform   types.String `tfsdk:"platform"`
+}
+
+func (d *TunnelDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_tunnel"
+}
+
+func (d *TunnelDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Looks up a tunnel declared in the `tunnels` map of the provider. The tunnel is started once " +
+			"when the provider is configured, so modules can share it by name instead of each declaring an " +
+			"`awsssmtunnels_remote_tunnel`. The tunnels take the same settings as the resource, e.g. `probe`, `rewrite` and `lazy`, " +
+			"so the choice between them is only about their lifecycle.",
+
+		Attributes: map[string]schema.Attribute{
+			"name": schema.StringAttribute{
+				MarkdownDescription: "The key of the tunnel in the `tunnels` map of the provider",
+				Required:            true,
+			},
+			"target": schema.StringAttribute{
+				MarkdownDescription: "The target the tunnel goes through",
+				Computed:            true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "The region of the target",
+				Computed:            true,
+			},
+			"remote_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the remote host",
+				Computed:            true,
+			},
+			"remote_port": schema.Int64Attribute{
+				MarkdownDescription: "The port number of the remote host",
+				Computed:            true,
+			},
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The local host the tunnel listens on",
+				Computed:            true,
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: "The local port the tunnel listens on",
+				Computed:            true,
+			},
+			"platform": schema.StringAttribute{
+				MarkdownDescription: "The platform of the target as detected by its SSM agent, `Linux`, `Windows` or `MacOS`. Null if it couldn't be detected",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *TunnelDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tunnels = configData.Tunnels
+}
+
+func (d *TunnelDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data TunnelDataSourceModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tunnel, ok := d.tunnels[data.Name.ValueString()]
+	if !ok {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("name"),
+			"Unknown tunnel",
+			fmt.Sprintf("No tunnel named %q is declared in the tunnels of the provider", data.Name.ValueString()),
+		)
+		return
+	}
+	if tunnel.Info == nil {
+		// Terraform supporting deferred actions reads the data source again once the values are known
+		if req.ClientCapabilities.DeferralAllowed {
+			resp.Deferred = &datasource.Deferred{Reason: datasource.DeferredReasonProviderConfigUnknown}
+			return
+		}
+		resp.Diagnostics.AddAttributeError(
+			path.Root("name"),
+			"Tunnel not started yet",
+			fmt.Sprintf("Tunnel %q depends on values which are only known after apply, so it isn't started while planning. "+
+				"Add a depends_on to the data source on the resources the tunnel uses, so it is read during the apply.", data.Name.ValueString()),
+		)
+		return
+	}
+
+	data.Target = basetypes.NewStringValue(tunnel.Info.Target())
+	data.Region = basetypes.NewStringValue(tunnel.Spec.Region)
+	data.RemoteHost = basetypes.NewStringValue(tunnel.Spec.RemoteHost)
+	data.RemotePort = basetypes.NewInt64Value(int64(tunnel.Spec.RemotePort))
+	data.LocalHost = basetypes.NewStringValue(tunnel.Info.LocalHost)
+	data.LocalPort = basetypes.NewInt64Value(int64(tunnel.Info.LocalPort))
+	data.Platform = platformValue(tunnel.Info)
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
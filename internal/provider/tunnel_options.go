@@ -0,0 +1,180 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// tunnelOptionsModel holds the attributes shaping how a tunnel is started and
+// forwards, which awsssmtunnels_remote_tunnel and the tunnels of the provider
+// have in common.
+type tunnelOptionsModel struct {
+	Rewrite             types.List
+	WaitForVPCEndpoints types.List
+	WaitForTargetOnline types.Bool
+	MaxTransferBytes    types.Int64
+	MaxConnections      types.Int64
+	MaxQueued           types.Int64
+	BandwidthWeight     types.Int64
+	Lazy                types.Bool
+	CloseAfterIdle      types.String
+	ProbeCommand        types.String
+	ProbeTimeoutSeconds types.Int64
+	Probe               types.Object
+	RequirePlatform     types.String
+	DocumentName        types.String
+}
+
+// apply sets the options on the tunnel to start. Errors point to the
+// attributes below at, the root for a resource.
+func (m tunnelOptionsModel) apply(ctx context.Context, spec *TunnelSpec, at path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	spec.WaitForTargetOnline = m.WaitForTargetOnline.ValueBool()
+	spec.MaxTransferBytes = m.MaxTransferBytes.ValueInt64()
+	spec.MaxConnections = int(m.MaxConnections.ValueInt64())
+	spec.MaxQueuedConnections = int(m.MaxQueued.ValueInt64())
+	spec.BandwidthWeight = int(m.BandwidthWeight.ValueInt64())
+	spec.Lazy = m.Lazy.ValueBool()
+	spec.ProbeCommand = m.ProbeCommand.ValueString()
+	spec.ProbeTimeout = time.Duration(m.ProbeTimeoutSeconds.ValueInt64()) * time.Second
+	spec.RequirePlatform = m.RequirePlatform.ValueString()
+	spec.DocumentName = m.DocumentName.ValueString()
+	if spec.ProbeTimeout <= 0 {
+		spec.ProbeTimeout = defaultProbeTimeoutSeconds * time.Second
+	}
+
+	closeAfterIdle, diags := parseCloseAfterIdle(m.CloseAfterIdle, at)
+	if diags.HasError() {
+		return diags
+	}
+	spec.CloseAfterIdle = closeAfterIdle
+	if spec.MaxConnections < 0 {
+		diags.AddAttributeError(
+			at.AtName("max_connections"),
+			"Invalid connection limit",
+			"max_connections must not be negative",
+		)
+		return diags
+	}
+	if spec.MaxQueuedConnections < 0 {
+		diags.AddAttributeError(
+			at.AtName("max_queued_connections"),
+			"Invalid queue limit",
+			"max_queued_connections must not be negative",
+		)
+		return diags
+	}
+	if spec.MaxQueuedConnections > 0 && spec.MaxConnections == 0 {
+		diags.AddAttributeError(
+			at.AtName("max_queued_connections"),
+			"Invalid queue limit",
+			"max_queued_connections requires max_connections, connections are only queued once that many are forwarded",
+		)
+		return diags
+	}
+	if !m.BandwidthWeight.IsNull() && (spec.BandwidthWeight < 1 || spec.BandwidthWeight > ssmtunnels.MaxBandwidthWeight) {
+		diags.AddAttributeError(
+			at.AtName("bandwidth_weight"),
+			"Invalid bandwidth weight",
+			fmt.Sprintf("bandwidth_weight must be between 1 and %d", ssmtunnels.MaxBandwidthWeight),
+		)
+		return diags
+	}
+	if spec.MaxTransferBytes < 0 {
+		diags.AddAttributeError(
+			at.AtName("max_transfer_bytes"),
+			"Invalid transfer limit",
+			"max_transfer_bytes must not be negative",
+		)
+		return diags
+	}
+	diags.Append(validatePlatform(m.RequirePlatform, at)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	if !m.Probe.IsNull() && !m.Probe.IsUnknown() {
+		var probe ProbeModel
+		diags.Append(m.Probe.As(ctx, &probe, basetypes.ObjectAsOptions{})...)
+		if diags.HasError() {
+			return diags
+		}
+		spec.Probe = &TunnelProbe{
+			Type:     probe.Type.ValueString(),
+			Service:  probe.Service.ValueString(),
+			TLS:      probe.TLS.ValueBool(),
+			CABundle: probe.CABundle.ValueString(),
+			Timeout:  time.Duration(probe.TimeoutSeconds.ValueInt64()) * time.Second,
+		}
+		if spec.Probe.Timeout <= 0 {
+			spec.Probe.Timeout = defaultProbeTimeoutSeconds * time.Second
+		}
+		if spec.Lazy {
+			diags.AddAttributeError(
+				at.AtName("probe"),
+				"Invalid probe",
+				"probe can't be combined with lazy, the session of a lazy tunnel is only started by the first connection",
+			)
+			return diags
+		}
+	}
+
+	diags.Append(m.WaitForVPCEndpoints.ElementsAs(ctx, &spec.WaitForVPCEndpoints, false)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	var rules []RewriteRuleModel
+	diags.Append(m.Rewrite.ElementsAs(ctx, &rules, false)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	for i, rule := range rules {
+		rewrite := ssmtunnels.RewriteRule{
+			Direction: ssmtunnels.RewriteDirection(rule.Direction.ValueString()),
+			Match:     rule.Match.ValueString(),
+			Replace:   rule.Replace.ValueString(),
+			Regex:     rule.Regex.ValueBool(),
+		}
+		if rewrite.Direction == "" {
+			rewrite.Direction = ssmtunnels.RewriteResponse
+		}
+		if err := rewrite.Compile(); err != nil {
+			diags.AddAttributeError(
+				at.AtName("rewrite").AtListIndex(i),
+				"Invalid rewrite rule",
+				fmt.Sprintf("Error: %s", err),
+			)
+			continue
+		}
+		spec.Rewrites = append(spec.Rewrites, rewrite)
+	}
+
+	return diags
+}
+
+// parseCloseAfterIdle returns the close_after_idle of a tunnel, zero if it isn't set.
+func parseCloseAfterIdle(value types.String, at path.Path) (time.Duration, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	if value.IsNull() || value.IsUnknown() {
+		return 0, diags
+	}
+	duration, err := time.ParseDuration(value.ValueString())
+	if err != nil || duration <= 0 {
+		diags.AddAttributeError(
+			at.AtName("close_after_idle"),
+			"Invalid close_after_idle",
+			fmt.Sprintf("%q is not a positive duration like 15m", value.ValueString()),
+		)
+	}
+	return duration, diags
+}
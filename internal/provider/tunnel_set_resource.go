@@ -0,0 +1,697 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &TunnelSetResource{}
+var _ resource.ResourceWithModifyPlan = &TunnelSetResource{}
+var _ resource.ResourceWithUpgradeState = &TunnelSetResource{}
+
+func NewTunnelSetResource() resource.Resource {
+	return &TunnelSetResource{}
+}
+
+// TunnelSetResource defines the resource implementation.
+type TunnelSetResource struct {
+	tracker *TunnelTracker
+	region  string
+	target  string
+	targets []string
+
+	portRangeMin int
+	portRangeMax int
+
+	// accessMatrix is nil unless the provider writes one, see accessMatrix
+	accessMatrix *accessMatrix
+}
+
+// TunnelSetResourceModel describes the resource data model.
+type TunnelSetResourceModel struct {
+	RefreshId types.String `tfsdk:"refresh_id"`
+	Triggers  types.Map    `tfsdk:"triggers"`
+	Region    types.String `tfsdk:"region"`
+	RoleArn   types.String `tfsdk:"role_arn"`
+	Profile   types.String `tfsdk:"profile"`
+	LocalHost types.String `tfsdk:"local_host"`
+	Forward   types.List   `tfsdk:"forward"`
+	Id        types.String `tfsdk:"id"`
+	Target    types.String `tfsdk:"target"`
+	Endpoints types.Map    `tfsdk:"endpoints"`
+	Timeouts  types.Object `tfsdk:"timeouts"`
+}
+
+// TunnelSetForwardModel describes a forward of a tunnel set.
+type TunnelSetForwardModel struct {
+	RemoteHost types.String `tfsdk:"remote_host"`
+	RemotePort types.Int64  `tfsdk:"remote_port"`
+	LocalPort  types.Int64  `tfsdk:"local_port"`
+}
+
+var tunnelSetForwardType = types.ObjectType{AttrTypes: map[string]attr.Type{
+	"remote_host": types.StringType,
+	"remote_port": types.Int64Type,
+	"local_port":  types.Int64Type,
+}}
+
+// remote returns the remote endpoint of the forward, the key of its local endpoint in endpoints.
+func (f TunnelSetForwardModel) remote() string {
+	return net.JoinHostPort(f.RemoteHost.ValueString(), strconv.FormatInt(f.RemotePort.ValueInt64(), 10))
+}
+
+func (d *TunnelSetResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_tunnel_set"
+}
+
+func (d *TunnelSetResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Version: 1,
+
+		MarkdownDescription: "Tunnels to several remote endpoints through a single target, e.g. the database, cache and " +
+			"API of one environment behind the same bastion. Every forward gets its own local listener and session, " +
+			"and `endpoints` maps each remote endpoint to its local one. Like `awsssmtunnels_remote_tunnel`, the set is only " +
+			"created once a connection through every forward reached its remote endpoint.",
+
+		Attributes: map[string]schema.Attribute{
+			"refresh_id": schema.StringAttribute{
+				MarkdownDescription: "Any value, changing it starts every tunnel of the set again",
+				Required:            true,
+			},
+			"triggers": schema.MapAttribute{
+				MarkdownDescription: "Arbitrary values which replace the set when they change, like the `triggers` of `null_resource`, " +
+					"e.g. the IDs of the instances behind the forwards, so their sessions are started again once they were replaced. " +
+					"Tunnels shared with other resources keep their sessions while they use them",
+				ElementType: types.StringType,
+				Optional:    true,
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "The region of the target. Defaults to the provider region",
+				Optional:            true,
+			},
+			"role_arn": schema.StringAttribute{
+				MarkdownDescription: "ARN of a role to assume for starting the sessions, e.g. for a target in another account. " +
+					"Defaults to the provider credentials",
+				Optional: true,
+			},
+			"profile": schema.StringAttribute{
+				MarkdownDescription: "Named profile of the shared config files whose credentials start the sessions. Combined " +
+					"with `role_arn`, the role is assumed with the profile credentials. Defaults to the provider credentials",
+				Optional: true,
+			},
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the local host the tunnels listen on",
+				Optional:            true,
+				Computed:            true,
+				Default:             stringdefault.StaticString(defaultLocalHost),
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "Identifier of the tunnel set, derived when it is created from the target, region, local host, " +
+					"role ARN, profile and the remote endpoints of its forwards",
+				Computed: true,
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"target": schema.StringAttribute{
+				MarkdownDescription: "The target serving every tunnel of the set, one of the provider's `targets` when it " +
+					"spreads tunnels across several",
+				Computed: true,
+			},
+			"endpoints": schema.MapAttribute{
+				MarkdownDescription: "The local endpoint of each forward as `local_host:local_port`, keyed by its remote " +
+					"endpoint as `remote_host:remote_port`. IPv6 addresses are in brackets",
+				ElementType: types.StringType,
+				Computed:    true,
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"forward": schema.ListNestedBlock{
+				MarkdownDescription: "A remote endpoint to forward a local port to. Adding or removing a forward leaves " +
+					"the tunnels of the other forwards running",
+				NestedObject: schema.NestedBlockObject{
+					Attributes: map[string]schema.Attribute{
+						"remote_host": schema.StringAttribute{
+							MarkdownDescription: "The DNS name or IP address of the remote host. IPv6 addresses can be given with or without brackets",
+							Required:            true,
+						},
+						"remote_port": schema.Int64Attribute{
+							MarkdownDescription: "The port number of the remote host",
+							Required:            true,
+						},
+						"local_port": schema.Int64Attribute{
+							MarkdownDescription: "The local port number to use for the forward. Defaults to a free port of the " +
+								"provider's local port range, which is kept as long as the remote endpoint stays in the set",
+							Optional: true,
+							Computed: true,
+						},
+					},
+				},
+			},
+			"timeouts": timeoutsBlock(),
+		},
+	}
+}
+
+func (d *TunnelSetResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tracker = configData.Tracker
+	d.region = configData.Region
+	d.target = configData.Target
+	d.targets = configData.Targets
+	d.portRangeMin = configData.LocalPortRangeMin
+	d.portRangeMax = configData.LocalPortRangeMax
+	d.accessMatrix = configData.AccessMatrix
+}
+
+// regionOf returns the region of the tunnel set, defaulting to the provider region.
+func (d *TunnelSetResource) regionOf(data TunnelSetResourceModel) string {
+	if data.Region.ValueString() != "" {
+		return data.Region.ValueString()
+	}
+	return d.region
+}
+
+// tunnelSetId derives the ID of a tunnel set from its target, region, local
+// host, credentials and the remote endpoints of its forwards, like
+// tunnelIdentity.id, so the same set gets the same ID in every run.
+func (d *TunnelSetResource) tunnelSetId(data TunnelSetResourceModel, forwards []TunnelSetForwardModel) string {
+	var remotes []string
+	for _, forward := range forwards {
+		remoteHost := forward.RemoteHost.ValueString()
+		if normalized, err := ssmtunnels.NormalizeHost(remoteHost); err == nil {
+			remoteHost = normalized
+		}
+		remotes = append(remotes, net.JoinHostPort(remoteHost, strconv.FormatInt(forward.RemotePort.ValueInt64(), 10)))
+	}
+	slices.Sort(remotes)
+
+	parts := []string{"tunnel_set", targetKeyOf(d.target, d.targets), d.regionOf(data)}
+	parts = append(parts, remotes...)
+	if localHost := data.LocalHost.ValueString(); localHost != "" && localHost != defaultLocalHost {
+		parts = append(parts, "local_host="+localHost)
+	}
+	if data.RoleArn.ValueString() != "" {
+		parts = append(parts, "role_arn="+data.RoleArn.ValueString())
+	}
+	if data.Profile.ValueString() != "" {
+		parts = append(parts, "profile="+data.Profile.ValueString())
+	}
+	return uuid.NewSHA1(tunnelIDNamespace, []byte(strings.Join(parts, "|"))).String()
+}
+
+// forwardID returns the ID the tunnel of a forward is started with. Each
+// forward has its own, so TunnelTracker.TunnelStats reports them separately.
+func forwardID(setId string, forward TunnelSetForwardModel) string {
+	return setId + "/" + forward.remote()
+}
+
+// pickSetTarget returns the target of the tunnel set. With the provider's
+// targets the set stays on the target of the state while it is one of them,
+// so its tunnels are never spread across several. The target counts as
+// starting tunnels until the returned function is called, see pickTarget.
+func (d *TunnelSetResource) pickSetTarget(current string) (string, func()) {
+	switch {
+	case d.target != "":
+		return d.target, func() {}
+	case current != "" && slices.Contains(d.targets, current):
+		return current, func() {}
+	case len(d.targets) > 0:
+		return d.tracker.pickTarget(d.targets)
+	}
+	return "", func() {}
+}
+
+// ModifyPlan validates the forwards and keeps the local port of each remote
+// endpoint which stays in the set, wherever it moves in the list.
+func (d *TunnelSetResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if !req.Config.Raw.IsNull() {
+		var config TunnelSetResourceModel
+		resp.Diagnostics.Append(req.Config.Get(ctx, &config)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		_, diags := parseTimeouts(ctx, config.Timeouts)
+		resp.Diagnostics.Append(diags...)
+		resp.Diagnostics.Append(validateRegion(config.Region, path.Root("region"))...)
+
+		if !config.Forward.IsUnknown() {
+			var forwards []TunnelSetForwardModel
+			resp.Diagnostics.Append(config.Forward.ElementsAs(ctx, &forwards, false)...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+			if len(forwards) == 0 {
+				resp.Diagnostics.AddAttributeError(
+					path.Root("forward"),
+					"Missing forward",
+					"A tunnel set needs at least one forward block",
+				)
+			}
+			seen := map[string]bool{}
+			for i, forward := range forwards {
+				resp.Diagnostics.Append(validatePort(forward.RemotePort, path.Root("forward").AtListIndex(i).AtName("remote_port"))...)
+				resp.Diagnostics.Append(validatePort(forward.LocalPort, path.Root("forward").AtListIndex(i).AtName("local_port"))...)
+				if forward.RemoteHost.IsUnknown() || forward.RemotePort.IsUnknown() {
+					continue
+				}
+				if _, err := ssmtunnels.NormalizeHost(forward.RemoteHost.ValueString()); err != nil {
+					resp.Diagnostics.AddAttributeError(
+						path.Root("forward").AtListIndex(i).AtName("remote_host"),
+						"Invalid remote host",
+						fmt.Sprintf("Error: %s", err),
+					)
+					continue
+				}
+				if seen[forward.remote()] {
+					resp.Diagnostics.AddAttributeError(
+						path.Root("forward").AtListIndex(i),
+						"Duplicate forward",
+						fmt.Sprintf("%s is forwarded more than once, each remote endpoint can only be forwarded once per set", forward.remote()),
+					)
+				}
+				seen[forward.remote()] = true
+			}
+		}
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	// Nothing to plan on destroy, or if nothing changed
+	if req.Plan.Raw.IsNull() || req.Plan.Raw.Equal(req.State.Raw) {
+		if d.accessMatrix != nil && !req.State.Raw.IsNull() {
+			var state TunnelSetResourceModel
+			var forwards []TunnelSetForwardModel
+			resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+			resp.Diagnostics.Append(state.Forward.ElementsAs(ctx, &forwards, false)...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+			for _, forward := range forwards {
+				recordAccess(&resp.Diagnostics, d.accessMatrix, "awsssmtunnels_tunnel_set", plannedChange(req.State, req.Plan), d.plannedTunnel(state, state.Target, forward))
+			}
+		}
+		return
+	}
+
+	var plan TunnelSetResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	state := TunnelSetResourceModel{Forward: types.ListNull(tunnelSetForwardType)}
+	if !req.State.Raw.IsNull() {
+		resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+	var forwards, stateForwards []TunnelSetForwardModel
+	if !plan.Forward.IsUnknown() {
+		resp.Diagnostics.Append(plan.Forward.ElementsAs(ctx, &forwards, false)...)
+	}
+	resp.Diagnostics.Append(state.Forward.ElementsAs(ctx, &stateForwards, false)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Forwards whose settings all stay the same keep running, see applyForwards
+	sameSettings := !req.State.Raw.IsNull() && plan.RefreshId.Equal(state.RefreshId) && d.regionOf(plan) == d.regionOf(state) &&
+		plan.RoleArn.Equal(state.RoleArn) && plan.Profile.Equal(state.Profile) && plan.LocalHost.Equal(state.LocalHost)
+	target := types.StringUnknown()
+	if d.target != "" {
+		target = basetypes.NewStringValue(d.target)
+	} else if slices.Contains(d.targets, state.Target.ValueString()) {
+		target = state.Target
+	}
+
+	endpoints := map[string]string{}
+	for i, forward := range forwards {
+		known := !forward.RemoteHost.IsUnknown() && !forward.RemotePort.IsUnknown()
+		unchanged := false
+		for _, stateForward := range stateForwards {
+			if !known || stateForward.remote() != forward.remote() {
+				continue
+			}
+			if forward.LocalPort.IsUnknown() {
+				forwards[i].LocalPort = stateForward.LocalPort
+				forward.LocalPort = stateForward.LocalPort
+			}
+			unchanged = sameSettings && forward.LocalPort.Equal(stateForward.LocalPort)
+		}
+
+		// Each new tunnel opens a session, except for offline providers
+		if !unchanged && d.tracker != nil && !d.tracker.Offline() {
+			addPlannedTunnelWarning(&resp.Diagnostics, d.plannedTunnel(plan, target, forward))
+		}
+		change := plannedChange(req.State, req.Plan)
+		if unchanged {
+			change = "no change"
+		}
+		recordAccess(&resp.Diagnostics, d.accessMatrix, "awsssmtunnels_tunnel_set", change, d.plannedTunnel(plan, target, forward))
+
+		if !known || forward.LocalPort.IsUnknown() || plan.LocalHost.IsUnknown() {
+			endpoints = nil
+		}
+		if endpoints != nil {
+			endpoints[forward.remote()] = net.JoinHostPort(plan.LocalHost.ValueString(), strconv.FormatInt(forward.LocalPort.ValueInt64(), 10))
+		}
+	}
+
+	if !plan.Forward.IsUnknown() {
+		forwardList, diags := types.ListValueFrom(ctx, tunnelSetForwardType, forwards)
+		resp.Diagnostics.Append(diags...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("forward"), forwardList)...)
+	}
+	endpointsMap := types.MapUnknown(types.StringType)
+	if endpoints != nil && !plan.Forward.IsUnknown() {
+		var diags diag.Diagnostics
+		endpointsMap, diags = types.MapValueFrom(ctx, types.StringType, endpoints)
+		resp.Diagnostics.Append(diags...)
+	}
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("endpoints"), endpointsMap)...)
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("target"), target)...)
+}
+
+// plannedTunnel describes the tunnel of a forward of data for the plan, see
+// addPlannedTunnelWarning.
+func (d *TunnelSetResource) plannedTunnel(data TunnelSetResourceModel, target types.String, forward TunnelSetForwardModel) plannedTunnel {
+	return plannedTunnel{
+		target:     targetDescription(target.ValueString(), d.targets),
+		region:     d.regionOf(data),
+		roleArn:    data.RoleArn.ValueString(),
+		profile:    data.Profile.ValueString(),
+		remoteHost: forward.RemoteHost,
+		remotePort: forward.RemotePort,
+		local:      localEndpoint(data.LocalHost.ValueString(), forward.LocalPort, d.portRangeMin, d.portRangeMax),
+	}
+}
+
+// applyForwards starts the tunnels of the forwards of data on one target and
+// sets the computed attributes of data. Tunnels of prior, the state, which
+// still match their forward are kept running and the others are closed.
+// Tunnels started or shared before a forward failed to start are closed again.
+func (d *TunnelSetResource) applyForwards(ctx context.Context, data *TunnelSetResourceModel, prior *TunnelSetResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	var forwards, priorForwards []TunnelSetForwardModel
+	diags.Append(data.Forward.ElementsAs(ctx, &forwards, false)...)
+	if prior != nil {
+		diags.Append(prior.Forward.ElementsAs(ctx, &priorForwards, false)...)
+	}
+	if diags.HasError() {
+		return diags
+	}
+
+	currentTarget := ""
+	if prior != nil {
+		currentTarget = prior.Target.ValueString()
+	}
+	target, done := d.pickSetTarget(currentTarget)
+	defer done()
+
+	specs := make([]TunnelSpec, len(forwards))
+	running := make([]*OtherTunnelInfo, len(forwards))
+	kept := map[string]bool{}
+	for i, forward := range forwards {
+		specs[i] = TunnelSpec{
+			Id:         forwardID(data.Id.ValueString(), forward),
+			Target:     target,
+			Region:     d.regionOf(*data),
+			RemoteHost: forward.RemoteHost.ValueString(),
+			RemotePort: int(forward.RemotePort.ValueInt64()),
+			LocalHost:  data.LocalHost.ValueString(),
+			LocalPort:  int(forward.LocalPort.ValueInt64()),
+			RoleArn:    data.RoleArn.ValueString(),
+			Profile:    data.Profile.ValueString(),
+		}
+		if prior == nil || !prior.RefreshId.Equal(data.RefreshId) {
+			continue
+		}
+		if tunnel := d.tracker.LiveTunnel(specs[i]); tunnel != nil && d.tracker.UsedBy(tunnel, specs[i].Id) {
+			running[i] = tunnel
+			kept[specs[i].Id] = true
+		}
+	}
+
+	// Close the tunnels of the state which don't serve a forward anymore first,
+	// they may hold on to a local port a forward moves to
+	for _, forward := range priorForwards {
+		if id := forwardID(prior.Id.ValueString(), forward); !kept[id] {
+			if err := d.tracker.CloseTunnels(ctx, id); err != nil {
+				diags.AddError(
+					"Failed to close remote tunnel",
+					fmt.Sprintf("Error: %s", err),
+				)
+				return diags
+			}
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		started []int
+	)
+	for i := range specs {
+		if running[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			info, err := d.startForward(ctx, specs[i])
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				diags.AddAttributeError(
+					path.Root("forward").AtListIndex(i),
+					startTunnelErrorSummary(err),
+					failureDetail(fmt.Sprintf("Error starting tunnel to %s: %s", forwards[i].remote(), err), err),
+				)
+				return
+			}
+			running[i] = info
+			started = append(started, i)
+		}(i)
+	}
+	wg.Wait()
+
+	if diags.HasError() {
+		for _, i := range started {
+			if err := d.tracker.CloseTunnels(ctx, specs[i].Id); err != nil {
+				diags.AddError(
+					"Failed to close remote tunnel",
+					fmt.Sprintf("Error: %s", err),
+				)
+			}
+		}
+		return diags
+	}
+
+	endpoints := make(map[string]string, len(forwards))
+	for i := range forwards {
+		forwards[i].LocalPort = basetypes.NewInt64Value(int64(running[i].LocalPort))
+		endpoints[forwards[i].remote()] = net.JoinHostPort(running[i].LocalHost, strconv.Itoa(running[i].LocalPort))
+	}
+	var forwardDiags diag.Diagnostics
+	data.Forward, forwardDiags = types.ListValueFrom(ctx, tunnelSetForwardType, forwards)
+	diags.Append(forwardDiags...)
+	data.Endpoints, forwardDiags = types.MapValueFrom(ctx, types.StringType, endpoints)
+	diags.Append(forwardDiags...)
+	data.Target = basetypes.NewStringValue(target)
+	return diags
+}
+
+// startForward starts the tunnel of a forward, or shares a matching tunnel
+// of another resource, see TunnelTracker.AcquireTunnel. Like the ready check
+// of awsssmtunnels_remote_tunnel, the forward is only handed out once a
+// connection through it reached the remote endpoint, otherwise it is closed.
+func (d *TunnelSetResource) startForward(ctx context.Context, spec TunnelSpec) (*OtherTunnelInfo, error) {
+	tunnel, err := d.acquireForward(ctx, spec)
+	if err != nil || d.tracker.Offline() {
+		return tunnel, err
+	}
+	remote := net.JoinHostPort(spec.RemoteHost, strconv.Itoa(spec.RemotePort))
+	if err := checkTunnel(ctx, tunnel, remote, defaultReadyTimeout); err != nil {
+		if closeErr := d.tracker.CloseTunnels(context.Background(), spec.Id); closeErr != nil {
+			log.Printf("Error closing the tunnel to %q which isn't ready: %v", remote, closeErr)
+		}
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// acquireForward starts the tunnel of a forward, or shares a matching tunnel of another resource.
+func (d *TunnelSetResource) acquireForward(ctx context.Context, spec TunnelSpec) (*OtherTunnelInfo, error) {
+	tunnel, release, err := d.tracker.AcquireTunnel(ctx, spec)
+	defer release()
+	if err != nil || tunnel != nil {
+		return tunnel, err
+	}
+	port, err := pickLocalPort(d.tracker, spec.LocalHost, spec.LocalPort, spec.RemoteHost, spec.RemotePort, d.portRangeMin, d.portRangeMax)
+	if err != nil {
+		return nil, fmt.Errorf("finding an open port: %w", err)
+	}
+	spec.LocalPort = port
+	return d.tracker.StartTunnel(ctx, spec)
+}
+
+func (d *TunnelSetResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data TunnelSetResourceModel
+
+	// The plan has the local ports of ModifyPlan
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	ctx, cancel, diags := withTimeout(ctx, data.Timeouts, timeoutCreate)
+	defer cancel()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var forwards []TunnelSetForwardModel
+	resp.Diagnostics.Append(data.Forward.ElementsAs(ctx, &forwards, false)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The ID is set first so the tunnels are reported under it, see TunnelTracker.TunnelStats
+	data.Id = basetypes.NewStringValue(d.tunnelSetId(data, forwards))
+	resp.Diagnostics.Append(d.applyForwards(ctx, &data, nil)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *TunnelSetResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data TunnelSetResourceModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	ctx, cancel, diags := withTimeout(ctx, data.Timeouts, timeoutRead)
+	defer cancel()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Like for awsssmtunnels_remote_tunnel, live tunnels are kept and the
+	// others started again, since tunnels don't outlive the provider process
+	prior := data
+	resp.Diagnostics.Append(d.applyForwards(ctx, &data, &prior)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *TunnelSetResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data, state TunnelSetResourceModel
+
+	// The plan has the local ports of ModifyPlan
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	ctx, cancel, diags := withTimeout(ctx, data.Timeouts, timeoutUpdate)
+	defer cancel()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(d.applyForwards(ctx, &data, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *TunnelSetResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data TunnelSetResourceModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var forwards []TunnelSetForwardModel
+	resp.Diagnostics.Append(data.Forward.ElementsAs(ctx, &forwards, false)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	for _, forward := range forwards {
+		if err := d.tracker.CloseTunnels(ctx, forwardID(data.Id.ValueString(), forward)); err != nil {
+			resp.Diagnostics.AddError(
+				"Failed to close remote tunnel",
+				fmt.Sprintf("Error: %s", err),
+			)
+			return
+		}
+	}
+}
+
+func (d *TunnelSetResource) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	return map[int64]resource.StateUpgrader{
+		0: upgradeUnversionedState(),
+	}
+}
@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// The validations below run while planning, so invalid configurations fail
+// before the apply instead of halfway through it. Null and unknown values pass.
+
+// validatePort checks the attribute at p is a port number.
+func validatePort(value types.Int64, p path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !value.IsNull() && !value.IsUnknown() && (value.ValueInt64() < 1 || value.ValueInt64() > 65535) {
+		diags.AddAttributeError(
+			p,
+			"Invalid port",
+			fmt.Sprintf("%d is not a port number between 1 and 65535", value.ValueInt64()),
+		)
+	}
+	return diags
+}
+
+// validateRegion checks the attribute at p names a region.
+func validateRegion(value types.String, p path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if value.IsNull() || value.IsUnknown() || value.ValueString() == "" {
+		return diags
+	}
+	if err := ssmtunnels.ValidateRegion(value.ValueString()); err != nil {
+		diags.AddAttributeError(
+			p,
+			"Invalid region",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+	return diags
+}
+
+// validateTarget checks the attribute at p is a target of Session Manager.
+func validateTarget(value types.String, p path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if value.IsNull() || value.IsUnknown() || value.ValueString() == "" {
+		return diags
+	}
+	if _, err := ssmtunnels.NormalizeTarget(value.ValueString()); err != nil {
+		diags.AddAttributeError(
+			p,
+			"Invalid target",
+			fmt.Sprintf("Error: %s", err),
+		)
+	}
+	return diags
+}
+
+// validatePlatform checks the require_platform of a tunnel names a platform
+// the way Session Manager reports it.
+func validatePlatform(value types.String, at path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if !value.IsNull() && !value.IsUnknown() && !slices.Contains(ssmtunnels.Platforms, value.ValueString()) {
+		diags.AddAttributeError(
+			at.AtName("require_platform"),
+			"Invalid platform",
+			fmt.Sprintf("require_platform must be one of %s", strings.Join(ssmtunnels.Platforms, ", ")),
+		)
+	}
+	return diags
+}
+
+// validateTunnelConfig checks the attributes a remote tunnel and the tunnels
+// of the provider have in common, below at.
+func validateTunnelConfig(remotePort, localPort types.Int64, stableLocalPort, lazy types.Bool, probe types.Object, at path.Path) diag.Diagnostics {
+	var diags diag.Diagnostics
+	diags.Append(validatePort(remotePort, at.AtName("remote_port"))...)
+	diags.Append(validatePort(localPort, at.AtName("local_port"))...)
+	if stableLocalPort.ValueBool() && !localPort.IsNull() {
+		diags.AddAttributeError(
+			at.AtName("stable_local_port"),
+			"Conflicting local port",
+			"stable_local_port derives the local port, it can't be combined with local_port",
+		)
+	}
+	if lazy.ValueBool() && !probe.IsNull() {
+		diags.AddAttributeError(
+			at.AtName("probe"),
+			"Invalid probe",
+			"probe can't be combined with lazy, the session of a lazy tunnel is only started by the first connection",
+		)
+	}
+	return diags
+}
+
+// oneOf is a schema validator for string attributes which only take one of
+// a few values, like the type of a probe.
+type oneOf struct {
+	summary string
+	values  []string
+}
+
+var _ validator.String = oneOf{}
+
+func (v oneOf) Description(ctx context.Context) string {
+	quoted := make([]string, len(v.values))
+	for i, value := range v.values {
+		quoted[i] = fmt.Sprintf("%q", value)
+	}
+	return "must be one of " + strings.Join(quoted, ", ")
+}
+
+func (v oneOf) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v oneOf) ValidateString(ctx context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() || slices.Contains(v.values, req.ConfigValue.ValueString()) {
+		return
+	}
+	resp.Diagnostics.AddAttributeError(
+		req.Path,
+		v.summary,
+		fmt.Sprintf("%s %s, got %q", req.Path, v.Description(ctx), req.ConfigValue.ValueString()),
+	)
+}
@@ -0,0 +1,299 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/booldefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/boolplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64default"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/objectplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &WaitForResource{}
+var _ resource.ResourceWithUpgradeState = &WaitForResource{}
+var _ resource.ResourceWithModifyPlan = &WaitForResource{}
+
+func NewWaitForResource() resource.Resource {
+	return &WaitForResource{}
+}
+
+// probeTypeTCP waits for a connection through a tunnel which the remote side keeps open.
+const probeTypeTCP = "tcp"
+
+// defaultWaitForTimeoutSeconds is how long awsssmtunnels_wait_for waits by default.
+const defaultWaitForTimeoutSeconds = 300
+
+// WaitForResource defines the resource implementation.
+type WaitForResource struct {
+	tracker *TunnelTracker
+}
+
+// WaitForResourceModel describes the resource data model.
+type WaitForResourceModel struct {
+	LocalHost      types.String `tfsdk:"local_host"`
+	LocalPort      types.Int64  `tfsdk:"local_port"`
+	Probe          types.Object `tfsdk:"probe"`
+	TimeoutSeconds types.Int64  `tfsdk:"timeout_seconds"`
+	FailOnTimeout  types.Bool   `tfsdk:"fail_on_timeout"`
+	Passed         types.Bool   `tfsdk:"passed"`
+	ElapsedSeconds types.Int64  `tfsdk:"elapsed_seconds"`
+	Id             types.String `tfsdk:"id"`
+}
+
+// WaitForProbeModel describes the condition awsssmtunnels_wait_for waits for.
+type WaitForProbeModel struct {
+	Type       types.String `tfsdk:"type"`
+	Service    types.String `tfsdk:"service"`
+	TLS        types.Bool   `tfsdk:"tls"`
+	ServerName types.String `tfsdk:"server_name"`
+	CABundle   types.String `tfsdk:"ca_bundle"`
+}
+
+func (d *WaitForResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_wait_for"
+}
+
+func (d *WaitForResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		Version: 1,
+
+		MarkdownDescription: "Waits until the service behind a tunnel is ready, or the timeout passed. Use it as an explicit " +
+			"ordering gate between a tunnel and the resources using it, instead of sleeping for a fixed time.",
+
+		Attributes: map[string]schema.Attribute{
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The local host of the tunnel, e.g. `awsssmtunnels_remote_tunnel.example.local_host`",
+				Optional:            true,
+				Computed:            true,
+				Default:             stringdefault.StaticString(defaultLocalHost),
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: "The local port of the tunnel, e.g. `awsssmtunnels_remote_tunnel.example.local_port`",
+				Required:            true,
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
+			},
+			"probe": schema.SingleNestedAttribute{
+				MarkdownDescription: "The condition to wait for",
+				Required:            true,
+				PlanModifiers: []planmodifier.Object{
+					objectplanmodifier.RequiresReplace(),
+				},
+				Attributes: map[string]schema.Attribute{
+					"type": schema.StringAttribute{
+						MarkdownDescription: "`tcp` to wait for a connection through the tunnel which the remote host keeps open, " +
+							"`grpc` to call the standard gRPC health checking protocol (`grpc.health.v1.Health/Check`) until it reports `SERVING`",
+						Required:   true,
+						Validators: []validator.String{oneOf{summary: "Invalid probe type", values: []string{probeTypeTCP, probeTypeGRPC}}},
+					},
+					"service": schema.StringAttribute{
+						MarkdownDescription: "The gRPC service to check. Defaults to the server as a whole",
+						Optional:            true,
+					},
+					"tls": schema.BoolAttribute{
+						MarkdownDescription: "Connect to the gRPC server with TLS, verifying the certificate against `server_name`",
+						Optional:            true,
+					},
+					"server_name": schema.StringAttribute{
+						MarkdownDescription: "The name the certificate is verified against with `tls`, usually the remote host of the tunnel",
+						Optional:            true,
+					},
+					"ca_bundle": schema.StringAttribute{
+						MarkdownDescription: "Path to a PEM file with certificates trusted with `tls` in addition to the system's. " +
+							"The provider's `ca_bundle` and `insecure` only apply to AWS",
+						Optional: true,
+					},
+				},
+			},
+			"timeout_seconds": schema.Int64Attribute{
+				MarkdownDescription: "How long to wait for the condition. Defaults to 300",
+				Optional:            true,
+				Computed:            true,
+				Default:             int64default.StaticInt64(defaultWaitForTimeoutSeconds),
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
+			},
+			"fail_on_timeout": schema.BoolAttribute{
+				MarkdownDescription: "Fail the apply if the condition isn't met in time. With `false` the resource is created " +
+					"anyway and `passed` is `false`. Defaults to `true`",
+				Optional: true,
+				Computed: true,
+				Default:  booldefault.StaticBool(true),
+				PlanModifiers: []planmodifier.Bool{
+					boolplanmodifier.RequiresReplace(),
+				},
+			},
+			"passed": schema.BoolAttribute{
+				MarkdownDescription: "Whether the condition was met before the timeout",
+				Computed:            true,
+			},
+			"elapsed_seconds": schema.Int64Attribute{
+				MarkdownDescription: "How long it took until the condition was met or the timeout passed",
+				Computed:            true,
+			},
+			"id": schema.StringAttribute{
+				MarkdownDescription: "Identifier of the wait",
+				Computed:            true,
+			},
+		},
+	}
+}
+
+func (d *WaitForResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	configData, ok := req.ProviderData.(*ProvidedConfigData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *ProvidedConfigData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.tracker = configData.Tracker
+}
+
+// ModifyPlan rejects local ports which can't be the port of a tunnel.
+func (d *WaitForResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if req.Config.Raw.IsNull() {
+		return
+	}
+	var localPort types.Int64
+	resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("local_port"), &localPort)...)
+	resp.Diagnostics.Append(validatePort(localPort, path.Root("local_port"))...)
+}
+
+func (d *WaitForResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data WaitForResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var probe WaitForProbeModel
+	resp.Diagnostics.Append(data.Probe.As(ctx, &probe, basetypes.ObjectAsOptions{})...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	localHost, err := ssmtunnels.NormalizeHost(data.LocalHost.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("local_host"),
+			"Invalid local host",
+			fmt.Sprintf("Error: %s", err),
+		)
+		return
+	}
+	addr := net.JoinHostPort(localHost, strconv.Itoa(int(data.LocalPort.ValueInt64())))
+
+	timeout := time.Duration(data.TimeoutSeconds.ValueInt64()) * time.Second
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	// Tunnels of an offline provider don't listen, there is nothing to wait for
+	if !d.tracker.Offline() {
+		switch probe.Type.ValueString() {
+		case probeTypeTCP:
+			_, err = checkConnection(waitCtx, addr)
+		case probeTypeGRPC:
+			err = d.waitForGRPC(waitCtx, addr, probe)
+		}
+	}
+	elapsed := time.Since(start)
+
+	if err != nil && data.FailOnTimeout.ValueBool() {
+		resp.Diagnostics.AddError(
+			"Condition not met",
+			classifiedDetail(fmt.Sprintf("Waited %s for %s through %s: %s", elapsed.Round(time.Second), probe.Type.ValueString(), addr, err), failureConnect),
+		)
+		return
+	}
+
+	data.Id = basetypes.NewStringValue(uuid.New().String())
+	data.Passed = basetypes.NewBoolValue(err == nil)
+	data.ElapsedSeconds = basetypes.NewInt64Value(int64(elapsed.Seconds()))
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// waitForGRPC waits until the gRPC server listening on addr reports the service as serving.
+func (d *WaitForResource) waitForGRPC(ctx context.Context, addr string, probe WaitForProbeModel) error {
+	tlsConfig, err := ssmtunnels.TLSConfig{CABundle: probe.CABundle.ValueString()}.ClientConfig()
+	if err != nil {
+		return err
+	}
+	return ssmtunnels.WaitForGRPCHealth(ctx, ssmtunnels.GRPCHealthConfig{
+		Addr:       addr,
+		Service:    probe.Service.ValueString(),
+		TLS:        probe.TLS.ValueBool(),
+		ServerName: probe.ServerName.ValueString(),
+		TLSConfig:  tlsConfig,
+	})
+}
+
+func (d *WaitForResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data WaitForResourceModel
+
+	// The wait only happens on create, keep whatever is in state
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *WaitForResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data WaitForResourceModel
+
+	// All arguments require replacement, so there is nothing to do here
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (d *WaitForResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	// Nothing is left running once the wait is over
+}
+
+func (d *WaitForResource) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	return map[int64]resource.StateUpgrader{
+		0: upgradeUnversionedState(),
+	}
+}
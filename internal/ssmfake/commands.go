@@ -0,0 +1,119 @@
+package ssmfake
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CommandResult is how a command sent to a target with SendCommand ends.
+type CommandResult struct {
+	// Status is the final status of the invocation, e.g. Success or Failed
+	Status   string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// command is a command sent with SendCommand.
+type command struct {
+	target   string
+	commands []string
+	result   CommandResult
+	// polls counts the GetCommandInvocation calls of the command
+	polls int
+}
+
+// SetCommandResults sets how the commands sent to the target from now on
+// end, in order, the last result repeating. Commands succeed unless set.
+// GetCommandInvocation doesn't know the invocation of a command at first, then
+// reports it in progress, and only then its result, like Run Command does.
+func (s *Server) SetCommandResults(target string, results ...CommandResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.commandResults == nil {
+		s.commandResults = map[string][]CommandResult{}
+	}
+	s.commandResults[target] = results
+}
+
+// DenyCommands refuses the commands sent to the target with AccessDeniedException.
+func (s *Server) DenyCommands(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deniedCommands == nil {
+		s.deniedCommands = map[string]bool{}
+	}
+	s.deniedCommands[target] = true
+}
+
+// Commands returns the shell commands sent to the target, in order.
+func (s *Server) Commands(target string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var commands []string
+	for _, cmd := range s.commands {
+		if cmd.target == target {
+			commands = append(commands, strings.Join(cmd.commands, "\n"))
+		}
+	}
+	return commands
+}
+
+// serveCommand serves the calls of Run Command, reporting whether the operation is one of them.
+func (s *Server) serveCommand(w http.ResponseWriter, operation string, instanceIds []string, parameters map[string][]string, commandId string, instanceId string) bool {
+	switch operation {
+	case "SendCommand":
+		if len(instanceIds) != 1 {
+			writeError(w, "ValidationException", "the fake only sends commands to a single instance")
+			return true
+		}
+		target := instanceIds[0]
+		if s.deniedCommands[target] {
+			writeError(w, "AccessDeniedException", fmt.Sprintf("not authorized to perform ssm:SendCommand on %s", target))
+			return true
+		}
+		result := CommandResult{Status: "Success"}
+		if results := s.commandResults[target]; len(results) > 0 {
+			result = results[0]
+			if len(results) > 1 {
+				s.commandResults[target] = results[1:]
+			}
+		}
+		s.commands = append(s.commands, &command{target: target, commands: parameters["commands"], result: result})
+		writeJSON(w, map[string]any{"Command": map[string]any{
+			"CommandId":   fmt.Sprintf("command-%012d", len(s.commands)),
+			"InstanceIds": instanceIds,
+			"Status":      "Pending",
+		}})
+	case "GetCommandInvocation":
+		var cmd *command
+		var index int
+		if _, err := fmt.Sscanf(commandId, "command-%d", &index); err == nil && index > 0 && index <= len(s.commands) {
+			cmd = s.commands[index-1]
+		}
+		if cmd == nil || cmd.target != instanceId {
+			writeError(w, "InvalidCommandId", fmt.Sprintf("command %s does not exist", commandId))
+			return true
+		}
+		cmd.polls++
+		switch cmd.polls {
+		case 1:
+			writeError(w, "InvocationDoesNotExist", fmt.Sprintf("invocation of %s on %s does not exist", commandId, instanceId))
+		case 2:
+			writeJSON(w, map[string]any{"CommandId": commandId, "InstanceId": instanceId, "Status": "InProgress", "ResponseCode": -1})
+		default:
+			writeJSON(w, map[string]any{
+				"CommandId":             commandId,
+				"InstanceId":            instanceId,
+				"Status":                cmd.result.Status,
+				"ResponseCode":          cmd.result.ExitCode,
+				"StandardOutputContent": cmd.result.Stdout,
+				"StandardErrorContent":  cmd.result.Stderr,
+			})
+		}
+	default:
+		return false
+	}
+	return true
+}
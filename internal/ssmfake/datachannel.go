@@ -0,0 +1,240 @@
+package ssmfake
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// agentVersion is old enough for the plugin to forward a single connection at
+// a time instead of multiplexing connections with smux.
+const agentVersion = "3.0.0.0"
+
+// streamDataPayloadSize is the largest payload the plugin sends, the fake sends the same.
+const streamDataPayloadSize = 1024
+
+// streamState is where the stream of a session is at. Like the agent, the fake
+// continues the stream of a resumed session instead of starting over.
+type streamState struct {
+	// sequence is the sequence number of the next message sent to the plugin
+	sequence int64
+	// expected is the sequence number of the next message of the plugin
+	expected int64
+	// handshaken is set once the handshake was sent, which isn't repeated on resume
+	handshaken bool
+}
+
+// dataChannel plays the agent of a session: it runs the handshake with the
+// plugin and relays the stream to a connection to the remote host.
+type dataChannel struct {
+	conn    *websocket.Conn
+	session SessionInfo
+	delay   time.Duration
+
+	writeMu    sync.Mutex
+	sequence   int64
+	expected   int64
+	handshaken bool
+
+	remoteMu sync.Mutex
+	remote   net.Conn
+
+	closeOnce sync.Once
+}
+
+func newDataChannel(conn *websocket.Conn, session SessionInfo, delay time.Duration, stream streamState) *dataChannel {
+	return &dataChannel{conn: conn, session: session, delay: delay, sequence: stream.sequence, expected: stream.expected, handshaken: stream.handshaken}
+}
+
+// state returns where the stream is at, once run returned.
+func (c *dataChannel) state() streamState {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return streamState{sequence: c.sequence, expected: c.expected, handshaken: c.handshaken}
+}
+
+// run serves the channel until the plugin goes away or the session is
+// terminated. It reports whether the plugin terminated the session.
+func (c *dataChannel) run() bool {
+	defer c.close(false)
+
+	handshake, _ := json.Marshal(map[string]any{
+		"AgentVersion": agentVersion,
+		"RequestedClientActions": []map[string]any{{
+			"ActionType": "SessionType",
+			"ActionParameters": map[string]any{
+				"SessionType": "Port",
+				"Properties": map[string]string{
+					"portNumber":      strconv.Itoa(c.session.RemotePort),
+					"localPortNumber": strconv.Itoa(c.session.LocalPort),
+					"type":            "LocalPortForwarding",
+				},
+			},
+		}},
+	})
+	if !c.handshaken {
+		time.Sleep(c.delay)
+		if err := c.send(payloadHandshakeRequest, handshake); err != nil {
+			return false
+		}
+		c.writeMu.Lock()
+		c.handshaken = true
+		c.writeMu.Unlock()
+	}
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return false
+		}
+		message, err := decodeMessage(data)
+		if err != nil || message.MessageType != inputStreamMessage {
+			// The plugin acknowledges what we sent, there is nothing to resend on a local connection
+			continue
+		}
+		// Messages the plugin resends or sends ahead are acknowledged once they are next in line
+		c.writeMu.Lock()
+		expected := c.expected
+		c.writeMu.Unlock()
+		if message.SequenceNumber != expected {
+			if message.SequenceNumber < expected {
+				_ = c.acknowledge(message)
+			}
+			continue
+		}
+		if err := c.acknowledge(message); err != nil {
+			return false
+		}
+		c.writeMu.Lock()
+		c.expected++
+		c.writeMu.Unlock()
+
+		switch message.PayloadType {
+		case payloadHandshakeResponse:
+			complete, _ := json.Marshal(map[string]any{"HandshakeTimeToComplete": 0, "CustomerMessage": ""})
+			if err := c.send(payloadHandshakeComplete, complete); err != nil {
+				return false
+			}
+		case payloadOutput:
+			c.forward(message.Payload)
+		case payloadFlag:
+			if len(message.Payload) < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint32(message.Payload) {
+			case flagDisconnectToPort:
+				c.disconnect()
+			case flagTerminateSession:
+				return true
+			}
+		}
+	}
+}
+
+// forward writes data of the plugin to the remote host, connecting on the
+// first data like the agent does.
+func (c *dataChannel) forward(data []byte) {
+	c.remoteMu.Lock()
+	defer c.remoteMu.Unlock()
+
+	if c.remote == nil {
+		remote, err := net.DialTimeout("tcp", net.JoinHostPort(c.session.RemoteHost, strconv.Itoa(c.session.RemotePort)), 5*time.Second)
+		if err != nil {
+			return
+		}
+		c.remote = remote
+		go c.relay(remote)
+	}
+	if _, err := c.remote.Write(data); err != nil {
+		c.remote.Close()
+		c.remote = nil
+	}
+}
+
+// relay sends everything the remote host writes back to the plugin.
+func (c *dataChannel) relay(remote net.Conn) {
+	buf := make([]byte, streamDataPayloadSize)
+	for {
+		n, err := remote.Read(buf)
+		if n > 0 {
+			if err := c.send(payloadOutput, buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// disconnect closes the remote connection after the client closed its end.
+func (c *dataChannel) disconnect() {
+	c.remoteMu.Lock()
+	defer c.remoteMu.Unlock()
+
+	if c.remote != nil {
+		c.remote.Close()
+		c.remote = nil
+	}
+}
+
+// send writes the payload as the next output message of the stream.
+func (c *dataChannel) send(payloadType uint32, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	message := clientMessage{
+		MessageType:    outputStreamMessage,
+		SequenceNumber: c.sequence,
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, message.encode()); err != nil {
+		return err
+	}
+	c.sequence++
+	return nil
+}
+
+func (c *dataChannel) acknowledge(message clientMessage) error {
+	content, _ := json.Marshal(map[string]any{
+		"AcknowledgedMessageType":           message.MessageType,
+		"AcknowledgedMessageId":             message.uuid(),
+		"AcknowledgedMessageSequenceNumber": message.SequenceNumber,
+		"IsSequentialMessage":               true,
+	})
+	return c.write(clientMessage{
+		MessageType: acknowledgeMessage,
+		Flags:       3,
+		Payload:     content,
+	})
+}
+
+func (c *dataChannel) write(message clientMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, message.encode())
+}
+
+// close ends the channel, telling the plugin the session is over if terminated.
+func (c *dataChannel) close(terminated bool) {
+	c.closeOnce.Do(func() {
+		if terminated {
+			content, _ := json.Marshal(map[string]any{
+				"MessageType":   channelClosedMessage,
+				"SessionId":     c.session.Id,
+				"CreatedDate":   time.Now().UTC().Format(time.RFC3339),
+				"SchemaVersion": 1,
+				"Output":        "",
+			})
+			_ = c.write(clientMessage{MessageType: channelClosedMessage, Payload: content})
+		}
+		c.disconnect()
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,118 @@
+package ssmfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// document is a custom session document created on the fake.
+type document struct {
+	// versions are the contents of every version, version n being versions[n-1]
+	versions       []string
+	defaultVersion int
+}
+
+// documentContent is the part of a port forwarding document the fake checks
+// sessions against.
+type documentContent struct {
+	SessionType string `json:"sessionType"`
+	Parameters  map[string]struct {
+		AllowedValues []string `json:"allowedValues"`
+	} `json:"parameters"`
+}
+
+// allows reports whether sessions with the content may forward to the host and port.
+func (c documentContent) allows(host string, port int) bool {
+	allowed := func(name string, value string) bool {
+		values := c.Parameters[name].AllowedValues
+		return len(values) == 0 || slices.Contains(values, value)
+	}
+	return allowed("host", host) && allowed("portNumber", strconv.Itoa(port))
+}
+
+// serveDocument serves the calls managing documents, reporting whether the operation is one of them.
+func (s *Server) serveDocument(w http.ResponseWriter, operation string, name string, content string, version string) bool {
+	describe := func(doc *document, version int) map[string]any {
+		return map[string]any{
+			"Name":            name,
+			"DocumentType":    "Session",
+			"DocumentVersion": strconv.Itoa(version),
+			"LatestVersion":   strconv.Itoa(len(doc.versions)),
+			"DefaultVersion":  strconv.Itoa(doc.defaultVersion),
+		}
+	}
+
+	doc, exists := s.documents[name]
+	switch operation {
+	case "CreateDocument":
+		if exists {
+			writeError(w, "DocumentAlreadyExists", fmt.Sprintf("Document %s already exists", name))
+			return true
+		}
+		if err := json.Unmarshal([]byte(content), &documentContent{}); err != nil {
+			writeError(w, "InvalidDocumentContent", err.Error())
+			return true
+		}
+		doc = &document{versions: []string{content}, defaultVersion: 1}
+		if s.documents == nil {
+			s.documents = map[string]*document{}
+		}
+		s.documents[name] = doc
+		writeJSON(w, map[string]any{"DocumentDescription": describe(doc, 1)})
+	case "UpdateDocument":
+		if !exists {
+			writeError(w, "InvalidDocument", fmt.Sprintf("Document %s does not exist", name))
+			return true
+		}
+		if content == doc.versions[len(doc.versions)-1] {
+			writeError(w, "DuplicateDocumentContent", "The content of the document is the same as its latest version")
+			return true
+		}
+		doc.versions = append(doc.versions, content)
+		writeJSON(w, map[string]any{"DocumentDescription": describe(doc, len(doc.versions))})
+	case "UpdateDocumentDefaultVersion":
+		n, err := strconv.Atoi(version)
+		if !exists || err != nil || n < 1 || n > len(doc.versions) {
+			writeError(w, "InvalidDocumentVersion", fmt.Sprintf("Document %s has no version %s", name, version))
+			return true
+		}
+		doc.defaultVersion = n
+		writeJSON(w, map[string]any{"Description": map[string]string{"Name": name, "DefaultVersion": version}})
+	case "GetDocument":
+		if !exists {
+			writeError(w, "InvalidDocument", fmt.Sprintf("Document %s does not exist", name))
+			return true
+		}
+		writeJSON(w, map[string]any{
+			"Name":            name,
+			"DocumentType":    "Session",
+			"DocumentFormat":  "JSON",
+			"DocumentVersion": strconv.Itoa(doc.defaultVersion),
+			"Content":         doc.versions[doc.defaultVersion-1],
+		})
+	case "DeleteDocument":
+		if !exists {
+			writeError(w, "InvalidDocument", fmt.Sprintf("Document %s does not exist", name))
+			return true
+		}
+		delete(s.documents, name)
+		writeJSON(w, map[string]any{})
+	default:
+		return false
+	}
+	return true
+}
+
+// Document returns the content of the default version of a document, and whether it exists.
+func (s *Server) Document(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.documents[name]
+	if !ok {
+		return "", false
+	}
+	return doc.versions[doc.defaultVersion-1], true
+}
@@ -0,0 +1,100 @@
+package ssmfake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Message types and payload types of the data channel, see the message
+// package of the session manager plugin.
+const (
+	outputStreamMessage  = "output_stream_data"
+	inputStreamMessage   = "input_stream_data"
+	acknowledgeMessage   = "acknowledge"
+	channelClosedMessage = "channel_closed"
+
+	payloadOutput            = 1
+	payloadHandshakeRequest  = 5
+	payloadHandshakeResponse = 6
+	payloadHandshakeComplete = 7
+	payloadFlag              = 10
+
+	flagDisconnectToPort = 1
+	flagTerminateSession = 2
+)
+
+// Field lengths of the binary message header.
+const (
+	messageTypeLength = 32
+	// headerLength is the length of the header up to the payload length, which is how the plugin counts it
+	headerLength = 4 + messageTypeLength + 4 + 8 + 8 + 8 + 16 + 32 + 4
+)
+
+// clientMessage is a message of the data channel.
+type clientMessage struct {
+	MessageType    string
+	SequenceNumber int64
+	Flags          uint64
+	MessageId      []byte
+	PayloadType    uint32
+	Payload        []byte
+}
+
+// encode serializes the message in the big endian layout the plugin expects.
+func (m clientMessage) encode() []byte {
+	var buf bytes.Buffer
+	write := func(v any) { _ = binary.Write(&buf, binary.BigEndian, v) }
+
+	messageType := bytes.Repeat([]byte(" "), messageTypeLength)
+	copy(messageType, m.MessageType)
+	messageId := m.MessageId
+	if len(messageId) != 16 {
+		messageId = make([]byte, 16)
+		_, _ = rand.Read(messageId)
+	}
+	digest := sha256.Sum256(m.Payload)
+
+	write(uint32(headerLength))
+	buf.Write(messageType)
+	write(uint32(1))
+	write(uint64(time.Now().UnixMilli()))
+	write(m.SequenceNumber)
+	write(m.Flags)
+	buf.Write(messageId)
+	buf.Write(digest[:])
+	write(m.PayloadType)
+	write(uint32(len(m.Payload)))
+	buf.Write(m.Payload)
+	return buf.Bytes()
+}
+
+// decodeMessage parses a binary message sent by the plugin.
+func decodeMessage(data []byte) (clientMessage, error) {
+	if len(data) < headerLength+4 {
+		return clientMessage{}, errors.New("message is shorter than its header")
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	if int(length)+4 > len(data) {
+		return clientMessage{}, errors.New("header length exceeds the message")
+	}
+	return clientMessage{
+		MessageType:    string(bytes.TrimSpace(bytes.Trim(data[4:4+messageTypeLength], "\x00"))),
+		SequenceNumber: int64(binary.BigEndian.Uint64(data[48:56])),
+		Flags:          binary.BigEndian.Uint64(data[56:64]),
+		MessageId:      data[64:80],
+		PayloadType:    binary.BigEndian.Uint32(data[112:116]),
+		Payload:        data[length+4:],
+	}, nil
+}
+
+// uuid formats the message id like the plugin does, which swaps both halves.
+func (m clientMessage) uuid() string {
+	id := append(append([]byte{}, m.MessageId[8:]...), m.MessageId[:8]...)
+	s := hex.EncodeToString(id)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
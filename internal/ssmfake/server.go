@@ -0,0 +1,486 @@
+// Package ssmfake fakes the parts of Session Manager a port forwarding tunnel
+// talks to: the session API calls of the control plane and the data channel
+// the session manager plugin connects to. The agent side of the data channel
+// dials the remote host itself, so tunnels through the fake reach services
+// listening on the machine running the tests.
+package ssmfake
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dataChannelPath is the path of the stream URLs handed out by StartSession.
+const dataChannelPath = "/v1/data-channel/"
+
+// credentialPattern matches the access key ID in the Authorization header of a signed request.
+var credentialPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+
+// SessionInfo describes a session started on the fake.
+type SessionInfo struct {
+	Id         string
+	Target     string
+	Document   string
+	Reason     string
+	RemoteHost string
+	RemotePort int
+	LocalPort  int
+	Started    time.Time
+	Terminated bool
+}
+
+// filter is a filter of the Describe calls. Sessions are filtered by a single
+// value, instances by several.
+type filter struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Values []string
+}
+
+type session struct {
+	SessionInfo
+	token   string
+	channel *dataChannel
+	// stream is where the stream of the last channel was at, which a resumed session continues from
+	stream streamState
+}
+
+// Server serves the SSM API and the data channel on one local HTTP server.
+// Point the provider at it with AWS_ENDPOINT_URL_SSM.
+type Server struct {
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	started   int
+	platforms map[string]string
+	documents map[string]*document
+	// disconnected counts the sessions of a target refused with TargetNotConnected
+	disconnected map[string]int
+	// offline counts the descriptions of a target reporting it as ConnectionLost
+	offline map[string]int
+	// handshakeDelay holds back the handshake of every data channel
+	handshakeDelay time.Duration
+	// accessKeys are the access key IDs the API calls were signed with, by operation
+	accessKeys map[string][]string
+	// commands are the commands sent with SendCommand, see serveCommand
+	commands       []*command
+	commandResults map[string][]CommandResult
+	deniedCommands map[string]bool
+}
+
+// NewServer starts a fake without any sessions.
+func NewServer() *Server {
+	s := &Server{sessions: map[string]*session{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetPlatform sets the platform the target reports, targets run Linux unless set otherwise.
+func (s *Server) SetPlatform(target string, platform string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.platforms == nil {
+		s.platforms = map[string]string{}
+	}
+	s.platforms[target] = platform
+}
+
+// DisconnectTarget refuses the next sessions of the target with
+// TargetNotConnected, like Session Manager does while the SSM agent of an
+// instance which just booted hasn't connected yet.
+func (s *Server) DisconnectTarget(target string, sessions int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disconnected == nil {
+		s.disconnected = map[string]int{}
+	}
+	s.disconnected[target] = sessions
+}
+
+// DelayHandshake holds back the handshake of the data channels opened from now
+// on, like an SSM agent which is slow to answer does.
+func (s *Server) DelayHandshake(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshakeDelay = delay
+}
+
+// DropDataChannel closes the data channel of the session without terminating
+// it, like a network interruption does. The plugin resumes the session.
+func (s *Server) DropDataChannel(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok && sess.channel != nil {
+		sess.channel.close(false)
+	}
+}
+
+// AccessKeyIds returns the access key IDs the calls of the operation were
+// signed with, in order, e.g. to check which credentials a plugin used.
+func (s *Server) AccessKeyIds(operation string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.accessKeys[operation]...)
+}
+
+// SetOffline reports the target as ConnectionLost in its next descriptions, like
+// Systems Manager does until the SSM agent of an instance which just booted
+// connected.
+func (s *Server) SetOffline(target string, describes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.offline == nil {
+		s.offline = map[string]int{}
+	}
+	s.offline[target] = describes
+}
+
+// AddSession records an active session which was started at the given time
+// and nobody is attached to, like one left behind by a run which crashed. It
+// returns the ID of the session.
+func (s *Server) AddSession(target string, reason string, started time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started++
+	sess := &session{
+		SessionInfo: SessionInfo{
+			Id:       fmt.Sprintf("fake-%012d", s.started),
+			Target:   target,
+			Document: "AWS-StartPortForwardingSessionToRemoteHost",
+			Reason:   reason,
+			Started:  started,
+		},
+	}
+	s.sessions[sess.Id] = sess
+	return sess.Id
+}
+
+// TerminateSession ends a session from the side of Session Manager, like its
+// idle timeout or a reboot of the target does.
+func (s *Server) TerminateSession(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		s.terminateLocked(sess)
+	}
+}
+
+// URL is the endpoint of the fake.
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Close terminates every session and stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		s.terminateLocked(sess)
+	}
+	s.mu.Unlock()
+	s.server.CloseClientConnections()
+	s.server.Close()
+}
+
+// Sessions returns every session started so far, in the order they were started.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess.SessionInfo)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	return sessions
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, dataChannelPath) {
+		s.serveDataChannel(w, r)
+		return
+	}
+
+	var input struct {
+		Target       string
+		DocumentName string
+		Reason       string
+		Parameters   map[string][]string
+		SessionId    string
+		State        string
+		Filters      []filter
+
+		Name            string
+		Content         string
+		DocumentVersion string
+
+		InstanceIds []string
+		CommandId   string
+		InstanceId  string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeError(w, "ValidationException", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	if match := credentialPattern.FindStringSubmatch(r.Header.Get("Authorization")); match != nil {
+		if s.accessKeys == nil {
+			s.accessKeys = map[string][]string{}
+		}
+		s.accessKeys[operation] = append(s.accessKeys[operation], match[1])
+	}
+	switch operation {
+	case "StartSession":
+		if s.disconnected[input.Target] > 0 {
+			s.disconnected[input.Target]--
+			writeError(w, "TargetNotConnected", fmt.Sprintf("%s is not connected.", input.Target))
+			return
+		}
+		sess, err := s.startLocked(input.Target, input.DocumentName, input.Reason, input.Parameters)
+		if err != nil {
+			writeError(w, "ValidationException", err.Error())
+			return
+		}
+		writeJSON(w, map[string]string{
+			"SessionId":  sess.Id,
+			"TokenValue": sess.token,
+			"StreamUrl":  streamURL(r, sess.Id),
+		})
+	case "ResumeSession":
+		sess, ok := s.sessions[input.SessionId]
+		if !ok || sess.Terminated {
+			writeError(w, "DoesNotExistException", fmt.Sprintf("Session %s does not exist", input.SessionId))
+			return
+		}
+		writeJSON(w, map[string]string{
+			"SessionId":  sess.Id,
+			"TokenValue": sess.token,
+			"StreamUrl":  streamURL(r, sess.Id),
+		})
+	case "TerminateSession":
+		if sess, ok := s.sessions[input.SessionId]; ok {
+			s.terminateLocked(sess)
+		}
+		writeJSON(w, map[string]string{"SessionId": input.SessionId})
+	case "DescribeSessions":
+		writeJSON(w, map[string]any{"Sessions": s.describeLocked(input.State, input.Filters)})
+	case "DescribeInstanceInformation":
+		writeJSON(w, map[string]any{"InstanceInformationList": s.instancesLocked(input.Filters)})
+	default:
+		if s.serveDocument(w, operation, input.Name, input.Content, input.DocumentVersion) {
+			return
+		}
+		if s.serveCommand(w, operation, input.InstanceIds, input.Parameters, input.CommandId, input.InstanceId) {
+			return
+		}
+		writeError(w, "InvalidAction", fmt.Sprintf("%s is not supported by the fake", operation))
+	}
+}
+
+func (s *Server) startLocked(target string, document string, reason string, parameters map[string][]string) (*session, error) {
+	if target == "" {
+		return nil, fmt.Errorf("target must be set")
+	}
+	param := func(name string) string {
+		if values := parameters[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	host := "localhost"
+	switch document {
+	case "AWS-StartPortForwardingSessionToRemoteHost":
+		host = param("host")
+	case "AWS-StartPortForwardingSession":
+	default:
+		// Custom port forwarding documents forward to remote hosts, but only the allowed ones
+		custom, ok := s.documents[document]
+		if !ok {
+			return nil, fmt.Errorf("document %q is not supported by the fake", document)
+		}
+		var content documentContent
+		if err := json.Unmarshal([]byte(custom.versions[custom.defaultVersion-1]), &content); err != nil || content.SessionType != "Port" {
+			return nil, fmt.Errorf("document %q is not a port forwarding document", document)
+		}
+		port, _ := strconv.Atoi(param("portNumber"))
+		if !content.allows(param("host"), port) {
+			return nil, fmt.Errorf("document %q doesn't allow %s:%s", document, param("host"), param("portNumber"))
+		}
+		host = param("host")
+	}
+	port, err := strconv.Atoi(param("portNumber"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid portNumber: %w", err)
+	}
+	localPort, _ := strconv.Atoi(param("localPortNumber"))
+
+	s.started++
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	sess := &session{
+		SessionInfo: SessionInfo{
+			Id:         fmt.Sprintf("fake-%012d", s.started),
+			Target:     target,
+			Document:   document,
+			Reason:     reason,
+			RemoteHost: host,
+			RemotePort: port,
+			LocalPort:  localPort,
+			Started:    time.Now(),
+		},
+		token: hex.EncodeToString(token),
+	}
+	s.sessions[sess.Id] = sess
+	return sess, nil
+}
+
+// terminateLocked ends the session and closes its data channel, which makes the plugin exit.
+func (s *Server) terminateLocked(sess *session) {
+	sess.Terminated = true
+	if sess.channel != nil {
+		sess.channel.close(true)
+		sess.channel = nil
+	}
+}
+
+func (s *Server) describeLocked(state string, filters []filter) []map[string]any {
+	sessions := []map[string]any{}
+	for _, sess := range s.sessions {
+		if sess.Terminated != (state == "History") {
+			continue
+		}
+		matches := true
+		for _, filter := range filters {
+			switch filter.Key {
+			case "SessionId":
+				matches = matches && sess.Id == filter.Value
+			case "Target":
+				matches = matches && sess.Target == filter.Value
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		status := "Connected"
+		if sess.Terminated {
+			status = "Terminated"
+		}
+		sessions = append(sessions, map[string]any{
+			"SessionId":    sess.Id,
+			"Target":       sess.Target,
+			"DocumentName": sess.Document,
+			"Reason":       sess.Reason,
+			"Owner":        "arn:aws:iam::000000000000:user/test",
+			"StartDate":    float64(sess.Started.Unix()),
+			"Status":       status,
+		})
+	}
+	return sessions
+}
+
+// instancesLocked describes the targets filtered by ID. Every target is a
+// connected managed node.
+func (s *Server) instancesLocked(filters []filter) []map[string]any {
+	instances := []map[string]any{}
+	for _, filter := range filters {
+		if filter.Key != "InstanceIds" {
+			continue
+		}
+		for _, target := range filter.Values {
+			platform := s.platforms[target]
+			if platform == "" {
+				platform = "Linux"
+			}
+			status := "Online"
+			if s.offline[target] > 0 {
+				s.offline[target]--
+				status = "ConnectionLost"
+			}
+			instances = append(instances, map[string]any{
+				"InstanceId":   target,
+				"PingStatus":   status,
+				"PlatformType": platform,
+			})
+		}
+	}
+	return instances
+}
+
+func (s *Server) serveDataChannel(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, dataChannelPath)
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	// The plugin opens the channel with the token of the session
+	var open struct {
+		TokenValue string
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || json.Unmarshal(data, &open) != nil {
+		conn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	if !ok || sess.Terminated || open.TokenValue != sess.token {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	// A resumed session replaces the channel it had before
+	if sess.channel != nil {
+		sess.channel.close(false)
+	}
+	channel := newDataChannel(conn, sess.SessionInfo, s.handshakeDelay, sess.stream)
+	sess.channel = channel
+	s.mu.Unlock()
+
+	terminated := channel.run()
+
+	s.mu.Lock()
+	if sess.channel == channel {
+		sess.channel = nil
+		sess.stream = channel.state()
+		if terminated {
+			sess.Terminated = true
+		}
+	}
+	s.mu.Unlock()
+}
+
+func streamURL(r *http.Request, sessionId string) string {
+	return "ws://" + r.Host + dataChannelPath + sessionId + "?role=publish_subscribe"
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code string, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	writeJSON(w, map[string]string{"__type": code, "message": message})
+}
@@ -0,0 +1,134 @@
+package ssmtunnels
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// credentialsRefreshMargin makes the plugin fetch new credentials this long
+// before the provider's credentials expire.
+const credentialsRefreshMargin = 5 * time.Minute
+
+// credentialsServer hands the provider's credentials to a plugin process in
+// the format of the container credentials endpoint. Unlike credentials passed
+// through the environment, the plugin fetches them again before they expire,
+// so sessions using assumed roles can still be resumed after the initial STS
+// credentials expired. The plugin only needs credentials to resume a session
+// once its data channel was interrupted, the channel itself authenticates
+// with the token of the session and isn't re-established ahead of expiry.
+type credentialsServer struct {
+	listener net.Listener
+	server   *http.Server
+	token    string
+}
+
+func startCredentialsServer(provider aws.CredentialsProvider) (*credentialsServer, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+
+	// The plugin only accepts loopback hosts for plain HTTP endpoints
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &credentialsServer{
+		listener: listener,
+		token:    hex.EncodeToString(tokenBytes),
+	}
+	s.server = &http.Server{
+		Handler:           s.handler(provider),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving credentials to the session manager plugin: %v", err)
+		}
+	}()
+
+	return s, nil
+}
+
+type containerCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string     `json:",omitempty"`
+	Expiration      *time.Time `json:",omitempty"`
+}
+
+func (s *credentialsServer) handler(provider aws.CredentialsProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.token)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		credentials, err := provider.Retrieve(r.Context())
+		if err != nil {
+			log.Printf("Error retrieving credentials for the session manager plugin: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := containerCredentials{
+			AccessKeyId:     credentials.AccessKeyID,
+			SecretAccessKey: credentials.SecretAccessKey,
+			Token:           credentials.SessionToken,
+		}
+		if credentials.CanExpire {
+			response.Expiration = refreshAt(credentials.Expires, time.Now())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	})
+}
+
+// refreshAt returns when the plugin should fetch credentials expiring at
+// expires again. Credentials expiring within credentialsRefreshMargin are
+// handed out until they expire, not as already expired, which would make the
+// plugin fetch them again right away.
+func refreshAt(expires time.Time, now time.Time) *time.Time {
+	refresh := expires.Add(-credentialsRefreshMargin)
+	if refresh.Before(now) {
+		refresh = expires
+	}
+	if refresh.Before(now) {
+		refresh = now
+	}
+	return &refresh
+}
+
+// environ points the AWS SDK of the plugin at the server. Every other source
+// of credentials is cleared, as the SDK would prefer them.
+func (s *credentialsServer) environ() []string {
+	return []string{
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI=http://" + s.listener.Addr().String() + "/",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN=" + s.token,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE=",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI=",
+		"AWS_ACCESS_KEY_ID=",
+		"AWS_ACCESS_KEY=",
+		"AWS_SECRET_ACCESS_KEY=",
+		"AWS_SECRET_KEY=",
+		"AWS_SESSION_TOKEN=",
+		"AWS_PROFILE=",
+		"AWS_SHARED_CREDENTIALS_FILE=" + os.DevNull,
+		"AWS_CONFIG_FILE=" + os.DevNull,
+	}
+}
+
+func (s *credentialsServer) Close() error {
+	return s.server.Close()
+}
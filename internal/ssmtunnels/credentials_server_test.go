@@ -0,0 +1,64 @@
+package ssmtunnels
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestCredentialsServerToken(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	s := &credentialsServer{token: "secret"}
+	handler := s.handler(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET", CanExpire: true, Expires: expires}, nil
+	}))
+
+	for _, token := range []string{"", "secre", "secret2", "SECRET"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Authorization", token)
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("token %q: got status %d, want %d", token, recorder.Code, http.StatusForbidden)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "secret")
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	var credentials containerCredentials
+	if err := json.NewDecoder(recorder.Body).Decode(&credentials); err != nil {
+		t.Fatal(err)
+	}
+	if credentials.AccessKeyId != "AKID" || credentials.Expiration == nil || !credentials.Expiration.Equal(expires.Add(-credentialsRefreshMargin)) {
+		t.Errorf("got %+v, want the credentials refreshed %s before they expire", credentials, credentialsRefreshMargin)
+	}
+}
+
+func TestRefreshAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		expires time.Time
+		want    time.Time
+	}{
+		// Refreshed ahead of the expiry
+		{now.Add(time.Hour), now.Add(time.Hour - credentialsRefreshMargin)},
+		// Within the margin, handed out until they expire
+		{now.Add(2 * time.Minute), now.Add(2 * time.Minute)},
+		// Already expired, never in the past
+		{now.Add(-time.Minute), now},
+	} {
+		if got := refreshAt(test.expires, now); !got.Equal(test.want) {
+			t.Errorf("expires %s: got %s, want %s", test.expires, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package ssmtunnels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// ErrDocumentNotFound means the session document doesn't exist, e.g. it was deleted outside of Terraform.
+var ErrDocumentNotFound = errors.New("session document not found")
+
+// localPortPattern allows the local ports the session manager plugin listens
+// on, like the parameter of AWS-StartPortForwardingSessionToRemoteHost.
+const localPortPattern = "^([0-9]|[1-9][0-9]{1,3}|[1-5][0-9]{4}|6[0-4][0-9]{3}|65[0-4][0-9]{2}|655[0-2][0-9]|6553[0-5])$"
+
+// PortForwardingDocument is a custom session document forwarding to remote
+// hosts like AWS-StartPortForwardingSessionToRemoteHost, but which only
+// allows the listed hosts and ports. Granting ssm:StartSession on it instead
+// of on the AWS document limits what the sessions can reach.
+type PortForwardingDocument struct {
+	Description string
+	Hosts       []string
+	Ports       []int
+}
+
+// documentParameter is a parameter of a session document.
+type documentParameter struct {
+	Type           string   `json:"type"`
+	Description    string   `json:"description"`
+	AllowedValues  []string `json:"allowedValues,omitempty"`
+	AllowedPattern string   `json:"allowedPattern,omitempty"`
+	Default        string   `json:"default,omitempty"`
+}
+
+// documentContent is the content of a port forwarding session document.
+type documentContent struct {
+	SchemaVersion string                       `json:"schemaVersion"`
+	Description   string                       `json:"description"`
+	SessionType   string                       `json:"sessionType"`
+	Parameters    map[string]documentParameter `json:"parameters"`
+	Properties    map[string]string            `json:"properties"`
+}
+
+// Content returns the JSON content of the document. The hosts are normalized
+// like the remote hosts of tunnels, so both match.
+func (d PortForwardingDocument) Content() (string, error) {
+	hosts := make([]string, 0, len(d.Hosts))
+	for _, host := range d.Hosts {
+		normalized, err := NormalizeHost(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid host %q: %w", host, err)
+		}
+		hosts = append(hosts, normalized)
+	}
+	ports := make([]string, 0, len(d.Ports))
+	for _, port := range d.Ports {
+		ports = append(ports, strconv.Itoa(port))
+	}
+
+	content, err := json.MarshalIndent(documentContent{
+		SchemaVersion: "1.0",
+		Description:   d.Description,
+		SessionType:   "Port",
+		Parameters: map[string]documentParameter{
+			"host": {
+				Type:          "String",
+				Description:   "The remote host to forward to",
+				AllowedValues: hosts,
+			},
+			"portNumber": {
+				Type:          "String",
+				Description:   "The port of the remote host",
+				AllowedValues: ports,
+			},
+			"localPortNumber": {
+				Type:           "String",
+				Description:    "The local port of the session manager plugin",
+				AllowedPattern: localPortPattern,
+				Default:        "0",
+			},
+		},
+		Properties: map[string]string{
+			"type":            "LocalPortForwarding",
+			"host":            "{{ host }}",
+			"portNumber":      "{{ portNumber }}",
+			"localPortNumber": "{{ localPortNumber }}",
+		},
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// ParsePortForwardingDocument reads the allowed hosts and ports back from the
+// content of a document.
+func ParsePortForwardingDocument(content string) (PortForwardingDocument, error) {
+	var parsed documentContent
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return PortForwardingDocument{}, fmt.Errorf("parsing session document: %w", err)
+	}
+	if parsed.SessionType != "Port" || parsed.Properties["type"] != "LocalPortForwarding" {
+		return PortForwardingDocument{}, fmt.Errorf("not a port forwarding session document")
+	}
+
+	doc := PortForwardingDocument{
+		Description: parsed.Description,
+		Hosts:       parsed.Parameters["host"].AllowedValues,
+	}
+	for _, value := range parsed.Parameters["portNumber"].AllowedValues {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return PortForwardingDocument{}, fmt.Errorf("invalid port %q: %w", value, err)
+		}
+		doc.Ports = append(doc.Ports, port)
+	}
+	return doc, nil
+}
+
+// CreateDocument creates the session document and returns its version.
+func CreateDocument(ctx context.Context, client *ssm.Client, name string, doc PortForwardingDocument) (string, error) {
+	content, err := doc.Content()
+	if err != nil {
+		return "", err
+	}
+	output, err := client.CreateDocument(ctx, &ssm.CreateDocumentInput{
+		Name:           aws.String(name),
+		Content:        aws.String(content),
+		DocumentType:   ssmtypes.DocumentTypeSession,
+		DocumentFormat: ssmtypes.DocumentFormatJson,
+	})
+	if err != nil {
+		return "", fmt.Errorf("ssm:CreateDocument of %s failed: %w", name, classifyAPIError(err))
+	}
+	return aws.ToString(output.DocumentDescription.DocumentVersion), nil
+}
+
+// UpdateDocument adds a version with the new content to the session document
+// and makes it the default, which sessions use. It returns the new version, or
+// the current one if the content didn't change.
+func UpdateDocument(ctx context.Context, client *ssm.Client, name string, doc PortForwardingDocument) (string, error) {
+	content, err := doc.Content()
+	if err != nil {
+		return "", err
+	}
+	output, err := client.UpdateDocument(ctx, &ssm.UpdateDocumentInput{
+		Name:            aws.String(name),
+		Content:         aws.String(content),
+		DocumentVersion: aws.String("$LATEST"),
+		DocumentFormat:  ssmtypes.DocumentFormatJson,
+	})
+	var duplicate *ssmtypes.DuplicateDocumentContent
+	if errors.As(err, &duplicate) {
+		_, version, err := GetDocument(ctx, client, name)
+		return version, err
+	}
+	if err != nil {
+		return "", fmt.Errorf("ssm:UpdateDocument of %s failed: %w", name, classifyAPIError(err))
+	}
+
+	version := output.DocumentDescription.DocumentVersion
+	_, err = client.UpdateDocumentDefaultVersion(ctx, &ssm.UpdateDocumentDefaultVersionInput{
+		Name:            aws.String(name),
+		DocumentVersion: version,
+	})
+	if err != nil {
+		return "", fmt.Errorf("ssm:UpdateDocumentDefaultVersion of %s failed: %w", name, classifyAPIError(err))
+	}
+	return aws.ToString(version), nil
+}
+
+// GetDocument returns the default version of the session document, which
+// sessions use, and its version number.
+func GetDocument(ctx context.Context, client *ssm.Client, name string) (PortForwardingDocument, string, error) {
+	output, err := client.GetDocument(ctx, &ssm.GetDocumentInput{
+		Name: aws.String(name),
+	})
+	var invalid *ssmtypes.InvalidDocument
+	if errors.As(err, &invalid) {
+		return PortForwardingDocument{}, "", fmt.Errorf("%w: %s", ErrDocumentNotFound, name)
+	}
+	if err != nil {
+		return PortForwardingDocument{}, "", fmt.Errorf("ssm:GetDocument of %s failed: %w", name, classifyAPIError(err))
+	}
+	doc, err := ParsePortForwardingDocument(aws.ToString(output.Content))
+	if err != nil {
+		return PortForwardingDocument{}, "", fmt.Errorf("session document %s: %w", name, err)
+	}
+	return doc, aws.ToString(output.DocumentVersion), nil
+}
+
+// DeleteDocument deletes the session document with all its versions. A
+// document which is already gone isn't an error.
+func DeleteDocument(ctx context.Context, client *ssm.Client, name string) error {
+	_, err := client.DeleteDocument(ctx, &ssm.DeleteDocumentInput{
+		Name: aws.String(name),
+	})
+	var invalid *ssmtypes.InvalidDocument
+	if err != nil && !errors.As(err, &invalid) {
+		return fmt.Errorf("ssm:DeleteDocument of %s failed: %w", name, classifyAPIError(err))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package ssmtunnels
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/smithy-go"
+)
+
+// Errors returned by the tunnel engine wrap one of these when the cause is
+// known, so callers can use errors.Is instead of matching messages. The
+// original error stays in the chain.
+var (
+	// ErrTargetOffline means the target is not connected to Session Manager,
+	// e.g. it is stopped or its SSM agent can't reach the endpoints.
+	ErrTargetOffline = errors.New("target is not connected to Session Manager")
+	// ErrInvalidTarget means the target doesn't exist or isn't managed by
+	// Session Manager, which doesn't pass by retrying.
+	ErrInvalidTarget = errors.New("target is not managed by Session Manager")
+	// ErrPortInUse means the local port of the tunnel is taken by another process.
+	ErrPortInUse = errors.New("local port is already in use")
+	// ErrSessionLimit means the account reached its quota of concurrent sessions.
+	ErrSessionLimit = errors.New("session limit reached")
+	// ErrAccessDenied means the credentials are not allowed to start or manage the session.
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// classifyAPIError wraps err with the matching sentinel error, if any.
+func classifyAPIError(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	switch apiErr.ErrorCode() {
+	case "TargetNotConnected":
+		return fmt.Errorf("%w: %w", ErrTargetOffline, err)
+	case "InvalidTarget":
+		return fmt.Errorf("%w: %w", ErrInvalidTarget, err)
+	case "AccessDeniedException", "AccessDenied", "UnauthorizedOperation":
+		return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+	case "ServiceQuotaExceededException", "LimitExceededException":
+		return fmt.Errorf("%w: %w", ErrSessionLimit, err)
+	}
+	return err
+}
+
+// IsTargetNotConnected reports whether Session Manager refused to start a
+// session because the SSM agent of the target isn't connected right now, e.g.
+// while the instance boots, which can pass unlike an unknown target.
+func IsTargetNotConnected(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "TargetNotConnected"
+}
+
+// classifyListenError wraps err with ErrPortInUse if the address is taken.
+func classifyListenError(err error) error {
+	if isAddrInUse(err) {
+		return fmt.Errorf("%w: %w", ErrPortInUse, err)
+	}
+	return err
+}
@@ -0,0 +1,34 @@
+package ssmtunnels
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestClassifyAPIError(t *testing.T) {
+	for _, test := range []struct {
+		code string
+		want error
+	}{
+		{"TargetNotConnected", ErrTargetOffline},
+		{"InvalidTarget", ErrInvalidTarget},
+		{"AccessDeniedException", ErrAccessDenied},
+		{"ServiceQuotaExceededException", ErrSessionLimit},
+	} {
+		apiErr := &smithy.GenericAPIError{Code: test.code}
+		err := classifyAPIError(apiErr)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.code, err, test.want)
+		}
+		if !errors.As(err, new(smithy.APIError)) {
+			t.Errorf("%s: got %v, want the API error kept in the chain", test.code, err)
+		}
+	}
+
+	// An unknown target isn't offline, retrying won't make it connect
+	if err := classifyAPIError(&smithy.GenericAPIError{Code: "InvalidTarget"}); errors.Is(err, ErrTargetOffline) {
+		t.Errorf("got %v, want InvalidTarget not to be reported as offline", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package ssmtunnels
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaeaddrinuse is the Winsock error for an address in use, syscall.EADDRINUSE
+// is a different value on Windows.
+const wsaeaddrinuse = syscall.Errno(10048)
+
+func isAddrInUse(err error) bool {
+	return errors.Is(err, wsaeaddrinuse) || errors.Is(err, syscall.EADDRINUSE)
+}
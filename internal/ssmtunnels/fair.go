@@ -0,0 +1,106 @@
+package ssmtunnels
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// fairQuantum is what a tunnel of weight one writes per turn, bigger
+	// writes are split so other tunnels get their turns in between.
+	fairQuantum = 4 * 1024
+	// MaxBandwidthWeight is the largest useful weight, connections are copied
+	// in writes of at most 32KiB which a turn then covers entirely.
+	MaxBandwidthWeight = 8
+	// fairStall is how long a write may block before the next turn is handed
+	// out anyway, so a tunnel whose session is stuck doesn't hold up the others.
+	fairStall = 50 * time.Millisecond
+)
+
+// FairScheduler shares the network between the tunnels of a provider by
+// weighted round robin of their writes. Writes take turns in the order they
+// arrive, and each turn covers as many bytes as the weight of the tunnel
+// allows. While the network keeps up no write waits, once it is saturated a
+// bulk transfer through one tunnel can't starve the small writes of the
+// others, such as the API calls of the kubernetes provider.
+type FairScheduler struct {
+	mu sync.Mutex
+	// busy is set while a turn is handed out
+	busy    bool
+	waiting []chan struct{}
+}
+
+// FairFlow is the share of a tunnel in a FairScheduler.
+type FairFlow struct {
+	s *FairScheduler
+	// quantum is what the flow writes per turn
+	quantum int
+}
+
+func NewFairScheduler() *FairScheduler {
+	return &FairScheduler{}
+}
+
+// Flow adds a tunnel to the scheduler. A tunnel with twice the weight of
+// another gets twice its share of the network while both are busy. Weights
+// are capped between one and MaxBandwidthWeight.
+func (s *FairScheduler) Flow(weight int) *FairFlow {
+	return &FairFlow{s: s, quantum: min(max(weight, 1), MaxBandwidthWeight) * fairQuantum}
+}
+
+// acquire waits for a turn and returns the func to call once it is over.
+func (f *FairFlow) acquire() func() {
+	s := f.s
+	s.mu.Lock()
+	if !s.busy {
+		s.busy = true
+		s.mu.Unlock()
+	} else {
+		ready := make(chan struct{})
+		s.waiting = append(s.waiting, ready)
+		s.mu.Unlock()
+		<-ready
+	}
+
+	var once sync.Once
+	stalled := time.AfterFunc(fairStall, func() { once.Do(s.next) })
+	return func() {
+		stalled.Stop()
+		once.Do(s.next)
+	}
+}
+
+// next hands the turn to the write waiting the longest.
+func (s *FairScheduler) next() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiting) == 0 {
+		s.busy = false
+		return
+	}
+	close(s.waiting[0])
+	s.waiting = s.waiting[1:]
+}
+
+// fairWriter writes to w in turns of the flow.
+type fairWriter struct {
+	w    io.Writer
+	flow *FairFlow
+}
+
+func (fw *fairWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), fw.flow.quantum)]
+		done := fw.flow.acquire()
+		n, err := fw.w.Write(chunk)
+		done()
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,77 @@
+package ssmtunnels
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowReader reads a few bytes at a time, like a client on a bad link.
+type slowReader struct {
+	r io.Reader
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return s.r.Read(p[:min(len(p), 16)])
+}
+
+func TestFairWriterBlockedReader(t *testing.T) {
+	scheduler := NewFairScheduler()
+
+	// Nobody reads the other end, the write of the first chunk never returns
+	blocked, other := net.Pipe()
+	defer blocked.Close()
+	defer other.Close()
+	go func() {
+		_, _ = (&fairWriter{w: blocked, flow: scheduler.Flow(8)}).Write(make([]byte, 1<<20))
+	}()
+
+	// A reader draining slowly holds its turns for as long as it lets them
+	slow, slowPeer := net.Pipe()
+	defer slow.Close()
+	defer slowPeer.Close()
+	go func() { _, _ = io.Copy(io.Discard, slowReader{slowPeer}) }()
+	go func() {
+		_, _ = (&fairWriter{w: slow, flow: scheduler.Flow(8)}).Write(make([]byte, 1<<20))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// 256 turns of the weight 1 flow, which would take seconds if every one
+	// of them waited out the stalled turns of the others
+	var out bytes.Buffer
+	start := time.Now()
+	n, err := (&fairWriter{w: &out, flow: scheduler.Flow(1)}).Write(make([]byte, 1<<20))
+	if err != nil || n != 1<<20 {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writing 1MiB took %s next to blocked readers", elapsed)
+	}
+}
+
+func TestFairWriterTakesTurns(t *testing.T) {
+	scheduler := NewFairScheduler()
+	flow := scheduler.Flow(2)
+
+	// Writes are split into turns of the flow's quantum
+	var writes []int
+	w := &fairWriter{w: writerFunc(func(p []byte) (int, error) {
+		writes = append(writes, len(p))
+		return len(p), nil
+	}), flow: flow}
+	if _, err := w.Write(make([]byte, 3*fairQuantum)); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 2 || writes[0] != 2*fairQuantum || writes[1] != fairQuantum {
+		t.Errorf("got writes of %v bytes, want %d and %d", writes, 2*fairQuantum, fairQuantum)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
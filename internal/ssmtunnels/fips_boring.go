@@ -0,0 +1,15 @@
+//go:build boringcrypto
+
+package ssmtunnels
+
+import (
+	"crypto/boring"
+	// Restricts TLS to the versions, cipher suites and curves approved by FIPS 140
+	_ "crypto/tls/fipsonly"
+)
+
+// FIPSCrypto reports whether the cryptography of the binary is the FIPS 140
+// validated BoringCrypto module, i.e. it was built with GOEXPERIMENT=boringcrypto.
+func FIPSCrypto() bool {
+	return boring.Enabled()
+}
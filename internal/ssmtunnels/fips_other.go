@@ -0,0 +1,9 @@
+//go:build !boringcrypto
+
+package ssmtunnels
+
+// FIPSCrypto reports whether the cryptography of the binary is the FIPS 140
+// validated BoringCrypto module, which needs a build with GOEXPERIMENT=boringcrypto.
+func FIPSCrypto() bool {
+	return false
+}
@@ -0,0 +1,532 @@
+package ssmtunnels
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionRecord describes a single local connection that was forwarded
+// through a tunnel. It is handed to ForwarderConfig.OnConnectionClosed once the
+// connection has been closed on both sides.
+type ConnectionRecord struct {
+	Target        string        `json:"target"`
+	SourceAddr    string        `json:"source_addr"`
+	LocalAddr     string        `json:"local_addr"`
+	RemoteHost    string        `json:"remote_host"`
+	RemotePort    int           `json:"remote_port"`
+	StartedAt     time.Time     `json:"started_at"`
+	Duration      time.Duration `json:"duration_ns"`
+	Queued        time.Duration `json:"queued_ns"`
+	BytesSent     int64         `json:"bytes_sent"`
+	BytesReceived int64         `json:"bytes_received"`
+}
+
+type ForwarderConfig struct {
+	ListenAddr   string // Address exposed to the user, e.g. 127.0.0.1:16000
+	UpstreamAddr string // Address of the session manager plugin listener
+
+	// Listener is adopted instead of listening on ListenAddr if set, e.g. one
+	// holding a port reserved for the forwarder, see ports.ReservePort. It is
+	// closed if the forwarder fails to start.
+	Listener net.Listener
+
+	// The following are only used to describe connections
+	Target     string
+	RemoteHost string
+	RemotePort int
+
+	// Rewrites are applied to the data forwarded in either direction, see RewriteRule
+	Rewrites []RewriteRule
+
+	// MaxTransferBytes caps the bytes forwarded in both directions over all
+	// connections. Once reached the forwarder stops, see Forwarder.Stopped. Zero means no limit.
+	MaxTransferBytes int64
+
+	// MaxConnections caps the connections forwarded at the same time, further
+	// connections are accepted but wait for a free slot before they are
+	// forwarded, so bursts don't overwhelm the single data channel. Zero means no limit.
+	MaxConnections int
+
+	// MaxQueuedConnections caps the connections waiting for a slot of
+	// MaxConnections, further connections are closed right away instead of
+	// piling up behind a saturated tunnel. Zero means no limit.
+	MaxQueuedConnections int
+
+	// Flow schedules the writes of every connection fairly with the other
+	// tunnels of its FairScheduler. Nil writes right away.
+	Flow *FairFlow
+
+	// Connect is called (if set) for every connection before it is relayed
+	// upstream, e.g. to start the session of a lazy tunnel. The connection is
+	// dropped if it fails. The time it takes is included in Queued.
+	Connect func() error
+
+	// OnConnectionClosed is called (if set) for every connection once it is closed
+	OnConnectionClosed func(ConnectionRecord)
+}
+
+// Forwarder accepts connections on the user facing address and relays them to
+// the listener opened by the session manager plugin. Sitting in front of the
+// plugin gives the provider visibility into every connection going through the
+// tunnel.
+type Forwarder struct {
+	cfg      ForwarderConfig
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	transferred atomic.Int64
+
+	slots  chan struct{}
+	closed chan struct{}
+
+	active     atomic.Int64
+	queued     atomic.Int64
+	peakQueued atomic.Int64
+	rejected   atomic.Int64
+	total      atomic.Int64
+
+	// open counts accepted connections, queued or forwarded, and lastActive is
+	// when the last one was accepted or closed (unix nanoseconds), see IdleFor
+	open       atomic.Int64
+	lastActive atomic.Int64
+
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+
+	closeOnce sync.Once
+	mu        sync.Mutex
+	conns     map[net.Conn]struct{}
+	aborted   bool
+	stopped   chan struct{}
+	stopOnce  sync.Once
+	err       error
+}
+
+// TransferLimitExceededError is returned by Forwarder.Err when the forwarder
+// was stopped because MaxTransferBytes was reached.
+type TransferLimitExceededError struct {
+	Limit      int64
+	RemoteHost string
+	RemotePort int
+}
+
+func (e *TransferLimitExceededError) Error() string {
+	return fmt.Sprintf("tunnel to %s was closed after transferring its limit of %d bytes", net.JoinHostPort(e.RemoteHost, strconv.Itoa(e.RemotePort)), e.Limit)
+}
+
+// ForwarderStats is a snapshot of the connections of a forwarder.
+type ForwarderStats struct {
+	// ActiveConnections are being forwarded right now
+	ActiveConnections int64
+	// QueuedConnections are accepted and wait for a slot, see ForwarderConfig.MaxConnections
+	QueuedConnections int64
+	// PeakQueuedConnections is the most connections which waited for a slot at once
+	PeakQueuedConnections int64
+	// RejectedConnections were closed right away because MaxQueuedConnections were waiting already
+	RejectedConnections int64
+	// TotalConnections were accepted since the forwarder started
+	TotalConnections int64
+	// BytesSent and BytesReceived are the bytes forwarded to and from the remote host
+	BytesSent     int64
+	BytesReceived int64
+}
+
+func StartForwarder(cfg ForwarderConfig) (*Forwarder, error) {
+	fail := func(err error) (*Forwarder, error) {
+		if cfg.Listener != nil {
+			cfg.Listener.Close()
+		}
+		return nil, err
+	}
+	if cfg.ListenAddr == "" {
+		return fail(fmt.Errorf("listenAddr must be set"))
+	}
+	if cfg.UpstreamAddr == "" {
+		return fail(fmt.Errorf("upstreamAddr must be set"))
+	}
+
+	cfg.Rewrites = append([]RewriteRule(nil), cfg.Rewrites...)
+	for i := range cfg.Rewrites {
+		if err := cfg.Rewrites[i].Compile(); err != nil {
+			return fail(fmt.Errorf("invalid rewrite rule %d: %w", i, err))
+		}
+	}
+
+	listener := cfg.Listener
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", cfg.ListenAddr); err != nil {
+			return nil, classifyListenError(err)
+		}
+	}
+
+	f := &Forwarder{
+		cfg:      cfg,
+		listener: listener,
+		conns:    map[net.Conn]struct{}{},
+		stopped:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	if cfg.MaxConnections > 0 {
+		f.slots = make(chan struct{}, cfg.MaxConnections)
+	}
+	f.lastActive.Store(time.Now().UnixNano())
+	go f.serve(listener)
+
+	return f, nil
+}
+
+// Addr returns the address the forwarder is listening on.
+func (f *Forwarder) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.listener.Addr()
+}
+
+// Rebind moves the forwarder to listen on addr instead. Open connections keep
+// being forwarded through the same session, only new ones use the new address.
+func (f *Forwarder) Rebind(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return classifyListenError(err)
+	}
+
+	f.mu.Lock()
+	select {
+	case <-f.closed:
+		f.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("the forwarder was closed")
+	default:
+	}
+	if f.err != nil {
+		f.mu.Unlock()
+		listener.Close()
+		return fmt.Errorf("the forwarder was stopped: %w", f.err)
+	}
+	previous := f.listener
+	f.listener = listener
+	f.mu.Unlock()
+
+	previous.Close()
+	go f.serve(listener)
+	return nil
+}
+
+// Close stops accepting new connections, drops queued ones and waits for
+// in-flight connections to finish.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	err := f.listener.Close()
+	f.closeOnce.Do(func() { close(f.closed) })
+	f.mu.Unlock()
+	f.wg.Wait()
+	return err
+}
+
+// Drain stops accepting new connections and waits for the open ones to be
+// closed, until ctx is done. It reports whether every connection finished in
+// time. The forwarder still has to be closed or aborted afterwards.
+func (f *Forwarder) Drain(ctx context.Context) bool {
+	f.mu.Lock()
+	f.listener.Close()
+	f.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Abort is like Close, but closes in-flight connections instead of waiting for
+// them, e.g. when the session they go through is kept for other forwarders.
+func (f *Forwarder) Abort() error {
+	f.mu.Lock()
+	err := f.listener.Close()
+	f.closeOnce.Do(func() { close(f.closed) })
+	f.aborted = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+	return err
+}
+
+// Stats returns a snapshot of the forwarder's connections.
+func (f *Forwarder) Stats() ForwarderStats {
+	return ForwarderStats{
+		ActiveConnections:     f.active.Load(),
+		QueuedConnections:     f.queued.Load(),
+		PeakQueuedConnections: f.peakQueued.Load(),
+		RejectedConnections:   f.rejected.Load(),
+		TotalConnections:      f.total.Load(),
+		BytesSent:             f.bytesSent.Load(),
+		BytesReceived:         f.bytesReceived.Load(),
+	}
+}
+
+// IdleFor returns how long the forwarder has been without connections, zero
+// while a connection is open or waiting for a slot.
+func (f *Forwarder) IdleFor() time.Duration {
+	if f.open.Load() > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, f.lastActive.Load()))
+}
+
+// acquireSlot waits until the connection may be forwarded. It returns false
+// if the queue is full, or the forwarder was closed or stopped in the meantime.
+func (f *Forwarder) acquireSlot() bool {
+	if f.slots == nil {
+		return true
+	}
+
+	select {
+	case f.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	queued := f.queued.Add(1)
+	defer f.queued.Add(-1)
+	remote := net.JoinHostPort(f.cfg.RemoteHost, strconv.Itoa(f.cfg.RemotePort))
+	if f.cfg.MaxQueuedConnections > 0 && queued > int64(f.cfg.MaxQueuedConnections) {
+		f.rejected.Add(1)
+		log.Printf("%d connections to %q are queued already, closing the new one", f.cfg.MaxQueuedConnections, remote)
+		return false
+	}
+	for peak := f.peakQueued.Load(); queued > peak && !f.peakQueued.CompareAndSwap(peak, queued); peak = f.peakQueued.Load() {
+	}
+	log.Printf("%d connections to %q are forwarded, %d queued", f.cfg.MaxConnections, remote, queued)
+
+	select {
+	case f.slots <- struct{}{}:
+		return true
+	case <-f.closed:
+		return false
+	case <-f.stopped:
+		return false
+	}
+}
+
+func (f *Forwarder) releaseSlot() {
+	if f.slots != nil {
+		<-f.slots
+	}
+}
+
+// Stopped is closed when the forwarder stopped on its own, i.e. the transfer
+// limit was reached. Err returns the reason.
+func (f *Forwarder) Stopped() <-chan struct{} {
+	return f.stopped
+}
+
+// Err returns why the forwarder stopped on its own, or nil.
+func (f *Forwarder) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// stop closes the listener and every open connection.
+func (f *Forwarder) stop(err error) {
+	f.stopOnce.Do(func() {
+		f.mu.Lock()
+		f.err = err
+		for conn := range f.conns {
+			conn.Close()
+		}
+		f.listener.Close()
+		f.mu.Unlock()
+
+		close(f.stopped)
+	})
+}
+
+// track registers an open connection so it can be closed by stop and Abort. It
+// returns false if the forwarder has already been stopped or aborted.
+func (f *Forwarder) track(conns ...net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil || f.aborted {
+		return false
+	}
+	for _, conn := range conns {
+		f.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (f *Forwarder) untrack(conns ...net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range conns {
+		delete(f.conns, conn)
+	}
+}
+
+// limitWriter counts the bytes written against the forwarder's transfer
+// limit, and stops the forwarder once the limit is reached.
+type limitWriter struct {
+	w io.Writer
+	f *Forwarder
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	limit := lw.f.cfg.MaxTransferBytes
+	total := lw.f.transferred.Add(int64(len(p)))
+	if total <= limit {
+		return lw.w.Write(p)
+	}
+
+	allowed := max(int64(len(p))-(total-limit), 0)
+	n, err := lw.w.Write(p[:allowed])
+	limitErr := &TransferLimitExceededError{Limit: limit, RemoteHost: lw.f.cfg.RemoteHost, RemotePort: lw.f.cfg.RemotePort}
+	lw.f.stop(limitErr)
+	if err == nil {
+		err = limitErr
+	}
+	return n, err
+}
+
+// countingWriter adds the bytes written to n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+// limited wraps w if the forwarder has a transfer limit.
+func (f *Forwarder) limited(w io.Writer) io.Writer {
+	if f.cfg.MaxTransferBytes <= 0 {
+		return w
+	}
+	return &limitWriter{w: w, f: f}
+}
+
+// scheduled wraps w if the forwarder shares the network with other tunnels.
+func (f *Forwarder) scheduled(w io.Writer) io.Writer {
+	if f.cfg.Flow == nil {
+		return w
+	}
+	return &fairWriter{w: w, flow: f.cfg.Flow}
+}
+
+func (f *Forwarder) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// The listener was closed, or replaced by Rebind
+			return
+		}
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.handle(conn)
+		}()
+	}
+}
+
+func (f *Forwarder) handle(conn net.Conn) {
+	defer conn.Close()
+
+	f.open.Add(1)
+	f.lastActive.Store(time.Now().UnixNano())
+	defer func() {
+		f.lastActive.Store(time.Now().UnixNano())
+		f.open.Add(-1)
+	}()
+
+	f.total.Add(1)
+	acceptedAt := time.Now()
+	if !f.acquireSlot() {
+		return
+	}
+	defer f.releaseSlot()
+	f.active.Add(1)
+	defer f.active.Add(-1)
+
+	if f.cfg.Connect != nil {
+		if err := f.cfg.Connect(); err != nil {
+			log.Printf("Error connecting to session for %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	record := ConnectionRecord{
+		Target:     f.cfg.Target,
+		SourceAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+		RemoteHost: f.cfg.RemoteHost,
+		RemotePort: f.cfg.RemotePort,
+		StartedAt:  time.Now(),
+	}
+	record.Queued = record.StartedAt.Sub(acceptedAt)
+
+	upstream, err := net.Dial("tcp", f.cfg.UpstreamAddr)
+	if err != nil {
+		log.Printf("Error connecting to session for %s: %v", record.SourceAddr, err)
+		return
+	}
+	defer upstream.Close()
+
+	if !f.track(conn, upstream) {
+		return
+	}
+	defer f.untrack(conn, upstream)
+
+	var sent, received atomic.Int64
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := copyRewriting(f.limited(&countingWriter{w: f.scheduled(upstream), n: &f.bytesSent}), conn, rewritesFor(f.cfg.Rewrites, RewriteRequest))
+		sent.Add(n)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := copyRewriting(f.limited(&countingWriter{w: f.scheduled(conn), n: &f.bytesReceived}), upstream, rewritesFor(f.cfg.Rewrites, RewriteResponse))
+		received.Add(n)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	record.Duration = time.Since(record.StartedAt)
+	record.BytesSent = sent.Load()
+	record.BytesReceived = received.Load()
+
+	if f.cfg.OnConnectionClosed != nil {
+		f.cfg.OnConnectionClosed(record)
+	}
+}
+
+// closeWrite signals EOF to the peer while still allowing reads to finish.
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,473 @@
+package ssmtunnels
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoUpstream stands in for the listener of the session manager plugin.
+func echoUpstream(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+func echo(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, message+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != message+"\n" {
+		t.Fatalf("got %q back, want %q", reply, message)
+	}
+}
+
+func TestForwarderRebind(t *testing.T) {
+	upstream := echoUpstream(t)
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamAddr: upstream.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+	previous := forwarder.Addr().String()
+
+	open, err := net.Dial("tcp", previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	echo(t, open, "before")
+
+	if err := forwarder.Rebind("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The open connection keeps going, new ones use the new address only
+	echo(t, open, "after")
+	moved, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer moved.Close()
+	echo(t, moved, "moved")
+	if conn, err := net.Dial("tcp", previous); err == nil {
+		conn.Close()
+		t.Errorf("the forwarder still accepts connections on %s", previous)
+	}
+
+	if stats := forwarder.Stats(); stats.TotalConnections != 2 {
+		t.Errorf("got %d connections, want 2", stats.TotalConnections)
+	}
+}
+
+func TestForwarderAdoptsListener(t *testing.T) {
+	upstream := echoUpstream(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Connections arriving while the port is reserved are served once the forwarder starts
+	early, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:   listener.Addr().String(),
+		UpstreamAddr: upstream.Addr().String(),
+		Listener:     listener,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+	defer early.Close()
+	echo(t, early, "early")
+
+	// A forwarder failing to start releases the port
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = StartForwarder(ForwarderConfig{
+		ListenAddr:   listener.Addr().String(),
+		UpstreamAddr: upstream.Addr().String(),
+		Listener:     listener,
+		Rewrites:     []RewriteRule{{Match: "(", Regex: true}},
+	})
+	if err == nil {
+		t.Fatal("started a forwarder with an invalid rewrite rule")
+	}
+	if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("%s still accepts connections", listener.Addr())
+	}
+}
+
+func TestForwarderAbort(t *testing.T) {
+	upstream := echoUpstream(t)
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamAddr: upstream.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := forwarder.Addr().String()
+
+	open, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	echo(t, open, "before")
+
+	// Unlike Close, Abort doesn't wait for the open connection to be closed by the client
+	aborted := make(chan error, 1)
+	go func() { aborted <- forwarder.Abort() }()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Abort waits for the open connection")
+	}
+	_ = open.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := open.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading from the aborted connection, want EOF", err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("the forwarder still accepts connections on %s", addr)
+	}
+}
+
+func TestForwarderDrain(t *testing.T) {
+	upstream := echoUpstream(t)
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamAddr: upstream.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Abort()
+	addr := forwarder.Addr().String()
+
+	open, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	echo(t, open, "before")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if forwarder.Drain(ctx) {
+		t.Fatal("Drain reports the open connection as finished")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("the draining forwarder still accepts connections on %s", addr)
+	}
+
+	// The open connection keeps being forwarded until the client is done with it
+	drained := make(chan bool, 1)
+	go func() { drained <- forwarder.Drain(context.Background()) }()
+	echo(t, open, "during")
+	open.Close()
+	select {
+	case ok := <-drained:
+		if !ok {
+			t.Error("Drain reports the closed connection as open")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain waits although the connection was closed")
+	}
+}
+
+func TestForwarderIdleFor(t *testing.T) {
+	upstream := echoUpstream(t)
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamAddr: upstream.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	if idle := forwarder.IdleFor(); idle < 20*time.Millisecond {
+		t.Errorf("got idle for %s after starting, want at least 20ms", idle)
+	}
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "busy")
+	time.Sleep(20 * time.Millisecond)
+	if idle := forwarder.IdleFor(); idle != 0 {
+		t.Errorf("got idle for %s with an open connection, want 0", idle)
+	}
+
+	// Idle again from when the connection closed
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for forwarder.IdleFor() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if idle := forwarder.IdleFor(); idle == 0 || idle > 100*time.Millisecond {
+		t.Errorf("got idle for %s after the connection closed, want it counted from the close", idle)
+	}
+}
+
+func TestForwarderQueue(t *testing.T) {
+	upstream := echoUpstream(t)
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:           "127.0.0.1:0",
+		UpstreamAddr:         upstream.Addr().String(),
+		MaxConnections:       1,
+		MaxQueuedConnections: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Abort()
+	addr := forwarder.Addr().String()
+
+	forwarded, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarded.Close()
+	echo(t, forwarded, "first")
+
+	queued, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queued.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for forwarder.Stats().QueuedConnections == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := forwarder.Stats(); stats.QueuedConnections != 1 || stats.PeakQueuedConnections != 1 {
+		t.Fatalf("got %d queued connections, at most %d, want 1", stats.QueuedConnections, stats.PeakQueuedConnections)
+	}
+
+	// The queue is full, the next connection is closed right away
+	rejected, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	_ = rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading from the connection beyond the queue, want EOF", err)
+	}
+	if stats := forwarder.Stats(); stats.RejectedConnections != 1 || stats.QueuedConnections != 1 {
+		t.Errorf("got %d rejected and %d queued connections, want 1 each", stats.RejectedConnections, stats.QueuedConnections)
+	}
+
+	// The queued connection is forwarded once the slot is free
+	forwarded.Close()
+	echo(t, queued, "second")
+	if stats := forwarder.Stats(); stats.QueuedConnections != 0 || stats.PeakQueuedConnections != 1 {
+		t.Errorf("got %d queued connections, at most %d, want 0, at most 1", stats.QueuedConnections, stats.PeakQueuedConnections)
+	}
+}
+
+// shortWriter writes at most n bytes, then fails.
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		return written, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestCountingWriter(t *testing.T) {
+	var n atomic.Int64
+	var buf bytes.Buffer
+	cw := &countingWriter{w: &buf, n: &n}
+	for _, p := range []string{"hello", "", " world"} {
+		if _, err := io.WriteString(cw, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := n.Load(); got != int64(buf.Len()) || got != 11 {
+		t.Errorf("counted %d bytes, want the %d written", got, buf.Len())
+	}
+
+	// Only the bytes which made it are counted
+	n.Store(0)
+	cw = &countingWriter{w: &shortWriter{n: 3}, n: &n}
+	if written, err := io.WriteString(cw, "hello"); written != 3 || err != io.ErrShortWrite {
+		t.Errorf("got %d, %v writing, want 3, %v", written, err, io.ErrShortWrite)
+	}
+	if got := n.Load(); got != 3 {
+		t.Errorf("counted %d bytes of a short write, want 3", got)
+	}
+
+	// Connections of a forwarder count into the same total concurrently
+	n.Store(0)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cw := &countingWriter{w: io.Discard, n: &n}
+			for range 1000 {
+				_, _ = cw.Write([]byte("0123456789"))
+			}
+		}()
+	}
+	wg.Wait()
+	if got := n.Load(); got != 8*1000*10 {
+		t.Errorf("counted %d bytes written concurrently, want %d", got, 8*1000*10)
+	}
+}
+
+func TestForwarderStatsBytes(t *testing.T) {
+	upstream := echoUpstream(t)
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamAddr: upstream.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+
+	conn, err := net.Dial("tcp", forwarder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "hello")
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for forwarder.Stats().ActiveConnections > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := forwarder.Stats(); stats.BytesSent != 6 || stats.BytesReceived != 6 || stats.TotalConnections != 1 {
+		t.Errorf("got %d bytes sent and %d received over %d connections, want 6 each over 1", stats.BytesSent, stats.BytesReceived, stats.TotalConnections)
+	}
+}
+
+// saturatedWriter stands in for a saturated network, every write takes a while.
+type saturatedWriter struct {
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (w *saturatedWriter) Write(p []byte) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, p)
+	return len(p), nil
+}
+
+// written returns the bytes written starting with b among the first writes.
+func (w *saturatedWriter) written(b byte, writes int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, write := range w.writes[:min(writes, len(w.writes))] {
+		if write[0] == b {
+			n += len(write)
+		}
+	}
+	return n
+}
+
+func TestFairSchedulerSmallWrites(t *testing.T) {
+	scheduler := NewFairScheduler()
+	network := &saturatedWriter{}
+	bulk := &fairWriter{w: network, flow: scheduler.Flow(1)}
+	api := &fairWriter{w: network, flow: scheduler.Flow(1)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 32 {
+			bulk.Write(bytes.Repeat([]byte("b"), 32*1024))
+		}
+	}()
+	for network.written('b', 1) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := api.Write([]byte("a small request")); err != nil {
+		t.Fatal(err)
+	}
+	// The request only waits for the turns handed out before it
+	if written := network.written('b', 1000); written > 4*fairQuantum {
+		t.Errorf("small write waited for %d bytes of the bulk transfer", written)
+	}
+	<-done
+}
+
+func TestFairSchedulerWeights(t *testing.T) {
+	scheduler := NewFairScheduler()
+	network := &saturatedWriter{}
+	light := &fairWriter{w: network, flow: scheduler.Flow(1)}
+	heavy := &fairWriter{w: network, flow: scheduler.Flow(3)}
+
+	var wg sync.WaitGroup
+	for _, flow := range []struct {
+		w io.Writer
+		b byte
+	}{{light, 'l'}, {heavy, 'h'}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 8 {
+				flow.w.Write(bytes.Repeat([]byte{flow.b}, 32*1024))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// While both were busy the heavy flow got about three times the bytes of the light one
+	light1, heavy1 := network.written('l', 40), network.written('h', 40)
+	if heavy1 < 2*light1 {
+		t.Errorf("of the first 40 writes %d bytes were heavy and %d light, want about three times as many heavy", heavy1, light1)
+	}
+}
@@ -0,0 +1,99 @@
+package ssmtunnels
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	grpcHealthRetryInterval = 2 * time.Second
+	grpcHealthCheckTimeout  = 5 * time.Second
+)
+
+// GRPCHealthConfig describes the gRPC health check of a tunnel.
+type GRPCHealthConfig struct {
+	// Addr is the local address of the tunnel
+	Addr string
+	// Service is checked, the empty string means the server as a whole
+	Service string
+	// TLS connects with TLS, verifying the certificate against ServerName
+	TLS        bool
+	ServerName string
+	// TLSConfig is the base TLS configuration, e.g. with a CA bundle. Optional.
+	TLSConfig *tls.Config
+}
+
+// HealthCheckFailedError is returned by WaitForGRPCHealth when the service
+// did not report SERVING before the context was done.
+type HealthCheckFailedError struct {
+	Service string
+	Status  healthpb.HealthCheckResponse_ServingStatus
+	Err     error
+}
+
+func (e *HealthCheckFailedError) Error() string {
+	service := e.Service
+	if service == "" {
+		service = "(server)"
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("gRPC health check of %s did not succeed: %v", service, e.Err)
+	}
+	return fmt.Sprintf("gRPC health check of %s did not succeed: status %s", service, e.Status)
+}
+
+func (e *HealthCheckFailedError) Unwrap() error {
+	return e.Err
+}
+
+// WaitForGRPCHealth calls the standard gRPC health checking protocol through
+// the tunnel until the service reports SERVING, retrying every few seconds
+// until the context is done.
+func WaitForGRPCHealth(ctx context.Context, cfg GRPCHealthConfig) error {
+	creds := insecure.NewCredentials()
+	if cfg.TLS {
+		tlsConfig := &tls.Config{}
+		if cfg.TLSConfig != nil {
+			tlsConfig = cfg.TLSConfig.Clone()
+		}
+		// The tunnel is dialed on a local address, the certificate is for the remote host
+		tlsConfig.ServerName = cfg.ServerName
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient("passthrough:///"+cfg.Addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, grpcHealthCheckTimeout)
+		response, err := client.Check(checkCtx, &healthpb.HealthCheckRequest{Service: cfg.Service})
+		cancel()
+
+		lastErr := &HealthCheckFailedError{Service: cfg.Service, Err: err}
+		if err == nil {
+			if response.Status == healthpb.HealthCheckResponse_SERVING {
+				return nil
+			}
+			lastErr.Status = response.Status
+		}
+
+		log.Printf("gRPC health check through %s not successful yet: %v", cfg.Addr, lastErr)
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(grpcHealthRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package ssmtunnels
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// documentHostForbidden are the characters the host parameter of the port
+// forwarding documents rejects. Underscores and uppercase letters are fine.
+const documentHostForbidden = ",$^&()!;'\"<>`{}|#="
+
+// NormalizeHost accepts a DNS name, an IPv4 address or an IPv6 address with or
+// without brackets, and returns it in the form expected by the SSM document
+// parameters and net.JoinHostPort, i.e. IPv6 addresses without brackets.
+// Hosts the document would reject are reported here, naming the character.
+func NormalizeHost(host string) (string, error) {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return "", fmt.Errorf("host must be set")
+	}
+	for _, r := range host {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return "", fmt.Errorf("invalid host %q: contains whitespace or invisible characters", host)
+		}
+		if strings.ContainsRune(documentHostForbidden, r) {
+			return "", fmt.Errorf("invalid host %q: %q is not allowed by Session Manager", host, r)
+		}
+	}
+
+	bracketed := strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")
+	if bracketed {
+		host = host[1 : len(host)-1]
+	}
+	if strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("invalid host %q: unbalanced brackets", host)
+	}
+
+	if !strings.Contains(host, ":") {
+		if bracketed {
+			return "", fmt.Errorf("invalid host %q: only IPv6 addresses can be bracketed", host)
+		}
+		return host, nil
+	}
+
+	// Zones only make sense on the machine they were taken from
+	if strings.Contains(host, "%") {
+		return "", fmt.Errorf("invalid host %q: IPv6 zones are not supported", host)
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid host %q: expected an IPv6 address without a port", host)
+	}
+	return host, nil
+}
+
+// targetPattern matches the targets of Session Manager: EC2 instances, managed
+// nodes and containers of ECS tasks.
+var targetPattern = regexp.MustCompile(`^(i-[0-9a-f]+|mi-[0-9a-f]+|ecs:.+_.+_.+)$`)
+
+// NormalizeTarget trims whitespace around a target, e.g. an instance ID pasted
+// with a trailing newline, and rejects targets with whitespace inside.
+func NormalizeTarget(target string) (string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", fmt.Errorf("target must be set")
+	}
+	if strings.IndexFunc(target, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		return "", fmt.Errorf("invalid target %q: contains whitespace or invisible characters", target)
+	}
+	if !targetPattern.MatchString(target) {
+		return "", fmt.Errorf("invalid target %q: expected an instance ID like i-0123456789abcdef0, a managed node ID like "+
+			"mi-0123456789abcdef0 or an ECS task like ecs:cluster_task-id_container-runtime-id", target)
+	}
+	return target, nil
+}
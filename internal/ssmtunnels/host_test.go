@@ -0,0 +1,133 @@
+package ssmtunnels
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{host: "db.example.internal", want: "db.example.internal"},
+		{host: "10.0.0.12", want: "10.0.0.12"},
+		{host: "2001:db8::12", want: "2001:db8::12"},
+		{host: "[2001:db8::12]", want: "2001:db8::12"},
+		{host: "::1", want: "::1"},
+		{host: "[::1]", want: "::1"},
+		{host: "::ffff:10.0.0.12", want: "::ffff:10.0.0.12"},
+		{host: " fd00:ec2::254 ", want: "fd00:ec2::254"},
+		{host: "DB_Primary.Example.internal", want: "DB_Primary.Example.internal"},
+		{host: "db.example.internal\n", want: "db.example.internal"},
+		{host: "db example.internal", wantErr: true},
+		{host: "db.example.internal;", wantErr: true},
+		{host: "db\u200b.example.internal", wantErr: true},
+		{host: "[db.example.internal", wantErr: true},
+		{host: "", wantErr: true},
+		{host: "[10.0.0.12]", wantErr: true},
+		{host: "[2001:db8::12]:443", wantErr: true},
+		{host: "db.example.internal:5432", wantErr: true},
+		{host: "fe80::1%eth0", wantErr: true},
+		{host: "2001:db8:::12", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := NormalizeHost(tt.host)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NormalizeHost(%q) = %q, want an error", tt.host, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeHost(%q) returned an error: %v", tt.host, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeHost(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTarget(t *testing.T) {
+	for target, want := range map[string]string{
+		"i-0123456789abcdef0":        "i-0123456789abcdef0",
+		" i-0123456789abcdef0\n":     "i-0123456789abcdef0",
+		"\tmi-0123456789abcdef0 ":    "mi-0123456789abcdef0",
+		"ecs:cluster_task_container": "ecs:cluster_task_container",
+		"i-0123 456789abcdef0":       "",
+		"i-0123456789ABCDEF0":        "",
+		"bastion":                    "",
+		"ecs:cluster":                "",
+		"  ":                         "",
+	} {
+		got, err := NormalizeTarget(target)
+		if want == "" {
+			if err == nil {
+				t.Errorf("NormalizeTarget(%q) = %q, want an error", target, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("NormalizeTarget(%q) = %q, %v, want %q", target, got, err, want)
+		}
+	}
+}
+
+func TestForwarderIPv6(t *testing.T) {
+	upstream, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	host, err := NormalizeHost("[::1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarder, err := StartForwarder(ForwarderConfig{
+		ListenAddr:   net.JoinHostPort(host, "0"),
+		UpstreamAddr: upstream.Addr().String(),
+		RemoteHost:   "2001:db8::12",
+		RemotePort:   5432,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+
+	port := forwarder.Addr().(*net.TCPAddr).Port
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q through the forwarder, want %q", buf, "ping")
+	}
+}
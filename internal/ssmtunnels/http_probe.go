@@ -0,0 +1,127 @@
+package ssmtunnels
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	httpHealthRetryInterval = 2 * time.Second
+	httpHealthCheckTimeout  = 5 * time.Second
+)
+
+// HTTPHealthConfig describes the HTTP health check of a tunnel.
+type HTTPHealthConfig struct {
+	// Addr is the local address of the tunnel
+	Addr string
+	// RemoteHost and RemotePort are the endpoint behind the tunnel, sent as Host
+	// header, so load balancers routing by host see the name they serve
+	RemoteHost string
+	RemotePort int
+	// Path is requested with GET, e.g. /healthz
+	Path string
+	// ExpectedStatus is the status code the check waits for
+	ExpectedStatus int
+	// TLS connects with TLS, verifying the certificate against RemoteHost
+	TLS bool
+	// TLSConfig is the base TLS configuration, e.g. with a CA bundle. Optional.
+	TLSConfig *tls.Config
+}
+
+// HTTPCheckFailedError is returned by WaitForHTTP when the endpoint did not
+// answer with the expected status before the context was done.
+type HTTPCheckFailedError struct {
+	URL      string
+	Status   int
+	Expected int
+	Err      error
+}
+
+func (e *HTTPCheckFailedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("HTTP health check of %s did not succeed: %v", e.URL, e.Err)
+	}
+	return fmt.Sprintf("HTTP health check of %s did not succeed: status %d, want %d", e.URL, e.Status, e.Expected)
+}
+
+func (e *HTTPCheckFailedError) Unwrap() error {
+	return e.Err
+}
+
+// healthURL returns the URL the check requests, with the port left out if it
+// is the default of the scheme.
+func (cfg HTTPHealthConfig) healthURL() string {
+	scheme, defaultPort := "http", 80
+	if cfg.TLS {
+		scheme, defaultPort = "https", 443
+	}
+	host := cfg.RemoteHost
+	if cfg.RemotePort != defaultPort {
+		host = net.JoinHostPort(cfg.RemoteHost, strconv.Itoa(cfg.RemotePort))
+	} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	return (&url.URL{Scheme: scheme, Host: host, Path: cfg.Path}).String()
+}
+
+// WaitForHTTP requests the path through the tunnel until it answers with the
+// expected status, retrying every few seconds until the context is done.
+// Redirects aren't followed, so a redirecting endpoint can be checked too.
+func WaitForHTTP(ctx context.Context, cfg HTTPHealthConfig) error {
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	// The tunnel is dialed on a local address, the certificate is for the remote host
+	tlsConfig.ServerName = cfg.RemoteHost
+	var dialer net.Dialer
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp", cfg.Addr)
+			},
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	target := cfg.healthURL()
+
+	for {
+		lastErr := &HTTPCheckFailedError{URL: target, Expected: cfg.ExpectedStatus}
+		checkCtx, cancel := context.WithTimeout(ctx, httpHealthCheckTimeout)
+		request, err := http.NewRequestWithContext(checkCtx, http.MethodGet, target, nil)
+		if err != nil {
+			cancel()
+			return err
+		}
+		response, err := client.Do(request)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			response.Body.Close()
+			lastErr.Status = response.StatusCode
+		}
+		cancel()
+		lastErr.Err = err
+		if err == nil && response.StatusCode == cfg.ExpectedStatus {
+			return nil
+		}
+
+		log.Printf("HTTP health check through %s not successful yet: %v", cfg.Addr, lastErr)
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(httpHealthRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package ssmtunnels
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	mysqlRetryInterval = 2 * time.Second
+	mysqlCheckTimeout  = 5 * time.Second
+
+	// mysqlHandshakeV10 starts the initial handshake packet of every MySQL
+	// and MariaDB server since 3.21
+	mysqlHandshakeV10 = 0x0a
+	// mysqlErrPacket starts an ERR packet
+	mysqlErrPacket = 0xff
+)
+
+// mysqlNotAccepting are the error codes of servers which are up but don't
+// accept connections yet, or for now: too many connections, shutting down,
+// in offline mode and not available, e.g. while Aurora is failing over.
+var mysqlNotAccepting = map[uint16]bool{
+	1040: true,
+	1053: true,
+	3032: true,
+	3168: true,
+}
+
+// MySQLHealthConfig describes the MySQL readiness check of a tunnel.
+type MySQLHealthConfig struct {
+	// Addr is the local address of the tunnel
+	Addr string
+}
+
+// MySQLCheckFailedError is returned by WaitForMySQL when the server did not
+// greet with a handshake before the context was done.
+type MySQLCheckFailedError struct {
+	Addr string
+	// Code and Message are the error code and message of the server's last error
+	Code    uint16
+	Message string
+	Err     error
+}
+
+func (e *MySQLCheckFailedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("MySQL readiness check through %s did not succeed: %v", e.Addr, e.Err)
+	}
+	return fmt.Sprintf("MySQL readiness check through %s did not succeed: %s (error %d)", e.Addr, e.Message, e.Code)
+}
+
+func (e *MySQLCheckFailedError) Unwrap() error {
+	return e.Err
+}
+
+// WaitForMySQL connects through the tunnel until the server greets with its
+// initial handshake, retrying every few seconds until the context is done.
+// Errors of a server which doesn't accept connections yet are retried, other
+// errors, e.g. about the host not being allowed, mean the server is up. The
+// check never authenticates.
+func WaitForMySQL(ctx context.Context, cfg MySQLHealthConfig) error {
+	for {
+		lastErr := &MySQLCheckFailedError{Addr: cfg.Addr}
+		checkCtx, cancel := context.WithTimeout(ctx, mysqlCheckTimeout)
+		lastErr.Code, lastErr.Message, lastErr.Err = mysqlGreeting(checkCtx, cfg)
+		cancel()
+		if lastErr.Err == nil && !mysqlNotAccepting[lastErr.Code] {
+			return nil
+		}
+
+		log.Printf("MySQL readiness check through %s not successful yet: %v", cfg.Addr, lastErr)
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(mysqlRetryInterval):
+		}
+	}
+}
+
+// mysqlGreeting reads the first packet the server sends and returns the code
+// and message of the error it greeted with, zero if it sent a handshake.
+func mysqlGreeting(ctx context.Context, cfg MySQLHealthConfig) (uint16, string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	// Packets start with a 3 byte little endian length and a sequence number
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, "", err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length < 1 || length > 64<<10 {
+		return 0, "", fmt.Errorf("not a MySQL server: packet of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, "", err
+	}
+
+	switch payload[0] {
+	case mysqlHandshakeV10:
+		return 0, "", nil
+	case mysqlErrPacket:
+		if len(payload) < 3 {
+			return 0, "", fmt.Errorf("not a MySQL server: ERR packet of %d bytes", length)
+		}
+		code := binary.LittleEndian.Uint16(payload[1:3])
+		message := payload[3:]
+		// Servers since 4.1 send the SQLSTATE as # and 5 characters first
+		if len(message) >= 6 && message[0] == '#' {
+			message = message[6:]
+		}
+		return code, string(message), nil
+	default:
+		return 0, "", fmt.Errorf("not a MySQL server: unexpected packet starting with %#x", payload[0])
+	}
+}
@@ -0,0 +1,122 @@
+package ssmtunnels
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NetworkState holds the addresses of the network interfaces which are up, by
+// interface name. Loopback interfaces and link-local addresses are left out,
+// sessions don't use them.
+type NetworkState map[string][]string
+
+// CurrentNetworkState returns the state of the network interfaces of the host.
+func CurrentNetworkState() (NetworkState, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("listing network interfaces: %w", err)
+	}
+	state := NetworkState{}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("listing addresses of %s: %w", iface.Name, err)
+		}
+		var names []string
+		for _, addr := range addrs {
+			if prefix, ok := addr.(*net.IPNet); ok && prefix.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			names = append(names, addr.String())
+		}
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		state[iface.Name] = names
+	}
+	return state, nil
+}
+
+// Changes describes how the network changed from s to other, e.g. "utun3 came
+// up with 10.8.0.2/32" when a VPN connected. It is empty if nothing changed.
+func (s NetworkState) Changes(other NetworkState) []string {
+	names := make([]string, 0, len(s)+len(other))
+	for name := range s {
+		names = append(names, name)
+	}
+	for name := range other {
+		if _, ok := s[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		before, wasUp := s[name]
+		after, isUp := other[name]
+		switch {
+		case !wasUp:
+			changes = append(changes, fmt.Sprintf("%s came up with %s", name, strings.Join(after, ", ")))
+		case !isUp:
+			changes = append(changes, fmt.Sprintf("%s went down", name))
+		case !slices.Equal(before, after):
+			changes = append(changes, fmt.Sprintf("%s changed to %s", name, strings.Join(after, ", ")))
+		}
+	}
+	return changes
+}
+
+// WatchNetwork compares the network interfaces every interval until stop is
+// closed, and calls onChange with what changed, e.g. because a VPN connected or
+// disconnected and moved the default route. Changes are only reported once the
+// interfaces stayed the same for an interval, connecting a VPN takes a few
+// steps and the sessions should be checked once it is done.
+func WatchNetwork(interval time.Duration, stop <-chan struct{}, onChange func(changes []string)) {
+	watchNetwork(interval, stop, CurrentNetworkState, onChange)
+}
+
+func watchNetwork(interval time.Duration, stop <-chan struct{}, current func() (NetworkState, error), onChange func(changes []string)) {
+	reported, err := current()
+	if err != nil {
+		log.Printf("Not watching for network changes: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// pending is the changed state waiting to settle
+	var pending NetworkState
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		state, err := current()
+		if err != nil {
+			log.Printf("Error checking for network changes: %v", err)
+			continue
+		}
+		if pending != nil && len(pending.Changes(state)) == 0 {
+			changes := reported.Changes(state)
+			reported, pending = state, nil
+			onChange(changes)
+			continue
+		}
+		pending = nil
+		if len(reported.Changes(state)) > 0 {
+			pending = state
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package ssmtunnels
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNetworkStateChanges(t *testing.T) {
+	before := NetworkState{
+		"en0":   {"192.168.1.20/24"},
+		"utun2": {"10.8.0.2/32"},
+	}
+	after := NetworkState{
+		"en0":   {"192.168.1.21/24"},
+		"utun3": {"10.9.0.2/32"},
+	}
+	want := []string{
+		"en0 changed to 192.168.1.21/24",
+		"utun2 went down",
+		"utun3 came up with 10.9.0.2/32",
+	}
+	if got := before.Changes(after); !slices.Equal(got, want) {
+		t.Errorf("got changes %q, want %q", got, want)
+	}
+	if got := before.Changes(before); len(got) != 0 {
+		t.Errorf("got changes %q of the same state, want none", got)
+	}
+}
+
+func TestWatchNetworkSettles(t *testing.T) {
+	office := NetworkState{"en0": {"192.168.1.20/24"}}
+	vpn := NetworkState{"en0": {"192.168.1.20/24"}, "utun3": {"10.9.0.2/32"}}
+	// Connecting the VPN flaps the interfaces before they settle
+	states := []NetworkState{office, office, vpn, office, vpn, vpn, vpn}
+
+	var mu sync.Mutex
+	polls := 0
+	current := func() (NetworkState, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		state := states[min(polls, len(states)-1)]
+		polls++
+		return state, nil
+	}
+
+	stop := make(chan struct{})
+	reported := make(chan []string, len(states))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchNetwork(time.Millisecond, stop, current, func(changes []string) { reported <- changes })
+	}()
+
+	select {
+	case changes := <-reported:
+		if want := []string{"utun3 came up with 10.9.0.2/32"}; !slices.Equal(changes, want) {
+			t.Errorf("got changes %q, want %q", changes, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the settled change was never reported")
+	}
+	close(stop)
+	<-done
+	if len(reported) > 0 {
+		t.Errorf("got changes %q reported again", <-reported)
+	}
+}
@@ -0,0 +1,121 @@
+package ssmtunnels
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// portForwardingDocument is the document of the sessions the provider starts, unless a tunnel has its own.
+const portForwardingDocument = "AWS-StartPortForwardingSessionToRemoteHost"
+
+// OperatorSession is a port forwarding session opened outside of the provider,
+// e.g. with aws ssm start-session by the operator running Terraform.
+type OperatorSession struct {
+	SessionId  string
+	Target     string
+	RemoteHost string
+	RemotePort int
+	LocalPort  int
+}
+
+// FindOperatorSessions lists the port forwarding sessions of the
+// session-manager-plugin processes running on this machine. Sessions without
+// a fixed local port are left out, their port isn't known.
+func FindOperatorSessions() ([]OperatorSession, error) {
+	commands, err := processCommandLines()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []OperatorSession
+	for _, command := range commands {
+		if !strings.Contains(command, "session-manager-plugin") {
+			continue
+		}
+		if session, ok := parseOperatorSession(command); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// parseOperatorSession reads the session from the command line of the plugin,
+// whose arguments include the StartSession response and request as JSON. The
+// documents are searched for instead of splitting the arguments, as ps joins
+// them with spaces on some systems.
+func parseOperatorSession(command string) (OperatorSession, bool) {
+	var response struct {
+		SessionId string
+	}
+	var request struct {
+		Target       string
+		DocumentName string
+		Parameters   map[string][]string
+	}
+
+	for i := 0; i < len(command); i++ {
+		if command[i] != '{' {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(command[i:]))
+		var document map[string]json.RawMessage
+		if err := decoder.Decode(&document); err != nil {
+			continue
+		}
+		raw := command[i : i+int(decoder.InputOffset())]
+		if _, ok := document["SessionId"]; ok {
+			_ = json.Unmarshal([]byte(raw), &response)
+		}
+		if _, ok := document["DocumentName"]; ok {
+			_ = json.Unmarshal([]byte(raw), &request)
+		}
+		i += len(raw) - 1
+	}
+
+	// The plugins started by the provider get the response from the environment, see Session
+	if response.SessionId == "" || request.DocumentName != portForwardingDocument {
+		return OperatorSession{}, false
+	}
+	first := func(name string) string {
+		if values := request.Parameters[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	remotePort, err := strconv.Atoi(first("portNumber"))
+	if err != nil {
+		return OperatorSession{}, false
+	}
+	localPort, err := strconv.Atoi(first("localPortNumber"))
+	if err != nil || localPort == 0 {
+		return OperatorSession{}, false
+	}
+	return OperatorSession{
+		SessionId:  response.SessionId,
+		Target:     request.Target,
+		RemoteHost: first("host"),
+		RemotePort: remotePort,
+		LocalPort:  localPort,
+	}, true
+}
+
+// Live reports whether the session is still active and its local port, on
+// localHost, accepts connections.
+func (s OperatorSession) Live(ctx context.Context, client *ssm.Client, localHost string) bool {
+	active, err := isSessionActive(ctx, client, s.SessionId)
+	if err != nil || !active {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(localHost, strconv.Itoa(s.LocalPort)), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
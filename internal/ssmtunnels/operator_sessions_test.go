@@ -0,0 +1,41 @@
+package ssmtunnels
+
+import "testing"
+
+func TestParseOperatorSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    OperatorSession
+		ok      bool
+	}{
+		{
+			name: "aws cli",
+			command: `session-manager-plugin {"SessionId": "operator-0abc", "TokenValue": "secret", "StreamUrl": "wss://ssmmessages.us-east-1.amazonaws.com/v1/data-channel/operator-0abc"} us-east-1 StartSession default ` +
+				`{"Target": "i-123456789", "DocumentName": "AWS-StartPortForwardingSessionToRemoteHost", "Parameters": {"host": ["db.example.internal"], "portNumber": ["5432"], "localPortNumber": ["15432"]}} https://ssm.us-east-1.amazonaws.com`,
+			want: OperatorSession{SessionId: "operator-0abc", Target: "i-123456789", RemoteHost: "db.example.internal", RemotePort: 5432, LocalPort: 15432},
+			ok:   true,
+		},
+		{
+			name:    "started by the provider",
+			command: `/usr/bin/terraform-provider-awsssmtunnels session-manager-plugin AWS_SSM_START_SESSION_RESPONSE us-east-1 StartSession  {"Target":"i-123456789","DocumentName":"AWS-StartPortForwardingSessionToRemoteHost","Parameters":{"host":["db.example.internal"],"portNumber":["5432"],"localPortNumber":["40001"]}} https://ssm.us-east-1.amazonaws.com`,
+		},
+		{
+			name:    "random local port",
+			command: `session-manager-plugin {"SessionId": "operator-0abc"} us-east-1 StartSession default {"Target": "i-123456789", "DocumentName": "AWS-StartPortForwardingSessionToRemoteHost", "Parameters": {"host": ["db.example.internal"], "portNumber": ["5432"]}} https://ssm.us-east-1.amazonaws.com`,
+		},
+		{
+			name:    "shell session",
+			command: `session-manager-plugin {"SessionId": "operator-0abc"} us-east-1 StartSession default {"Target": "i-123456789"} https://ssm.us-east-1.amazonaws.com`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseOperatorSession(tt.command)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("parseOperatorSession() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
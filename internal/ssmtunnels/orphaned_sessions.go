@@ -0,0 +1,44 @@
+package ssmtunnels
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// FindOrphanedSessions lists the active sessions which were started with the
+// reason prefix, see sessionReason, more than olderThan ago. They are left
+// behind by runs which were killed before terminating their sessions, and
+// would otherwise only end with the idle timeout of Session Manager.
+func FindOrphanedSessions(ctx context.Context, client *ssm.Client, reasonPrefix string, olderThan time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-olderThan)
+	paginator := ssm.NewDescribeSessionsPaginator(client, &ssm.DescribeSessionsInput{
+		State: ssmtypes.SessionStateActive,
+		Filters: []ssmtypes.SessionFilter{
+			{Key: ssmtypes.SessionFilterKeyInvokedBefore, Value: aws.String(cutoff.UTC().Format(time.RFC3339))},
+		},
+	})
+
+	var sessionIds []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("ssm:DescribeSessions failed: %w", classifyAPIError(err))
+		}
+		for _, session := range page.Sessions {
+			if !strings.HasPrefix(aws.ToString(session.Reason), reasonPrefix+": ") {
+				continue
+			}
+			if session.StartDate == nil || !session.StartDate.Before(cutoff) {
+				continue
+			}
+			sessionIds = append(sessionIds, aws.ToString(session.SessionId))
+		}
+	}
+	return sessionIds, nil
+}
@@ -0,0 +1,119 @@
+package ssmtunnels
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Partition describes the parts of an AWS partition needed to build endpoints.
+type Partition struct {
+	ID        string
+	DNSSuffix string
+}
+
+var (
+	PartitionAWS      = Partition{ID: "aws", DNSSuffix: "amazonaws.com"}
+	PartitionAWSCN    = Partition{ID: "aws-cn", DNSSuffix: "amazonaws.com.cn"}
+	PartitionAWSUSGov = Partition{ID: "aws-us-gov", DNSSuffix: "amazonaws.com"}
+	PartitionAWSISO   = Partition{ID: "aws-iso", DNSSuffix: "c2s.ic.gov"}
+	PartitionAWSISOB  = Partition{ID: "aws-iso-b", DNSSuffix: "sc2s.sgov.gov"}
+	PartitionAWSISOE  = Partition{ID: "aws-iso-e", DNSSuffix: "cloud.adc-e.uk"}
+	PartitionAWSISOF  = Partition{ID: "aws-iso-f", DNSSuffix: "csp.hci.ic.gov"}
+)
+
+// regionPrefixes maps region name prefixes to their partition. More specific
+// prefixes must come first.
+var regionPrefixes = []struct {
+	prefix    string
+	partition Partition
+}{
+	{"cn-", PartitionAWSCN},
+	{"us-gov-", PartitionAWSUSGov},
+	{"us-isob-", PartitionAWSISOB},
+	{"us-isof-", PartitionAWSISOF},
+	{"us-iso-", PartitionAWSISO},
+	{"eu-isoe-", PartitionAWSISOE},
+}
+
+// regionPattern matches region names of every partition, e.g. us-east-1,
+// us-gov-west-1 or eu-isoe-west-1.
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// ValidateRegion rejects names which can't be an AWS region, e.g. an
+// availability zone or a region with a typo in its format.
+func ValidateRegion(region string) error {
+	if !regionPattern.MatchString(region) {
+		return fmt.Errorf("%q is not an AWS region like us-east-1", region)
+	}
+	return nil
+}
+
+// PartitionForRegion returns the partition a region belongs to, defaulting to
+// the commercial partition.
+func PartitionForRegion(region string) Partition {
+	for _, p := range regionPrefixes {
+		if strings.HasPrefix(region, p.prefix) {
+			return p.partition
+		}
+	}
+	return PartitionAWS
+}
+
+// SSMEndpoint returns the SSM control plane endpoint for the region.
+func SSMEndpoint(region string) string {
+	return fmt.Sprintf("https://ssm.%s.%s", region, PartitionForRegion(region).DNSSuffix)
+}
+
+// SSMMessagesHost returns the hostname used for the session data channel in the region.
+func SSMMessagesHost(region string) string {
+	return fmt.Sprintf("ssmmessages.%s.%s", region, PartitionForRegion(region).DNSSuffix)
+}
+
+// SSMFIPSEndpoint returns the FIPS endpoint of the SSM control plane for the region.
+func SSMFIPSEndpoint(region string) string {
+	return fmt.Sprintf("https://ssm-fips.%s.%s", region, PartitionForRegion(region).DNSSuffix)
+}
+
+// SSMMessagesFIPSHost returns the hostname of the FIPS endpoint of the session data channel in the region.
+func SSMMessagesFIPSHost(region string) string {
+	return fmt.Sprintf("ssmmessages-fips.%s.%s", region, PartitionForRegion(region).DNSSuffix)
+}
+
+// StreamURL returns the data channel websocket URL for a session in the region.
+func StreamURL(region string, sessionId string) string {
+	return fmt.Sprintf("wss://%s/v1/data-channel/%s?role=publish_subscribe", SSMMessagesHost(region), sessionId)
+}
+
+// OverrideStreamURLHost points the data channel URL of a session at another
+// ssmmessages endpoint, e.g. a dual-stack or FIPS one. The endpoint is either a
+// hostname or a URL, of which only the host is used.
+func OverrideStreamURLHost(streamURL string, endpoint string) (string, error) {
+	host, err := EndpointHost(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid stream URL: %w", err)
+	}
+	u.Host = host
+	return u.String(), nil
+}
+
+// EndpointHost returns the host of an endpoint given as a hostname or URL.
+func EndpointHost(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "wss://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	if u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("invalid endpoint %q: expected a hostname", endpoint)
+	}
+	return u.Host, nil
+}
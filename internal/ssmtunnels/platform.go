@@ -0,0 +1,59 @@
+package ssmtunnels
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// Platforms of managed nodes, as reported by their SSM agent.
+const (
+	PlatformLinux   = string(ssmtypes.PlatformTypeLinux)
+	PlatformWindows = string(ssmtypes.PlatformTypeWindows)
+	PlatformMacOS   = string(ssmtypes.PlatformTypeMacos)
+)
+
+// Platforms lists the platforms a target can run.
+var Platforms = []string{PlatformLinux, PlatformWindows, PlatformMacOS}
+
+// PlatformMismatchError means the target doesn't run the platform a tunnel
+// requires, e.g. for a command which only exists there.
+type PlatformMismatchError struct {
+	Target   string
+	Platform string
+	Required string
+}
+
+func (e *PlatformMismatchError) Error() string {
+	platform := e.Platform
+	if platform == "" {
+		platform = "an unknown platform"
+	}
+	return fmt.Sprintf("target %s runs %s, but %s is required", e.Target, platform, e.Required)
+}
+
+// TargetPlatform returns the platform of the target as detected by its SSM
+// agent, one of Platforms. Targets which aren't managed nodes, such as ECS
+// tasks, have no platform and return an empty string.
+func TargetPlatform(ctx context.Context, client *ssm.Client, target string) (string, error) {
+	if !strings.HasPrefix(target, "i-") && !strings.HasPrefix(target, "mi-") {
+		return "", nil
+	}
+
+	output, err := client.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{
+			{Key: aws.String("InstanceIds"), Values: []string{target}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("ssm:DescribeInstanceInformation of %s failed: %w", target, classifyAPIError(err))
+	}
+	if len(output.InstanceInformationList) == 0 {
+		return "", fmt.Errorf("%w: %s is not registered with Systems Manager", ErrTargetOffline, target)
+	}
+	return string(output.InstanceInformationList[0].PlatformType), nil
+}
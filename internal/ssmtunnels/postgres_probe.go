@@ -0,0 +1,164 @@
+package ssmtunnels
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	postgresRetryInterval = 2 * time.Second
+	postgresCheckTimeout  = 5 * time.Second
+
+	// postgresProtocolVersion is version 3.0 of the frontend/backend protocol
+	postgresProtocolVersion = 3 << 16
+	// postgresCannotConnectNow is the SQLSTATE of a server which is starting
+	// up, shutting down or in recovery and doesn't accept connections yet
+	postgresCannotConnectNow = "57P03"
+)
+
+// PostgresHealthConfig describes the PostgreSQL readiness check of a tunnel.
+type PostgresHealthConfig struct {
+	// Addr is the local address of the tunnel
+	Addr string
+	// User and Database are sent in the startup message. The check doesn't
+	// authenticate, so they don't need to exist.
+	User     string
+	Database string
+}
+
+// PostgresCheckFailedError is returned by WaitForPostgres when the server did
+// not accept connections before the context was done.
+type PostgresCheckFailedError struct {
+	Addr string
+	// Code and Message are the SQLSTATE and message of the server's last error
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *PostgresCheckFailedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("PostgreSQL readiness check through %s did not succeed: %v", e.Addr, e.Err)
+	}
+	return fmt.Sprintf("PostgreSQL readiness check through %s did not succeed: %s (SQLSTATE %s)", e.Addr, e.Message, e.Code)
+}
+
+func (e *PostgresCheckFailedError) Unwrap() error {
+	return e.Err
+}
+
+// WaitForPostgres sends a startup message through the tunnel until the
+// server answers it with anything but the error of a server which is still
+// starting up, retrying every few seconds until the context is done. An
+// authentication request means the server accepts connections, and so do
+// errors about the user, database or pg_hba.conf, as the server only checks
+// those once it is up. The check never authenticates.
+func WaitForPostgres(ctx context.Context, cfg PostgresHealthConfig) error {
+	for {
+		lastErr := &PostgresCheckFailedError{Addr: cfg.Addr}
+		checkCtx, cancel := context.WithTimeout(ctx, postgresCheckTimeout)
+		lastErr.Code, lastErr.Message, lastErr.Err = postgresStartup(checkCtx, cfg)
+		cancel()
+		if lastErr.Err == nil && lastErr.Code != postgresCannotConnectNow {
+			return nil
+		}
+
+		log.Printf("PostgreSQL readiness check through %s not successful yet: %v", cfg.Addr, lastErr)
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(postgresRetryInterval):
+		}
+	}
+}
+
+// postgresStartup sends a startup message and returns the SQLSTATE and
+// message of the error the server answered with, empty if it asked to
+// authenticate instead.
+func postgresStartup(ctx context.Context, cfg PostgresHealthConfig) (string, string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return "", "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(postgresStartupMessage(cfg.User, cfg.Database)); err != nil {
+		return "", "", err
+	}
+	reader := bufio.NewReader(conn)
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	var length int32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return "", "", err
+	}
+	if length < 4 || length > 64<<10 {
+		return "", "", fmt.Errorf("not a PostgreSQL server: message of %d bytes", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return "", "", err
+	}
+
+	switch kind {
+	case 'R':
+		// Terminate politely, the server would log an unexpected EOF otherwise
+		_, _ = conn.Write([]byte{'X', 0, 0, 0, 4})
+		return "", "", nil
+	case 'E':
+		code, message := postgresErrorFields(body)
+		return code, message, nil
+	default:
+		return "", "", fmt.Errorf("not a PostgreSQL server: unexpected message %q", kind)
+	}
+}
+
+// postgresStartupMessage returns the startup message of protocol 3.0.
+func postgresStartupMessage(user, database string) []byte {
+	var params bytes.Buffer
+	params.WriteString("user\x00" + user + "\x00")
+	if database != "" {
+		params.WriteString("database\x00" + database + "\x00")
+	}
+	params.WriteString("application_name\x00terraform-provider-aws-ssm-tunnels\x00")
+	params.WriteByte(0)
+
+	message := make([]byte, 8, 8+params.Len())
+	binary.BigEndian.PutUint32(message[0:4], uint32(8+params.Len()))
+	binary.BigEndian.PutUint32(message[4:8], postgresProtocolVersion)
+	return append(message, params.Bytes()...)
+}
+
+// postgresErrorFields returns the SQLSTATE and message of the body of an
+// ErrorResponse.
+func postgresErrorFields(body []byte) (code string, message string) {
+	for len(body) > 1 {
+		field := body[0]
+		end := bytes.IndexByte(body[1:], 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		body = body[2+end:]
+		switch field {
+		case 'C':
+			code = value
+		case 'M':
+			message = value
+		}
+	}
+	return code, message
+}
@@ -0,0 +1,67 @@
+package ssmtunnels
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+type PreflightConfig struct {
+	Client *ssm.Client
+	Target string
+
+	// DocumentName, RemoteHost and RemotePort are those of the tunnel the check
+	// is done for, so documents only allowing some hosts and ports accept it.
+	// DocumentName defaults to AWS-StartPortForwardingSessionToRemoteHost.
+	DocumentName string
+	RemoteHost   string
+	RemotePort   int
+
+	// ReasonPrefix and Runner go into the reason of the session, see RemoteTunnelConfig
+	ReasonPrefix string
+	Runner       string
+}
+
+// PreflightCheck verifies that the credentials can start and terminate port
+// forwarding sessions on the target, and that the target is connected. There
+// is no dry run for StartSession, so a session is started and terminated right
+// away without ever attaching to it. The session shows up in the history with
+// the given reason prefix and, if set, the runner, see RemoteTunnelConfig.Runner.
+func PreflightCheck(ctx context.Context, cfg PreflightConfig) error {
+	reasonPrefix := cfg.ReasonPrefix
+	if reasonPrefix == "" {
+		reasonPrefix = "awsssmtunnels"
+	}
+	reason := reasonPrefix + ": preflight check"
+	if cfg.Runner != "" {
+		reason += " from " + cfg.Runner
+	}
+	documentName := cfg.DocumentName
+	if documentName == "" {
+		documentName = portForwardingDocument
+	}
+
+	output, err := cfg.Client.StartSession(ctx, &ssm.StartSessionInput{
+		Target:       aws.String(cfg.Target),
+		DocumentName: aws.String(documentName),
+		Parameters: map[string][]string{
+			"host":       {cfg.RemoteHost},
+			"portNumber": {strconv.Itoa(cfg.RemotePort)},
+		},
+		Reason: aws.String(truncateReason(reason)),
+	})
+	if err != nil {
+		return fmt.Errorf("ssm:StartSession on %s failed: %w", cfg.Target, classifyAPIError(err))
+	}
+
+	_, err = cfg.Client.TerminateSession(ctx, &ssm.TerminateSessionInput{
+		SessionId: output.SessionId,
+	})
+	if err != nil {
+		return fmt.Errorf("ssm:TerminateSession of preflight session %s failed, terminate it manually: %w", aws.ToString(output.SessionId), classifyAPIError(err))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+var (
+	probeRetryInterval = 5 * time.Second
+	probePollInterval  = time.Second
+)
+
+// ProbeFailedError is returned by WaitForProbe when the probe command did not
+// succeed before the context was done.
+type ProbeFailedError struct {
+	Command    string
+	ExitCode   int32
+	Output     string
+	LastStatus ssmtypes.CommandInvocationStatus
+}
+
+func (e *ProbeFailedError) Error() string {
+	return fmt.Sprintf("probe command %q did not succeed (status %s, exit code %d): %s", e.Command, e.LastStatus, e.ExitCode, e.Output)
+}
+
+// WaitForProbe runs the shell command on the target with SSM Run Command
+// (AWS-RunShellScript, so Linux targets only) until it exits with 0, retrying
+// every few seconds until the context is done.
+func WaitForProbe(ctx context.Context, client *ssm.Client, target string, command string) error {
+	var lastErr error
+	for {
+		err := runProbe(ctx, client, target, command)
+		if err == nil {
+			return nil
+		}
+		// Retrying won't help if we aren't allowed to run commands
+		if errors.Is(err, ErrAccessDenied) {
+			return err
+		}
+		if ctx.Err() != nil {
+			if lastErr == nil {
+				lastErr = err
+			}
+			return lastErr
+		}
+		lastErr = err
+
+		log.Printf("Probe on %q not successful yet: %v", target, err)
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(probeRetryInterval):
+		}
+	}
+}
+
+func runProbe(ctx context.Context, client *ssm.Client, target string, command string) error {
+	output, err := client.SendCommand(ctx, &ssm.SendCommandInput{
+		InstanceIds:  []string{target},
+		DocumentName: aws.String("AWS-RunShellScript"),
+		Comment:      aws.String("awsssmtunnels readiness probe"),
+		Parameters: map[string][]string{
+			"commands": {command},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send probe command: %w", classifyAPIError(err))
+	}
+	commandId := output.Command.CommandId
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(probePollInterval):
+		}
+
+		invocation, err := client.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  commandId,
+			InstanceId: aws.String(target),
+		})
+		var notFound *ssmtypes.InvocationDoesNotExist
+		if errors.As(err, &notFound) {
+			// The invocation takes a moment to show up after SendCommand
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get probe result: %w", classifyAPIError(err))
+		}
+
+		switch invocation.Status {
+		case ssmtypes.CommandInvocationStatusPending, ssmtypes.CommandInvocationStatusInProgress, ssmtypes.CommandInvocationStatusDelayed:
+			continue
+		case ssmtypes.CommandInvocationStatusSuccess:
+			return nil
+		}
+		return &ProbeFailedError{
+			Command:    command,
+			ExitCode:   invocation.ResponseCode,
+			Output:     strings.TrimSpace(aws.ToString(invocation.StandardErrorContent) + "\n" + aws.ToString(invocation.StandardOutputContent)),
+			LastStatus: invocation.Status,
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmfake"
+)
+
+const probeTarget = "i-0123456789abcdef0"
+
+// newProbeClient returns a client of a fake running commands, and makes probes poll and retry quickly.
+func newProbeClient(t *testing.T) (*ssm.Client, *ssmfake.Server) {
+	t.Helper()
+	poll, retry := probePollInterval, probeRetryInterval
+	t.Cleanup(func() { probePollInterval, probeRetryInterval = poll, retry })
+	probePollInterval, probeRetryInterval = 10*time.Millisecond, 50*time.Millisecond
+
+	fake := ssmfake.NewServer()
+	t.Cleanup(fake.Close)
+	client := ssm.NewFromConfig(aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}, func(o *ssm.Options) {
+		o.BaseEndpoint = aws.String(fake.URL())
+	})
+	return client, fake
+}
+
+func TestWaitForProbe(t *testing.T) {
+	client, fake := newProbeClient(t)
+	fake.SetCommandResults(probeTarget,
+		ssmfake.CommandResult{Status: "Failed", ExitCode: 1, Stderr: "pg_isready: no response"},
+		ssmfake.CommandResult{Status: "Success", Stdout: "accepting connections"},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := WaitForProbe(ctx, client, probeTarget, "pg_isready -h db"); err != nil {
+		t.Fatal(err)
+	}
+	// The failed probe is run again
+	commands := fake.Commands(probeTarget)
+	if len(commands) != 2 || commands[0] != "pg_isready -h db" || commands[1] != "pg_isready -h db" {
+		t.Errorf("got commands %q, want the probe twice", commands)
+	}
+}
+
+func TestWaitForProbeTimeout(t *testing.T) {
+	client, fake := newProbeClient(t)
+	fake.SetCommandResults(probeTarget, ssmfake.CommandResult{Status: "Failed", ExitCode: 2, Stdout: "starting", Stderr: "no response"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := WaitForProbe(ctx, client, probeTarget, "pg_isready -h db")
+
+	// The result of the last probe is reported, not that the context is done
+	var probeErr *ProbeFailedError
+	if !errors.As(err, &probeErr) {
+		t.Fatalf("got %v, want the probe to fail", err)
+	}
+	if probeErr.ExitCode != 2 || probeErr.LastStatus != ssmtypes.CommandInvocationStatusFailed || probeErr.Output != "no response\nstarting" {
+		t.Errorf("got %+v, want the exit code, status and output of the probe", probeErr)
+	}
+	if n := len(fake.Commands(probeTarget)); n < 2 {
+		t.Errorf("the probe ran %d times, want it retried until the timeout", n)
+	}
+}
+
+func TestWaitForProbeAccessDenied(t *testing.T) {
+	client, fake := newProbeClient(t)
+	fake.DenyCommands(probeTarget)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	started := time.Now()
+	err := WaitForProbe(ctx, client, probeTarget, "true")
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("got %v, want access denied", err)
+	}
+	// Retrying can't help
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("gave up after %s, want right away", elapsed)
+	}
+}
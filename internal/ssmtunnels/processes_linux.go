@@ -0,0 +1,29 @@
+//go:build linux
+
+package ssmtunnels
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// processCommandLines returns the command lines of the running processes,
+// with the arguments joined by spaces.
+func processCommandLines() ([]string, error) {
+	paths, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []string
+	for _, path := range paths {
+		// Processes may exit in the meantime
+		data, err := os.ReadFile(path)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		commands = append(commands, strings.ReplaceAll(strings.TrimRight(string(data), "\x00"), "\x00", " "))
+	}
+	return commands, nil
+}
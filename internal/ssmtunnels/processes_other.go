@@ -0,0 +1,18 @@
+//go:build !linux && !windows
+
+package ssmtunnels
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// processCommandLines returns the command lines of the running processes,
+// with the arguments joined by spaces.
+func processCommandLines() ([]string, error) {
+	output, err := exec.Command("ps", "-axww", "-o", "command=").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSpace(string(output)), "\n"), nil
+}
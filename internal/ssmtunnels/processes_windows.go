@@ -0,0 +1,11 @@
+//go:build windows
+
+package ssmtunnels
+
+import "errors"
+
+// processCommandLines isn't implemented on Windows, where command lines of
+// other processes can't be read without WMI.
+func processCommandLines() ([]string, error) {
+	return nil, errors.New("finding the sessions of other processes is not supported on Windows")
+}
@@ -0,0 +1,92 @@
+package ssmtunnels
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/pac"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const proxyPACURLEnv = "AWSSSMTUNNELS_PROXY_PAC_URL"
+
+// ProxyConfig holds the proxy settings used for both the SSM API calls and the
+// session data channel. Empty fields fall back to the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables.
+type ProxyConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+
+	// PACURL points to a proxy auto-config file which, when set, decides the
+	// proxy for the session data channel
+	PACURL string
+}
+
+func (c ProxyConfig) resolve() *httpproxy.Config {
+	resolved := httpproxy.FromEnvironment()
+	if c.HTTPProxy != "" {
+		resolved.HTTPProxy = c.HTTPProxy
+	}
+	if c.HTTPSProxy != "" {
+		resolved.HTTPSProxy = c.HTTPSProxy
+	}
+	if c.NoProxy != "" {
+		resolved.NoProxy = c.NoProxy
+	}
+	return resolved
+}
+
+// ProxyFunc returns a function suitable for http.Transport.Proxy.
+func (c ProxyConfig) ProxyFunc() func(*http.Request) (*url.URL, error) {
+	proxyFunc := c.resolve().ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+// environ returns the proxy settings as environment variables for the plugin
+// process, whose websocket dialer and AWS SDK read them from the environment.
+func (c ProxyConfig) environ() []string {
+	resolved := c.resolve()
+	return []string{
+		"HTTP_PROXY=" + resolved.HTTPProxy,
+		"HTTPS_PROXY=" + resolved.HTTPSProxy,
+		"NO_PROXY=" + resolved.NoProxy,
+		"http_proxy=" + resolved.HTTPProxy,
+		"https_proxy=" + resolved.HTTPSProxy,
+		"no_proxy=" + resolved.NoProxy,
+		proxyPACURLEnv + "=" + c.PACURL,
+	}
+}
+
+// applyProxyFromEnvironment makes the websocket dialer of the plugin process
+// use the PAC file passed by the provider, if any.
+func applyProxyFromEnvironment() error {
+	pacURL := os.Getenv(proxyPACURLEnv)
+	if pacURL == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	script, err := pac.Load(ctx, http.DefaultClient, pacURL)
+	if err != nil {
+		return err
+	}
+
+	websocket.DefaultDialer.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := script.Proxy(req.URL)
+		if err != nil {
+			log.Printf("Error evaluating PAC file, falling back to the proxy environment variables: %v", err)
+			return http.ProxyFromEnvironment(req)
+		}
+		return proxyURL, nil
+	}
+	return nil
+}
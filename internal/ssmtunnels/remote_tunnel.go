@@ -4,13 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"net"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	pluginSession "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session"
-	_ "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session/portsession"
 )
 
 type RemoteTunnelConfig struct {
@@ -20,31 +18,52 @@ type RemoteTunnelConfig struct {
 	RemoteHost string
 	RemotePort int
 	LocalPort  int
+	Proxy      ProxyConfig
+	TLS        TLSConfig
+
+	// ReasonPrefix is prepended to the reason of the session, which shows up in the session history
+	ReasonPrefix string
+	// Runner identifies the machine or CI job starting the session in its reason, see sessionReason
+	Runner string
+
+	// MessagesEndpoint overrides the ssmmessages host of the data channel, see OverrideStreamURLHost
+	MessagesEndpoint string
+
+	// DocumentName is the session document, e.g. a PortForwardingDocument. Defaults to
+	// AWS-StartPortForwardingSessionToRemoteHost.
+	DocumentName string
 }
 
-func StartRemoteTunnel(ctx context.Context, cfg RemoteTunnelConfig) error {
+// StartRemoteTunnel starts an SSM port forwarding session and hands it over to
+// a session manager plugin process which listens on cfg.LocalPort.
+func StartRemoteTunnel(ctx context.Context, cfg RemoteTunnelConfig) (*Session, error) {
 	if cfg.Target == "" {
-		return fmt.Errorf("target must be set")
+		return nil, fmt.Errorf("target must be set")
 	}
 	if cfg.Region == "" {
-		return fmt.Errorf("region must be set")
+		return nil, fmt.Errorf("region must be set")
 	}
-	if cfg.RemoteHost == "" {
-		return fmt.Errorf("remoteHost must be set")
+	remoteHost, err := NormalizeHost(cfg.RemoteHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remoteHost: %w", err)
 	}
 	if cfg.RemotePort == 0 {
-		return fmt.Errorf("remotePort must be set")
+		return nil, fmt.Errorf("remotePort must be set")
 	}
 	if cfg.LocalPort == 0 {
-		return fmt.Errorf("localPort must be set")
+		return nil, fmt.Errorf("localPort must be set")
 	}
 
+	documentName := cfg.DocumentName
+	if documentName == "" {
+		documentName = portForwardingDocument
+	}
 	startSessionInput := ssm.StartSessionInput{
 		Target:       &cfg.Target,
-		DocumentName: aws.String("AWS-StartPortForwardingSessionToRemoteHost"),
+		DocumentName: aws.String(documentName),
 		Parameters: map[string][]string{
 			"host": {
-				cfg.RemoteHost,
+				remoteHost,
 			},
 			"portNumber": {
 				strconv.Itoa(cfg.RemotePort),
@@ -55,32 +74,107 @@ func StartRemoteTunnel(ctx context.Context, cfg RemoteTunnelConfig) error {
 		},
 	}
 
+	if cfg.ReasonPrefix != "" || cfg.Runner != "" {
+		startSessionInput.Reason = aws.String(sessionReason(cfg.ReasonPrefix, cfg.Runner, remoteHost, cfg.RemotePort))
+	}
+
 	startSessionOutput, err := cfg.Client.StartSession(ctx, &startSessionInput)
 	if err != nil {
-		return err
+		return nil, classifyAPIError(err)
+	}
+
+	// Fall back to the data channel of the target's partition when the service does not return one
+	if aws.ToString(startSessionOutput.StreamUrl) == "" {
+		startSessionOutput.StreamUrl = aws.String(StreamURL(cfg.Region, aws.ToString(startSessionOutput.SessionId)))
+	}
+	messagesEndpoint := cfg.MessagesEndpoint
+	if messagesEndpoint == "" && usesFIPSEndpoints(cfg.Client) {
+		// Not relying on the service to hand out a FIPS data channel endpoint
+		messagesEndpoint = SSMMessagesFIPSHost(cfg.Region)
+	}
+	if messagesEndpoint != "" {
+		streamURL, err := OverrideStreamURLHost(aws.ToString(startSessionOutput.StreamUrl), messagesEndpoint)
+		if err != nil {
+			_, _ = cfg.Client.TerminateSession(context.Background(), &ssm.TerminateSessionInput{
+				SessionId: startSessionOutput.SessionId,
+			})
+			return nil, err
+		}
+		startSessionOutput.StreamUrl = aws.String(streamURL)
 	}
 
 	startSessionOuputJson, err := json.Marshal(startSessionOutput)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// Encoded rather than formatted, so quotes or backslashes in the target can't break the JSON
+	parameters, err := json.Marshal(map[string]string{"Target": cfg.Target})
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Add a way to terminate the session
-	// cfg.Client.TerminateSession()
+	session := &Session{
+		Id:     aws.ToString(startSessionOutput.SessionId),
+		client: cfg.Client,
+	}
 
-	args := []string{
-		"session-manager-plugin",
-		string(startSessionOuputJson),
-		cfg.Region,
-		"StartSession",
-		"",
-		fmt.Sprintf("{\"Target\": \"%s\"}", cfg.Target),
-		fmt.Sprintf("https://ssm.%s.amazonaws.com", cfg.Region),
+	err = session.startPlugin(ctx, pluginInput{
+		StartSessionOutput: string(startSessionOuputJson),
+		Region:             cfg.Region,
+		Parameters:         string(parameters),
+		Endpoint:           pluginEndpoint(cfg.Client, cfg.Region),
+		Env:                append(cfg.Proxy.environ(), cfg.TLS.environ()...),
+	})
+	if err != nil {
+		// Don't leave the session dangling if we couldn't attach to it
+		_, _ = cfg.Client.TerminateSession(context.Background(), &ssm.TerminateSessionInput{
+			SessionId: aws.String(session.Id),
+		})
+		return nil, err
 	}
 
-	// TODO: Run this in a cancelable goroutine
+	return session, nil
+}
 
-	pluginSession.ValidateInputAndStartSession(args, os.Stdout)
+// pluginEndpoint is the SSM endpoint the plugin resumes and terminates the
+// session with. The plugin doesn't read AWS_ENDPOINT_URL_SSM and the like
+// itself, so it gets the endpoint of the client if that was overridden.
+func pluginEndpoint(client *ssm.Client, region string) string {
+	if endpoint := aws.ToString(client.Options().BaseEndpoint); endpoint != "" {
+		return endpoint
+	}
+	if usesFIPSEndpoints(client) {
+		return SSMFIPSEndpoint(region)
+	}
+	return SSMEndpoint(region)
+}
+
+// usesFIPSEndpoints reports whether the client calls the FIPS endpoints of SSM.
+func usesFIPSEndpoints(client *ssm.Client) bool {
+	return client.Options().EndpointOptions.UseFIPSEndpoint == aws.FIPSEndpointStateEnabled
+}
 
-	return nil
+// maxReasonLength is the longest reason StartSession accepts.
+const maxReasonLength = 256
+
+// sessionReason describes the session, e.g. "terraform: port forwarding to
+// db.internal:5432 from ci-runner-7". The prefix and the runner are optional.
+func sessionReason(prefix, runner string, remoteHost string, remotePort int) string {
+	reason := "port forwarding to " + net.JoinHostPort(remoteHost, strconv.Itoa(remotePort))
+	if prefix != "" {
+		reason = prefix + ": " + reason
+	}
+	if runner != "" {
+		reason += " from " + runner
+	}
+	return truncateReason(reason)
+}
+
+// truncateReason shortens the reason to what StartSession accepts.
+func truncateReason(s string) string {
+	reason := []rune(s)
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+	return string(reason)
 }
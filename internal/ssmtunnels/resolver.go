@@ -0,0 +1,130 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// nameserverTimeout bounds the lookups of a name on one nameserver, so a
+// nameserver which doesn't answer leaves time to fall back on the next.
+const nameserverTimeout = 5 * time.Second
+
+// Resolver resolves remote hosts on the machine running Terraform using
+// specific nameservers instead of the system resolver, e.g. a corporate DNS
+// server reachable through a VPN.
+type Resolver struct {
+	// Nameservers are queried in order, as host:port. The next one is only
+	// asked if a query failed, not if the name doesn't exist.
+	Nameservers []string
+	// SearchDomains are appended to names without a dot, like the search option of resolv.conf
+	SearchDomains []string
+
+	// resolvers query Nameservers, one each
+	resolvers []*net.Resolver
+}
+
+// NewResolver validates the nameservers and returns the resolver.
+func NewResolver(nameservers []string, searchDomains []string) (*Resolver, error) {
+	if len(nameservers) == 0 {
+		return nil, fmt.Errorf("at least one nameserver must be set")
+	}
+
+	addrs := make([]string, 0, len(nameservers))
+	for _, nameserver := range nameservers {
+		addr, err := nameserverAddr(nameserver)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	r := &Resolver{
+		Nameservers:   addrs,
+		SearchDomains: searchDomains,
+	}
+	// Dialing UDP never fails, so falling back on the next nameserver has to
+	// happen once a query failed, see lookup.
+	for _, addr := range addrs {
+		r.resolvers = append(r.resolvers, &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		})
+	}
+	return r, nil
+}
+
+// lookup asks the nameservers for the addresses of name in order, until one
+// answers. A nameserver answering that the name doesn't exist is final.
+func (r *Resolver) lookup(ctx context.Context, name string) ([]net.IPAddr, error) {
+	var lastErr error
+	for i, resolver := range r.resolvers {
+		lookupCtx, cancel := context.WithTimeout(ctx, nameserverTimeout)
+		addrs, err := resolver.LookupIPAddr(lookupCtx, name)
+		cancel()
+		if err == nil {
+			return addrs, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound || ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = fmt.Errorf("nameserver %s: %w", r.Nameservers[i], err)
+	}
+	return nil, lastErr
+}
+
+func nameserverAddr(nameserver string) (string, error) {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver, nil
+	}
+	host, err := NormalizeHost(nameserver)
+	if err != nil {
+		return "", fmt.Errorf("invalid nameserver %q: %w", nameserver, err)
+	}
+	return net.JoinHostPort(host, "53"), nil
+}
+
+// Resolve returns an IP address of the host. IP addresses are returned as is,
+// names without a dot are tried with every search domain first.
+func (r *Resolver) Resolve(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	var candidates []string
+	if !strings.Contains(strings.TrimSuffix(host, "."), ".") {
+		for _, domain := range r.SearchDomains {
+			candidates = append(candidates, host+"."+strings.Trim(domain, "."))
+		}
+	}
+	candidates = append(candidates, host)
+
+	var lastErr error
+	for _, name := range candidates {
+		addrs, err := r.lookup(ctx, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// Prefer IPv4, the target is more likely to reach it
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return addr.IP.String(), nil
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs[0].IP.String(), nil
+		}
+	}
+	if lastErr == nil {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+	return "", fmt.Errorf("failed to resolve %s: %w", host, lastErr)
+}
@@ -0,0 +1,128 @@
+package ssmtunnels
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsServer answers A queries for the names in records over UDP, and that
+// every other name doesn't exist.
+func dnsServer(t *testing.T, records map[string]string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := dnsReply(buf[:n], records); reply != nil {
+				_, _ = conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dnsReply answers a query with a single question.
+func dnsReply(query []byte, records map[string]string) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	var labels []string
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		length := int(query[end])
+		if end+1+length > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+length]))
+		end += 1 + length
+	}
+	end += 5 // the terminating zero, type and class
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	reply := append([]byte(nil), query[:end]...)
+	reply[2], reply[3] = 0x81, 0x80 // a response, recursion desired and available
+	binary.BigEndian.PutUint16(reply[6:], 0)
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	ip, ok := records[strings.ToLower(strings.Join(labels, "."))]
+	if !ok {
+		reply[3] |= 3 // NXDOMAIN
+		return reply
+	}
+	if qtype != 1 {
+		return reply
+	}
+	binary.BigEndian.PutUint16(reply[6:], 1)
+	reply = append(reply, 0xc0, 12) // the name of the question
+	reply = binary.BigEndian.AppendUint16(reply, 1)
+	reply = binary.BigEndian.AppendUint16(reply, 1)
+	reply = binary.BigEndian.AppendUint32(reply, 60)
+	reply = binary.BigEndian.AppendUint16(reply, 4)
+	return append(reply, net.ParseIP(ip).To4()...)
+}
+
+// deadNameserver returns an address nothing listens on.
+func deadNameserver(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestResolver(t *testing.T) {
+	corporate := dnsServer(t, map[string]string{
+		"db.corp.example": "10.0.0.5",
+	})
+	empty := dnsServer(t, map[string]string{})
+
+	for name, tt := range map[string]struct {
+		nameservers   []string
+		searchDomains []string
+		host          string
+		want          string
+		wantErr       bool
+	}{
+		"name":                 {nameservers: []string{corporate}, host: "db.corp.example", want: "10.0.0.5"},
+		"ip":                   {nameservers: []string{corporate}, host: "10.1.2.3", want: "10.1.2.3"},
+		"search domain":        {nameservers: []string{corporate}, searchDomains: []string{"corp.example"}, host: "db", want: "10.0.0.5"},
+		"dead first":           {nameservers: []string{deadNameserver(t), corporate}, host: "db.corp.example", want: "10.0.0.5"},
+		"all dead":             {nameservers: []string{deadNameserver(t), deadNameserver(t)}, host: "db.corp.example", wantErr: true},
+		"not found is final":   {nameservers: []string{empty, corporate}, host: "db.corp.example", wantErr: true},
+		"not found everywhere": {nameservers: []string{corporate}, host: "cache.corp.example", wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resolver, err := NewResolver(tt.nameservers, tt.searchDomains)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			got, err := resolver.Resolve(ctx, tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package ssmtunnels
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+const (
+	// rewriteFlushDelay is how long data held back for a match continuing in
+	// the next read waits for it, before it is forwarded as it is.
+	rewriteFlushDelay = 50 * time.Millisecond
+	// rewriteLineLimit bounds the data regular expression rules hold back for
+	// the end of its line.
+	rewriteLineLimit = 64 * 1024
+)
+
+type RewriteDirection string
+
+const (
+	// RewriteRequest applies to data sent from the local client to the remote host
+	RewriteRequest RewriteDirection = "request"
+	// RewriteResponse applies to data sent from the remote host to the local client
+	RewriteResponse RewriteDirection = "response"
+)
+
+// RewriteRule replaces text in the data forwarded through a tunnel. A match
+// split across two reads is still rewritten: the end of the data which may be
+// the start of a match, and for regular expressions the last incomplete line,
+// is held back until the next read, see copyRewriting. Regular expressions
+// therefore only match within a line. Nothing is parsed, so replacing text
+// with text of another length in an HTTP body breaks its Content-Length; the
+// rules are meant for headers and line based text protocols, not for binary
+// protocols.
+type RewriteRule struct {
+	Direction RewriteDirection
+	Match     string
+	Replace   string
+	// Regex makes Match a regular expression and allows $1 style references in Replace
+	Regex bool
+
+	re *regexp.Regexp
+}
+
+// Compile validates the rule. It must be called before the rule is used.
+func (r *RewriteRule) Compile() error {
+	if r.Direction != RewriteRequest && r.Direction != RewriteResponse {
+		return fmt.Errorf("direction must be %q or %q", RewriteRequest, RewriteResponse)
+	}
+	if r.Match == "" {
+		return fmt.Errorf("match must be set")
+	}
+	if r.Regex {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	}
+	return nil
+}
+
+func (r *RewriteRule) apply(data []byte) []byte {
+	if r.re != nil {
+		return r.re.ReplaceAll(data, []byte(r.Replace))
+	}
+	return bytes.ReplaceAll(data, []byte(r.Match), []byte(r.Replace))
+}
+
+func rewritesFor(rules []RewriteRule, direction RewriteDirection) []*RewriteRule {
+	var matching []*RewriteRule
+	for i := range rules {
+		if rules[i].Direction == direction {
+			matching = append(matching, &rules[i])
+		}
+	}
+	return matching
+}
+
+// holdBack returns how many bytes at the end of data a match of the rules may
+// continue from in the next read: the longest end which is the start of the
+// text of a literal rule, or the last incomplete line for regular expressions.
+func holdBack(data []byte, rules []*RewriteRule) int {
+	hold := 0
+	for _, rule := range rules {
+		if rule.re != nil {
+			if line := len(data) - (bytes.LastIndexByte(data, '\n') + 1); line <= rewriteLineLimit {
+				hold = max(hold, line)
+			}
+			continue
+		}
+		for n := min(len(data), len(rule.Match)-1); n > hold; n-- {
+			if string(data[len(data)-n:]) == rule.Match[:n] {
+				hold = n
+				break
+			}
+		}
+	}
+	return hold
+}
+
+// copyRewriting copies src to dst like io.Copy, applying the rules. Data
+// which a match may continue from in the next read is held back for it, see
+// holdBack, and forwarded as it is if nothing arrives within
+// rewriteFlushDelay, so protocols waiting for the other side don't stall.
+func copyRewriting(dst io.Writer, src io.Reader, rules []*RewriteRule) (int64, error) {
+	if len(rules) == 0 {
+		return io.Copy(dst, src)
+	}
+
+	// Reads happen in the background so held back data can be flushed while waiting for the next one
+	reads := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				select {
+				case reads <- buf[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var written int64
+	write := func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		for _, rule := range rules {
+			data = rule.apply(data)
+		}
+		n, err := dst.Write(data)
+		written += int64(n)
+		return err
+	}
+
+	var pending []byte
+	var flush <-chan time.Time
+	for {
+		select {
+		case data := <-reads:
+			pending = append(pending, data...)
+			complete := len(pending) - holdBack(pending, rules)
+			if err := write(pending[:complete]); err != nil {
+				return written, err
+			}
+			pending = append([]byte(nil), pending[complete:]...)
+			flush = nil
+			if len(pending) > 0 {
+				flush = time.After(rewriteFlushDelay)
+			}
+		case <-flush:
+			if err := write(pending); err != nil {
+				return written, err
+			}
+			pending, flush = nil, nil
+		case err := <-readErr:
+			// Everything read was received before the error
+			if werr := write(pending); werr != nil {
+				return written, werr
+			}
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+	}
+}
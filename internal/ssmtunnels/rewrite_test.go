@@ -0,0 +1,137 @@
+package ssmtunnels
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// chunkReader returns one chunk per read, like a connection the data arrives on in pieces.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestCopyRewriting(t *testing.T) {
+	location := RewriteRule{Direction: RewriteResponse, Match: "http://10.0.0.5:8080", Replace: "http://127.0.0.1:16000"}
+	header := RewriteRule{Direction: RewriteResponse, Match: `(?m)^Server: [^\r\n]*`, Replace: "Server: tunnel", Regex: true}
+	empty := RewriteRule{Direction: RewriteResponse, Match: `x*`, Replace: "-", Regex: true}
+
+	for name, tt := range map[string]struct {
+		rules  []RewriteRule
+		chunks []string
+		want   string
+	}{
+		"no rules": {
+			chunks: []string{"Location: http://10.0", ".0.5:8080/\r\n"},
+			want:   "Location: http://10.0.0.5:8080/\r\n",
+		},
+		"one read": {
+			rules:  []RewriteRule{location},
+			chunks: []string{"Location: http://10.0.0.5:8080/login\r\n"},
+			want:   "Location: http://127.0.0.1:16000/login\r\n",
+		},
+		"split match": {
+			rules:  []RewriteRule{location},
+			chunks: []string{"Location: http://10.0", ".0.5:8080/login\r\n"},
+			want:   "Location: http://127.0.0.1:16000/login\r\n",
+		},
+		"split in three": {
+			rules:  []RewriteRule{location},
+			chunks: []string{"a http://1", "0.0.0.5:80", "80 b http://10.0.0.5:8080"},
+			want:   "a http://127.0.0.1:16000 b http://127.0.0.1:16000",
+		},
+		"incomplete match at the end": {
+			rules:  []RewriteRule{location},
+			chunks: []string{"Location: http://10.0", ".0.6"},
+			want:   "Location: http://10.0.0.6",
+		},
+		"regex split line": {
+			rules:  []RewriteRule{header},
+			chunks: []string{"HTTP/1.1 200 OK\r\nServer: ng", "inx/1.25\r\nContent-Length: 0\r\n\r\n"},
+			want:   "HTTP/1.1 200 OK\r\nServer: tunnel\r\nContent-Length: 0\r\n\r\n",
+		},
+		"regex line at the end": {
+			rules:  []RewriteRule{header},
+			chunks: []string{"Server: ", "nginx"},
+			want:   "Server: tunnel",
+		},
+		"both": {
+			rules:  []RewriteRule{location, header},
+			chunks: []string{"Server: nginx\r\nLocation: http://10.0.0.5", ":8080/\r\n"},
+			want:   "Server: tunnel\r\nLocation: http://127.0.0.1:16000/\r\n",
+		},
+		"empty match": {
+			rules:  []RewriteRule{empty},
+			chunks: []string{"ab\n"},
+			want:   "-a-b-\n-",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var rules []*RewriteRule
+			for i := range tt.rules {
+				if err := tt.rules[i].Compile(); err != nil {
+					t.Fatal(err)
+				}
+				rules = append(rules, &tt.rules[i])
+			}
+			var dst bytes.Buffer
+			n, err := copyRewriting(&dst, &chunkReader{chunks: append([]string(nil), tt.chunks...)}, rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dst.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if n != int64(dst.Len()) {
+				t.Errorf("got %d bytes written, want %d", n, dst.Len())
+			}
+		})
+	}
+}
+
+// TestCopyRewritingFlushes checks that data held back for a match is
+// forwarded while the source waits, e.g. for a reply to it.
+func TestCopyRewritingFlushes(t *testing.T) {
+	rule := RewriteRule{Direction: RewriteResponse, Match: "http://10.0.0.5:8080", Replace: "http://127.0.0.1:16000"}
+	if err := rule.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	src, srcWriter := io.Pipe()
+	dst, dstWriter := io.Pipe()
+	go func() {
+		_, err := copyRewriting(dstWriter, src, []*RewriteRule{&rule})
+		dstWriter.CloseWithError(err)
+	}()
+	defer srcWriter.Close()
+
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := io.ReadAtLeast(dst, buf, len("prompt http://"))
+		got <- string(buf[:n])
+	}()
+	if _, err := io.WriteString(srcWriter, "prompt http://"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-got:
+		if data != "prompt http://" {
+			t.Errorf("got %q, want the data as it is", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("data held back for a match wasn't forwarded while the source waits")
+	}
+}
@@ -0,0 +1,226 @@
+package ssmtunnels
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	pluginSession "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session"
+	_ "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session/portsession"
+)
+
+// The session manager plugin calls os.Exit whenever a session ends and keeps
+// its state in package level variables, so every session runs in its own
+// process. That process is the provider binary itself, started with
+// PluginCommand as its first argument.
+const (
+	PluginCommand = "session-manager-plugin"
+
+	startSessionResponseEnv = "AWS_SSM_START_SESSION_RESPONSE"
+
+	// portOpenedMessage ends the line the plugin prints once the data channel
+	// completed its handshake with the SSM agent and the plugin listens on its
+	// local port, e.g. "Port 16001 opened for sessionId ...".
+	portOpenedMessage = "opened for sessionId"
+)
+
+// IsPluginProcess reports whether the current process was started to run a session.
+func IsPluginProcess() bool {
+	return len(os.Args) > 1 && os.Args[1] == PluginCommand
+}
+
+// RunPlugin runs the session manager plugin with the process arguments. It
+// only returns if the plugin fails to start or loses the session.
+func RunPlugin() {
+	if err := applyTLSFromEnvironment(); err != nil {
+		log.Printf("Error configuring TLS: %v", err)
+		return
+	}
+	if err := applyProxyFromEnvironment(); err != nil {
+		log.Printf("Error configuring proxy: %v", err)
+		return
+	}
+
+	// Don't keep the listener open if the provider went away without closing
+	// the session. Stdin is a pipe from the provider, see startPlugin.
+	go WatchStdin(os.Stdin, func() {
+		log.Printf("Provider process exited, closing session")
+		os.Exit(0)
+	})
+
+	pluginSession.ValidateInputAndStartSession(os.Args[1:], os.Stdout)
+}
+
+type pluginInput struct {
+	StartSessionOutput string
+	Region             string
+	Parameters         string
+	Endpoint           string
+	Env                []string
+}
+
+// Session is a running SSM session and the plugin process attached to it.
+type Session struct {
+	Id string
+
+	client *ssm.Client
+	cmd    *exec.Cmd
+	done   chan struct{}
+	err    error
+	ready  chan struct{}
+
+	closeOnce sync.Once
+	readyOnce sync.Once
+}
+
+func (s *Session) startPlugin(ctx context.Context, input pluginInput) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Fail early if there are no usable credentials, the plugin would only log it
+	if _, err := s.client.Options().Credentials.Retrieve(ctx); err != nil {
+		return err
+	}
+	credentials, err := startCredentialsServer(s.client.Options().Credentials)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable,
+		PluginCommand,
+		startSessionResponseEnv,
+		input.Region,
+		"StartSession",
+		"",
+		input.Parameters,
+		input.Endpoint,
+	)
+	// The plugin calls ResumeSession/TerminateSession itself, so it needs the same credentials as we do
+	cmd.Env = append(os.Environ(), startSessionResponseEnv+"="+input.StartSessionOutput)
+	cmd.Env = append(cmd.Env, credentials.environ()...)
+	cmd.Env = append(cmd.Env, input.Env...)
+
+	// Nothing is written to stdin, the plugin exits once it reaches EOF as
+	// the provider is gone, see RunPlugin. cmd closes it after Wait.
+	if _, err := cmd.StdinPipe(); err != nil {
+		credentials.Close()
+		return err
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		credentials.Close()
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := cmd.Start(); err != nil {
+		credentials.Close()
+		return err
+	}
+
+	s.cmd = cmd
+	s.done = make(chan struct{})
+	s.ready = make(chan struct{})
+	go s.logOutput(output)
+	go func() {
+		s.err = cmd.Wait()
+		credentials.Close()
+		close(s.done)
+	}()
+
+	return nil
+}
+
+func (s *Session) logOutput(output io.Reader) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		log.Printf("[session %s] %s", s.Id, line)
+		if strings.Contains(line, portOpenedMessage) {
+			s.readyOnce.Do(func() { close(s.ready) })
+		}
+	}
+}
+
+// Done is closed once the plugin process has exited.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Ready is closed once the data channel of the session is open and the
+// plugin listens on its local port, so connections reach the SSM agent.
+func (s *Session) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Err returns why the plugin process exited. Only valid after Done is closed.
+func (s *Session) Err() error {
+	if s.err != nil {
+		return fmt.Errorf("session %s ended: %w", s.Id, s.err)
+	}
+	return fmt.Errorf("session %s ended", s.Id)
+}
+
+// Close terminates the SSM session and stops the plugin process.
+func (s *Session) Close(ctx context.Context) error {
+	return CloseSessions(ctx, []*Session{s})
+}
+
+// CloseSessions terminates the SSM sessions in batches and stops their plugin
+// processes. See TerminateSessions for how failures are reported.
+func CloseSessions(ctx context.Context, sessions []*Session) error {
+	// Sessions of different regions or roles have to be terminated with their own client
+	var clients []*ssm.Client
+	sessionIds := map[*ssm.Client][]string{}
+	var pending []*Session
+	for _, s := range sessions {
+		s.closeOnce.Do(func() {
+			if _, ok := sessionIds[s.client]; !ok {
+				clients = append(clients, s.client)
+			}
+			sessionIds[s.client] = append(sessionIds[s.client], s.Id)
+			pending = append(pending, s)
+		})
+	}
+
+	var unterminated []string
+	var errs []error
+	for _, client := range clients {
+		err := TerminateSessions(ctx, client, sessionIds[client])
+		var unterminatedErr *UnterminatedSessionsError
+		if errors.As(err, &unterminatedErr) {
+			unterminated = append(unterminated, unterminatedErr.SessionIds...)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, s := range pending {
+		s.stopPlugin()
+	}
+
+	if len(unterminated) > 0 {
+		errs = append(errs, &UnterminatedSessionsError{SessionIds: unterminated})
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Session) stopPlugin() {
+	if s.cmd != nil && s.cmd.Process != nil {
+		_ = s.cmd.Process.Kill()
+		<-s.done
+	}
+}
@@ -0,0 +1,65 @@
+package ssmtunnels
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const (
+	targetOnlinePollInterval = 5 * time.Second
+	targetOnlineWaitTimeout  = 10 * time.Minute
+)
+
+// WaitForTargetOnline polls the ping status of the target until its SSM agent
+// reports Online, e.g. of an instance created in the same apply which is still
+// booting, and gives up after ten minutes. Targets which aren't managed nodes,
+// such as ECS tasks, have no ping status and aren't waited for.
+func WaitForTargetOnline(ctx context.Context, client *ssm.Client, target string) error {
+	if !strings.HasPrefix(target, "i-") && !strings.HasPrefix(target, "mi-") {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, targetOnlineWaitTimeout)
+	defer cancel()
+
+	for {
+		status, err := targetPingStatus(ctx, client, target)
+		if err != nil {
+			return err
+		}
+		if status == ssmtypes.PingStatusOnline {
+			return nil
+		}
+
+		log.Printf("Waiting for %s to come online in Systems Manager, its ping status is %s", target, status)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: timed out waiting for %s to come online, its ping status is %s", ErrTargetOffline, target, status)
+		case <-time.After(targetOnlinePollInterval):
+		}
+	}
+}
+
+// targetPingStatus returns the ping status of the target, "not registered"
+// while Systems Manager doesn't know it yet.
+func targetPingStatus(ctx context.Context, client *ssm.Client, target string) (ssmtypes.PingStatus, error) {
+	output, err := client.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+		Filters: []ssmtypes.InstanceInformationStringFilter{
+			{Key: aws.String("InstanceIds"), Values: []string{target}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("ssm:DescribeInstanceInformation of %s failed: %w", target, classifyAPIError(err))
+	}
+	if len(output.InstanceInformationList) == 0 {
+		return "not registered", nil
+	}
+	return output.InstanceInformationList[0].PingStatus, nil
+}
@@ -0,0 +1,135 @@
+package ssmtunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	terminateBatchSize   = 5
+	terminateMaxAttempts = 8
+	terminateBaseDelay   = 500 * time.Millisecond
+	terminateMaxDelay    = 10 * time.Second
+)
+
+// UnterminatedSessionsError lists sessions that could not be terminated and
+// have to be cleaned up manually.
+type UnterminatedSessionsError struct {
+	SessionIds []string
+}
+
+func (e *UnterminatedSessionsError) Error() string {
+	return fmt.Sprintf("failed to terminate SSM sessions, terminate them manually: %s", strings.Join(e.SessionIds, ", "))
+}
+
+// TerminateSessions terminates the sessions in batches, retrying throttled
+// calls with exponential backoff, and verifies that every session is no
+// longer active. Sessions that are still active at the end are returned in an
+// *UnterminatedSessionsError.
+func TerminateSessions(ctx context.Context, client *ssm.Client, sessionIds []string) error {
+	var mu sync.Mutex
+	var failed []string
+
+	for start := 0; start < len(sessionIds); start += terminateBatchSize {
+		end := min(start+terminateBatchSize, len(sessionIds))
+
+		var wg sync.WaitGroup
+		for _, id := range sessionIds[start:end] {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if err := terminateSession(ctx, client, id); err != nil {
+					log.Printf("Error terminating session %s: %v", id, err)
+					mu.Lock()
+					failed = append(failed, id)
+					mu.Unlock()
+				}
+			}(id)
+		}
+		wg.Wait()
+	}
+
+	if len(failed) > 0 {
+		return &UnterminatedSessionsError{SessionIds: failed}
+	}
+	return nil
+}
+
+func terminateSession(ctx context.Context, client *ssm.Client, id string) error {
+	delay := terminateBaseDelay
+	var err error
+	for attempt := 0; attempt < terminateMaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, terminateMaxDelay)
+		}
+
+		_, err = client.TerminateSession(ctx, &ssm.TerminateSessionInput{
+			SessionId: aws.String(id),
+		})
+		if err != nil {
+			if isThrottlingError(err) {
+				continue
+			}
+			return err
+		}
+
+		var active bool
+		active, err = isSessionActive(ctx, client, id)
+		if err == nil && !active {
+			return nil
+		}
+		if err == nil {
+			err = errors.New("session is still active")
+		}
+	}
+	return err
+}
+
+func isSessionActive(ctx context.Context, client *ssm.Client, id string) (bool, error) {
+	output, err := client.DescribeSessions(ctx, &ssm.DescribeSessionsInput{
+		State: ssmtypes.SessionStateActive,
+		Filters: []ssmtypes.SessionFilter{
+			{
+				Key:   ssmtypes.SessionFilterKeySessionId,
+				Value: aws.String(id),
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, session := range output.Sessions {
+		if aws.ToString(session.SessionId) == id && session.Status != ssmtypes.SessionStatusTerminated {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ThrottlingException", "TooManyRequestsException", "RequestLimitExceeded", "Throttling":
+		return true
+	}
+	return false
+}
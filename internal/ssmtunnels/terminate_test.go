@@ -0,0 +1,117 @@
+package ssmtunnels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// mockSSMServer implements the SSM API calls used to terminate sessions. The
+// first TerminateSession call of every throttleEvery-th session is throttled.
+type mockSSMServer struct {
+	throttleEvery int
+
+	mu         sync.Mutex
+	throttled  map[string]bool
+	terminated map[string]int
+}
+
+func (m *mockSSMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SessionId string
+		Filters   []struct{ Key, Value string }
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.") {
+	case "TerminateSession":
+		var n int
+		_, _ = fmt.Sscanf(input.SessionId, "session-%d", &n)
+		if m.throttleEvery > 0 && n%m.throttleEvery == 0 && !m.throttled[input.SessionId] {
+			m.throttled[input.SessionId] = true
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"ThrottlingException","message":"Rate exceeded"}`))
+			return
+		}
+		m.terminated[input.SessionId]++
+		_, _ = fmt.Fprintf(w, `{"SessionId":%q}`, input.SessionId)
+	case "DescribeSessions":
+		// Terminated sessions are never active
+		_, _ = w.Write([]byte(`{"Sessions":[]}`))
+	default:
+		http.Error(w, "unexpected operation "+r.Header.Get("X-Amz-Target"), http.StatusBadRequest)
+	}
+}
+
+func newMockSSMClient(t *testing.T, handler http.Handler) *ssm.Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return ssm.NewFromConfig(aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		// Throttling is retried by TerminateSessions itself
+		Retryer: func() aws.Retryer { return aws.NopRetryer{} },
+	}, func(o *ssm.Options) {
+		o.BaseEndpoint = aws.String(server.URL)
+	})
+}
+
+func TestCloseSessionsParallel(t *testing.T) {
+	mock := &mockSSMServer{
+		throttleEvery: 25,
+		throttled:     map[string]bool{},
+		terminated:    map[string]int{},
+	}
+	client := newMockSSMClient(t, mock)
+
+	sessions := make([]*Session, 100)
+	for i := range sessions {
+		sessions[i] = &Session{Id: fmt.Sprintf("session-%d", i), client: client}
+	}
+
+	// Every session is closed on its own, e.g. by a connectivity check, while
+	// the provider closes all of them at once
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			if err := s.Close(context.Background()); err != nil {
+				t.Errorf("closing %s: %v", s.Id, err)
+			}
+		}(s)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := CloseSessions(context.Background(), sessions); err != nil {
+			t.Errorf("closing all sessions: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	for _, s := range sessions {
+		if n := mock.terminated[s.Id]; n != 1 {
+			t.Errorf("%s was terminated %d times, want 1", s.Id, n)
+		}
+	}
+}
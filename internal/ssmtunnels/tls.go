@@ -0,0 +1,83 @@
+package ssmtunnels
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	caBundleEnv = "AWSSSMTUNNELS_CA_BUNDLE"
+	insecureEnv = "AWSSSMTUNNELS_INSECURE"
+)
+
+// TLSConfig controls how TLS connections to AWS are verified, for both the
+// SSM API calls and the session data channel.
+type TLSConfig struct {
+	// CABundle is the path to a PEM file with additional trusted certificates
+	CABundle string
+	// Insecure disables certificate verification entirely
+	Insecure bool
+}
+
+// ClientConfig returns the *tls.Config to use, or nil when the defaults apply.
+func (c TLSConfig) ClientConfig() (*tls.Config, error) {
+	if c.CABundle == "" && !c.Insecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.Insecure, //nolint:gosec // Explicitly requested by the user
+	}
+
+	if c.CABundle != "" {
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// environ passes the settings on to the plugin process.
+func (c TLSConfig) environ() []string {
+	return []string{
+		caBundleEnv + "=" + c.CABundle,
+		insecureEnv + "=" + strconv.FormatBool(c.Insecure),
+	}
+}
+
+// applyTLSFromEnvironment configures the websocket dialer and the default HTTP
+// transport used by the plugin with the settings passed by the provider.
+func applyTLSFromEnvironment() error {
+	insecure, _ := strconv.ParseBool(os.Getenv(insecureEnv))
+	tlsConfig, err := TLSConfig{
+		CABundle: os.Getenv(caBundleEnv),
+		Insecure: insecure,
+	}.ClientConfig()
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+
+	websocket.DefaultDialer.TLSClientConfig = tlsConfig
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package ssmtunnels
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	tlsHandshakeRetryInterval = 2 * time.Second
+	tlsHandshakeCheckTimeout  = 5 * time.Second
+)
+
+// TLSHandshakeConfig describes the TLS handshake check of a tunnel.
+type TLSHandshakeConfig struct {
+	// Addr is the local address of the tunnel
+	Addr string
+	// ServerName is sent with SNI, usually the remote host of the tunnel
+	ServerName string
+	// VerifyName requires the certificate to be valid for ServerName, by its
+	// subject alternative names or common name. The chain isn't verified.
+	VerifyName bool
+}
+
+// TLSCheckFailedError is returned by WaitForTLSHandshake when no handshake
+// succeeded before the context was done.
+type TLSCheckFailedError struct {
+	Addr       string
+	ServerName string
+	Err        error
+}
+
+func (e *TLSCheckFailedError) Error() string {
+	return fmt.Sprintf("TLS handshake with %s through %s did not succeed: %v", e.ServerName, e.Addr, e.Err)
+}
+
+func (e *TLSCheckFailedError) Unwrap() error {
+	return e.Err
+}
+
+// WaitForTLSHandshake completes TLS handshakes through the tunnel until one
+// succeeds, retrying every few seconds until the context is done, e.g. while
+// a load balancer or OpenSearch domain is still provisioning its certificate.
+func WaitForTLSHandshake(ctx context.Context, cfg TLSHandshakeConfig) error {
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, tlsHandshakeCheckTimeout)
+		err := tlsHandshake(checkCtx, cfg)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		lastErr := &TLSCheckFailedError{Addr: cfg.Addr, ServerName: cfg.ServerName, Err: err}
+
+		log.Printf("TLS handshake check through %s not successful yet: %v", cfg.Addr, lastErr)
+		select {
+		case <-ctx.Done():
+			return lastErr
+		case <-time.After(tlsHandshakeRetryInterval):
+		}
+	}
+}
+
+// tlsHandshake completes one handshake and checks the name of the certificate.
+func tlsHandshake(ctx context.Context, cfg TLSHandshakeConfig) error {
+	dialer := tls.Dialer{Config: &tls.Config{
+		ServerName: cfg.ServerName,
+		// Only the handshake and optionally the name are checked, not the chain
+		InsecureSkipVerify: true,
+	}}
+	conn, err := dialer.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !cfg.VerifyName {
+		return nil
+	}
+
+	certificates := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return fmt.Errorf("the server sent no certificate")
+	}
+	leaf := certificates[0]
+	err = leaf.VerifyHostname(cfg.ServerName)
+	// VerifyHostname ignores the common name, which older certificates rely on
+	if err != nil && len(leaf.DNSNames) == 0 && strings.EqualFold(leaf.Subject.CommonName, cfg.ServerName) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package ssmtunnels
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	vpcEndpointPollInterval = 10 * time.Second
+	vpcEndpointWaitTimeout  = 10 * time.Minute
+)
+
+// WaitForVPCEndpoints polls the VPC endpoints until all of them are available.
+// It fails early if an endpoint ends up in a state it can not recover from,
+// and gives up after ten minutes.
+func WaitForVPCEndpoints(ctx context.Context, client *ec2.Client, endpointIds []string) error {
+	if len(endpointIds) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, vpcEndpointWaitTimeout)
+	defer cancel()
+
+	for {
+		pending, err := pendingVPCEndpoints(ctx, client, endpointIds)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		log.Printf("Waiting for VPC endpoints to become available: %s", strings.Join(pending, ", "))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for VPC endpoints to become available: %s", strings.Join(pending, ", "))
+		case <-time.After(vpcEndpointPollInterval):
+		}
+	}
+}
+
+// pendingVPCEndpoints returns the endpoints which are not available yet.
+func pendingVPCEndpoints(ctx context.Context, client *ec2.Client, endpointIds []string) ([]string, error) {
+	output, err := client.DescribeVpcEndpoints(ctx, &ec2.DescribeVpcEndpointsInput{
+		VpcEndpointIds: endpointIds,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe VPC endpoints: %w", classifyAPIError(err))
+	}
+
+	states := map[string]ec2types.State{}
+	for _, endpoint := range output.VpcEndpoints {
+		states[*endpoint.VpcEndpointId] = endpoint.State
+	}
+
+	var pending []string
+	for _, id := range endpointIds {
+		state, ok := states[id]
+		if !ok {
+			// Freshly created endpoints may not be visible yet
+			pending = append(pending, id)
+			continue
+		}
+
+		switch strings.ToLower(string(state)) {
+		case "available":
+		case "failed", "rejected", "deleting", "deleted", "expired":
+			return nil, fmt.Errorf("VPC endpoint %s is %s", id, state)
+		default:
+			pending = append(pending, id)
+		}
+	}
+	return pending, nil
+}
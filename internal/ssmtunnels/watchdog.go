@@ -0,0 +1,23 @@
+package ssmtunnels
+
+import (
+	"io"
+	"time"
+)
+
+// WatchParent blocks until the parent process is gone and then calls onExit.
+// It lets a process clean up after Terraform (or the provider, for plugin
+// processes) was killed without shutting it down. How the parent is watched
+// depends on the platform, see waitForParent.
+func WatchParent(interval time.Duration, onExit func()) {
+	waitForParent(interval)
+	onExit()
+}
+
+// WatchStdin blocks until stdin reaches EOF and then calls onExit. The parent
+// holds the write end of stdin without writing to it, so EOF means it closed
+// the pipe or exited, on every platform and however it was killed.
+func WatchStdin(stdin io.Reader, onExit func()) {
+	_, _ = io.Copy(io.Discard, stdin)
+	onExit()
+}
@@ -0,0 +1,74 @@
+package ssmtunnels
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestWatchStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	exited := make(chan struct{})
+	go WatchStdin(r, func() { close(exited) })
+
+	// Writes of the parent, if any, don't count as it exiting
+	if _, err := w.Write([]byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+		t.Fatal("onExit called while the pipe is open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	w.Close()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onExit not called after the pipe was closed")
+	}
+}
+
+// TestWatchStdinProcess runs the test binary as a child which watches its
+// stdin like the plugin processes, and checks that it exits once the pipe
+// of its parent is closed.
+func TestWatchStdinProcess(t *testing.T) {
+	if os.Getenv("WATCH_STDIN_CHILD") != "" {
+		WatchStdin(os.Stdin, func() { os.Exit(0) })
+		os.Exit(2)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWatchStdinProcess$")
+	cmd.Env = append(os.Environ(), "WATCH_STDIN_CHILD=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("child exited while its stdin is open: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	stdin.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("child exited with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("child didn't exit after its stdin was closed")
+	}
+}
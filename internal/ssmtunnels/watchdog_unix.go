@@ -0,0 +1,17 @@
+//go:build !windows
+
+package ssmtunnels
+
+import (
+	"os"
+	"time"
+)
+
+// waitForParent polls the parent process ID, which changes once the parent
+// is gone and the process was re-parented.
+func waitForParent(interval time.Duration) {
+	parent := os.Getppid()
+	for os.Getppid() == parent {
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package ssmtunnels
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// waitForParent waits on a handle of the parent process. Processes aren't
+// re-parented on Windows, os.Getppid keeps returning the ID of the exited
+// parent.
+func waitForParent(interval time.Duration) {
+	parent, err := os.FindProcess(os.Getppid())
+	if err != nil {
+		// The parent is already gone
+		return
+	}
+	if _, err := parent.Wait(); err != nil {
+		// Without a handle to wait on the parent can't be watched, never report it gone
+		log.Printf("Not watching the parent process: %v", err)
+		select {}
+	}
+}
@@ -7,13 +7,21 @@ import (
 	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/provider"
-	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/complyco/terraform-provider-aws-ssm-tunnels/internal/ssmtunnels"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6/tf6server"
 )
 
 // Run "go generate" to format example terraform files and generate the docs for the registry/website
 
+// The complete example is generated from the schema, see internal/examplegen.
+//go:generate go run ./internal/examplegen -out examples/complete/main.tf
+
 // If you do not have terraform installed, you can remove the formatting command, but its suggested to
 // ensure the documentation is formatted properly.
 //go:generate terraform fmt -recursive ./examples/
@@ -32,18 +40,42 @@ var (
 )
 
 func main() {
+	// Every SSM session runs in a child process of the provider, see ssmtunnels.Session
+	if ssmtunnels.IsPluginProcess() {
+		ssmtunnels.RunPlugin()
+		log.Fatal("session manager plugin exited")
+	}
+
 	var debug bool
 
 	flag.BoolVar(&debug, "debug", false, "set to true to run the provider with support for debuggers like delve")
 	flag.Parse()
 
-	opts := providerserver.ServeOpts{
-		Address: "registry.terraform.io/ComplyCo/aws-ssm-tunnels",
-		Debug:   debug,
-	}
+	// Terraform normally stops the provider, but if it is killed the tunnels
+	// would be left behind as orphaned listeners and sessions
+	go ssmtunnels.WatchParent(5*time.Second, func() {
+		provider.Shutdown("Terraform exited")
+		os.Exit(0)
+	})
+
+	// Interrupts are left to Terraform, which stops the provider on the first
+	// Ctrl+C, see provider.NewServer. Being terminated doesn't go through it.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		provider.Shutdown("Provider terminated")
+		os.Exit(1)
+	}()
 
-	err := providerserver.Serve(context.Background(), provider.New(version), opts)
+	var opts []tf6server.ServeOpt
+	if debug {
+		opts = append(opts, tf6server.WithManagedDebug())
+	}
 
+	err := tf6server.Serve("registry.terraform.io/ComplyCo/aws-ssm-tunnels", provider.NewServer(version), opts...)
+	// Terraform is done with the provider, sessions still running would only end with the idle timeout
+	provider.Shutdown("Provider exiting")
 	if err != nil {
 		log.Fatal(err.Error())
 	}